@@ -1,56 +1,204 @@
 package main
 
 import (
-	mq "mqtt-conn/mqttset"
-	ws "mqtt-conn/websockets"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"tdce-shared/ain"
+	"tdce-shared/config"
+	"tdce-shared/health"
+	mq "tdce-shared/mqttset"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
 )
 
-/* Function panics upon receiving error */
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
+/* Settings read from config.yaml, AIN_* environment variables and flags */
+/* The topics, QoS and filter are applied on SIGHUP, the connection settings after a restart */
+type settings struct {
+	Mqtt struct {
+		// 5 adds the content type, user properties and reason codes of refused messages
+		Version  int    `json:"version" validate:"oneof=3 5" help:"MQTT version, 3 or 5"`
+		Broker   string `json:"broker" validate:"required,url" help:"MQTT broker address"`
+		ClientId string `json:"clientId" validate:"required" help:"MQTT client ID"`
+		Username string `json:"username" help:"MQTT user"`
+		// for safety, reference the password from a file, e.g. AIN_MQTT_PASSWORD_FILE=/run/secrets/mqtt_password
+		Password config.Secret `json:"password" help:"MQTT password"`
+		Topic    string        `json:"topic" validate:"required" reload:"true" help:"topic the AIN values are published on"`
+		Qos      int           `json:"qos" validate:"max=2" reload:"true" help:"QoS of the published messages"`
+		// min/max/avg of every statistics window; empty disables them
+		StatsTopic string `json:"statsTopic" reload:"true" help:"topic the AIN statistics are published on"`
+		/* Brokers on ssl:// need the tls section, client certificates included */
+		TLS       mq.TLS       `json:"tls"`
+		Reconnect mq.Reconnect `json:"reconnect"`
+		Session   mq.Session   `json:"session"`
+		/* Retained online/offline message; the offline one is the last will */
+		Status mq.Status `json:"status"`
+		V5     mq.V5     `json:"v5"`
+	} `json:"mqtt"`
+	WebSocket string `json:"websocket" validate:"required,hostport" help:"host of the AIN WebSocket stream"`
+	/* Only values that passed the filter and moved past the deadband are published */
+	Filter ain.Filter `json:"filter" reload:"true"`
+	// /healthz and /readyz for Docker HEALTHCHECK and Portainer; empty disables them
+	HealthAddress string `json:"healthAddress" validate:"hostport" help:"address of /healthz and /readyz, empty disables them"`
 }
 
-/* Fetches AIN value from websocket */
-func fetchAinVal(conn *websocket.Conn) []byte {
-
-	obj, err := ws.ListenOnWS(conn)
-	check(err)
-	return obj
+func defaults() settings {
+	var s settings
+	s.Mqtt.Version = 3
+	s.Mqtt.Broker = "tcp://192.168.0.100:1883"
+	s.Mqtt.ClientId = "clientest"
+	s.Mqtt.Username = "user1"
+	s.Mqtt.Topic = "ainval"
+	s.Mqtt.Qos = 0
+	s.Mqtt.StatsTopic = "ainval/stats"
+	s.Mqtt.Reconnect.Enabled = true
+	s.Mqtt.Reconnect.RetryInterval = config.Duration(10 * time.Second)
+	s.Mqtt.Reconnect.MaxBackoff = config.Duration(2 * time.Minute)
+	s.Mqtt.Status.Topic = "ainval/status"
+	s.Mqtt.Status.QoS = 1
+	s.Mqtt.V5.SessionExpiry = config.Duration(24 * time.Hour)
+	s.WebSocket = "192.168.0.100:31768"
+	s.Filter.Median = 3
+	s.Filter.Deadband = 0.05
+	s.Filter.Heartbeat = config.Duration(10 * time.Minute)
+	s.Filter.Window = config.Duration(time.Minute)
+	s.HealthAddress = ":8084"
+	return s
 }
 
 /* Sets broker parameters, connects to broker and sends AIN message */
-func connectToBroker() {
+func connectToBroker(conf *config.Store[settings]) {
+	cfg := conf.Get()
 
 	/* Setting up MQTT broker */
-	brokerAddress := "tcp://192.168.0.100:1883"
-	clientId := "clientest"
+	client, err := mq.NewClient(mq.ClientOptions{
+		Version:   cfg.Mqtt.Version,
+		Broker:    cfg.Mqtt.Broker,
+		ClientId:  cfg.Mqtt.ClientId,
+		Username:  cfg.Mqtt.Username,
+		Password:  cfg.Mqtt.Password.Value(),
+		TLS:       cfg.Mqtt.TLS,
+		Reconnect: cfg.Mqtt.Reconnect,
+		Session:   cfg.Mqtt.Session,
+		Status:    cfg.Mqtt.Status,
+		V5:        cfg.Mqtt.V5,
+	})
+	if err != nil {
+		fmt.Println("Error creating MQTT client: ", err)
+		os.Exit(1)
+	}
+	/* With reconnect enabled this doesn't wait for the broker; values are published once it is reachable */
+	if err := mq.ConnectClientToBroker(client); err != nil {
+		fmt.Println("Error connecting to broker: ", err)
+		os.Exit(1)
+	}
+	/* Values are published without waiting for each acknowledgement; failures are logged by the publisher */
+	/* With MQTT 5 every message says what it is and where it comes from */
+	publisher := mq.NewPublisher(client, mq.Options{
+		QoS: byte(cfg.Mqtt.Qos),
+		Properties: &mq.Properties{
+			ContentType: "application/json",
+			User:        map[string]string{"deviceId": cfg.Mqtt.ClientId, "schemaVersion": "1"},
+		},
+	})
+	defer mq.Disconnect(client, cfg.Mqtt.Status, 1000)
+	defer func() {
+		/* Gives the messages in flight a moment to be acknowledged before disconnecting */
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		publisher.Close(ctx)
+	}()
+
+	/* Setting up WebSocket; it reconnects on its own and is closed cleanly on Ctrl-C or docker stop */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// for safety, specify the username and password parameters in another file
-	username := "user1"
-	password := "password"
+	stream := wsclient.New(wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.AnalogInputsValue)})
+	go stream.Run(ctx)
 
-	client := mq.CreateMqttClientPass(brokerAddress, clientId, username, password)
-	mq.ConnectClientToBroker(client)
+	/* AIN values are only sent when they change, so a silent stream is not stale; only the connection is checked */
+	if cfg.HealthAddress != "" {
+		checks := health.New()
+		checks.Ready("mqtt", health.MQTT(client))
+		checks.Ready("ain stream", func(context.Context) (map[string]any, error) {
+			if !stream.Connected() {
+				return nil, wsclient.ErrNotConnected
+			}
+			return map[string]any{"lastMessage": stream.LastMessage()}, nil
+		})
+		go checks.Serve(ctx, cfg.HealthAddress)
+	}
+
+	reloaded := make(chan struct{}, 1)
+	go conf.WatchSIGHUP(ctx, func(*settings) {
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+	})
+
+	/* One pipeline per AIN; the statistics are published as their windows end */
+	newChannels := func(cfg *settings) *ain.Channels {
+		return ain.NewChannels(func(string) *ain.Pipeline {
+			return cfg.Filter.Build(func(stats ain.Stats) {
+				if cfg.Mqtt.StatsTopic != "" {
+					publishJSON(ctx, publisher, cfg.Mqtt.StatsTopic, stats)
+				}
+			})
+		})
+	}
+	channels := newChannels(cfg)
 
-	/* Setting up WebSocket */
-	conn, err := ws.OpenWebsocket("ws", "192.168.0.100:31768", "/ws/tdce/analog-inputs/value")
-	check(err)
-	defer conn.Close()
+	/* Ends the statistics windows of inputs that stopped changing */
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	// fetching AIN value every ten seconds
-	// publishes with qos 0
 	for {
-		mq.PublishMessage("ainval", fetchAinVal(conn), client, 0)
-		time.Sleep(10 * time.Second)
+		select {
+		case msg, ok := <-stream.Messages():
+			if !ok {
+				return
+			}
+			var change tdce.AnalogValueChange
+			if err := json.Unmarshal(msg, &change); err != nil {
+				fmt.Println("Problem parsing AIN message: ", err)
+				continue
+			}
+			m := ain.Measurement{Channel: change.AinName, Value: change.NewValue, Time: time.Now()}
+			if m, ok := channels.Push(m); ok {
+				publishJSON(ctx, publisher, cfg.Mqtt.Topic, m)
+			}
+		case <-reloaded:
+			/* The filters start over with the new settings */
+			cfg = conf.Get()
+			publisher.SetQoS(byte(cfg.Mqtt.Qos), nil)
+			channels = newChannels(cfg)
+		case now := <-ticker.C:
+			channels.Tick(now)
+		}
 	}
+}
 
+func publishJSON(ctx context.Context, publisher *mq.Publisher, topic string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Problem encoding message: ", err)
+		return
+	}
+	publisher.Publish(ctx, mq.Message{Topic: topic, Payload: payload})
 }
 
 func main() {
-	connectToBroker()
+	conf := config.NewStore(defaults(), config.Options{
+		Name:      "mqtt-go-ain",
+		File:      "config.yaml",
+		EnvPrefix: "AIN",
+		Args:      os.Args[1:],
+	})
+	connectToBroker(conf)
 }
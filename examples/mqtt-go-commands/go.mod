@@ -0,0 +1,23 @@
+module mqtt-commands
+
+go 1.21.0
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	tdce-shared v0.0.0
+)
+
+require (
+	github.com/eclipse/paho.golang v0.21.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/oauth2 v0.16.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	google.golang.org/appengine v1.6.7 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace tdce-shared => ../../shared
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/command"
+	"tdce-shared/config"
+	"tdce-shared/health"
+	"tdce-shared/modem"
+	mq "tdce-shared/mqttset"
+	"tdce-shared/ropc"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
+)
+
+/* Settings read from config.yaml, CMD_* environment variables and flags; all of them apply after a restart */
+type settings struct {
+	// commands arrive on devices/{deviceId}/cmd/#, responses go to devices/{deviceId}/resp/{correlationId}
+	DeviceId string `json:"deviceId" validate:"required" help:"device ID in the command and response topics"`
+	Mqtt     struct {
+		// 5 also answers on the response topic an MQTT 5 request names
+		Version  int    `json:"version" validate:"oneof=3 5" help:"MQTT version, 3 or 5"`
+		Broker   string `json:"broker" validate:"required,url" help:"MQTT broker address"`
+		ClientId string `json:"clientId" validate:"required" help:"MQTT client ID"`
+		Username string `json:"username" help:"MQTT user"`
+		// for safety, reference the password from a file, e.g. CMD_MQTT_PASSWORD_FILE=/run/secrets/mqtt_password
+		Password config.Secret `json:"password" help:"MQTT password"`
+		// QoS of the responses
+		Qos int `json:"qos" validate:"max=2" help:"QoS of the responses"`
+		/* Brokers on ssl:// need the tls section, client certificates included */
+		TLS       mq.TLS       `json:"tls"`
+		Reconnect mq.Reconnect `json:"reconnect"`
+		Session   mq.Session   `json:"session"`
+		/* Retained online/offline message; devices/{deviceId}/status when the topic is empty */
+		Status mq.Status `json:"status"`
+		V5     mq.V5     `json:"v5"`
+	} `json:"mqtt"`
+	/* Time boxes and the window in which repeated commands are not executed again */
+	Commands command.Options `json:"commands"`
+
+	Device   string        `json:"device" validate:"required,url" help:"base URL of the DIO/AIN REST API"`
+	Password config.Secret `json:"password" help:"password of the DIO/AIN REST API"`
+	// RS-232 data is written to the WebSocket stream; empty disables sendRs232
+	WebSocket string `json:"websocket" validate:"hostport" help:"host of the RS-232 WebSocket stream, empty disables sendRs232"`
+	API       string `json:"api" validate:"url" help:"base URL of the device manager API"`
+	// OAuth2.0 settings of the device manager API; sendSms is disabled without them
+	Params string `json:"params" help:"file with the OAuth2.0 settings, empty disables sendSms"`
+	// /healthz and /readyz for Docker HEALTHCHECK and Portainer; empty disables them
+	HealthAddress string `json:"healthAddress" validate:"hostport" help:"address of /healthz and /readyz, empty disables them"`
+}
+
+func defaults() settings {
+	var s settings
+	s.DeviceId = "tdce-1"
+	s.Mqtt.Version = 3
+	s.Mqtt.Broker = "tcp://192.168.0.100:1883"
+	s.Mqtt.ClientId = "tdce-1-commands"
+	s.Mqtt.Qos = 1
+	s.Mqtt.Reconnect.Enabled = true
+	s.Mqtt.Reconnect.RetryInterval = config.Duration(10 * time.Second)
+	s.Mqtt.Reconnect.MaxBackoff = config.Duration(2 * time.Minute)
+	s.Mqtt.Status.QoS = 1
+	s.Mqtt.V5.SessionExpiry = config.Duration(24 * time.Hour)
+	s.Commands.QoS = 1
+	s.Commands.Timeout = config.Duration(10 * time.Second)
+	s.Commands.MaxTimeout = config.Duration(time.Minute)
+	s.Commands.Remember = config.Duration(10 * time.Minute)
+	s.Commands.StateFile = "commands-state.json"
+	s.Device = tdce.DefaultBaseURL
+	s.Password = config.NewSecret("servicelevel")
+	s.WebSocket = "192.168.0.100:31768"
+	s.API = modem.DefaultAPI
+	s.Params = "params.json"
+	s.HealthAddress = ":8085"
+	return s
+}
+
+/* Executes commands received over MQTT on the DIOs, AINs, RS-232 and the modem of the device */
+func main() {
+	conf := config.NewStore(defaults(), config.Options{
+		Name:      "mqtt-go-commands",
+		File:      "config.yaml",
+		EnvPrefix: "CMD",
+		Args:      os.Args[1:],
+	})
+	cfg := conf.Get()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	device := &command.API{IO: tdce.NewClient(cfg.Device, cfg.Password.Value())}
+	var rs232 *wsclient.Client
+	if cfg.WebSocket != "" {
+		rs232 = wsclient.New(wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.Rs232Data)})
+		go rs232.Run(ctx)
+		/* Data received on RS-232 is not used here */
+		go func() {
+			for range rs232.Messages() {
+			}
+		}()
+		device.RS232 = rs232
+	}
+	var token *ropc.TokenSource
+	if cfg.Params != "" {
+		oauthConf, err := ropc.LoadConfig(cfg.Params)
+		if err != nil {
+			fmt.Println("SMS commands disabled: ", err)
+		} else {
+			token = ropc.NewTokenSource(oauthConf)
+			device.Modem = &modem.Client{API: ropc.NewClient(token), BaseURL: cfg.API}
+		}
+	}
+
+	status := cfg.Mqtt.Status
+	if status.Topic == "" {
+		status.Topic = "devices/" + cfg.DeviceId + "/status"
+	}
+
+	/* The handler needs the publisher and the publisher the client, so the subscription is made in onConnect */
+	var handler *command.Handler
+	onConnect := func(c mqtt.Client) {
+		fmt.Println("Connected")
+		if err := handler.Subscribe(c); err != nil {
+			fmt.Println("Error subscribing to commands: ", err)
+		}
+	}
+	client, err := mq.NewClient(mq.ClientOptions{
+		Version:   cfg.Mqtt.Version,
+		Broker:    cfg.Mqtt.Broker,
+		ClientId:  cfg.Mqtt.ClientId,
+		Username:  cfg.Mqtt.Username,
+		Password:  cfg.Mqtt.Password.Value(),
+		TLS:       cfg.Mqtt.TLS,
+		Reconnect: cfg.Mqtt.Reconnect,
+		Session:   cfg.Mqtt.Session,
+		Status:    status,
+		V5:        cfg.Mqtt.V5,
+		OnConnect: onConnect,
+	})
+	if err != nil {
+		fmt.Println("Error creating MQTT client: ", err)
+		os.Exit(1)
+	}
+	publisher := mq.NewPublisher(client, mq.Options{
+		QoS: byte(cfg.Mqtt.Qos),
+		Properties: &mq.Properties{
+			ContentType: "application/json",
+			User:        map[string]string{"deviceId": cfg.DeviceId, "schemaVersion": "1"},
+		},
+	})
+	/* Commands of a persistent session are redelivered after a restart; only the state file keeps them from running twice */
+	if cfg.Mqtt.Session.Persistent && cfg.Commands.StateFile == "" {
+		fmt.Println("A persistent session needs commands.stateFile")
+		os.Exit(1)
+	}
+	handler, err = command.NewHandler(cfg.DeviceId, device, publisher, cfg.Commands)
+	if err != nil {
+		fmt.Println("Error reading executed commands: ", err)
+		os.Exit(1)
+	}
+
+	if err := mq.ConnectClientToBroker(client); err != nil {
+		fmt.Println("Error connecting to broker: ", err)
+		os.Exit(1)
+	}
+	/* Running commands finish within their time box, then their responses are sent before disconnecting */
+	defer mq.Disconnect(client, status, 1000)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Commands.MaxTimeout)+5*time.Second)
+		defer cancel()
+		handler.Close(ctx)
+		publisher.Close(ctx)
+	}()
+
+	if cfg.HealthAddress != "" {
+		checks := health.New()
+		checks.Ready("mqtt", health.MQTT(client))
+		checks.Ready("device token", func(ctx context.Context) (map[string]any, error) {
+			_, err := device.IO.Token(ctx)
+			return nil, err
+		})
+		if token != nil {
+			checks.Ready("api token", health.Token(token))
+		}
+		if rs232 != nil {
+			checks.Ready("rs232 stream", func(context.Context) (map[string]any, error) {
+				if !rs232.Connected() {
+					return nil, wsclient.ErrNotConnected
+				}
+				return nil, nil
+			})
+		}
+		go checks.Serve(ctx, cfg.HealthAddress)
+	}
+
+	fmt.Printf("Waiting for commands on %s\n", handler.Topic())
+	<-ctx.Done()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"tdce-shared/config"
+	"tdce-shared/dio"
+	"tdce-shared/health"
+	mq "tdce-shared/mqttset"
+	"tdce-shared/sparkplug"
+	"tdce-shared/supervisor"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
+)
+
+/* Devices of the edge node */
+const (
+	ainDevice = "ain"
+	dioDevice = "dio"
+	gpsDevice = "gps"
+)
+
+/* Settings read from config.yaml, SPB_* environment variables and flags; all of them apply after a restart */
+type settings struct {
+	Sparkplug sparkplug.Options `json:"sparkplug"`
+	Mqtt      struct {
+		Version  int    `json:"version" validate:"oneof=3 5" help:"MQTT version, 3 or 5"`
+		Broker   string `json:"broker" validate:"required,url" help:"MQTT broker address"`
+		ClientId string `json:"clientId" validate:"required" help:"MQTT client ID"`
+		Username string `json:"username" help:"MQTT user"`
+		// for safety, reference the password from a file, e.g. SPB_MQTT_PASSWORD_FILE=/run/secrets/mqtt_password
+		Password config.Secret `json:"password" help:"MQTT password"`
+		/* Brokers on ssl:// need the tls section, client certificates included */
+		TLS mq.TLS `json:"tls"`
+		// the node reconnects on its own; maxBackoff caps the wait between sessions
+		Reconnect mq.Reconnect `json:"reconnect"`
+		V5        mq.V5        `json:"v5"`
+	} `json:"mqtt"`
+
+	Device   string        `json:"device" validate:"required,url" help:"base URL of the DIO/AIN REST API"`
+	Password config.Secret `json:"password" help:"password of the DIO/AIN REST API"`
+	// AIN, DIO and GPS streams on port 31768
+	WebSocket string   `json:"websocket" validate:"required,hostport" help:"host of the WebSocket streams"`
+	Dios      []string `json:"dios" help:"DIOs published as metrics of the dio device"`
+	// the DIOs are polled at this interval while their stream is not connected
+	PollInterval config.Duration `json:"pollInterval" help:"poll interval of the DIOs while their stream is down"`
+	// DCMD writes to these DIOs set them as outputs; writes to the others are refused
+	Outputs []string `json:"outputs" help:"DIOs a host application may set"`
+	// /healthz and /readyz for Docker HEALTHCHECK and Portainer; empty disables them
+	HealthAddress string `json:"healthAddress" validate:"hostport" help:"address of /healthz and /readyz, empty disables them"`
+}
+
+func defaults() settings {
+	var s settings
+	s.Sparkplug.Group = "TDC-E"
+	s.Sparkplug.EdgeNode = "tdce-1"
+	s.Sparkplug.Aliases = true
+	s.Sparkplug.BdSeqFile = "sparkplug-bdseq"
+	s.Mqtt.Version = 3
+	s.Mqtt.Broker = "tcp://192.168.0.100:1883"
+	s.Mqtt.ClientId = "tdce-1-sparkplug"
+	s.Mqtt.Reconnect.MaxBackoff = config.Duration(2 * time.Minute)
+	s.Device = tdce.DefaultBaseURL
+	s.Password = config.NewSecret("servicelevel")
+	s.WebSocket = "192.168.0.100:31768"
+	s.Dios = []string{"DIO_A", "DIO_B", "DIO_C", "DIO_D"}
+	s.PollInterval = config.Duration(time.Second)
+	s.Outputs = []string{"DIO_A", "DIO_B"}
+	s.HealthAddress = ":8086"
+	return s
+}
+
+var (
+	cfg    *settings
+	device *tdce.Client
+	node   *sparkplug.EdgeNode
+)
+
+/* Publishes the AINs, DIOs and GPS of the device as a Sparkplug B edge node with the devices ain, dio and gps */
+func main() {
+	conf := config.NewStore(defaults(), config.Options{
+		Name:      "mqtt-go-sparkplug",
+		File:      "config.yaml",
+		EnvPrefix: "SPB",
+		Args:      os.Args[1:],
+	})
+	cfg = conf.Get()
+	device = tdce.NewClient(cfg.Device, cfg.Password.Value())
+
+	node = sparkplug.NewEdgeNode(mq.ClientOptions{
+		Version:   cfg.Mqtt.Version,
+		Broker:    cfg.Mqtt.Broker,
+		ClientId:  cfg.Mqtt.ClientId,
+		Username:  cfg.Mqtt.Username,
+		Password:  cfg.Mqtt.Password.Value(),
+		TLS:       cfg.Mqtt.TLS,
+		Reconnect: cfg.Mqtt.Reconnect,
+		V5:        cfg.Mqtt.V5,
+	}, cfg.Sparkplug)
+	node.OnCommand(writeOutputs)
+
+	/* The node publishes NDEATH when it stops; the inputs restart if they crash */
+	sup := supervisor.New()
+	sup.Go("sparkplug", node.Run)
+	sup.Go("ain", publishAIN)
+	sup.Go("dio", publishDIO)
+	sup.Go("gps", publishGPS)
+
+	if cfg.HealthAddress != "" {
+		checks := health.New()
+		checks.Live("services", health.Supervisor(sup))
+		checks.Ready("sparkplug", func(context.Context) (map[string]any, error) {
+			if state := node.State(); state != sparkplug.Online {
+				return map[string]any{"state": state.String()}, fmt.Errorf("edge node is %s", state)
+			}
+			return nil, nil
+		})
+		sup.Go("health", func(ctx context.Context) error {
+			return checks.Serve(ctx, cfg.HealthAddress)
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("Edge node %s/%s\n", cfg.Sparkplug.Group, cfg.Sparkplug.EdgeNode)
+	if err := sup.Run(ctx); err != nil {
+		fmt.Println("Error shutting down:", err)
+		os.Exit(1)
+	}
+}
+
+/* Double metrics named after the AINs; the current values go into the DBIRTH, the stream sends changes */
+func publishAIN(ctx context.Context) error {
+	values, err := device.AnalogValues(ctx)
+	if err != nil {
+		fmt.Println("Error reading AINs: ", err)
+	}
+	metrics := make([]sparkplug.Metric, 0, len(values))
+	for _, v := range values {
+		metrics = append(metrics, sparkplug.NewMetric(v.AinName, v.Value))
+	}
+	if len(metrics) > 0 {
+		node.Update(ainDevice, metrics...)
+	}
+
+	_, stream := wsclient.Subscribe[tdce.AnalogValueChange](ctx, wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.AnalogInputsValue)})
+	for change := range stream {
+		if err := node.Update(ainDevice, sparkplug.NewMetric(change.AinName, change.NewValue)); err != nil {
+			fmt.Println("Error publishing AIN: ", err)
+		}
+	}
+	return ctx.Err()
+}
+
+/* Boolean metrics named after the DIOs, published when a level changes */
+func publishDIO(ctx context.Context) error {
+	source := &dio.WebSocketSource{
+		Host:     cfg.WebSocket,
+		Fallback: &dio.PollSource{Device: device, Channels: cfg.Dios, Interval: time.Duration(cfg.PollInterval)},
+	}
+	wanted := map[string]bool{}
+	for _, ch := range cfg.Dios {
+		wanted[ch] = true
+	}
+	/* Sources may repeat levels, only changes are published */
+	levels := map[string]int{}
+	return source.Run(ctx, func(s dio.Sample) {
+		if level, ok := levels[s.Channel]; !wanted[s.Channel] || ok && level == s.Value {
+			return
+		}
+		levels[s.Channel] = s.Value
+		m := sparkplug.NewMetric(s.Channel, s.Value != 0)
+		m.Timestamp = s.Time
+		if err := node.Update(dioDevice, m); err != nil {
+			fmt.Println("Error publishing DIO: ", err)
+		}
+	})
+}
+
+/* Position, fix and speed; the GPS stream sends about once a second */
+func publishGPS(ctx context.Context) error {
+	_, stream := wsclient.Subscribe[tdce.GpsData](ctx, wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.GpsData)})
+	for gps := range stream {
+		err := node.Update(gpsDevice,
+			sparkplug.NewMetric("Latitude", gps.Latitude),
+			sparkplug.NewMetric("Longitude", gps.Longitude),
+			sparkplug.NewMetric("Altitude", gps.Altitude),
+			sparkplug.NewMetric("Hdop", gps.Hdop),
+			sparkplug.NewMetric("SpeedKnots", gps.SpeedKnots),
+			sparkplug.NewMetric("Fix", int32(gps.Fix)),
+			sparkplug.NewMetric("Satellites", int32(gps.NumberOfSatellites)),
+			sparkplug.NewMetric("FixAvailable", gps.GpsFixAvailable),
+		)
+		if err != nil {
+			fmt.Println("Error publishing GPS: ", err)
+		}
+	}
+	return ctx.Err()
+}
+
+/* DCMD writes of Boolean DIO metrics set the outputs; the new level comes back through the DIO stream as DDATA */
+func writeOutputs(deviceID string, metrics []sparkplug.Metric) {
+	for _, m := range metrics {
+		level, ok := m.Value.(bool)
+		switch {
+		case deviceID != dioDevice || !ok:
+			fmt.Printf("Ignoring command %s/%s\n", deviceID, m.Name)
+			continue
+		case !isOutput(m.Name):
+			fmt.Printf("Ignoring command %s/%s: not an output\n", deviceID, m.Name)
+			continue
+		}
+		value := 0
+		if level {
+			value = 1
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := device.SetDIO(ctx, m.Name, value, tdce.Output); err != nil {
+			fmt.Printf("Error setting %s: %v\n", m.Name, err)
+		}
+		cancel()
+	}
+}
+
+func isOutput(name string) bool {
+	for _, out := range cfg.Outputs {
+		if strings.EqualFold(out, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,3 +1,12 @@
 module client
 
 go 1.21.0
+
+require tdce-shared v0.0.0
+
+require (
+	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace tdce-shared => ../../../shared
@@ -3,23 +3,98 @@ package main
 import (
 	"fmt"
 	"net"
+	"os"
+	"time"
+
+	"tdce-shared/config"
 )
 
+/* Sample tags the gateway can decode with the matching rfidDecoder format */
+var tags = map[string][]string{
+	"raw":       {"Hello, there!", "TAG-0002"},
+	"em4100":    {"0415A2C3D1", "0415A2C3D1A1"},
+	"wiegand26": {"2F764DD", "2020002"},
+	"wiegand34": {"209A5BBAA", "2000E0054"},
+}
+
+/* Wraps a tag into a frame for the given framing */
+func frame(framing string, tag string, length int) []byte {
+	switch framing {
+	case "stx-etx":
+		return append(append([]byte{0x02}, tag...), 0x03)
+	case "fixed":
+		padded := fmt.Sprintf("%-*s", length, tag)
+		return []byte(padded[:length])
+	}
+	return []byte(tag + "\r\n")
+}
+
+/* Settings from flags, SIM_* environment variables or a file given with -config */
+type settings struct {
+	Address string `json:"address" validate:"required,hostport" help:"address of the gateway's RFID listener"`
+	Framing string `json:"framing" validate:"oneof=delimiter stx-etx fixed" help:"framing to send: delimiter, stx-etx or fixed"`
+	Format  string `json:"format" validate:"oneof=raw em4100 wiegand26 wiegand34" help:"tag format: raw, em4100, wiegand26 or wiegand34"`
+	Length  int    `json:"length" validate:"min=1" help:"frame length for the fixed framing"`
+	Chunk   int    `json:"chunk" validate:"min=0" help:"split the stream into writes of this many bytes to exercise partial reads"`
+	Merge   bool   `json:"merge" help:"send all frames in a single write to exercise merged reads"`
+	Repeat  int    `json:"repeat" validate:"min=1" help:"send each tag this many times to exercise de-duplication"`
+}
+
 func main() {
-	conn, err := net.Dial("tcp", "localhost:5247")
+	cfg := config.MustLoad(settings{
+		Address: "localhost:5247",
+		Framing: "delimiter",
+		Format:  "raw",
+		Length:  12,
+		Repeat:  1,
+	}, config.Options{Name: "client", EnvPrefix: "SIM", Args: os.Args[1:]})
+
+	samples, ok := tags[cfg.Format]
+	if !ok {
+		fmt.Println("Error: unknown format", cfg.Format)
+		return
+	}
+
+	conn, err := net.Dial("tcp", cfg.Address)
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
 	}
 	defer conn.Close()
-	sendData(conn)
+
+	var frames [][]byte
+	for _, tag := range samples {
+		for i := 0; i < cfg.Repeat; i++ {
+			frames = append(frames, frame(cfg.Framing, tag, cfg.Length))
+		}
+	}
+
+	if cfg.Merge {
+		var all []byte
+		for _, f := range frames {
+			all = append(all, f...)
+		}
+		frames = [][]byte{all}
+	}
+
+	for _, f := range frames {
+		sendData(conn, f, cfg.Chunk)
+	}
 }
 
-func sendData(conn net.Conn) {
-	data := []byte("Hello, there!")
-	_, err := conn.Write(data)
-	if err != nil {
-		fmt.Println("Error:", err)
-		return
+/* Writes data, optionally in small chunks with a pause in between so they arrive as separate reads */
+func sendData(conn net.Conn, data []byte, chunk int) {
+	if chunk <= 0 {
+		chunk = len(data)
+	}
+	for len(data) > 0 {
+		n := min(chunk, len(data))
+		if _, err := conn.Write(data[:n]); err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		fmt.Printf("Sent: %q\n", data[:n])
+		data = data[n:]
+		time.Sleep(50 * time.Millisecond)
 	}
 }
@@ -2,14 +2,17 @@
 /* Created to connect to a database and add / delete values from it */
 
 /* Package was modified 04.10.2023. to fit MQTT needs */
+/* Package was modified 18.10.2026. to use prepared statements and manage its own schema */
 
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
 )
 
 /* MQTT Data struct */
@@ -29,49 +32,161 @@ type MQTTData struct {
 	Rssi               int
 	DataLinkType       string
 	Rfid               string
+	PositionAgeSeconds float64
+	PositionReason     string
 }
 
-/* Function connects to a database using the specified dbms and connection string */
-/* In case of not being able to connect, it prints the error received by the service. Otherwise, returns the connection that is used for other operations. */
-/* Use with defer db.Close() */
-func Connect(dbms string, connectionString string) *sql.DB {
-	db, err := sql.Open(dbms, connectionString)
+const columns = `Altitude, Course, Fix, GpsFixAvailable, Hdop, Latitude, Longitude,
+	NumberOfSatellites, SpeedKnots, SpeedMph, TimeSt, Rssi, DataLinkType, Rfid, PositionAgeSeconds, PositionReason`
+
+/* Repository stores queued MQTT messages; all queries go through prepared statements */
+type Repository struct {
+	db      *sql.DB
+	insert  *sql.Stmt
+	pending *sql.Stmt
+	remove  *sql.Stmt
+	count   *sql.Stmt
+}
+
+/* Opens the database with the given driver ("mysql" or "sqlite"), applies pending migrations and prepares statements */
+/* Use with defer repo.Close() */
+func Open(ctx context.Context, driver string, connectionString string) (*Repository, error) {
+	migrations, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+
+	conn, err := sql.Open(driver, connectionString)
 	if err != nil {
-		fmt.Println("Couldn't connect to SQL database: ", err)
+		return nil, err
+	}
+	if driver == "sqlite" {
+		/* SQLite allows a single writer */
+		conn.SetMaxOpenConns(1)
+	}
+	if err := conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("couldn't connect to database: %w", err)
+	}
+	if err := migrate(ctx, conn, migrations); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	repo := &Repository{db: conn}
+	if err := repo.prepare(ctx); err != nil {
+		repo.Close()
+		return nil, err
 	}
-	return db
+	return repo, nil
 }
 
-/* Processes the given string command by connecting to the sql.DB object */
-func ModifyDB(db *sql.DB, action string) {
-	_, err := db.Exec(action)
-	if err != nil {
-		fmt.Println("Database error: ", err)
+func (r *Repository) prepare(ctx context.Context) error {
+	var err error
+	if r.insert, err = r.db.PrepareContext(ctx, `INSERT INTO mqtt (`+columns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`); err != nil {
+		return err
+	}
+	if r.pending, err = r.db.PrepareContext(ctx, `SELECT Id, `+columns+` FROM mqtt ORDER BY Id LIMIT ?`); err != nil {
+		return err
+	}
+	if r.remove, err = r.db.PrepareContext(ctx, `DELETE FROM mqtt WHERE Id = ?`); err != nil {
+		return err
 	}
-	fmt.Println("Action successfully completed.")
+	if r.count, err = r.db.PrepareContext(ctx, `SELECT COUNT(*) FROM mqtt`); err != nil {
+		return err
+	}
+	return nil
 }
 
-/* Selects values from database specified in query */
-func SelectValues(db *sql.DB, query string) []MQTTData {
-	var results []MQTTData
+/* Closes prepared statements and the database connection */
+func (r *Repository) Close() error {
+	for _, stmt := range []*sql.Stmt{r.insert, r.pending, r.remove, r.count} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return r.db.Close()
+}
+
+/* Underlying connection pool, e.g. for health checks */
+func (r *Repository) DB() *sql.DB {
+	return r.db
+}
+
+/* Stores a message that couldn't be published; returns its Id */
+func (r *Repository) InsertMessage(ctx context.Context, msg MQTTData) (int64, error) {
+	/* Empty course is stored as NULL */
+	var course sql.NullString
+	if msg.Course != nil && *msg.Course != "" {
+		course = sql.NullString{String: *msg.Course, Valid: true}
+	}
+
+	res, err := r.insert.ExecContext(ctx,
+		msg.Altitude, course, msg.Fix, msg.GpsFixAvailable, msg.Hdop, msg.Latitude, msg.Longitude,
+		msg.NumberOfSatellites, msg.SpeedKnots, msg.SpeedMph, msg.Time, msg.Rssi, msg.DataLinkType, msg.Rfid,
+		msg.PositionAgeSeconds, msg.PositionReason)
+	if err != nil {
+		return 0, fmt.Errorf("inserting message: %w", err)
+	}
+	return res.LastInsertId()
+}
 
-	rows, err := db.Query(query)
+/* Returns up to limit stored messages, oldest first */
+func (r *Repository) PendingMessages(ctx context.Context, limit int) ([]MQTTData, error) {
+	rows, err := r.pending.QueryContext(ctx, limit)
 	if err != nil {
-		fmt.Println("Error finding rows: ", err)
+		return nil, fmt.Errorf("selecting pending messages: %w", err)
 	}
 	defer rows.Close()
 
+	var results []MQTTData
 	for rows.Next() {
 		var data MQTTData
+		var course, reason sql.NullString
+		var ageSeconds sql.NullFloat64
 		err := rows.Scan(
-			&data.Id, &data.Altitude, &data.Course, &data.Fix, &data.GpsFixAvailable,
+			&data.Id, &data.Altitude, &course, &data.Fix, &data.GpsFixAvailable,
 			&data.Hdop, &data.Latitude, &data.Longitude, &data.NumberOfSatellites,
 			&data.SpeedKnots, &data.SpeedMph, &data.Time, &data.Rssi, &data.DataLinkType, &data.Rfid,
+			&ageSeconds, &reason,
 		)
 		if err != nil {
-			fmt.Println("Error fetching data: ", err)
+			return nil, fmt.Errorf("reading pending message: %w", err)
 		}
+		if course.Valid {
+			data.Course = &course.String
+		}
+		/* Rows stored before migration 2 have no position age and reason */
+		data.PositionAgeSeconds, data.PositionReason = ageSeconds.Float64, reason.String
 		results = append(results, data)
 	}
-	return results
+	return results, rows.Err()
+}
+
+/* Removes messages that were published successfully */
+func (r *Repository) Ack(ctx context.Context, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := tx.StmtContext(ctx, r.remove)
+	for _, id := range ids {
+		if _, err := stmt.ExecContext(ctx, id); err != nil {
+			return fmt.Errorf("deleting message %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+/* Number of stored messages */
+func (r *Repository) Count(ctx context.Context) (int, error) {
+	var n int
+	err := r.count.QueryRowContext(ctx).Scan(&n)
+	return n, err
 }
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+/* Opens the SQLite database at path and closes it when the test ends */
+func openTest(t *testing.T, path string) *Repository {
+	t.Helper()
+	repo, err := Open(context.Background(), "sqlite", path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestMigrationsAppliedOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	openTest(t, path).Close()
+	/* The second open finds the schema up to date and must not fail on CREATE or the version insert */
+	repo := openTest(t, path)
+
+	var applied, latest int
+	err := repo.DB().QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&applied, &latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dialects["sqlite"]
+	if applied != len(want) || latest != want[len(want)-1].version {
+		t.Errorf("schema_migrations has %d rows up to version %d, want %d up to %d", applied, latest, len(want), want[len(want)-1].version)
+	}
+}
+
+/* A database created before the position columns is upgraded, and its rows read back without them */
+func TestMigrationUpgradesOldSchema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(ctx, conn, dialects["sqlite"][:1]); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(`INSERT INTO mqtt (Altitude, Fix, GpsFixAvailable, Hdop, Latitude, Longitude,
+		NumberOfSatellites, SpeedKnots, SpeedMph, TimeSt, Rssi, DataLinkType, Rfid)
+		VALUES (120, 1, true, 0.9, 45.8, 15.9, 9, 0, 0, '08:00:00', -80, 'LTE', 'old')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	repo := openTest(t, path)
+	pending, err := repo.PendingMessages(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Rfid != "old" || pending[0].PositionAgeSeconds != 0 || pending[0].PositionReason != "" {
+		t.Errorf("PendingMessages = %+v, want the old row without position age and reason", pending)
+	}
+}
+
+/* A migration that failed after its first ALTER, as MySQL leaves it, completes on the next run */
+func TestMigrationResumesPartialRun(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(ctx, conn, dialects["sqlite"][:1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(dialects["sqlite"][1].steps[0].statement); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	repo := openTest(t, path)
+	var latest int
+	if err := repo.DB().QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest != 2 {
+		t.Errorf("schema version %d, want 2", latest)
+	}
+	if _, err := repo.DB().Exec(`SELECT PositionAgeSeconds, PositionReason FROM mqtt`); err != nil {
+		t.Errorf("position columns: %v", err)
+	}
+}
+
+func TestInsertPendingAckOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := openTest(t, filepath.Join(t.TempDir(), "queue.db"))
+
+	course := "N"
+	for _, rfid := range []string{"a", "b", "c"} {
+		if _, err := repo.InsertMessage(ctx, MQTTData{Rfid: rfid, Course: &course, Latitude: 45.5, Rssi: -70, DataLinkType: "LTE", PositionAgeSeconds: 1.5, PositionReason: "best position received"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := repo.Count(ctx); err != nil || n != 3 {
+		t.Fatalf("Count = %d, %v; want 3", n, err)
+	}
+
+	pending, err := repo.PendingMessages(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Rfid != "a" || pending[1].Rfid != "b" {
+		t.Fatalf("PendingMessages(2) = %+v, want a and b", pending)
+	}
+	if got := pending[0]; got.Course == nil || *got.Course != "N" || got.Latitude != 45.5 || got.Rssi != -70 || got.DataLinkType != "LTE" ||
+		got.PositionAgeSeconds != 1.5 || got.PositionReason != "best position received" {
+		t.Errorf("stored row = %+v, fields not kept", got)
+	}
+
+	/* Acknowledging the oldest leaves the rest in order */
+	if err := repo.Ack(ctx, []int{pending[0].Id}); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = repo.PendingMessages(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Rfid != "b" || pending[1].Rfid != "c" {
+		t.Fatalf("after Ack: %+v, want b and c", pending)
+	}
+	if err := repo.Ack(ctx, []int{pending[0].Id, pending[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.Count(ctx); err != nil || n != 0 {
+		t.Errorf("Count = %d, %v; want 0", n, err)
+	}
+	if err := repo.Ack(ctx, nil); err != nil {
+		t.Errorf("Ack(nil) = %v", err)
+	}
+}
+
+func TestEmptyCourseIsNull(t *testing.T) {
+	ctx := context.Background()
+	repo := openTest(t, filepath.Join(t.TempDir(), "queue.db"))
+
+	empty := ""
+	if _, err := repo.InsertMessage(ctx, MQTTData{Course: &empty}); err != nil {
+		t.Fatal(err)
+	}
+	var course sql.NullString
+	if err := repo.DB().QueryRow(`SELECT Course FROM mqtt`).Scan(&course); err != nil {
+		t.Fatal(err)
+	}
+	if course.Valid {
+		t.Errorf("Course = %q, want NULL", course.String)
+	}
+	pending, err := repo.PendingMessages(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Course != nil {
+		t.Errorf("PendingMessages = %+v, want nil Course", pending)
+	}
+}
+
+func TestUnsupportedDriver(t *testing.T) {
+	if _, err := Open(context.Background(), "postgres", ""); err == nil {
+		t.Error("Open with postgres succeeded")
+	}
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+/* A schema change; migrations are applied in order of version and recorded in schema_migrations */
+type migration struct {
+	version     int
+	description string
+	steps       []step
+}
+
+/* One statement of a migration; MySQL commits DDL at once, so a step adding a column that a failed run already added is skipped */
+type step struct {
+	statement string
+	table     string
+	column    string
+}
+
+func statement(s string) step {
+	return step{statement: s}
+}
+
+func addColumn(table, column, definition string) step {
+	return step{
+		statement: fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition),
+		table:     table,
+		column:    column,
+	}
+}
+
+/* Migrations for every supported driver; append new versions at the end and never edit applied ones */
+var dialects = map[string][]migration{
+	"mysql": {
+		{1, "create mqtt table", []step{statement(`CREATE TABLE IF NOT EXISTS mqtt (
+			Id int PRIMARY KEY AUTO_INCREMENT,
+			Altitude float,
+			Course varchar(45),
+			Fix int,
+			GpsFixAvailable bool,
+			Hdop float,
+			Latitude float,
+			Longitude float,
+			NumberOfSatellites int,
+			SpeedKnots float,
+			SpeedMph float,
+			TimeSt varchar(45),
+			Rssi integer,
+			DataLinkType varchar(45),
+			Rfid varchar(45))`)}},
+		{2, "add position age and reason", []step{
+			addColumn("mqtt", "PositionAgeSeconds", "double"),
+			addColumn("mqtt", "PositionReason", "varchar(255)")}},
+	},
+	"sqlite": {
+		{1, "create mqtt table", []step{statement(`CREATE TABLE IF NOT EXISTS mqtt (
+			Id integer PRIMARY KEY AUTOINCREMENT,
+			Altitude real,
+			Course text,
+			Fix integer,
+			GpsFixAvailable boolean,
+			Hdop real,
+			Latitude real,
+			Longitude real,
+			NumberOfSatellites integer,
+			SpeedKnots real,
+			SpeedMph real,
+			TimeSt text,
+			Rssi integer,
+			DataLinkType text,
+			Rfid text)`)}},
+		{2, "add position age and reason", []step{
+			addColumn("mqtt", "PositionAgeSeconds", "real"),
+			addColumn("mqtt", "PositionReason", "text")}},
+	},
+}
+
+/* Applies every migration newer than the version recorded in the database */
+func migrate(ctx context.Context, conn *sql.DB, migrations []migration) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		description varchar(255),
+		applied_at varchar(45))`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var current sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if current.Valid && int64(m.version) <= current.Int64 {
+			continue
+		}
+		if err := apply(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		fmt.Printf("Applied database migration %d: %s\n", m.version, m.description)
+	}
+	return nil
+}
+
+func apply(ctx context.Context, conn *sql.DB, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, s := range m.steps {
+		if s.column != "" {
+			exists, err := columnExists(ctx, tx, s.table, s.column)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+		}
+		if _, err := tx.ExecContext(ctx, s.statement); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.description, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/* Selecting a missing column fails on MySQL and SQLite alike; selecting from the table tells that apart from other errors */
+func columnExists(ctx context.Context, tx *sql.Tx, table, column string) (bool, error) {
+	if rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM %s LIMIT 0`, column, table)); err == nil {
+		return true, rows.Close()
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT 1 FROM %s LIMIT 0`, table))
+	if err != nil {
+		return false, err
+	}
+	return false, rows.Close()
+}
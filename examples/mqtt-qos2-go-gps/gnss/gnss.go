@@ -0,0 +1,198 @@
+/* Package created 18.10.2026. */
+/* Chooses which GNSS position to attach to an event, based on fix quality and age */
+
+package gnss
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"tdce-shared/tdce"
+)
+
+/* Position as sent on /ws/tdce/gps/data */
+type Position = tdce.GpsData
+
+/* Mode of a policy */
+const (
+	// the newest position that passes the policy
+	PreferLatest = "latest"
+	// the best position within MaxAge; newer wins between equally good ones
+	PreferBest = "best"
+)
+
+/* Rules a position has to pass to be selected; zero values disable a rule */
+type Policy struct {
+	Mode          string
+	MaxAge        time.Duration
+	MaxHdop       float32
+	MinSatellites int
+}
+
+/* Result of a selection */
+type Selection struct {
+	Position Position
+	// when the position was received
+	ReceivedAt time.Time
+	Age        time.Duration
+	// false when no position passed the policy and Position is only the latest one received
+	Ok     bool
+	Reason string
+}
+
+const maxSamples = 3600
+
+type sample struct {
+	pos Position
+	at  time.Time
+}
+
+/* Selector keeps recent positions and picks one according to its policy; safe for concurrent use */
+type Selector struct {
+	mu      sync.Mutex
+	policy  Policy
+	latest  *sample
+	samples []sample
+}
+
+func NewSelector(policy Policy) *Selector {
+	if policy.Mode == "" {
+		policy.Mode = PreferBest
+	}
+	return &Selector{policy: policy}
+}
+
+/* Replaces the policy, e.g. after the settings were reloaded; kept positions failing the new rules are dropped */
+func (s *Selector) SetPolicy(policy Policy) {
+	if policy.Mode == "" {
+		policy.Mode = PreferBest
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.policy = policy
+	kept := s.samples[:0]
+	for _, smp := range s.samples {
+		if s.rejection(smp.pos) == "" {
+			kept = append(kept, smp)
+		}
+	}
+	s.samples = kept
+}
+
+/* Records a position received at the given time */
+func (s *Selector) Update(pos Position, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latest = &sample{pos: pos, at: at}
+	if s.rejection(pos) == "" {
+		s.samples = append(s.samples, sample{pos: pos, at: at})
+	}
+	s.prune(at)
+}
+
+/* Picks the position for an event happening now */
+func (s *Selector) Select(now time.Time) Selection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(now)
+
+	if len(s.samples) > 0 {
+		chosen := s.samples[len(s.samples)-1]
+		reason := "latest position passing the policy"
+		if s.policy.Mode == PreferBest {
+			chosen = s.samples[0]
+			for _, candidate := range s.samples[1:] {
+				if !better(chosen.pos, candidate.pos) {
+					chosen = candidate
+				}
+			}
+			reason = "best position received"
+			if s.policy.MaxAge > 0 {
+				reason = fmt.Sprintf("best position within %s", s.policy.MaxAge)
+			}
+		}
+		return Selection{Position: chosen.pos, ReceivedAt: chosen.at, Age: now.Sub(chosen.at), Ok: true, Reason: reason}
+	}
+
+	if s.latest == nil {
+		return Selection{Reason: "no position received"}
+	}
+
+	/* Nothing passes the policy; report the latest position and why it was rejected */
+	reason := s.rejection(s.latest.pos)
+	if reason == "" {
+		reason = fmt.Sprintf("older than %s", s.policy.MaxAge)
+	}
+	return Selection{
+		Position:   s.latest.pos,
+		ReceivedAt: s.latest.at,
+		Age:        now.Sub(s.latest.at),
+		Reason:     "fallback to latest position: " + reason,
+	}
+}
+
+/* Returns why a position doesn't pass the policy or "" when it does */
+func (s *Selector) rejection(pos Position) string {
+	switch {
+	case pos.Fix == 0:
+		return "no fix"
+	case s.policy.MaxHdop > 0 && pos.Hdop > s.policy.MaxHdop:
+		return fmt.Sprintf("HDOP %.1f above %.1f", pos.Hdop, s.policy.MaxHdop)
+	case pos.NumberOfSatellites < s.policy.MinSatellites:
+		return fmt.Sprintf("%d satellites, at least %d needed", pos.NumberOfSatellites, s.policy.MinSatellites)
+	}
+	return ""
+}
+
+/* Drops samples older than MaxAge */
+func (s *Selector) prune(now time.Time) {
+	if s.policy.MaxAge <= 0 {
+		/* Without aging only the best and the newest sample can ever be selected */
+		if len(s.samples) > 2 {
+			best := s.samples[0]
+			for _, candidate := range s.samples[1 : len(s.samples)-1] {
+				if !better(best.pos, candidate.pos) {
+					best = candidate
+				}
+			}
+			s.samples = append(s.samples[:0], best, s.samples[len(s.samples)-1])
+		}
+		return
+	}
+
+	i := 0
+	for i < len(s.samples) && now.Sub(s.samples[i].at) > s.policy.MaxAge {
+		i++
+	}
+	/* Bound memory in case positions arrive much faster than expected */
+	if len(s.samples)-i > maxSamples {
+		i = len(s.samples) - maxSamples
+	}
+	s.samples = append(s.samples[:0], s.samples[i:]...)
+}
+
+/* Fix 1 is the best fix, 2 is an ok fix */
+func fixRank(fix int) int {
+	switch fix {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	}
+	return 2
+}
+
+/* Reports whether a is strictly better than b: fix type first, then HDOP, then satellite count */
+func better(a, b Position) bool {
+	if fixRank(a.Fix) != fixRank(b.Fix) {
+		return fixRank(a.Fix) < fixRank(b.Fix)
+	}
+	if a.Hdop != b.Hdop {
+		return a.Hdop < b.Hdop
+	}
+	return a.NumberOfSatellites > b.NumberOfSatellites
+}
@@ -0,0 +1,122 @@
+package gnss
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 10, 18, 8, 14, 20, 0, time.UTC)
+
+/* Frames recorded from /ws/tdce/gps/data, one JSON message per line, as they came in once a second */
+func loadFrames(t *testing.T, name string) []Position {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var frames []Position
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var pos Position
+		if err := json.Unmarshal(scanner.Bytes(), &pos); err != nil {
+			t.Fatalf("%s line %d: %v", name, len(frames)+1, err)
+		}
+		frames = append(frames, pos)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+/* Feeds the frames to a new selector, frame i received at start + i seconds */
+func replay(t *testing.T, name string, policy Policy) (*Selector, []Position) {
+	t.Helper()
+	frames := loadFrames(t, name)
+	s := NewSelector(policy)
+	for i, pos := range frames {
+		s.Update(pos, start.Add(time.Duration(i)*time.Second))
+	}
+	return s, frames
+}
+
+/* frames.jsonl: 0 no fix, 1 fix 2 HDOP 2.5, 2 fix 1 HDOP 0.9 (the best), 3 fix 1 HDOP 1.4 8 satellites, */
+/* 4 fix 2 HDOP 3.8, 5 fix 1 HDOP 1.1 (the newest) */
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		// seconds after start
+		at     int
+		frame  int
+		ok     bool
+		reason string
+	}{
+		{"latest", Policy{Mode: PreferLatest}, 5, 5, true, "latest position passing the policy"},
+		{"best", Policy{Mode: PreferBest}, 5, 2, true, "best position received"},
+		{"default mode is best", Policy{}, 5, 2, true, "best position received"},
+		{"best within max age", Policy{Mode: PreferBest, MaxAge: 3 * time.Second}, 6, 5, true, "best position within 3s"},
+		{"best still within max age", Policy{Mode: PreferBest, MaxAge: 3 * time.Second}, 5, 2, true, "best position within 3s"},
+		{"latest within max age", Policy{Mode: PreferLatest, MaxAge: 10 * time.Second}, 8, 5, true, "latest position passing the policy"},
+		{"max hdop", Policy{Mode: PreferLatest, MaxHdop: 1.0}, 5, 2, true, "latest position passing the policy"},
+		{"min satellites", Policy{Mode: PreferLatest, MinSatellites: 8}, 5, 3, true, "latest position passing the policy"},
+		{"min satellites best", Policy{Mode: PreferBest, MinSatellites: 5}, 5, 2, true, "best position received"},
+		{"hdop rejects all", Policy{Mode: PreferBest, MaxHdop: 0.5}, 5, 5, false, "fallback to latest position: HDOP 1.1 above 0.5"},
+		{"satellites reject all", Policy{Mode: PreferLatest, MinSatellites: 12}, 5, 5, false, "fallback to latest position: 7 satellites, at least 12 needed"},
+		{"all too old", Policy{Mode: PreferBest, MaxAge: 2 * time.Second}, 20, 5, false, "fallback to latest position: older than 2s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, frames := replay(t, "frames.jsonl", tt.policy)
+			now := start.Add(time.Duration(tt.at) * time.Second)
+			got := s.Select(now)
+
+			if got.Position != frames[tt.frame] {
+				t.Errorf("Position = %+v, want frame %d %+v", got.Position, tt.frame, frames[tt.frame])
+			}
+			if got.Ok != tt.ok || got.Reason != tt.reason {
+				t.Errorf("Ok, Reason = %v, %q; want %v, %q", got.Ok, got.Reason, tt.ok, tt.reason)
+			}
+			received := start.Add(time.Duration(tt.frame) * time.Second)
+			if !got.ReceivedAt.Equal(received) || got.Age != now.Sub(received) {
+				t.Errorf("ReceivedAt, Age = %s, %s; want %s, %s", got.ReceivedAt, got.Age, received, now.Sub(received))
+			}
+		})
+	}
+}
+
+func TestSelectNoFix(t *testing.T) {
+	for _, mode := range []string{PreferLatest, PreferBest} {
+		s, frames := replay(t, "nofix.jsonl", Policy{Mode: mode})
+		got := s.Select(start.Add(3 * time.Second))
+		if got.Ok || got.Reason != "fallback to latest position: no fix" {
+			t.Errorf("%s: Ok, Reason = %v, %q; want false, fallback for no fix", mode, got.Ok, got.Reason)
+		}
+		if got.Position != frames[len(frames)-1] {
+			t.Errorf("%s: Position = %+v, want the last frame", mode, got.Position)
+		}
+	}
+}
+
+func TestSelectNothingReceived(t *testing.T) {
+	got := NewSelector(Policy{}).Select(start)
+	if got.Ok || got.Reason != "no position received" || got.Position != (Position{}) {
+		t.Errorf("Select = %+v, want an empty selection", got)
+	}
+}
+
+/* A stricter policy after a reload drops the kept positions that fail it */
+func TestSetPolicy(t *testing.T) {
+	s, frames := replay(t, "frames.jsonl", Policy{Mode: PreferLatest, MaxAge: time.Minute})
+	s.SetPolicy(Policy{Mode: PreferLatest, MaxAge: time.Minute, MinSatellites: 8})
+	got := s.Select(start.Add(5 * time.Second))
+	if !got.Ok || got.Position != frames[3] {
+		t.Errorf("Select = %+v, want frame 3", got)
+	}
+}
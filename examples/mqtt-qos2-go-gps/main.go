@@ -1,35 +1,31 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"mqtt/db"
-	mq "mqtt/mqttset"
-	o2 "mqtt/request"
-	ws "mqtt/websockets"
-	"net"
+	"mqtt/gnss"
+	"mqtt/rfid"
+	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/gorilla/websocket"
+	"tdce-shared/config"
+	"tdce-shared/health"
+	"tdce-shared/metrics"
+	mq "tdce-shared/mqttset"
+	"tdce-shared/ropc"
+	"tdce-shared/supervisor"
+	"tdce-shared/wsclient"
 )
 
-type gps struct {
-	Altitude           float32 `json:"Altitude"`
-	Course             *string `json:"Course"`
-	Fix                int     `json:"Fix"`
-	GpsFixAvailable    bool    `json:"GpsFixAvailable"`
-	Hdop               float32 `json:"Hdop"`
-	Latitude           float32 `json:"Latitude"`
-	Longitude          float32 `json:"Longitude"`
-	NumberOfSatellites int     `json:"NumberOfSatellites"`
-	SpeedKnots         float32 `json:"SpeedKnots"`
-	SpeedMph           float32 `json:"SpeedMph"`
-	Time               string  `json:"Time"`
-}
+/* GPS object received from the websocket */
+type gps = gnss.Position
 
 type modem struct {
 	Rssi         int    `json:"Rssi"`
@@ -63,110 +59,95 @@ type modemFull struct {
 	State                   string `json:"state"`
 }
 
+/* Version of messageObject, sent as a user property with MQTT 5; raise it when the fields change */
+const schemaVersion = "1"
+
 type messageObject struct {
 	Rfid      string `json:"Rfid"`
 	Gps       gps    `json:"Gps"`
 	ModemData modem  `json:"ModemData"`
+	/* How old the attached position is and why it was chosen */
+	PositionAgeSeconds float64 `json:"PositionAgeSeconds"`
+	PositionReason     string  `json:"PositionReason"`
 }
 
 /* Defining parameters */
 var (
-	wg               sync.WaitGroup
-	brokerAddress    string
-	topic            string
-	quos             int
-	clientId         string
-	username         string
-	dbms             string
-	connectionString string
-	modemUrl         string
-	currentGps       gps
-	lastBestGps      gps
-	token            string
-	rfid             string
-	modemData        modem
-	messageTimer     *time.Timer
-	dbTimer          *time.Timer
-	client           mqtt.Client
-	conn             *sql.DB
+	conf           *config.Store[settings]
+	publishMetrics *metrics.MQTT
+	positions      *gnss.Selector
+	modemClient    *http.Client
+	modemToken     *ropc.TokenSource
+	gpsStream      atomic.Pointer[wsclient.Client]
+	client         mqtt.Client
+	publisher      *mq.Publisher
+	store          offlineStore
+	replaySignal   = make(chan struct{}, 1)
 )
 
-/* Sets parameters for working with mqtt */
-func setParameters() {
-	topic = "gps"
-	quos = 2
-	modemUrl = "http://192.168.0.100/devicemanager/api/v1/networking/modem/ppp0/details"
+/* Longest wait for the modem data of a tag; the message goes out with the last known data after it */
+const modemTimeout = 5 * time.Second
 
-	/* Setting connection parameters */
-	dbms = "mysql"
-	connectionString = "root:TDC_arch2023@tcp(localhost:3306)/gpsmqtt"
-}
-
-/* Sets Bearer Authentication token from OAuth2.0 */
-func setToken() {
-	for {
-		token = o2.Authorize()
-		/* Sleep for 59 minutes before reset */
-		if token != "" {
-			time.Sleep(59 * time.Minute)
-		}
-	}
-}
+/* Last modem data fetched; tags read on several connections fetch it at the same time */
+var (
+	modemMu   sync.Mutex
+	modemData modem
+)
 
-/* Opens connection to websocket and receives last websocket object */
-func getWsData(conn *websocket.Conn) gps {
-	receivedObject, erro := ws.ListenOnWS(conn)
-	var gps_obj gps
-	if erro != nil {
-		fmt.Println("Error fetching gps: ", erro)
+/* Fetches GPS data from websocket */
+/* The client reconnects on its own, so positions keep coming after a connection loss */
+func fetchGpsData(ctx context.Context) error {
+	cfg := wsclient.Config{URL: wsclient.URL(conf.Get().WebSocket, wsclient.GpsData)}
+	client, stream := wsclient.Subscribe[gps](ctx, cfg)
+	gpsStream.Store(client)
+
+	for currentGps := range stream {
+		/* The selector decides later which of the received positions is attached to a message */
+		positions.Update(currentGps, time.Now())
 	}
-	json.Unmarshal(receivedObject, &gps_obj)
-	return gps_obj
+	return nil
 }
 
-/* Fetches GPS data from websocket */
-func fetchGpsData() {
-	conn, _ := ws.OpenWebsocket("ws", "192.168.0.100:31768", "/ws/tdce/gps/data")
-	defer conn.Close()
-
-	for {
-		currentGps = getWsData(conn)
-		/* If the fix of the currently fetched gps object is equal to or better than the value in lastBestGps, set lastBestGps to this current value */
-		// 0 - no fix, 1 - best fix, 2 - ok fix
-		if currentGps.Fix <= lastBestGps.Fix && currentGps.Fix != 0 {
-			lastBestGps = currentGps
-		}
+/* Creates the configured RFID source */
+func createRfidSource(cfg *settings) (rfid.Source, error) {
+	switch cfg.Rfid.Source {
+	case "tcp":
+		return &rfid.TCPSource{Address: cfg.Rfid.Address, Framing: cfg.rfidFraming()}, nil
+	case "serial":
+		return &rfid.SerialSource{Device: cfg.Rfid.Device, Baud: cfg.Rfid.Baud, Framing: cfg.rfidFraming()}, nil
+	case "evdev":
+		return &rfid.EvdevSource{Device: cfg.Rfid.Device, Grab: true}, nil
 	}
-
+	return nil, fmt.Errorf("unknown RFID source %q", cfg.Rfid.Source)
 }
 
-/* Serves a TCP on localhost:1234 */
-func serveTcp() {
-	listener, err := net.Listen("tcp", "localhost:5247")
+/* Reads RFID tags and publishes a message for every new tag */
+/* A tag that is being published when ctx is cancelled is still published or queued */
+func readRfid(ctx context.Context) error {
+	cfg := conf.Get()
+	source, err := createRfidSource(cfg)
 	if err != nil {
-		fmt.Println("Error:", err)
-		return
+		return err
 	}
-	defer listener.Close()
-
-	fmt.Println("Server is listening on port 5247")
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("Error:", err)
-			continue
-		}
-		go handleClient(conn)
+	reader := rfid.Reader{
+		Sources: []rfid.Source{source},
+		Decoder: cfg.rfidDecoder(),
+		Dedup:   rfid.NewDeduplicator(time.Duration(cfg.Rfid.DedupWindow)),
 	}
+	return reader.Run(ctx, handleRead)
 }
 
 /* Creates data that will be sent to broker */
-func createMessage(rfid string) ([]byte, error) {
+func createMessage(tag string, modemInfo modem) ([]byte, error) {
 	var msg messageObject
-	msg.Rfid = rfid
-	msg.Gps = lastBestGps
-	msg.ModemData = modemData
+	msg.Rfid = tag
+	msg.ModemData = modemInfo
+
+	selection := positions.Select(time.Now())
+	msg.Gps = selection.Position
+	msg.PositionAgeSeconds = selection.Age.Seconds()
+	msg.PositionReason = selection.Reason
 
 	jsonData, err := json.Marshal(msg)
 	if err != nil {
@@ -176,232 +157,221 @@ func createMessage(rfid string) ([]byte, error) {
 }
 
 /* Makes OAuth2.0 authenticated request to REST API for fetching modem data */
-func fetchModemData() {
+/* On failure the last known modem data is returned */
+func fetchModemData() modem {
+	modemMu.Lock()
+	last := modemData
+	modemMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), modemTimeout)
+	defer cancel()
+	body, err := ropc.MakeROPCRequest(ctx, modemClient, conf.Get().ModemUrl)
+	if err != nil {
+		fmt.Println("Error fetching modem data: ", err)
+		return last
+	}
 	var modfull modemFull
-	err := json.Unmarshal(o2.MakeROPCRequest(modemUrl, token), &modfull)
+	err = json.Unmarshal(body, &modfull)
 	if err != nil {
 		fmt.Println("Error decoding: ", err)
+		return last
 	}
 	/* Setting values that will be shown in message */
-	modemData.Rssi = modfull.Rssi
-	modemData.DataLinkType = modfull.DataLinkType
+	current := modem{Rssi: modfull.Rssi, DataLinkType: modfull.DataLinkType}
+	modemMu.Lock()
+	modemData = current
+	modemMu.Unlock()
+	return current
 }
 
-/* Creates messages that will be published */
-func handleClient(conn net.Conn) {
-	defer conn.Close()
-	buffer := make([]byte, 1024)
-	clientDisconnected := false
-
-	for !clientDisconnected {
-		n, err := conn.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				clientDisconnected = true
-			} else {
-				fmt.Println("Error:", err)
-			}
-		}
-		if n > 0 {
-			fmt.Printf("Received: %s\n", buffer[:n])
-			rfid = string(buffer[:n])
-			fetchModemData()
-			msge, err := createMessage(rfid)
-			check(err)
-			publishToMqtt(msge)
-		}
+/* Creates the message for a tag read and publishes it; runs concurrently for reads from different sources */
+func handleRead(read rfid.Read) {
+	fmt.Printf("Received tag %s from %s\n", read.Tag, read.Source)
+	msge, err := createMessage(read.Tag, fetchModemData())
+	if err != nil {
+		fmt.Printf("Dropping tag %s: %v\n", read.Tag, err)
+		return
 	}
+	publishToMqtt(msge)
 }
 
-/* Inserts or deletes data from database */
-func modifyDB(conn *sql.DB, method string, data []byte, id int) {
-	var query string
-
-	switch method {
-	case "INSERT":
-		var msg messageObject
-		json.Unmarshal(data, &msg)
-		var courseValue string
-
-		/* Set course to null if there is no data for it; do the same for gateway if it will be implemented */
-		if msg.Gps.Course != nil && *msg.Gps.Course != "" {
-			courseValue = fmt.Sprintf("'%s'", *msg.Gps.Course)
-		} else {
-			courseValue = "NULL"
+/* Publishes the MQTT message without waiting for the broker; the future tells how it went */
+func publish(ctx context.Context, msge []byte, replay bool) *mq.Future {
+	topic := conf.Get().Mqtt.Topic
+	result := publisher.Publish(ctx, mq.Message{Topic: topic, Payload: msge, Replay: replay})
+	result.Then(func(err error) {
+		if err != nil {
+			publishMetrics.Failed(topic)
+			return
 		}
-
-		query = fmt.Sprintf(`INSERT INTO mqtt (Altitude, Course, Fix, GpsFixAvailable, Hdop, Latitude, 
-        Longitude, NumberOfSatellites, SpeedKnots, SpeedMph, TimeSt, Rssi, DataLinkType, 
-        Rfid) VALUES (%f, %s, %d, %t, %f, %f, %f, %d, %f, %f, '%s', %d, '%s', '%s');`,
-			msg.Gps.Altitude, courseValue, msg.Gps.Fix, msg.Gps.GpsFixAvailable,
-			msg.Gps.Hdop, msg.Gps.Latitude, msg.Gps.Longitude, msg.Gps.NumberOfSatellites,
-			msg.Gps.SpeedKnots, msg.Gps.SpeedMph, msg.Gps.Time, msg.ModemData.Rssi,
-			msg.ModemData.DataLinkType, msg.Rfid)
-
-		db.ModifyDB(conn, query)
-		break
-
-	case "DELETE":
-		query = fmt.Sprintf("DELETE FROM mqtt WHERE Id = %d", id)
-		db.ModifyDB(conn, query)
-		break
-	}
+		publishMetrics.Published(topic)
+	})
+	return result
 }
 
-/* Converts database mqtt object to message object for publishing */
-func convertToMessageObjects(queuedMessages []db.MQTTData) []messageObject {
-	var messageObjects []messageObject
-
-	for _, d := range queuedMessages {
-		gpsData := gps{
-			Altitude:           d.Altitude,
-			Course:             d.Course,
-			Fix:                d.Fix,
-			GpsFixAvailable:    d.GpsFixAvailable,
-			Hdop:               d.Hdop,
-			Latitude:           d.Latitude,
-			Longitude:          d.Longitude,
-			NumberOfSatellites: d.NumberOfSatellites,
-			SpeedKnots:         d.SpeedKnots,
-			SpeedMph:           d.SpeedMph,
-			Time:               d.Time,
-		}
+/* Longest wait of a new message for an in-flight slot */
+const slotTimeout = 5 * time.Second
 
-		modemData := modem{
-			Rssi:         d.Rssi,
-			DataLinkType: d.DataLinkType,
-		}
-
-		messageObj := messageObject{
-			Rfid:      d.Rfid,
-			Gps:       gpsData,
-			ModemData: modemData,
-		}
-
-		messageObjects = append(messageObjects, messageObj)
+/* Handles message publishing */
+/* While older messages are still queued, new ones are queued behind them so the broker receives everything in order */
+/* Messages the broker does not acknowledge go to the queue through queueMessage and are replayed later */
+func publishToMqtt(msge []byte) {
+	if store.Len() == 0 {
+		/* While paho holds on to every in-flight slot the message is queued instead of waiting */
+		ctx, cancel := context.WithTimeout(context.Background(), slotTimeout)
+		defer cancel()
+		publish(ctx, msge, false)
+		return
 	}
-	return messageObjects
+	queueMessage(mq.Message{Payload: msge}, nil)
 }
 
-/* Tries to publish the MQTT message */
-func tryToPublish(msge []byte) {
-	success := mq.PublishMessage(topic, msge, client, byte(quos))
-	if success == 1 {
-		messageTimer.Reset(5 * time.Minute)
+/* Offline hook of the publisher: keeps the message for the replay */
+func queueMessage(m mq.Message, _ error) {
+	if err := store.Append(m.Payload); err != nil {
+		fmt.Println("Error queueing message: ", err)
+		return
 	}
+	requestReplay()
 }
 
-/* Handles message publishing */
-/* If no message is published and timer has run out, insert the message into database; else publish the message and if it is a success, reset the timer */
-func publishToMqtt(msge []byte) {
+/* Asks forwardQueue to replay the queue without blocking the caller */
+func requestReplay() {
 	select {
-	// if the message timer ran out, publish insert to database and still try to publish afterwards; otherwise just publish the message
-	case <-messageTimer.C:
-		modifyDB(conn, "INSERT", msge, 0)
+	case replaySignal <- struct{}{}:
 	default:
-		tryToPublish(msge)
 	}
 }
 
-func check(err error) {
-	if err != nil {
-		fmt.Println("Error: ", err)
-	}
-}
+/* Replays queued messages in order as soon as the client (re)connects */
+/* Each one is acknowledged before the next, so the queue only moves on when the broker has the message */
+/* Also retries periodically in case a publish timed out while the connection stayed open */
+func forwardQueue(ctx context.Context) error {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
 
-func checkDatabase() {
 	for {
 		select {
-		// if the timer runs out
-		case <-dbTimer.C:
-			queuedMessages := db.SelectValues(conn, "SELECT * FROM mqtt")
-			messageObjects := convertToMessageObjects(queuedMessages)
-
-			for i, msg := range messageObjects {
-				jsonData, err := json.Marshal(msg)
-				if err != nil {
-					fmt.Println("Error marshaling JSON: ", err)
-					return
-				}
-				/* If message publishing is success, the message will be deleted from the database */
-				/* If it isn't successfully published, it will stay in the database and its deletion will be retried when timer runs out again */
-				success := mq.PublishMessage(topic, jsonData, client, byte(quos))
-
-				// if the message is published successfully, delete the message from the database
-				if success == 1 {
-					modifyDB(conn, "DELETE", nil, queuedMessages[i].Id)
-				}
-			}
-			/* After checking the messages stored in the database, the timer should be reset */
-			dbTimer.Reset(30 * time.Minute)
+		case <-ctx.Done():
+			return nil
+		case <-replaySignal:
+		case <-ticker.C:
+		}
+		if store.Len() == 0 || !client.IsConnectionOpen() {
+			continue
+		}
+
+		replayed, err := store.Replay(func(data []byte) error {
+			return publish(ctx, data, true).Wait(ctx)
+		})
+		if replayed > 0 {
+			fmt.Printf("Replayed %d queued messages, %d still queued.\n", replayed, store.Len())
+		}
+		if err != nil {
+			fmt.Println("Replay stopped: ", err)
 		}
 	}
 }
 
 func main() {
 
-	setParameters()
+	conf = config.NewStore(defaults(), config.Options{
+		Name:      "mqtt",
+		File:      "config.yaml",
+		EnvPrefix: "GPS",
+		Args:      os.Args[1:],
+	})
+	cfg := conf.Get()
+	positions = gnss.NewSelector(cfg.gpsPolicy())
+
+	/* OAuth2.0 client for the device manager API; tokens are fetched and renewed on demand */
+	oauthConf, err := ropc.LoadConfig(cfg.Params)
+	if err != nil {
+		fmt.Println("Error opening config file: ", err)
+		return
+	}
+	modemToken = ropc.NewTokenSource(oauthConf)
+	modemClient = ropc.NewClient(modemToken)
 
-	/* Open database connection */
-	conn = db.Connect(dbms, connectionString)
-	defer conn.Close()
+	/* Open the store-and-forward queue */
+	store, err = openStore(cfg)
+	if err != nil {
+		fmt.Println("Error opening message store: ", err)
+		return
+	}
 
 	/* Open broker connection - broker stays online even if message isn't published */
-	brokerAddress = "tcp://localhost:1883"
-	// brokerAddress = "tcp://192.168.0.100:1883"
-	clientId = "clientest"
-	username = "testerE"
-	client = mq.CreateMqttClient(brokerAddress, clientId, username)
-	mq.ConnectClientToBroker(client)
-
-	/* Creating timers */
-	messageTimer = time.NewTimer(5 * time.Minute)
-	dbTimer = time.NewTimer(30 * time.Minute)
-
-	/* Start 4 separate goroutines */
-	wg.Add(4)
-
-	// Authorize
-	go func() {
-		defer wg.Done()
-		setToken()
-	}()
-
-	// GPS websocket
-	go func() {
-		defer wg.Done()
-		fetchGpsData()
-	}()
-
-	// TCP server
-	go func() {
-		defer wg.Done()
-		serveTcp()
-	}()
-
-	// Database Check Timer
-	go func() {
-		defer wg.Done()
-		checkDatabase()
-	}()
-
-	wg.Wait()
-}
+	/* With reconnect enabled the gateway starts without the broker and queues the messages until it is reachable */
+	client, err = mq.NewClient(cfg.mqttOptions(func(c mqtt.Client) {
+		fmt.Println("Connected")
+		requestReplay()
+	}))
+	if err != nil {
+		fmt.Println("Error creating MQTT client: ", err)
+		return
+	}
+	if err := mq.ConnectClientToBroker(client); err != nil {
+		fmt.Println("Error connecting to broker: ", err)
+		return
+	}
+	publisher = mq.NewPublisher(client, mq.Options{
+		InFlight:   cfg.Mqtt.InFlight,
+		QoS:        byte(cfg.Mqtt.Qos),
+		Offline:    queueMessage,
+		Properties: cfg.mqttProperties(),
+		/* paho sends the messages in flight again after a reconnect of a persistent session, so they aren't queued twice */
+		KeepTimedOut: cfg.Mqtt.Session.Persistent,
+	})
+
+	/* Every goroutine runs as a supervised service; a crashed one is restarted */
+	/* On Ctrl-C or docker stop the services finish the message at hand, then the hooks wait for the */
+	/* messages in flight, disconnect from the broker and close the store, last registered first */
+	sup := supervisor.New()
+	sup.OnShutdown("store", func(context.Context) error { return store.Close() })
+	sup.OnShutdown("mqtt", func(ctx context.Context) error {
+		/* Messages that fail now are still queued, the store is closed after this */
+		err := publisher.Close(ctx)
+		mq.Disconnect(client, cfg.Mqtt.Status, 1000)
+		return err
+	})
+
+	sup.Go("gps", fetchGpsData)
+	sup.Go("rfid", readRfid)
+	sup.Go("replay", forwardQueue)
+	sup.Go("config", func(ctx context.Context) error {
+		conf.WatchSIGHUP(ctx, func(cfg *settings) {
+			positions.SetPolicy(cfg.gpsPolicy())
+			publisher.SetQoS(byte(cfg.Mqtt.Qos), nil)
+		})
+		return nil
+	})
+
+	/* Metrics are counted even when the endpoint is disabled */
+	reg := metrics.NewRegistry()
+	publishMetrics = metrics.NewMQTT(reg, store.Len)
+	if cfg.MetricsAddress != "" {
+		sup.Go("metrics", func(ctx context.Context) error {
+			return metrics.Serve(ctx, cfg.MetricsAddress, reg)
+		})
+	}
 
-/* DATABASE STRUCTURE */
-/*create table mqtt (
-	Id int primary key auto_increment,
-	Altitude float,
-    Course varchar(45),
-    Fix int,
-    GpsFixAvailable bool,
-    Hdop float,
-    Latitude float,
-    Longitude float,
-    NumberOfSatellites int,
-    SpeedKnots float,
-    SpeedMph float,
-    TimeSt varchar(45),
-	Rssi integer,
-    DataLinkType varchar(45),
-    Rfid varchar(45) );*/
+	/* /healthz restarts a wedged gateway, /readyz also reports the GPS stream, broker, store and modem API */
+	if cfg.HealthAddress != "" {
+		checks := health.New()
+		checks.Live("services", health.Supervisor(sup))
+		checks.Ready("gps stream", health.Stream(gpsStream.Load, time.Duration(cfg.StreamMaxAge)))
+		checks.Ready("mqtt", health.MQTT(client))
+		checks.Ready("store", checkStore)
+		checks.Ready("modem token", health.Token(modemToken))
+		sup.Go("health", func(ctx context.Context) error {
+			return checks.Serve(ctx, cfg.HealthAddress)
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := sup.Run(ctx); err != nil {
+		fmt.Println("Error shutting down: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,97 @@
+package rfid
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Reads a keyboard-wedge RFID reader through its Linux input device, e.g. /dev/input/event0 */
+/* The reader "types" the tag followed by Enter; Enter ends the frame */
+type EvdevSource struct {
+	Device string
+	// takes the device exclusively so the typed tags don't end up on a console
+	Grab bool
+}
+
+/* struct input_event; the size of the timestamp depends on the architecture */
+type inputEvent struct {
+	Time  unix.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+const (
+	evKey     = 0x01
+	keyPress  = 1
+	eviocgrab = 0x40044590
+)
+
+/* Key codes from linux/input-event-codes.h that readers send */
+var keymap = map[uint16]byte{
+	2: '1', 3: '2', 4: '3', 5: '4', 6: '5', 7: '6', 8: '7', 9: '8', 10: '9', 11: '0',
+	12: '-', 39: ';', 51: ',', 52: '.',
+	16: 'Q', 17: 'W', 18: 'E', 19: 'R', 20: 'T', 21: 'Y', 22: 'U', 23: 'I', 24: 'O', 25: 'P',
+	30: 'A', 31: 'S', 32: 'D', 33: 'F', 34: 'G', 35: 'H', 36: 'J', 37: 'K', 38: 'L',
+	44: 'Z', 45: 'X', 46: 'C', 47: 'V', 48: 'B', 49: 'N', 50: 'M',
+	71: '7', 72: '8', 73: '9', 75: '4', 76: '5', 77: '6', 79: '1', 80: '2', 81: '3', 82: '0',
+}
+
+var enterKeys = map[uint16]bool{28: true, 96: true}
+
+func (s *EvdevSource) Name() string {
+	return "evdev " + s.Device
+}
+
+func (s *EvdevSource) Run(ctx context.Context, emit func(frame []byte)) error {
+	dev, err := os.Open(s.Device)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	if s.Grab {
+		raw, err := dev.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var grabErr error
+		if err := raw.Control(func(fd uintptr) { grabErr = unix.IoctlSetInt(int(fd), eviocgrab, 1) }); err != nil {
+			return err
+		}
+		if grabErr != nil {
+			return grabErr
+		}
+	}
+
+	/* Closing the device unblocks the pending Read */
+	stop := context.AfterFunc(ctx, func() { dev.Close() })
+	defer stop()
+
+	var frame []byte
+	for {
+		var ev inputEvent
+		if err := binary.Read(dev, binary.LittleEndian, &ev); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if ev.Type != evKey || ev.Value != keyPress {
+			continue
+		}
+		if enterKeys[ev.Code] {
+			if len(frame) > 0 {
+				emit(frame)
+			}
+			frame = nil
+			continue
+		}
+		if c, ok := keymap[ev.Code]; ok {
+			frame = append(frame, c)
+		}
+	}
+}
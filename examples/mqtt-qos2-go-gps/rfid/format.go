@@ -0,0 +1,108 @@
+package rfid
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+/* Decodes frames into tag strings */
+/* Format is "raw" (default), "em4100", "wiegand26" or "wiegand34" */
+/* Encoding tells how the reader prints the number: "hex" (default) or "dec" */
+type Decoder struct {
+	Format   string
+	Encoding string
+}
+
+var errParity = errors.New("wiegand parity check failed")
+
+/* Returns the normalized tag: */
+/* raw - frame without surrounding whitespace and control characters */
+/* em4100 - 10 upper-case hex digits (version byte + 32-bit id) */
+/* wiegand26 / wiegand34 - facility:card in decimal */
+func (d Decoder) Decode(frame []byte) (string, error) {
+	text := strings.TrimFunc(string(frame), func(r rune) bool { return r <= ' ' || r == 0x7f })
+	if text == "" {
+		return "", errors.New("empty frame")
+	}
+
+	switch d.Format {
+	case "", "raw":
+		return text, nil
+	case "em4100":
+		return d.decodeEM4100(text)
+	case "wiegand26":
+		return d.decodeWiegand(text, 26)
+	case "wiegand34":
+		return d.decodeWiegand(text, 34)
+	}
+	return "", fmt.Errorf("unknown tag format %q", d.Format)
+}
+
+/* EM4100 readers send 10 hex digits, optionally followed by 2 hex digits of XOR checksum */
+/* With the dec encoding they print the 32-bit id as a decimal number instead */
+func (d Decoder) decodeEM4100(text string) (string, error) {
+	if d.Encoding == "dec" {
+		id, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid EM4100 id: %w", err)
+		}
+		return fmt.Sprintf("00%08X", id), nil
+	}
+
+	raw, err := hex.DecodeString(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid EM4100 id: %w", err)
+	}
+	switch len(raw) {
+	case 5:
+	case 6:
+		var sum byte
+		for _, b := range raw[:5] {
+			sum ^= b
+		}
+		if sum != raw[5] {
+			return "", errors.New("EM4100 checksum mismatch")
+		}
+		raw = raw[:5]
+	default:
+		return "", fmt.Errorf("EM4100 id must have 10 or 12 hex digits, got %d", len(text))
+	}
+	return strings.ToUpper(hex.EncodeToString(raw)), nil
+}
+
+/* Wiegand frames carry the raw bits including both parity bits, printed as hex or decimal */
+/* The leading parity bit is even parity over the first half of the data, the trailing one odd parity over the second half */
+func (d Decoder) decodeWiegand(text string, length int) (string, error) {
+	base := 16
+	if d.Encoding == "dec" {
+		base = 10
+	}
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(text), "0x"), base, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid wiegand%d value: %w", length, err)
+	}
+	if value>>length != 0 {
+		return "", fmt.Errorf("value has more than %d bits", length)
+	}
+
+	dataBits := length - 2
+	half := dataBits / 2
+	data := (value >> 1) & (1<<dataBits - 1)
+	high := data >> half
+	low := data & (1<<half - 1)
+	evenParity := value >> (length - 1) & 1
+	oddParity := value & 1
+
+	if uint64(bits.OnesCount64(high))%2 != evenParity || uint64(bits.OnesCount64(low)+1)%2 != oddParity {
+		return "", errParity
+	}
+
+	if length == 26 {
+		return fmt.Sprintf("%03d:%05d", data>>16, data&0xffff), nil
+	}
+	return fmt.Sprintf("%05d:%05d", data>>16, data&0xffff), nil
+}
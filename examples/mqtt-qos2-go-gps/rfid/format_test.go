@@ -0,0 +1,41 @@
+package rfid
+
+import "testing"
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		decoder Decoder
+		frame   string
+		want    string
+		wantErr bool
+	}{
+		{"raw", Decoder{}, " \x02tag-1\r\x7f", "tag-1", false},
+		{"raw empty", Decoder{Format: "raw"}, "\r\n", "", true},
+
+		{"em4100", Decoder{Format: "em4100"}, "0a0b0c0d0e", "0A0B0C0D0E", false},
+		{"em4100 with checksum", Decoder{Format: "em4100"}, "010203040501", "0102030405", false},
+		{"em4100 bad checksum", Decoder{Format: "em4100"}, "010203040500", "", true},
+		{"em4100 wrong length", Decoder{Format: "em4100"}, "01020304", "", true},
+		{"em4100 not hex", Decoder{Format: "em4100"}, "01020304zz", "", true},
+		{"em4100 decimal", Decoder{Format: "em4100", Encoding: "dec"}, "16909060", "0001020304", false},
+		{"em4100 decimal over 32 bits", Decoder{Format: "em4100", Encoding: "dec"}, "4294967296", "", true},
+
+		{"wiegand26", Decoder{Format: "wiegand26"}, "2f623ae", "123:04567", false},
+		{"wiegand26 0x", Decoder{Format: "wiegand26"}, "0x2020002", "001:00001", false},
+		{"wiegand26 decimal", Decoder{Format: "wiegand26", Encoding: "dec"}, "49685422", "123:04567", false},
+		{"wiegand26 even parity", Decoder{Format: "wiegand26"}, "0f623ae", "", true},
+		{"wiegand26 odd parity", Decoder{Format: "wiegand26"}, "2f623af", "", true},
+		{"wiegand26 too long", Decoder{Format: "wiegand26"}, "6f623ae", "", true},
+		{"wiegand34", Decoder{Format: "wiegand34"}, "f623af", "00123:04567", false},
+		{"wiegand34 parity", Decoder{Format: "wiegand34"}, "f623ae", "", true},
+
+		{"unknown format", Decoder{Format: "hid"}, "1234", "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.decoder.Decode([]byte(tt.frame))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: Decode(%q) = %q, %v; want %q", tt.name, tt.frame, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package rfid
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	stx = 0x02
+	etx = 0x03
+)
+
+/* Describes how frames are delimited in a byte stream */
+/* Mode is "delimiter" (default), "stx-etx" or "fixed" */
+type Framing struct {
+	Mode string
+	// frame terminator for the delimiter mode; defaults to "\n", a preceding "\r" is dropped
+	Delimiter []byte
+	// frame size for the fixed mode
+	Length int
+}
+
+/* Returns a bufio.SplitFunc that reassembles frames regardless of how the stream was split into reads */
+func (f Framing) SplitFunc() (bufio.SplitFunc, error) {
+	switch f.Mode {
+	case "", "delimiter":
+		delim := f.Delimiter
+		if len(delim) == 0 {
+			delim = []byte("\n")
+		}
+		return splitDelimiter(delim), nil
+	case "stx-etx":
+		return splitSTXETX, nil
+	case "fixed":
+		if f.Length <= 0 {
+			return nil, fmt.Errorf("fixed framing needs a positive length, got %d", f.Length)
+		}
+		return splitFixed(f.Length), nil
+	}
+	return nil, fmt.Errorf("unknown framing mode %q", f.Mode)
+}
+
+/* Scans frames from a stream; the returned scanner yields one frame per Scan */
+func (f Framing) Scanner(r io.Reader) (*bufio.Scanner, error) {
+	split, err := f.SplitFunc()
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(split)
+	return scanner, nil
+}
+
+func splitDelimiter(delim []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			frame := bytes.TrimSuffix(data[:i], []byte("\r"))
+			/* Empty frames, e.g. from blank lines, are skipped */
+			if len(frame) == 0 {
+				return i + len(delim), nil, nil
+			}
+			return i + len(delim), frame, nil
+		}
+		if atEOF && len(bytes.TrimSpace(data)) > 0 {
+			/* Last frame without terminator */
+			return len(data), bytes.TrimSpace(data), nil
+		}
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+/* Frames look like STX payload ETX; bytes outside of a frame are discarded */
+func splitSTXETX(data []byte, atEOF bool) (int, []byte, error) {
+	start := bytes.IndexByte(data, stx)
+	if start < 0 {
+		/* Nothing but noise so far */
+		return len(data), nil, nil
+	}
+	end := bytes.IndexByte(data[start+1:], etx)
+	if end < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		/* Drop the noise before STX and wait for the rest of the frame */
+		return start, nil, nil
+	}
+	end += start + 1
+	return end + 1, data[start+1 : end], nil
+}
+
+func splitFixed(length int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) >= length {
+			return length, data[:length], nil
+		}
+		if atEOF {
+			/* Incomplete frame at the end of the stream */
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+}
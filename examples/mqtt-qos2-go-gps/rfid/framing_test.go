@@ -0,0 +1,136 @@
+package rfid
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Hands out the chunks one Read at a time, like a TCP stream that split or merged the writes */
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+	} else {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing Framing
+		chunks  []string
+		want    []string
+	}{
+		{"delimiter", Framing{}, []string{"tag1\n", "tag2\r\n"}, []string{"tag1", "tag2"}},
+		{"delimiter split", Framing{}, []string{"ta", "g1", "\ntag", "2\n"}, []string{"tag1", "tag2"}},
+		{"delimiter merged", Framing{}, []string{"tag1\ntag2\ntag3\n"}, []string{"tag1", "tag2", "tag3"}},
+		{"delimiter blank lines and last frame", Framing{}, []string{"\n\ntag1\n", "\r\n", "tag2 "}, []string{"tag1", "tag2"}},
+		{"own delimiter", Framing{Delimiter: []byte(";")}, []string{"tag1;ta", "g2;"}, []string{"tag1", "tag2"}},
+		{"stx-etx", Framing{Mode: "stx-etx"}, []string{"\x02tag1\x03", "\x02tag2\x03"}, []string{"tag1", "tag2"}},
+		{"stx-etx split", Framing{Mode: "stx-etx"}, []string{"\x02ta", "g1", "\x03\x02", "tag2\x03"}, []string{"tag1", "tag2"}},
+		{"stx-etx merged with noise", Framing{Mode: "stx-etx"}, []string{"xx\x02tag1\x03yy\x02tag2\x03\r\n"}, []string{"tag1", "tag2"}},
+		{"stx-etx partial at the end", Framing{Mode: "stx-etx"}, []string{"\x02tag1\x03\x02ta"}, []string{"tag1"}},
+		{"fixed", Framing{Mode: "fixed", Length: 4}, []string{"tag1tag2"}, []string{"tag1", "tag2"}},
+		{"fixed split", Framing{Mode: "fixed", Length: 4}, []string{"t", "ag", "1ta", "g2"}, []string{"tag1", "tag2"}},
+		{"fixed partial at the end", Framing{Mode: "fixed", Length: 4}, []string{"tag1ta"}, []string{"tag1"}},
+	}
+	for _, tt := range tests {
+		scanner, err := tt.framing.Scanner(&chunkReader{chunks: append([]string(nil), tt.chunks...)})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for scanner.Scan() {
+			got = append(got, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: frames %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: frames %q, want %q", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+
+	for _, f := range []Framing{{Mode: "fixed"}, {Mode: "lines"}} {
+		if _, err := f.SplitFunc(); err == nil {
+			t.Errorf("framing %+v accepted", f)
+		}
+	}
+}
+
+/* A client that stays connected must not keep Run from returning */
+func TestTCPSourceStops(t *testing.T) {
+	src := &TCPSource{Address: "127.0.0.1:0"}
+	listener, err := net.Listen("tcp", src.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Address = listener.Addr().String()
+	listener.Close()
+
+	var mu sync.Mutex
+	var frames []string
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- src.Run(ctx, func(frame []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			frames = append(frames, string(frame))
+		})
+	}()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", src.Address); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	defer conn.Close()
+	conn.Write([]byte("ta"))
+	conn.Write([]byte("g1\ntag2\n"))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(frames)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("frames %q, want tag1 and tag2", frames)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return with a client connected")
+	}
+}
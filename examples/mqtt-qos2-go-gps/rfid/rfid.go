@@ -0,0 +1,106 @@
+/* Package created 18.10.2026. */
+/* Reads RFID tags from pluggable sources (TCP, serial port, keyboard-wedge readers) */
+/* Sources cut the incoming byte stream into frames, frames are decoded into tags and repeated reads are dropped */
+
+package rfid
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/* Source of raw RFID frames */
+type Source interface {
+	/* Name used in logs and attached to every read */
+	Name() string
+	/* Reads until ctx is cancelled and hands every complete frame to emit */
+	Run(ctx context.Context, emit func(frame []byte)) error
+}
+
+/* A decoded tag read */
+type Read struct {
+	Tag    string
+	Raw    []byte
+	Source string
+	Time   time.Time
+}
+
+/* Reader connects sources, decoder and de-duplication */
+type Reader struct {
+	Sources []Source
+	Decoder Decoder
+	// nil disables de-duplication
+	Dedup *Deduplicator
+}
+
+/* Runs all sources until ctx is cancelled and calls handle for every new tag */
+/* handle may be called from several goroutines at once */
+func (r *Reader) Run(ctx context.Context, handle func(Read)) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(r.Sources))
+
+	for _, src := range r.Sources {
+		wg.Add(1)
+		go func(src Source) {
+			defer wg.Done()
+			err := src.Run(ctx, func(frame []byte) {
+				r.process(src.Name(), frame, handle)
+			})
+			if err != nil && ctx.Err() == nil {
+				errs <- fmt.Errorf("rfid source %s: %w", src.Name(), err)
+			}
+		}(src)
+	}
+
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (r *Reader) process(source string, frame []byte, handle func(Read)) {
+	tag, err := r.Decoder.Decode(frame)
+	if err != nil {
+		fmt.Printf("Ignoring RFID frame %q from %s: %v\n", frame, source, err)
+		return
+	}
+
+	now := time.Now()
+	if r.Dedup != nil && r.Dedup.Seen(tag, now) {
+		return
+	}
+	handle(Read{Tag: tag, Raw: frame, Source: source, Time: now})
+}
+
+/* Drops reads of the same tag repeated within Window */
+type Deduplicator struct {
+	Window time.Duration
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{Window: window, lastSeen: make(map[string]time.Time)}
+}
+
+/* Reports whether tag was already seen within the window and records this read */
+/* A tag held in front of the reader keeps being suppressed until it is absent for a whole window */
+func (d *Deduplicator) Seen(tag string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	last, ok := d.lastSeen[tag]
+	d.lastSeen[tag] = now
+
+	/* Forget tags that expired so the map doesn't grow forever */
+	if len(d.lastSeen) > 1024 {
+		for t, seen := range d.lastSeen {
+			if now.Sub(seen) > d.Window {
+				delete(d.lastSeen, t)
+			}
+		}
+	}
+	return ok && now.Sub(last) < d.Window
+}
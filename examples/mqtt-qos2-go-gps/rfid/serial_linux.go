@@ -0,0 +1,95 @@
+package rfid
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Reads an RFID reader attached to a serial port, e.g. /dev/ttymxc1 */
+type SerialSource struct {
+	Device  string
+	Baud    int
+	Framing Framing
+}
+
+var baudRates = map[int]uint32{
+	1200:   unix.B1200,
+	2400:   unix.B2400,
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+}
+
+func (s *SerialSource) Name() string {
+	return "serial " + s.Device
+}
+
+func (s *SerialSource) Run(ctx context.Context, emit func(frame []byte)) error {
+	if _, err := s.Framing.SplitFunc(); err != nil {
+		return err
+	}
+
+	port, err := os.OpenFile(s.Device, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+
+	if err := s.configure(port); err != nil {
+		return fmt.Errorf("configuring %s: %w", s.Device, err)
+	}
+
+	/* Closing the port unblocks the pending Read */
+	stop := context.AfterFunc(ctx, func() { port.Close() })
+	defer stop()
+
+	scanner, _ := s.Framing.Scanner(port)
+	for scanner.Scan() {
+		emit(append([]byte(nil), scanner.Bytes()...))
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+/* Puts the port into raw 8N1 mode with the configured baud rate */
+func (s *SerialSource) configure(port *os.File) error {
+	baud, ok := baudRates[s.Baud]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", s.Baud)
+	}
+
+	raw, err := port.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	err = raw.Control(func(fd uintptr) {
+		t, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+		if err != nil {
+			ioctlErr = err
+			return
+		}
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		t.Oflag &^= unix.OPOST
+		t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CBAUD
+		t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | baud
+		t.Ispeed = baud
+		t.Ospeed = baud
+		t.Cc[unix.VMIN] = 1
+		t.Cc[unix.VTIME] = 0
+		ioctlErr = unix.IoctlSetTermios(int(fd), unix.TCSETS, t)
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
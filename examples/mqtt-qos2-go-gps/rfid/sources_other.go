@@ -0,0 +1,39 @@
+//go:build !linux
+
+package rfid
+
+import (
+	"context"
+	"errors"
+)
+
+var errLinuxOnly = errors.New("only supported on Linux")
+
+/* Reads an RFID reader attached to a serial port */
+type SerialSource struct {
+	Device  string
+	Baud    int
+	Framing Framing
+}
+
+func (s *SerialSource) Name() string {
+	return "serial " + s.Device
+}
+
+func (s *SerialSource) Run(ctx context.Context, emit func(frame []byte)) error {
+	return errLinuxOnly
+}
+
+/* Reads a keyboard-wedge RFID reader through its Linux input device */
+type EvdevSource struct {
+	Device string
+	Grab   bool
+}
+
+func (s *EvdevSource) Name() string {
+	return "evdev " + s.Device
+}
+
+func (s *EvdevSource) Run(ctx context.Context, emit func(frame []byte)) error {
+	return errLinuxOnly
+}
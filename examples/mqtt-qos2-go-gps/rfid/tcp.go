@@ -0,0 +1,88 @@
+package rfid
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+/* Accepts RFID readers (or the client simulation) connecting over TCP */
+type TCPSource struct {
+	Address string
+	Framing Framing
+}
+
+func (s *TCPSource) Name() string {
+	return "tcp " + s.Address
+}
+
+func (s *TCPSource) Run(ctx context.Context, emit func(frame []byte)) error {
+	if _, err := s.Framing.SplitFunc(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("RFID server is listening on %s\n", s.Address)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	/* Closing the listener and all clients is what stops the blocking Accept and Read calls */
+	var mu sync.Mutex
+	clients := make(map[net.Conn]struct{})
+	closeAll := func() {
+		listener.Close()
+		mu.Lock()
+		for conn := range clients {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+	stop := context.AfterFunc(ctx, closeAll)
+	defer stop()
+	/* Also when Accept fails, otherwise wg.Wait waits for clients that stay connected */
+	defer closeAll()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		mu.Lock()
+		clients[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleClient(conn, emit)
+			mu.Lock()
+			delete(clients, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+/* Frames the stream of a single client; partial and merged reads are reassembled by the scanner */
+func (s *TCPSource) handleClient(conn net.Conn, emit func(frame []byte)) {
+	defer conn.Close()
+
+	scanner, _ := s.Framing.Scanner(conn)
+	for scanner.Scan() {
+		emit(append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("RFID client %s: %v\n", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"mqtt/gnss"
+	"mqtt/rfid"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/config"
+	mq "tdce-shared/mqttset"
+)
+
+/* Settings read from config.yaml, GPS_* environment variables and flags */
+/* The topic, QoS and GPS policy are applied on SIGHUP, the other settings after a restart */
+type settings struct {
+	Mqtt struct {
+		/* 5 adds message expiry, user properties and reason codes of refused messages */
+		Version  int           `json:"version" validate:"oneof=3 5" help:"MQTT version, 3 or 5"`
+		Broker   string        `json:"broker" validate:"required,url" help:"MQTT broker address"`
+		ClientId string        `json:"clientId" validate:"required" help:"MQTT client ID"`
+		Username string        `json:"username" help:"MQTT user"`
+		Password config.Secret `json:"password" help:"MQTT password"`
+		Topic    string        `json:"topic" validate:"required" reload:"true" help:"topic the RFID messages are published on"`
+		Qos      int           `json:"qos" validate:"max=2" reload:"true" help:"QoS of the published messages"`
+		/* Messages are published without waiting for each acknowledgement; this many may be unacknowledged at a time */
+		InFlight int `json:"inFlight" validate:"min=1" help:"QoS 1 and 2 messages waiting for their acknowledgement at the same time"`
+		/* Brokers on ssl:// need the tls section, client certificates included */
+		TLS       mq.TLS       `json:"tls"`
+		Reconnect mq.Reconnect `json:"reconnect"`
+		Session   mq.Session   `json:"session"`
+		/* Retained online/offline message; the offline one is the last will */
+		Status mq.Status `json:"status"`
+		V5     mq.V5     `json:"v5"`
+		/* MQTT 5: the broker drops messages nobody received in time, so subscribers don't get stale positions */
+		Expiry config.Duration `json:"expiry" help:"expiry of the published messages (MQTT 5), 0 never"`
+	} `json:"mqtt"`
+
+	/* Store for messages the broker has not acknowledged */
+	Storage  string `json:"storage" validate:"oneof=queue mysql sqlite" help:"message store: queue, mysql or sqlite"`
+	QueueDir string `json:"queueDir" validate:"required" help:"directory of the on-disk queue"`
+	/* Connection string for the mysql and sqlite stores, e.g. "file:gpsmqtt.db" for sqlite */
+	Database config.Secret `json:"database" help:"connection string of the mysql or sqlite store"`
+
+	Rfid struct {
+		/* "evdev" is a keyboard-wedge reader */
+		Source  string `json:"source" validate:"oneof=tcp serial evdev" help:"RFID input: tcp, serial or evdev"`
+		Address string `json:"address" validate:"hostport" help:"listen address of the tcp source"`
+		Device  string `json:"device" help:"device of the serial and evdev sources"`
+		Baud    int    `json:"baud" validate:"min=1" help:"baud rate of the serial source"`
+		/* Framing of tcp and serial streams */
+		Framing   string `json:"framing" validate:"oneof=delimiter stx-etx fixed" help:"framing: delimiter, stx-etx or fixed"`
+		Delimiter string `json:"delimiter" help:"frame terminator of the delimiter framing"`
+		Length    int    `json:"length" help:"frame size of the fixed framing"`
+		Format    string `json:"format" validate:"oneof=raw em4100 wiegand26 wiegand34" help:"tag format: raw, em4100, wiegand26 or wiegand34"`
+		Encoding  string `json:"encoding" validate:"oneof=hex dec" help:"tag encoding: hex or dec"`
+		/* Repeated reads of the same tag within this window are dropped */
+		DedupWindow config.Duration `json:"dedupWindow" help:"window in which repeated reads of a tag are dropped"`
+	} `json:"rfid"`
+
+	/* Rules for choosing the position attached to an RFID read */
+	/* Mode "best" picks the best fix within maxAge, "latest" the newest one that passes the rules */
+	Gps struct {
+		Mode          string          `json:"mode" validate:"oneof=best latest" help:"position choice: best or latest"`
+		MaxAge        config.Duration `json:"maxAge" help:"oldest position that may be attached"`
+		MaxHdop       float32         `json:"maxHdop" help:"highest HDOP that may be attached"`
+		MinSatellites int             `json:"minSatellites" help:"fewest satellites a position needs"`
+	} `json:"gps" reload:"true"`
+
+	WebSocket string `json:"websocket" validate:"required,hostport" help:"host of the GPS WebSocket stream"`
+	ModemUrl  string `json:"modemUrl" validate:"required,url" help:"modem details of the device manager API"`
+	/* OAuth2.0 settings of the device manager API */
+	Params string `json:"params" validate:"required" help:"file with the OAuth2.0 settings"`
+	/* Prometheus /metrics endpoint with publish counters and the queue length; empty disables it */
+	MetricsAddress string `json:"metricsAddress" validate:"hostport" help:"address of the /metrics endpoint, empty disables it"`
+	/* /healthz and /readyz for Docker HEALTHCHECK and Portainer; empty disables them */
+	HealthAddress string `json:"healthAddress" validate:"hostport" help:"address of /healthz and /readyz, empty disables them"`
+	/* /healthz fails when the GPS stream was silent for longer */
+	StreamMaxAge config.Duration `json:"streamMaxAge" validate:"min=1s" help:"longest silence of the GPS stream before /readyz fails"`
+}
+
+func defaults() settings {
+	var s settings
+	s.Mqtt.Version = 3
+	s.Mqtt.Broker = "tcp://localhost:1883"
+	s.Mqtt.ClientId = "clientest"
+	s.Mqtt.Username = "testerE"
+	s.Mqtt.Topic = "gps"
+	s.Mqtt.Qos = 2
+	s.Mqtt.InFlight = 16
+	s.Mqtt.Reconnect.Enabled = true
+	s.Mqtt.Reconnect.RetryInterval = config.Duration(10 * time.Second)
+	s.Mqtt.Reconnect.MaxBackoff = config.Duration(2 * time.Minute)
+	s.Mqtt.Status.Topic = "gps/status"
+	s.Mqtt.Status.QoS = 1
+	s.Mqtt.V5.SessionExpiry = config.Duration(24 * time.Hour)
+	s.Mqtt.V5.TopicAliases = 10
+	s.Mqtt.Expiry = config.Duration(5 * time.Minute)
+
+	s.Storage = "queue"
+	s.QueueDir = "queue-data"
+
+	s.Rfid.Source = "tcp"
+	s.Rfid.Address = "localhost:5247"
+	s.Rfid.Device = "/dev/ttymxc1"
+	s.Rfid.Baud = 9600
+	s.Rfid.Framing = "delimiter"
+	s.Rfid.Delimiter = "\n"
+	s.Rfid.Length = 12
+	s.Rfid.Format = "raw"
+	s.Rfid.Encoding = "hex"
+	s.Rfid.DedupWindow = config.Duration(2 * time.Second)
+
+	s.Gps.Mode = gnss.PreferBest
+	s.Gps.MaxAge = config.Duration(30 * time.Second)
+	s.Gps.MaxHdop = 5
+	s.Gps.MinSatellites = 4
+
+	s.WebSocket = "192.168.0.100:31768"
+	s.ModemUrl = "http://192.168.0.100/devicemanager/api/v1/networking/modem/ppp0/details"
+	s.Params = "params.json"
+	s.MetricsAddress = ":9101"
+	s.HealthAddress = ":8081"
+	s.StreamMaxAge = config.Duration(30 * time.Second)
+	return s
+}
+
+func (s *settings) Validate() error {
+	if s.Storage != "queue" && s.Database.Value() == "" {
+		return fmt.Errorf("database: required for the %s store", s.Storage)
+	}
+	return nil
+}
+
+func (s *settings) mqttOptions(onConnect mqtt.OnConnectHandler) mq.ClientOptions {
+	return mq.ClientOptions{
+		Version:   s.Mqtt.Version,
+		Broker:    s.Mqtt.Broker,
+		ClientId:  s.Mqtt.ClientId,
+		Username:  s.Mqtt.Username,
+		Password:  s.Mqtt.Password.Value(),
+		TLS:       s.Mqtt.TLS,
+		Reconnect: s.Mqtt.Reconnect,
+		Session:   s.Mqtt.Session,
+		Status:    s.Mqtt.Status,
+		V5:        s.Mqtt.V5,
+		OnConnect: onConnect,
+	}
+}
+
+/* MQTT 5 properties of every published message; receivers tell devices and payload versions apart by them */
+func (s *settings) mqttProperties() *mq.Properties {
+	return &mq.Properties{
+		Expiry:      time.Duration(s.Mqtt.Expiry),
+		ContentType: "application/json",
+		User: map[string]string{
+			"deviceId":      s.Mqtt.ClientId,
+			"schemaVersion": schemaVersion,
+		},
+	}
+}
+
+func (s *settings) gpsPolicy() gnss.Policy {
+	return gnss.Policy{
+		Mode:          s.Gps.Mode,
+		MaxAge:        time.Duration(s.Gps.MaxAge),
+		MaxHdop:       s.Gps.MaxHdop,
+		MinSatellites: s.Gps.MinSatellites,
+	}
+}
+
+func (s *settings) rfidFraming() rfid.Framing {
+	return rfid.Framing{Mode: s.Rfid.Framing, Delimiter: []byte(s.Rfid.Delimiter), Length: s.Rfid.Length}
+}
+
+func (s *settings) rfidDecoder() rfid.Decoder {
+	return rfid.Decoder{Format: s.Rfid.Format, Encoding: s.Rfid.Encoding}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mqtt/db"
+	"tdce-shared/queue"
+	"time"
+)
+
+/* Holds messages the broker has not acknowledged until they can be replayed */
+type offlineStore interface {
+	Len() int
+	Append(data []byte) error
+	Replay(fn func(data []byte) error) (int, error)
+	Close() error
+}
+
+/* Opens the store selected by the storage setting */
+func openStore(cfg *settings) (offlineStore, error) {
+	switch cfg.Storage {
+	case "queue":
+		return queue.Open(cfg.QueueDir, queue.Options{})
+	case "mysql", "sqlite":
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		repo, err := db.Open(ctx, cfg.Storage, cfg.Database.Value())
+		if err != nil {
+			return nil, err
+		}
+		return &dbStore{repo: repo}, nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
+
+/* Readiness of the store: queued messages and, for the database stores, whether the database answers */
+func checkStore(ctx context.Context) (map[string]any, error) {
+	details := map[string]any{"storage": conf.Get().Storage, "queued": store.Len()}
+	if s, ok := store.(*dbStore); ok {
+		if err := s.repo.DB().PingContext(ctx); err != nil {
+			return details, err
+		}
+	}
+	return details, nil
+}
+
+/* Keeps queued messages in a MySQL or SQLite table instead of the on-disk queue */
+type dbStore struct {
+	repo *db.Repository
+}
+
+func (s *dbStore) Len() int {
+	n, err := s.repo.Count(context.Background())
+	if err != nil {
+		fmt.Println("Error counting queued messages: ", err)
+	}
+	return n
+}
+
+func (s *dbStore) Append(data []byte) error {
+	var msg messageObject
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	_, err := s.repo.InsertMessage(context.Background(), convertToMQTTData(msg))
+	return err
+}
+
+/* Replays stored messages in batches, deleting each batch once it was published */
+func (s *dbStore) Replay(fn func(data []byte) error) (int, error) {
+	ctx := context.Background()
+	replayed := 0
+	for {
+		queuedMessages, err := s.repo.PendingMessages(ctx, 100)
+		if err != nil || len(queuedMessages) == 0 {
+			return replayed, err
+		}
+
+		var published []int
+		var publishErr error
+		for _, d := range queuedMessages {
+			jsonData, err := json.Marshal(convertToMessageObject(d))
+			if err != nil {
+				publishErr = err
+				break
+			}
+			if publishErr = fn(jsonData); publishErr != nil {
+				break
+			}
+			published = append(published, d.Id)
+		}
+
+		if err := s.repo.Ack(ctx, published); err != nil {
+			return replayed, err
+		}
+		replayed += len(published)
+		if publishErr != nil {
+			return replayed, publishErr
+		}
+	}
+}
+
+func (s *dbStore) Close() error {
+	return s.repo.Close()
+}
+
+/* Converts message object to database row */
+func convertToMQTTData(msg messageObject) db.MQTTData {
+	return db.MQTTData{
+		Altitude:           msg.Gps.Altitude,
+		Course:             msg.Gps.Course,
+		Fix:                msg.Gps.Fix,
+		GpsFixAvailable:    msg.Gps.GpsFixAvailable,
+		Hdop:               msg.Gps.Hdop,
+		Latitude:           msg.Gps.Latitude,
+		Longitude:          msg.Gps.Longitude,
+		NumberOfSatellites: msg.Gps.NumberOfSatellites,
+		SpeedKnots:         msg.Gps.SpeedKnots,
+		SpeedMph:           msg.Gps.SpeedMph,
+		Time:               msg.Gps.Time,
+		Rssi:               msg.ModemData.Rssi,
+		DataLinkType:       msg.ModemData.DataLinkType,
+		Rfid:               msg.Rfid,
+		PositionAgeSeconds: msg.PositionAgeSeconds,
+		PositionReason:     msg.PositionReason,
+	}
+}
+
+/* Converts database row to message object for publishing */
+func convertToMessageObject(d db.MQTTData) messageObject {
+	return messageObject{
+		Rfid: d.Rfid,
+		Gps: gps{
+			Altitude:           d.Altitude,
+			Course:             d.Course,
+			Fix:                d.Fix,
+			GpsFixAvailable:    d.GpsFixAvailable,
+			Hdop:               d.Hdop,
+			Latitude:           d.Latitude,
+			Longitude:          d.Longitude,
+			NumberOfSatellites: d.NumberOfSatellites,
+			SpeedKnots:         d.SpeedKnots,
+			SpeedMph:           d.SpeedMph,
+			Time:               d.Time,
+		},
+		ModemData: modem{
+			Rssi:         d.Rssi,
+			DataLinkType: d.DataLinkType,
+		},
+		PositionAgeSeconds: d.PositionAgeSeconds,
+		PositionReason:     d.PositionReason,
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/* Messages kept in the MySQL or SQLite store come back as they were queued */
+func TestStoreConversionRoundTrip(t *testing.T) {
+	course := "212.5"
+	msg := messageObject{
+		Rfid: "0004123456",
+		Gps: gps{
+			Altitude: 121.9, Course: &course, Fix: 1, GpsFixAvailable: true, Hdop: 0.9,
+			Latitude: 45.81307, Longitude: 15.97726, NumberOfSatellites: 9,
+			SpeedKnots: 0.3, SpeedMph: 0.35, Time: "08:14:22",
+		},
+		ModemData:          modem{Rssi: -71, DataLinkType: "LTE"},
+		PositionAgeSeconds: (1500 * time.Millisecond).Seconds(),
+		PositionReason:     "best position within 30s",
+	}
+	got := convertToMessageObject(convertToMQTTData(msg))
+	if got.Gps.Course == nil || *got.Gps.Course != course {
+		t.Fatalf("Course = %v, want %q", got.Gps.Course, course)
+	}
+	got.Gps.Course = msg.Gps.Course
+	if got != msg {
+		t.Errorf("round trip = %+v\nwant %+v", got, msg)
+	}
+}
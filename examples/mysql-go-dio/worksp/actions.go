@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/modem"
+	mq "tdce-shared/mqttset"
+	"tdce-shared/ropc"
+	"tdce-shared/tdce"
+)
+
+// takes the actions of the rules: outputs over the device API, MQTT messages and SMS through the modem
+type actuator struct {
+	device *tdce.Client
+	// nil when no broker is set
+	mqtt mqtt.Client
+	// one publisher per QoS, as every publish action sets its own
+	publishers [3]*mq.Publisher
+	status     mq.Status
+	// nil when no params.json for the device manager is set
+	modem *modem.Client
+}
+
+// connects to the broker and the device manager if they are set
+func newActuator(cfg *settings) (*actuator, error) {
+	a := &actuator{device: device}
+	if cfg.MQTT.Broker != "" {
+		client, err := mq.NewClient(mq.ClientOptions{
+			Version:   cfg.MQTT.Version,
+			Broker:    cfg.MQTT.Broker,
+			ClientId:  cfg.MQTT.ClientId,
+			Username:  cfg.MQTT.Username,
+			Password:  cfg.MQTT.Password.Value(),
+			TLS:       cfg.MQTT.TLS,
+			Reconnect: cfg.MQTT.Reconnect,
+			Status:    cfg.MQTT.Status,
+			V5:        cfg.MQTT.V5,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: %w", err)
+		}
+		// with reconnect enabled the client keeps trying in the background, so the rules run without the broker
+		client.Connect()
+		a.mqtt, a.status = client, cfg.MQTT.Status
+		for qos := range a.publishers {
+			a.publishers[qos] = mq.NewPublisher(client, mq.Options{QoS: byte(qos)})
+		}
+	}
+	if cfg.SMS.Params != "" {
+		oauthConf, err := ropc.LoadConfig(cfg.SMS.Params)
+		if err != nil {
+			return nil, err
+		}
+		a.modem = &modem.Client{API: ropc.NewClient(ropc.NewTokenSource(oauthConf))}
+	}
+	return a, nil
+}
+
+func (a *actuator) SetOutput(ctx context.Context, output string, value int) error {
+	return a.device.SetDIO(ctx, output, value, tdce.Output)
+}
+
+func (a *actuator) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	if a.mqtt == nil {
+		return errors.New("no MQTT broker set")
+	}
+	if int(qos) >= len(a.publishers) {
+		return fmt.Errorf("invalid QoS %d", qos)
+	}
+	return a.publishers[qos].Publish(ctx, mq.Message{Topic: topic, Payload: payload, Retain: retain}).Wait(ctx)
+}
+
+func (a *actuator) SendSMS(ctx context.Context, to []string, text string) error {
+	if a.modem == nil {
+		return errors.New("no params.json for SMS set")
+	}
+	var errs []error
+	for _, number := range to {
+		if err := a.modem.SendSMS(ctx, number, text); err != nil {
+			errs = append(errs, fmt.Errorf("sms to %s: %w", number, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// disconnects from the broker, waiting a moment for messages in flight
+func (a *actuator) close() {
+	if a.mqtt == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, p := range a.publishers {
+		p.Close(ctx)
+	}
+	mq.Disconnect(a.mqtt, a.status, 1000)
+}
@@ -25,6 +25,7 @@ document.addEventListener('DOMContentLoaded', function () {
         xhr.onload = () => {
             if (xhr.readyState == 4 && xhr.status == 200) {
                 generateHtml(xhr.response)
+                followDetections();
             } else {
                 console.log(`Error: ${xhr.status}`);
                 document.getElementById("demo").innerHTML = "ERROR!"
@@ -44,6 +45,28 @@ document.addEventListener('DOMContentLoaded', function () {
         document.getElementById("demo").innerHTML = innerHtml;
     }
 
+    // new detections are pushed by the Go Web API, so the table stays current without reloading
+    let events = null;
+    function followDetections() {
+        if (events) {
+            return;
+        }
+        events = new EventSource("http://192.168.0.100:6001/api/v1/events?types=detection");
+        events.addEventListener("detection", (e) => {
+            let obj = JSON.parse(e.data).data;
+            let table = document.getElementById("dataTable");
+            if (!table) {
+                return;
+            }
+            let row = table.getElementsByTagName("tbody")[0].insertRow(-1);
+            row.insertCell(0).textContent = obj.id;
+            row.insertCell(1).textContent = obj.duration;
+            row.insertCell(2).textContent = new Date(obj.whattime).toISOString();
+        });
+        // events were missed while disconnected; read the whole table again
+        events.addEventListener("reset", () => form.requestSubmit());
+    }
+
     function sortTable() {
         let selectedOption = document.getElementById("dios").value;
         if(selectedOption != "---"){
@@ -1,223 +1,463 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-
+	"tdce-shared/config"
+	"tdce-shared/dio"
+	"tdce-shared/health"
+	mq "tdce-shared/mqttset"
+	"tdce-shared/supervisor"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
+
+	"worksp/rules"
 	"worksp/webapi"
 )
 
-// initiating variables; global
-// needing mutex for locks on values
-var (
-	token                string
-	startedTime          float64
-	started              bool
-	totalGlowingTime     float64
-	totalGlowingTimeLock sync.Mutex
-)
-
-// creating a dio struct to show values
-type Dio struct {
-	DioName   string `json:"DioName"`
-	Value     int    `json:"Value"`
-	Direction string `json:"Direction"`
+// measured durations that still have to be stored
+var inserting sync.WaitGroup
+
+// settings read from config.yaml, DIO_* environment variables and flags
+// the input, the events and the rules are applied on SIGHUP, the rest after a restart
+type settings struct {
+	// MySQL data source name; holds the password so it is better referenced from a file
+	Database config.Secret `json:"database" validate:"required" help:"MySQL data source name"`
+	Device   struct {
+		URL      string        `json:"url" validate:"required,url" help:"base URL of the DIO REST API"`
+		Password config.Secret `json:"password" validate:"required" help:"password of the DIO REST API"`
+	} `json:"device"`
+	// DIO whose high time is measured
+	Input string `json:"input" validate:"required" reload:"true" help:"DIO that is watched"`
+	// where the edges of the inputs come from and how they are filtered
+	Events struct {
+		Source       string          `json:"source" validate:"oneof=websocket poll sysfs" help:"input levels from: websocket, poll or sysfs"`
+		WebSocket    string          `json:"websocket" validate:"hostport" help:"host:port of the device WebSocket streams"`
+		PollInterval config.Duration `json:"pollInterval" validate:"min=10ms" help:"time between two reads of the REST API"`
+		// GPIO numbers of the inputs for the sysfs source, e.g. DIO_B: 497; only in the file
+		Pins     map[string]int  `json:"pins"`
+		Debounce config.Duration `json:"debounce" help:"time a new level has to hold before it counts"`
+		MinPulse config.Duration `json:"minPulse" help:"shorter high pulses are ignored"`
+	} `json:"events" reload:"true"`
+	// DIO levels and AIN values pushed to the browsers on /api/v1/events
+	Live struct {
+		Dios []string `json:"dios" help:"comma separated DIOs whose levels are pushed to /api/v1/events"`
+		Ain  bool     `json:"ain" help:"push AIN value changes to /api/v1/events"`
+	} `json:"live"`
+	// automation of the outputs, see rules.yaml; the file is read again on SIGHUP
+	Rules struct {
+		File   string `json:"file" help:"rules file, empty disables the rules"`
+		State  string `json:"state" help:"file the rule state is kept in across restarts"`
+		DryRun bool   `json:"dryRun" help:"print the actions of the rules instead of taking them"`
+	} `json:"rules"`
+	// broker of the publish actions; empty disables them
+	MQTT struct {
+		Version  int           `json:"version" validate:"oneof=3 5" help:"MQTT version, 3 or 5"`
+		Broker   string        `json:"broker" validate:"url" help:"MQTT broker of publish actions, empty disables them"`
+		ClientId string        `json:"clientId" help:"MQTT client ID"`
+		Username string        `json:"username" help:"MQTT username"`
+		Password config.Secret `json:"password" help:"MQTT password"`
+		// brokers on ssl:// need the tls section, client certificates included
+		TLS       mq.TLS       `json:"tls"`
+		Reconnect mq.Reconnect `json:"reconnect"`
+		// retained online/offline message; the offline one is the last will
+		Status mq.Status `json:"status"`
+		V5     mq.V5     `json:"v5"`
+	} `json:"mqtt"`
+	// device manager login for sms actions; empty disables them
+	SMS struct {
+		Params string `json:"params" help:"params.json with the oauthConf of the device manager, empty disables sms actions"`
+	} `json:"sms"`
+	WebAPI webapi.Settings `json:"webapi"`
+	// /healthz and /readyz for Docker HEALTHCHECK and Portainer; empty disables them
+	HealthAddress string `json:"healthAddress" validate:"hostport" help:"address of /healthz and /readyz, empty disables them"`
 }
 
-// defining struct tokenResponse
-// declares field named token with type string -> token = field tag; json key named token
-type TokenResponse struct {
-	Token string `json:"token"`
+func defaults() settings {
+	var s settings
+	s.Device.URL = tdce.DefaultBaseURL
+	s.Device.Password = config.NewSecret("servicelevel")
+	s.Input = "DIO_B"
+	s.WebAPI = webapi.Settings{
+		Listen:       ":6001",
+		AllowOrigins: []string{"http://192.168.0.100:8201", "http://localhost:8201"},
+		Whitelist:    []string{"127.0.0.1", "192.168.0.0/24"},
+		RequireAuth:  "writes",
+		DeviceTokens: true,
+		RateLimit:    20,
+		RateBurst:    40,
+		AuditLog:     "-",
+		MaxOpenConns: 10,
+	}
+	s.Events.Source = "websocket"
+	s.Events.WebSocket = "192.168.0.100:31768"
+	s.Events.PollInterval = config.Duration(100 * time.Millisecond)
+	s.Events.Debounce = config.Duration(20 * time.Millisecond)
+	s.Live.Dios = []string{"DIO_A", "DIO_B"}
+	s.Live.Ain = true
+	s.Rules.File = "rules.yaml"
+	s.Rules.State = "rules-state.json"
+	s.MQTT.Version = 3
+	s.MQTT.ClientId = "dio-rules"
+	s.MQTT.Reconnect.Enabled = true
+	s.MQTT.Reconnect.RetryInterval = config.Duration(10 * time.Second)
+	s.MQTT.Reconnect.MaxBackoff = config.Duration(2 * time.Minute)
+	s.HealthAddress = ":8082"
+	return s
 }
 
-func getToken() string {
-	tokenURL := "http://192.168.0.100:59801/user/Service/token"
-	password := "servicelevel"
-
-	form := url.Values{}
-	form.Add("password", password)
-
-	resp, err := http.PostForm(tokenURL, form)
-	if err != nil {
-		fmt.Println("Error making request:", err)
-		return ""
+func (s *settings) Validate() error {
+	if _, ok := s.Events.Pins[s.Input]; s.Events.Source == "sysfs" && !ok {
+		return fmt.Errorf("events.pins: no GPIO number of %s for the sysfs source", s.Input)
 	}
-	defer resp.Body.Close()
+	return s.WebAPI.Validate()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Response status code:", resp.StatusCode)
-		return ""
+// source of the levels of channels; the WebSocket stream falls back to polling while it is down
+func (s *settings) levelSource(channels []string) dio.Source {
+	poll := &dio.PollSource{
+		Device:   device,
+		Channels: channels,
+		Interval: time.Duration(s.Events.PollInterval),
 	}
-
-	var tokenResp TokenResponse
-	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
-	if err != nil {
-		fmt.Println("Error decoding JSON:", err)
-		return ""
+	switch s.Events.Source {
+	case "poll":
+		return poll
+	case "sysfs":
+		for _, ch := range channels {
+			if _, ok := s.Events.Pins[ch]; !ok {
+				fmt.Printf("No GPIO number of %s in events.pins, its edges are missed\n", ch)
+			}
+		}
+		return &dio.SysfsSource{Pins: s.Events.Pins}
 	}
-
-	return tokenResp.Token
+	return &dio.WebSocketSource{Host: s.Events.WebSocket, Fallback: poll}
 }
 
-func setDios(token string, js []byte) {
-	//needs mutex
-	url := "http://192.168.0.100:59801/tdce/dio/SetStates"
-	headers := map[string]string{"Content-Type": "application/json"}
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(js))
-	req.Header.Add("Authorization", "Bearer "+token)
-	req.Header.Add("Content-Type", headers["Content-Type"])
+var (
+	conf *config.Store[settings]
+	// pool of connections to the database, opened once in main
+	db *sql.DB
+	// client for the device REST API; fetches and refreshes the token on its own
+	device *tdce.Client
+)
 
-	//get response from server
-	client.Do(req)
+// opens the pool of connections the web API, the inserts and the health check share
+// sql.Open doesn't connect yet, so the example also starts while the database is down
+func openDatabase(cfg *settings) (*sql.DB, error) {
+	db, err := sql.Open("mysql", cfg.Database.Value())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.WebAPI.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.WebAPI.MaxOpenConns)
+	db.SetConnMaxLifetime(5 * time.Minute)
+	return db, nil
+}
 
-	//total glowing time
-	fmt.Println("Total Glowing Time: ", totalGlowingTime)
+// whether the database answers
+func pingDatabase(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
 
-	if totalGlowingTime > 0 {
-		client.Do(req)
-		startGlowTime := time.Now()
+// whether the device accepts the password; the token is fetched again once it expired
+func checkDeviceToken(ctx context.Context) (map[string]any, error) {
+	_, err := device.Token(ctx)
+	return map[string]any{"device": conf.Get().Device.URL}, err
+}
 
-		for totalGlowingTime > 0 {
-			// calculating remianing time with time.since the glow started
-			// times 1000 for milliseconds
-			remainingTime := totalGlowingTime - time.Since(startGlowTime).Seconds()*1000
-			if remainingTime <= 0 {
-				break
-			}
-			// sleep for 1 ms
-			time.Sleep(time.Millisecond)
-		}
+// asks the device about bearer tokens; a hung device must not hold the web API requests
+var tokenClient = &http.Client{Timeout: 10 * time.Second}
 
-		// create slice
-		js = []byte(`[{ "DioName": "DIO_A", "Value": 0, "Direction": "Output" }]`)
-		// new POST request with buffer and slice
-		req, _ = http.NewRequest("POST", url, bytes.NewBuffer(js))
-		req.Header.Add("Authorization", "Bearer "+token)
-		req.Header.Add("Content-Type", headers["Content-Type"])
-		client.Do(req)
-
-		// if the total glowing time isn't 0, insert into the database and print sleep time
-		totalGlowingTimeLock.Lock()
-		if totalGlowingTime > 0 {
-			modifyDatabase(totalGlowingTime)
-			fmt.Println("Sleep: ", totalGlowingTime)
-			// reset glow time
-			totalGlowingTime = 0
-		}
-		// unlock the resource and exit function
-		totalGlowingTimeLock.Unlock()
+// accepts bearer tokens for the web API that the device REST API accepts
+func verifyDeviceToken(ctx context.Context, token string) error {
+	cfg := conf.Get()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.Device.URL+"/tdce/dio/GetState/"+url.PathEscape(cfg.Input), nil)
+	if err != nil {
+		return err
 	}
-}
-
-// connect to database
-func connect() (*sql.DB, error) {
-	db, err := sql.Open("mysql", "root:TDC_arch2023@tcp(192.168.0.100:3306)/diobase")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := tokenClient.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return db, nil
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("device answered %s", resp.Status)
+	}
+	return nil
 }
 
-// insert values into database
+// insert values into database and push the new record to /api/v1/events
 func modifyDatabase(duration float64) {
-	db, err := connect()
+	result, err := db.Exec("INSERT INTO dios (duration, whattime) VALUES (?, CURRENT_TIMESTAMP())", duration)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("Error inserting record: ", err)
 		return
 	}
-	defer db.Close()
-
-	_, err = db.Exec("INSERT INTO dios (duration, whattime) VALUES (?, CURRENT_TIMESTAMP())", duration)
 	fmt.Println("1 record inserted.")
-}
 
-// fetching DIO state
-func fetchCurrState(token string) int {
-	resp := getDio(token, "http://192.168.0.100:59801/tdce/dio/GetState/DIO_B")
-	return resp.Value
-}
-
-// gets DIO state
-func getDio(token, url string) Dio {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, _ := client.Do(req)
-
-	var dio Dio
-	// decode the body of the response and store in dio
-	json.NewDecoder(resp.Body).Decode(&dio)
-	return dio
+	record := webapi.Dios{Duration: duration}
+	record.ID, err = result.LastInsertId()
+	if err == nil {
+		// the time as the database stored it
+		err = db.QueryRow("SELECT whattime FROM dios WHERE id = ?", record.ID).Scan(&record.WhatTime)
+	}
+	if err != nil {
+		fmt.Println("Error reading inserted record: ", err)
+		return
+	}
+	webapi.Events.Detection(record)
 }
 
-// stops counting time and calculates total glowing time
-func stopTime() {
-	started = false
-
-	endTime := time.Now().UnixNano() / int64(time.Millisecond)
-	elapsed := float64(endTime) - startedTime
-
-	//lock so only one routine may update the value
-	totalGlowingTimeLock.Lock()
-	totalGlowingTime += elapsed
-	totalGlowingTimeLock.Unlock()
+// stores the time the input was high; the output is driven by the rules
+func stopTime(elapsed time.Duration) {
+	fmt.Println("Input was high for: ", elapsed)
 
-	js := []byte(`[{ "DioName": "DIO_A", "Value": 1, "Direction": "Output" }]`)
-	go setDios(token, js)
+	// tracked so a shutdown waits for the database insert
+	inserting.Add(1)
+	go func() {
+		defer inserting.Done()
+		modifyDatabase(float64(elapsed.Milliseconds()))
+	}()
 }
 
-// starts time
-func startTime() {
-	startedTime = float64(time.Now().UnixNano() / int64(time.Millisecond))
-	started = true
+// signalled on SIGHUP so watchInput subscribes with the new settings
+var resubscribe = make(chan struct{}, 1)
+
+// measures how long the input is high, from its debounced edges, until ctx is cancelled
+func watchInput(ctx context.Context) error {
+	// when the input went high; zero while it is low or was already high at start
+	// kept across a resubscribe as long as the input stays the same
+	var highSince time.Time
+	input := ""
+	for {
+		cfg := conf.Get()
+		if cfg.Input != input {
+			input, highSince = cfg.Input, time.Time{}
+		}
+		engine := dio.NewEngine(cfg.levelSource([]string{cfg.Input}))
+		sub := engine.Subscribe(cfg.Input, dio.Filter{
+			Debounce: time.Duration(cfg.Events.Debounce),
+			MinPulse: time.Duration(cfg.Events.MinPulse),
+		})
+
+		runCtx, cancel := context.WithCancel(ctx)
+		failed := make(chan error, 1)
+		go func() {
+			failed <- engine.Run(runCtx)
+		}()
+		fmt.Printf("Watching %s with the %s source\n", cfg.Input, engine.Source.Name())
+
+		err := measure(ctx, sub, failed, &highSince)
+		cancel()
+		sub.Close()
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
 }
 
-// infinite for loop, fetches state then starts or stops counting time accordingly
-func welcome() {
+// handles the edges of one subscription; returns nil when the settings changed
+func measure(ctx context.Context, sub *dio.Subscription, failed <-chan error, highSince *time.Time) error {
 	for {
-		state := fetchCurrState(token)
-		if state == 0 {
-			if started {
-				stopTime()
+		select {
+		case <-ctx.Done():
+			// the input is still high on shutdown; store the time measured so far
+			if !highSince.IsZero() {
+				stopTime(time.Since(*highSince))
+			}
+			return nil
+		case err := <-failed:
+			return err
+		case <-resubscribe:
+			return nil
+		case event := <-sub.Events():
+			if event.Edge == dio.Rising {
+				*highSince = event.Time
+				continue
 			}
-		} else {
-			if !started {
-				startTime()
+			if highSince.IsZero() {
+				fmt.Println("Input was already high at start, duration unknown")
+				continue
 			}
+			stopTime(event.Time.Sub(*highSince))
+			*highSince = time.Time{}
 		}
 	}
 }
 
-func main() {
-	token = getToken()
+// pushes DIO levels and AIN value changes to the browsers connected to /api/v1/events
+func pushLive(ctx context.Context) error {
+	cfg := conf.Get()
+	if cfg.Live.Ain {
+		ain := wsclient.New(wsclient.Config{URL: wsclient.URL(cfg.Events.WebSocket, wsclient.AnalogInputsValue)})
+		go ain.Run(ctx)
+		go func() {
+			for msg := range ain.Messages() {
+				var change tdce.AnalogValueChange
+				if err := json.Unmarshal(msg, &change); err != nil || change.AinName == "" {
+					fmt.Printf("Error decoding AIN value %s: %v\n", msg, err)
+					continue
+				}
+				webapi.Events.State(webapi.EventAin, change.AinName, map[string]float64{
+					"value":    change.NewValue,
+					"previous": change.PreviousValue,
+				})
+			}
+		}()
+	}
+	if len(cfg.Live.Dios) == 0 {
+		<-ctx.Done()
+		return nil
+	}
 
-	// wait group used for syncing threads; more efficient than for loop in main
-	// two wait groups
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// only changes are pushed; the first level of each DIO is its state at start
+	var mu sync.Mutex
+	levels := map[string]int{}
+	wanted := map[string]bool{}
+	for _, d := range cfg.Live.Dios {
+		wanted[d] = true
+	}
+	err := cfg.levelSource(cfg.Live.Dios).Run(ctx, func(s dio.Sample) {
+		mu.Lock()
+		defer mu.Unlock()
+		if v, ok := levels[s.Channel]; !wanted[s.Channel] || ok && v == s.Value {
+			return
+		}
+		levels[s.Channel] = s.Value
+		webapi.Events.State(webapi.EventDio, s.Channel, map[string]any{"value": s.Value, "since": s.Time})
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
 
-	// internally created function; decrements wait group when finished and initialized web api
-	go func() {
-		defer wg.Done()
-		webapi.InitializeWebApi()
-	}()
+// runs the rules of the rules file until ctx is cancelled; the file is read again on SIGHUP
+func runRules(ctx context.Context) error {
+	cfg := conf.Get()
+	set, err := rules.Load(cfg.Rules.File)
+	if err != nil {
+		return err
+	}
+	act, err := newActuator(cfg)
+	if err != nil {
+		return err
+	}
+	defer act.close()
 
-	//runs main program and decrements work group when process ends
+	engine := rules.New(set)
+	engine.Actuator = act
+	engine.Levels = func(channels []string) dio.Source {
+		return conf.Get().levelSource(channels)
+	}
+	engine.ReadAnalog = device.ReadAnalog
+	engine.StateFile = cfg.Rules.State
+	engine.DryRun = cfg.Rules.DryRun
+	if engine.DryRun {
+		fmt.Println("Rules run dry: their actions are printed, not taken")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 	go func() {
-		defer wg.Done()
-		welcome()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			set, err := rules.Load(conf.Get().Rules.File)
+			if err != nil {
+				fmt.Println("Rules not reloaded: ", err)
+				continue
+			}
+			engine.Reload(set)
+		}
 	}()
+	return engine.Run(ctx)
+}
 
-	// Wait for all goroutines to finish before exiting
-	wg.Wait()
+func main() {
+	conf = config.NewStore(defaults(), config.Options{
+		Name:      "worksp",
+		File:      "config.yaml",
+		EnvPrefix: "DIO",
+		Args:      os.Args[1:],
+	})
+	cfg := conf.Get()
+	device = tdce.NewClient(cfg.Device.URL, cfg.Device.Password.Value())
+	var err error
+	if db, err = openDatabase(cfg); err != nil {
+		fmt.Println("Error opening database:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	// every loop runs as a supervised service and is restarted if it crashes
+	// on Ctrl-C or docker stop the web API stops, pulsing outputs are switched off and measured times stored
+	sup := supervisor.New()
+	sup.OnShutdown("database writes", func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			inserting.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	sup.Go("webapi", func(ctx context.Context) error {
+		return webapi.InitializeWebApi(ctx, cfg.WebAPI, db, verifyDeviceToken)
+	})
+	sup.Go("dio", watchInput)
+	sup.Go("live", pushLive)
+	if cfg.Rules.File != "" {
+		sup.Go("rules", runRules)
+	}
+	sup.Go("config", func(ctx context.Context) error {
+		conf.WatchSIGHUP(ctx, func(*settings) {
+			select {
+			case resubscribe <- struct{}{}:
+			default:
+			}
+		})
+		return nil
+	})
+
+	// /healthz restarts a wedged logger, /readyz also reports the database and the device API
+	if cfg.HealthAddress != "" {
+		checks := health.New()
+		checks.Live("services", health.Supervisor(sup))
+		checks.Ready("database", health.Ping(pingDatabase))
+		checks.Ready("device token", checkDeviceToken)
+		sup.Go("health", func(ctx context.Context) error {
+			return checks.Serve(ctx, cfg.HealthAddress)
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := sup.Run(ctx); err != nil {
+		fmt.Println("Error shutting down:", err)
+		db.Close()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keys of the gin context the access checks leave for the audit log
+const (
+	identityKey = "middleware.identity"
+	reasonKey   = "middleware.reason"
+)
+
+// one line of the audit log
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Identity string    `json:"identity,omitempty"`
+	// why the request was denied
+	Reason  string `json:"reason,omitempty"`
+	Latency string `json:"latency"`
+}
+
+// writes every request as a JSON line to w: who asked for what and whether it was allowed
+// goes first so it also sees the requests the other checks deny
+func Audit(w io.Writer) gin.HandlerFunc {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		entry := auditEntry{
+			Time:     start,
+			Client:   c.ClientIP(),
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.Path,
+			Status:   c.Writer.Status(),
+			Identity: c.GetString(identityKey),
+			Reason:   c.GetString(reasonKey),
+			Latency:  time.Since(start).String(),
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(entry)
+	}
+}
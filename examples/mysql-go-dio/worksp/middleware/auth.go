@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checks a bearer token with its issuer, e.g. the device REST API
+type TokenVerifier func(ctx context.Context, token string) error
+
+// which requests need an API key or a bearer token
+const (
+	AuthNone   = "none"
+	AuthWrites = "writes"
+	AuthAll    = "all"
+)
+
+type Auth struct {
+	// none, writes (everything but GET, HEAD and OPTIONS) or all
+	Require string
+	// keys sent as X-API-Key or as bearer token
+	Keys []string
+	// accepts bearer tokens it confirms; nil accepts API keys only
+	Verify TokenVerifier
+	// how long a confirmed token is accepted without asking again; 1 minute by default
+	CacheFor time.Duration
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// denies requests that need authentication and have no valid key or token with 401
+func RequireAuth(a *Auth) gin.HandlerFunc {
+	keys := make([][sha256.Size]byte, len(a.Keys))
+	for i, k := range a.Keys {
+		keys[i] = sha256.Sum256([]byte(k))
+	}
+	if a.CacheFor <= 0 {
+		a.CacheFor = time.Minute
+	}
+
+	return func(c *gin.Context) {
+		credential := c.GetHeader("X-API-Key")
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && credential == "" {
+			credential = strings.TrimSpace(bearer)
+		}
+		if credential != "" {
+			sum := sha256.Sum256([]byte(credential))
+			if id := matchKey(keys, sum); id != "" {
+				c.Set(identityKey, id)
+				c.Next()
+				return
+			}
+			if a.Verify != nil && a.verify(c.Request.Context(), credential, sum) {
+				c.Set(identityKey, "device-token")
+				c.Next()
+				return
+			}
+		}
+
+		if !a.required(c.Request.Method) {
+			return
+		}
+		reason := "no credentials"
+		if credential != "" {
+			reason = "invalid credentials"
+		}
+		c.Header("WWW-Authenticate", `Bearer realm="dio"`)
+		deny(c, http.StatusUnauthorized, "Authentication required", reason)
+	}
+}
+
+func (a *Auth) required(method string) bool {
+	switch a.Require {
+	case AuthAll:
+		return true
+	case AuthWrites:
+		return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+	}
+	return false
+}
+
+// compares all keys in constant time; returns a short id of the key for the audit log
+func matchKey(keys [][sha256.Size]byte, sum [sha256.Size]byte) string {
+	match := -1
+	for i, k := range keys {
+		if subtle.ConstantTimeCompare(k[:], sum[:]) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return ""
+	}
+	return "key:" + hex.EncodeToString(sum[:4])
+}
+
+func (a *Auth) verify(ctx context.Context, token string, sum [sha256.Size]byte) bool {
+	a.mu.Lock()
+	until, ok := a.verified[sum]
+	a.mu.Unlock()
+	if ok && time.Now().Before(until) {
+		return true
+	}
+
+	if err := a.Verify(ctx, token); err != nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.verified == nil {
+		a.verified = map[[sha256.Size]byte]time.Time{}
+	}
+	now := time.Now()
+	for k, t := range a.verified {
+		if now.After(t) {
+			delete(a.verified, k)
+		}
+	}
+	a.verified[sum] = now.Add(a.CacheFor)
+	return true
+}
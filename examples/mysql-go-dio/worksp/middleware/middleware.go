@@ -1,20 +1,75 @@
 package middleware
 
 import (
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func IPWhiteList(whitelist map[string]bool) gin.HandlerFunc {
+// IPs and CIDR ranges a client address is checked against
+type Networks []*net.IPNet
+
+// parses IPs like 127.0.0.1 and ranges like 192.168.0.0/24; IPv6 works the same way
+func ParseNetworks(list []string) (Networks, error) {
+	var nets Networks
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is no IP or CIDR range", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is no IP or CIDR range", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (n Networks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denies clients outside the whitelist with 403; an empty whitelist allows everybody
+// ClientIP only believes X-Forwarded-For from the trusted proxies of the router
+func IPWhiteList(whitelist Networks) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !whitelist[c.ClientIP()] {
+		if len(whitelist) == 0 {
+			return
+		}
+		if !whitelist.Contains(net.ParseIP(c.ClientIP())) {
 			// if the address isn't whitelisted, the API will ban user from seeing the data
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
-				"status":  http.StatusForbidden,
-				"message": "Permission denied",
-			})
+			deny(c, http.StatusForbidden, "Permission denied", "ip not whitelisted")
 			return
 		}
 	}
 }
+
+// ends the request with a JSON error and notes the reason for the audit log
+func deny(c *gin.Context, status int, message string, reason string) {
+	c.Set(reasonKey, reason)
+	c.AbortWithStatusJSON(status, gin.H{
+		"status":  status,
+		"message": message,
+	})
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// token bucket of one client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allows each client rate requests per second with bursts of burst; others get 429
+func RateLimit(rate float64, burst int) gin.HandlerFunc {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	var mu sync.Mutex
+	buckets := map[string]*bucket{}
+	lastSweep := time.Now()
+
+	return func(c *gin.Context) {
+		now := time.Now()
+		client := c.ClientIP()
+
+		mu.Lock()
+		// buckets that filled up again are the same as new ones
+		if now.Sub(lastSweep) > time.Minute {
+			full := time.Duration(float64(burst) / rate * float64(time.Second))
+			for ip, b := range buckets {
+				if now.Sub(b.last) > full {
+					delete(buckets, ip)
+				}
+			}
+			lastSweep = now
+		}
+		b, ok := buckets[client]
+		if !ok {
+			b = &bucket{tokens: float64(burst), last: now}
+			buckets[client] = b
+		}
+		b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+		allowed := b.tokens >= 1
+		if allowed {
+			b.tokens--
+		}
+		wait := (1 - b.tokens) / rate
+		mu.Unlock()
+
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait))))
+			deny(c, http.StatusTooManyRequests, "Too many requests", "rate limited")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takes the actions; the example implements it with the device API, MQTT and the modem
+type Actuator interface {
+	SetOutput(ctx context.Context, output string, value int) error
+	Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error
+	SendSMS(ctx context.Context, to []string, text string) error
+}
+
+// why a rule fired; fills the placeholders of payloads and texts
+type Fire struct {
+	Rule string    `json:"rule"`
+	Time time.Time `json:"time"`
+	// AIN value of threshold rules
+	Value float64 `json:"value,omitempty"`
+	// how long the input was at its previous level, for input rules
+	Previous time.Duration `json:"previous,omitempty"`
+}
+
+func (f Fire) expand(text string) string {
+	return strings.NewReplacer(
+		"{rule}", f.Rule,
+		"{time}", f.Time.Format(time.RFC3339),
+		"{value}", strconv.FormatFloat(f.Value, 'f', -1, 64),
+		"{duration}", strconv.FormatInt(f.Previous.Milliseconds(), 10),
+	).Replace(text)
+}
+
+// prints the actions instead of taking them
+type dryRun struct{}
+
+func (dryRun) SetOutput(ctx context.Context, output string, value int) error {
+	fmt.Printf("dry-run: would set %s to %d\n", output, value)
+	return nil
+}
+
+func (dryRun) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	fmt.Printf("dry-run: would publish %q to %s (qos %d, retain %t)\n", payload, topic, qos, retain)
+	return nil
+}
+
+func (dryRun) SendSMS(ctx context.Context, to []string, text string) error {
+	fmt.Printf("dry-run: would send %q to %s\n", text, strings.Join(to, ", "))
+	return nil
+}
@@ -0,0 +1,461 @@
+package rules
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"tdce-shared/dio"
+)
+
+// runs the rules; Run owns the state, so a running engine is changed through Reload only
+type Engine struct {
+	Actuator Actuator
+	// source of the levels of the inputs used by the rules
+	Levels func(channels []string) dio.Source
+	// reads an analog input; needed by AIN rules
+	ReadAnalog func(ctx context.Context, name string) (float64, error)
+	// file the rule state is kept in; empty keeps it in memory only
+	StateFile string
+	// prints the actions instead of taking them and doesn't write the state file
+	DryRun bool
+
+	set    *Set
+	reload chan *Set
+
+	st       *state
+	queue    schedule
+	holds    map[string]time.Time
+	lastAin  map[string]float64
+	edges    chan ruleEdge
+	readings chan reading
+	failed   chan error
+	// cancels the subscriptions and the AIN poll of the current rules
+	disarm context.CancelFunc
+	// publish and sms actions still being sent
+	background sync.WaitGroup
+}
+
+type ruleEdge struct {
+	rule  string
+	event dio.Event
+	// rules the edge was subscribed for; stale edges after a reload are dropped
+	generation int
+}
+
+type reading struct {
+	ain   string
+	value float64
+	at    time.Time
+}
+
+func New(set *Set) *Engine {
+	return &Engine{set: set, reload: make(chan *Set, 1)}
+}
+
+// replaces the rules of a running engine; the rule state and waiting actions are kept
+func (e *Engine) Reload(set *Set) {
+	select {
+	case <-e.reload:
+	default:
+	}
+	e.reload <- set
+}
+
+// runs the rules until ctx is cancelled; pulsing outputs are switched off when it returns
+func (e *Engine) Run(ctx context.Context) error {
+	st, err := loadState(e.StateFile)
+	if err != nil {
+		return fmt.Errorf("reading rule state: %w", err)
+	}
+	e.st = st
+	e.queue = nil
+	for _, p := range st.Pending {
+		heap.Push(&e.queue, &item{at: p.At, action: p})
+	}
+	e.edges = make(chan ruleEdge, 64)
+	e.readings = make(chan reading, 16)
+	e.failed = make(chan error, 1)
+
+	generation := 0
+	e.arm(ctx, generation)
+	defer func() {
+		e.disarm()
+		e.shutdown()
+	}()
+
+	// stopped until the first item is scheduled
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	for {
+		var due <-chan time.Time
+		if at, ok := e.queue.next(); ok {
+			timer.Reset(time.Until(at))
+			due = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-e.failed:
+			return err
+		case set := <-e.reload:
+			e.disarm()
+			e.set = set
+			generation++
+			e.arm(ctx, generation)
+			fmt.Printf("Rules reloaded, %d rules\n", len(set.Rules))
+		case edge := <-e.edges:
+			if edge.generation == generation {
+				e.edge(ctx, edge)
+			}
+		case r := <-e.readings:
+			e.reading(ctx, r)
+		case now := <-due:
+			e.due(ctx, now)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// subscribes to the inputs, schedules the timers and starts the AIN poll of the current rules
+func (e *Engine) arm(ctx context.Context, generation int) {
+	ctx, e.disarm = context.WithCancel(ctx)
+	e.holds = map[string]time.Time{}
+	e.lastAin = map[string]float64{}
+	e.queue.remove(func(it *item) bool { return it.action == nil })
+
+	var inputs, ains []string
+	var levels *dio.Engine
+	seen := map[string]bool{}
+	for _, r := range e.set.Rules {
+		w := r.When
+		switch {
+		case w.Input != "":
+			if !seen[w.Input] {
+				seen[w.Input] = true
+				inputs = append(inputs, w.Input)
+			}
+		case w.Ain != "":
+			if !seen[w.Ain] {
+				seen[w.Ain] = true
+				ains = append(ains, w.Ain)
+			}
+		case w.Every > 0:
+			heap.Push(&e.queue, &item{at: time.Now().Add(time.Duration(w.Every)), tick: r.Name})
+		}
+	}
+
+	if len(inputs) > 0 {
+		levels = dio.NewEngine(e.Levels(inputs))
+		for _, r := range e.set.Rules {
+			if r.When.Input == "" {
+				continue
+			}
+			sub := levels.Subscribe(r.When.Input, dio.Filter{Debounce: time.Duration(r.When.Debounce)})
+			go e.forward(ctx, r.Name, sub, generation)
+		}
+		go func() {
+			if err := levels.Run(ctx); err != nil {
+				select {
+				case e.failed <- fmt.Errorf("input levels: %w", err):
+				default:
+				}
+			}
+		}()
+	}
+	if len(ains) > 0 {
+		go e.pollAnalog(ctx, ains, time.Duration(e.set.AinInterval))
+	}
+}
+
+func (e *Engine) forward(ctx context.Context, rule string, sub *dio.Subscription, generation int) {
+	defer sub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-sub.Events():
+			select {
+			case e.edges <- ruleEdge{rule: rule, event: ev, generation: generation}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (e *Engine) pollAnalog(ctx context.Context, ains []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, ain := range ains {
+			value, err := e.ReadAnalog(ctx, ain)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				fmt.Printf("Error reading %s: %v\n", ain, err)
+				continue
+			}
+			select {
+			case e.readings <- reading{ain: ain, value: value, at: time.Now()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Engine) rule(name string) *Rule {
+	for i := range e.set.Rules {
+		if e.set.Rules[i].Name == name {
+			return &e.set.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (e *Engine) edge(ctx context.Context, edge ruleEdge) {
+	r := e.rule(edge.rule)
+	if r == nil {
+		return
+	}
+	// every edge ends the hold of the level before it
+	delete(e.holds, r.Name)
+	if want := r.When.edge(); want != 0 && want != edge.event.Edge {
+		return
+	}
+	f := Fire{Rule: r.Name, Time: edge.event.Time, Previous: edge.event.Previous}
+	if r.When.For <= 0 {
+		e.fire(ctx, r, f)
+		return
+	}
+	e.holds[r.Name] = f.Time
+	heap.Push(&e.queue, &item{
+		at:   f.Time.Add(time.Duration(r.When.For)),
+		hold: &hold{rule: r.Name, since: f.Time, fire: f},
+	})
+}
+
+func (e *Engine) reading(ctx context.Context, rd reading) {
+	e.lastAin[rd.ain] = rd.value
+	for i := range e.set.Rules {
+		r := &e.set.Rules[i]
+		if r.When.Ain != rd.ain {
+			continue
+		}
+		rs := e.st.rule(r.Name)
+		crossed := r.When.Above != nil && rd.value > *r.When.Above ||
+			r.When.Below != nil && rd.value < *r.When.Below
+		if !crossed {
+			delete(e.holds, r.Name)
+			if rs.Latched {
+				rs.Latched = false
+				e.save()
+			}
+			continue
+		}
+		if _, holding := e.holds[r.Name]; holding || rs.Latched {
+			continue
+		}
+		f := Fire{Rule: r.Name, Time: rd.at, Value: rd.value}
+		if r.When.For <= 0 {
+			rs.Latched = true
+			e.fire(ctx, r, f)
+			continue
+		}
+		e.holds[r.Name] = rd.at
+		heap.Push(&e.queue, &item{
+			at:   rd.at.Add(time.Duration(r.When.For)),
+			hold: &hold{rule: r.Name, since: rd.at, fire: f},
+		})
+	}
+}
+
+// handles the items whose time has come
+func (e *Engine) due(ctx context.Context, now time.Time) {
+	for {
+		at, ok := e.queue.next()
+		if !ok || at.After(now) {
+			return
+		}
+		it := heap.Pop(&e.queue).(*item)
+		switch {
+		case it.action != nil:
+			e.take(ctx, it.action.Action, it.action.Fire)
+			e.save()
+		case it.hold != nil:
+			since, holding := e.holds[it.hold.rule]
+			r := e.rule(it.hold.rule)
+			if !holding || !since.Equal(it.hold.since) || r == nil {
+				continue
+			}
+			delete(e.holds, r.Name)
+			f := it.hold.fire
+			if r.When.Ain != "" {
+				f.Value = e.lastAin[r.When.Ain]
+				e.st.rule(r.Name).Latched = true
+			}
+			e.fire(ctx, r, f)
+		case it.tick != "":
+			r := e.rule(it.tick)
+			if r == nil {
+				continue
+			}
+			// the next run keeps the rhythm unless the engine fell behind
+			next := it.at.Add(time.Duration(r.When.Every))
+			if next.Before(now) {
+				next = now.Add(time.Duration(r.When.Every))
+			}
+			heap.Push(&e.queue, &item{at: next, tick: r.Name})
+			e.fire(ctx, r, Fire{Rule: r.Name, Time: now})
+		}
+	}
+}
+
+// takes the actions of a rule that fired, or schedules them when they wait
+func (e *Engine) fire(ctx context.Context, r *Rule, f Fire) {
+	rs := e.st.rule(r.Name)
+	if r.Cooldown > 0 && !rs.LastFired.IsZero() && f.Time.Sub(rs.LastFired) < time.Duration(r.Cooldown) {
+		fmt.Printf("Rule %s: cooling down, not fired\n", r.Name)
+		return
+	}
+	rs.LastFired = f.Time
+	rs.Fired++
+	fmt.Printf("Rule %s fired\n", r.Name)
+
+	for _, a := range r.Then {
+		if a.After > 0 {
+			e.schedule(&pending{At: f.Time.Add(time.Duration(a.After)), Action: a, Fire: f})
+			continue
+		}
+		e.take(ctx, a, f)
+	}
+	e.save()
+}
+
+func (e *Engine) schedule(p *pending) {
+	heap.Push(&e.queue, &item{at: p.At, action: p})
+}
+
+func (e *Engine) actuator() Actuator {
+	if e.DryRun {
+		return dryRun{}
+	}
+	return e.Actuator
+}
+
+// takes one action; publish and sms are sent in the background so they don't delay the outputs
+func (e *Engine) take(ctx context.Context, a Action, f Fire) {
+	act := e.actuator()
+	// actions taken on shutdown still have to reach the device
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+
+	switch {
+	case a.Set != nil:
+		defer cancel()
+		if err := act.SetOutput(ctx, a.Set.Output, a.Set.Value); err != nil {
+			fmt.Printf("Rule %s: setting %s: %v\n", f.Rule, a.Set.Output, err)
+		}
+	case a.Pulse != nil:
+		defer cancel()
+		length := time.Duration(a.Pulse.For)
+		if a.Pulse.Replay {
+			length = f.Previous
+		}
+		if length <= 0 {
+			fmt.Printf("Rule %s: length of the previous level unknown, %s not pulsed\n", f.Rule, a.Pulse.Output)
+			return
+		}
+		if err := act.SetOutput(ctx, a.Pulse.Output, 1); err != nil {
+			fmt.Printf("Rule %s: setting %s: %v\n", f.Rule, a.Pulse.Output, err)
+		}
+		e.pulseEnd(a.Pulse.Output, time.Now().Add(length), f)
+	case a.Publish != nil:
+		payload := []byte(f.expand(a.Publish.Payload))
+		e.background.Add(1)
+		go func() {
+			defer e.background.Done()
+			defer cancel()
+			if err := act.Publish(ctx, a.Publish.Topic, a.Publish.QoS, a.Publish.Retain, payload); err != nil {
+				fmt.Printf("Rule %s: publishing to %s: %v\n", f.Rule, a.Publish.Topic, err)
+			}
+		}()
+	case a.SMS != nil:
+		text := f.expand(a.SMS.Text)
+		e.background.Add(1)
+		go func() {
+			defer e.background.Done()
+			defer cancel()
+			if err := act.SendSMS(ctx, a.SMS.To, text); err != nil {
+				fmt.Printf("Rule %s: sending SMS: %v\n", f.Rule, err)
+			}
+		}()
+	default:
+		cancel()
+	}
+}
+
+// schedules switching the output off; a pulse that already runs is extended if the new one ends later
+func (e *Engine) pulseEnd(output string, end time.Time, f Fire) {
+	for _, it := range e.queue {
+		if it.action != nil && it.action.PulseEnd && it.action.Action.Set.Output == output {
+			if end.After(it.at) {
+				it.at, it.action.At = end, end
+				heap.Fix(&e.queue, it.index)
+			}
+			return
+		}
+	}
+	e.schedule(&pending{
+		At:       end,
+		Action:   Action{Set: &SetAction{Output: output, Value: 0}},
+		Fire:     f,
+		PulseEnd: true,
+	})
+}
+
+// switches pulsing outputs off and keeps the other waiting actions for the next start
+func (e *Engine) shutdown() {
+	ctx := context.Background()
+	e.queue.remove(func(it *item) bool {
+		if it.action != nil && it.action.PulseEnd {
+			e.take(ctx, it.action.Action, it.action.Fire)
+			return true
+		}
+		return it.action == nil
+	})
+	e.background.Wait()
+	e.save()
+}
+
+// writes the rule state and the waiting actions; not in dry-run
+func (e *Engine) save() {
+	if e.StateFile == "" || e.DryRun {
+		return
+	}
+	e.st.Pending = e.st.Pending[:0]
+	for _, it := range e.queue {
+		if it.action != nil {
+			e.st.Pending = append(e.st.Pending, it.action)
+		}
+	}
+	if err := e.st.save(e.StateFile); err != nil {
+		fmt.Println("Error saving rule state: ", err)
+	}
+}
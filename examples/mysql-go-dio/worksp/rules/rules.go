@@ -0,0 +1,214 @@
+// Package created 18.10.2026.
+// Declarative DIO automation: "if input X for N ms then output Y for M ms"
+
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"tdce-shared/config"
+	"tdce-shared/dio"
+)
+
+// contents of the rules file, see rules.yaml
+type Set struct {
+	// how often the AIN thresholds are checked; 1s by default
+	AinInterval config.Duration `json:"ainInterval"`
+	Rules       []Rule          `json:"rules"`
+}
+
+// one rule: when the trigger fires, the actions are taken in order
+type Rule struct {
+	Name string  `json:"name"`
+	When Trigger `json:"when"`
+	// the rule doesn't fire again before this passed, also across restarts
+	Cooldown config.Duration `json:"cooldown"`
+	Then     []Action        `json:"then"`
+}
+
+// exactly one of input, ain and every is set
+type Trigger struct {
+	// edge of a DIO: rising, falling or both
+	Input string `json:"input"`
+	Edge  string `json:"edge"`
+	// glitch filter of the input
+	Debounce config.Duration `json:"debounce"`
+
+	// threshold of an analog input; fires once when crossed and again after it cleared
+	Ain   string   `json:"ain"`
+	Above *float64 `json:"above"`
+	Below *float64 `json:"below"`
+
+	// the new input level or the crossed threshold has to hold this long
+	For config.Duration `json:"for"`
+
+	// timer
+	Every config.Duration `json:"every"`
+}
+
+// exactly one of set, pulse, publish and sms is set
+type Action struct {
+	// waits this long after the trigger before the action is taken
+	After config.Duration `json:"after,omitempty"`
+
+	Set     *SetAction     `json:"set,omitempty"`
+	Pulse   *PulseAction   `json:"pulse,omitempty"`
+	Publish *PublishAction `json:"publish,omitempty"`
+	SMS     *SMSAction     `json:"sms,omitempty"`
+}
+
+type SetAction struct {
+	Output string `json:"output"`
+	Value  int    `json:"value"`
+}
+
+// sets the output high and low again after For
+// a pulse on an output that is still pulsing extends it if it ends later
+type PulseAction struct {
+	Output string          `json:"output"`
+	For    config.Duration `json:"for,omitempty"`
+	// lasts as long as the input was at its previous level, e.g. how long it was high before a falling edge
+	Replay bool `json:"replay,omitempty"`
+}
+
+// the payload may hold {rule}, {time}, {value} and {duration}
+type PublishAction struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// the text may hold {rule}, {time}, {value} and {duration}
+type SMSAction struct {
+	To   []string `json:"to"`
+	Text string   `json:"text"`
+}
+
+// reads a rules file; YAML or JSON
+func Load(path string) (*Set, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is read as JSON so the durations and the unknown field check work like in the settings
+	var raw any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var set Set
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&set); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if set.AinInterval <= 0 {
+		set.AinInterval = config.Duration(time.Second)
+	}
+	if err := set.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &set, nil
+}
+
+// reports every mistake in the rules at once
+func (s *Set) Validate() error {
+	var errs []error
+	names := map[string]bool{}
+	for i, r := range s.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+			errs = append(errs, fmt.Errorf("%s: name is required", name))
+		} else if names[name] {
+			errs = append(errs, fmt.Errorf("%s: name is used twice", name))
+		}
+		names[name] = true
+		for _, err := range r.problems() {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Rule) problems() []error {
+	var errs []error
+	w := r.When
+	kinds := 0
+	for _, set := range []bool{w.Input != "", w.Ain != "", w.Every > 0} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		errs = append(errs, errors.New("when needs exactly one of input, ain and every"))
+	}
+	if w.Input != "" && w.edge() == 0 && !strings.EqualFold(w.Edge, "both") {
+		errs = append(errs, fmt.Errorf("edge %q is not rising, falling or both", w.Edge))
+	}
+	if w.Ain != "" && (w.Above == nil) == (w.Below == nil) {
+		errs = append(errs, errors.New("ain needs exactly one of above and below"))
+	}
+	if w.Every > 0 && w.For > 0 {
+		errs = append(errs, errors.New("for can't be used with every"))
+	}
+	if len(r.Then) == 0 {
+		errs = append(errs, errors.New("then has no actions"))
+	}
+	for i, a := range r.Then {
+		if err := a.problem(w); err != nil {
+			errs = append(errs, fmt.Errorf("action %d: %w", i+1, err))
+		}
+	}
+	return errs
+}
+
+func (a *Action) problem(w Trigger) error {
+	kinds := 0
+	for _, set := range []bool{a.Set != nil, a.Pulse != nil, a.Publish != nil, a.SMS != nil} {
+		if set {
+			kinds++
+		}
+	}
+	switch {
+	case kinds != 1:
+		return errors.New("needs exactly one of set, pulse, publish and sms")
+	case a.Set != nil && a.Set.Output == "":
+		return errors.New("set needs an output")
+	case a.Pulse != nil && a.Pulse.Output == "":
+		return errors.New("pulse needs an output")
+	case a.Pulse != nil && a.Pulse.Replay && w.Input == "":
+		return errors.New("replay needs an input trigger")
+	case a.Pulse != nil && !a.Pulse.Replay && a.Pulse.For <= 0:
+		return errors.New("pulse needs for or replay")
+	case a.Publish != nil && a.Publish.Topic == "":
+		return errors.New("publish needs a topic")
+	case a.Publish != nil && a.Publish.QoS > 2:
+		return errors.New("qos must be 0, 1 or 2")
+	case a.SMS != nil && len(a.SMS.To) == 0:
+		return errors.New("sms needs numbers in to")
+	}
+	return nil
+}
+
+// the edge that fires the rule; 0 for both
+func (w Trigger) edge() dio.Edge {
+	switch strings.ToLower(w.Edge) {
+	case "rising":
+		return dio.Rising
+	case "falling":
+		return dio.Falling
+	}
+	return 0
+}
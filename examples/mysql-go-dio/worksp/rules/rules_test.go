@@ -0,0 +1,351 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tdce-shared/config"
+	"tdce-shared/dio"
+)
+
+type call struct {
+	kind    string
+	target  string
+	value   int
+	payload string
+	at      time.Time
+}
+
+// records the actions instead of taking them
+type fakeActuator struct {
+	mu    sync.Mutex
+	calls []call
+}
+
+func (f *fakeActuator) record(c call) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.at = time.Now()
+	f.calls = append(f.calls, c)
+}
+
+func (f *fakeActuator) SetOutput(ctx context.Context, output string, value int) error {
+	f.record(call{kind: "set", target: output, value: value})
+	return nil
+}
+
+func (f *fakeActuator) Publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	f.record(call{kind: "publish", target: topic, payload: string(payload)})
+	return nil
+}
+
+func (f *fakeActuator) SendSMS(ctx context.Context, to []string, text string) error {
+	f.record(call{kind: "sms", target: strings.Join(to, ","), payload: text})
+	return nil
+}
+
+func (f *fakeActuator) get() []call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]call(nil), f.calls...)
+}
+
+// delivers the levels the test sends, stamped with the time they are sent
+type fakeSource struct {
+	samples chan dio.Sample
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{samples: make(chan dio.Sample)}
+}
+
+func (s *fakeSource) Name() string {
+	return "fake"
+}
+
+func (s *fakeSource) Run(ctx context.Context, emit func(dio.Sample)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sample := <-s.samples:
+			emit(sample)
+		}
+	}
+}
+
+func (s *fakeSource) level(channel string, value int) {
+	s.samples <- dio.Sample{Channel: channel, Value: value, Time: time.Now()}
+}
+
+func testEngine(set *Set, src dio.Source) (*Engine, *fakeActuator) {
+	act := &fakeActuator{}
+	e := New(set)
+	e.Actuator = act
+	e.Levels = func([]string) dio.Source { return src }
+	return e, act
+}
+
+// runs the engine until the returned function is called
+func start(t *testing.T, e *Engine) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- e.Run(ctx) }()
+	return func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func duration(d time.Duration) config.Duration {
+	return config.Duration(d)
+}
+
+func ptr(f float64) *float64 {
+	return &f
+}
+
+// the opposite edge before for has passed cancels the hold
+func TestHoldCancelledByOppositeEdge(t *testing.T) {
+	src := newFakeSource()
+	e, act := testEngine(&Set{Rules: []Rule{{
+		Name: "door",
+		When: Trigger{Input: "DIO_A", Edge: "rising", For: duration(150 * time.Millisecond)},
+		Then: []Action{{Set: &SetAction{Output: "DIO_B", Value: 1}}},
+	}}}, src)
+	stop := start(t, e)
+	defer stop()
+
+	src.level("DIO_A", 0)
+	src.level("DIO_A", 1)
+	time.Sleep(50 * time.Millisecond)
+	src.level("DIO_A", 0)
+	time.Sleep(250 * time.Millisecond)
+	if calls := act.get(); len(calls) != 0 {
+		t.Fatalf("rule fired although the level didn't hold: %+v", calls)
+	}
+
+	held := time.Now()
+	src.level("DIO_A", 1)
+	eventually(t, "the held level to fire", func() bool { return len(act.get()) == 1 })
+	if c := act.get()[0]; c.target != "DIO_B" || c.value != 1 || c.at.Sub(held) < 150*time.Millisecond {
+		t.Errorf("fired %+v after %s, want DIO_B set after 150ms", c, c.at.Sub(held))
+	}
+}
+
+// an action that came due while the gateway was down is taken right after the start
+func TestOverduePendingAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules-state.json")
+	st := &state{
+		Rules: map[string]*ruleState{},
+		Pending: []*pending{{
+			At:     time.Now().Add(-time.Minute),
+			Action: Action{Set: &SetAction{Output: "DIO_C", Value: 1}},
+			Fire:   Fire{Rule: "late"},
+		}, {
+			At:     time.Now().Add(time.Hour),
+			Action: Action{Set: &SetAction{Output: "DIO_D", Value: 1}},
+			Fire:   Fire{Rule: "later"},
+		}},
+	}
+	if err := st.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	e, act := testEngine(&Set{}, nil)
+	e.StateFile = path
+	stop := start(t, e)
+	eventually(t, "the overdue action", func() bool { return len(act.get()) == 1 })
+	stop()
+
+	if c := act.get(); len(c) != 1 || c[0].target != "DIO_C" || c[0].value != 1 {
+		t.Errorf("actions after the restart: %+v, want only DIO_C set", c)
+	}
+	st, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Pending) != 1 || st.Pending[0].Fire.Rule != "later" {
+		t.Errorf("pending after the restart: %+v, want only the later action", st.Pending)
+	}
+}
+
+// a second pulse on a pulsing output moves its end instead of switching it off early
+func TestPulseExtended(t *testing.T) {
+	src := newFakeSource()
+	e, act := testEngine(&Set{Rules: []Rule{{
+		Name: "horn",
+		When: Trigger{Input: "DIO_A", Edge: "rising"},
+		Then: []Action{{Pulse: &PulseAction{Output: "DIO_B", For: duration(200 * time.Millisecond)}}},
+	}}}, src)
+	stop := start(t, e)
+	defer stop()
+
+	src.level("DIO_A", 0)
+	first := time.Now()
+	src.level("DIO_A", 1)
+	time.Sleep(20 * time.Millisecond)
+	src.level("DIO_A", 0)
+	time.Sleep(80 * time.Millisecond)
+	src.level("DIO_A", 1)
+
+	eventually(t, "the end of the pulse", func() bool {
+		calls := act.get()
+		return len(calls) > 0 && calls[len(calls)-1].value == 0
+	})
+	time.Sleep(100 * time.Millisecond)
+	var on, off int
+	var end time.Time
+	for _, c := range act.get() {
+		if c.value == 1 {
+			on++
+		} else {
+			off++
+			end = c.at
+		}
+	}
+	if on != 2 || off != 1 {
+		t.Errorf("%d on and %d off, want 2 and 1: %+v", on, off, act.get())
+	}
+	if end.Sub(first) < 290*time.Millisecond {
+		t.Errorf("pulse ended after %s, want the 200ms of the second pulse", end.Sub(first))
+	}
+}
+
+// a threshold fires once while crossed and again after the value went back
+func TestAinLatchRearms(t *testing.T) {
+	values := []float64{6, 7, 4, 8, 9}
+	var mu sync.Mutex
+	e, act := testEngine(&Set{AinInterval: duration(10 * time.Millisecond), Rules: []Rule{{
+		Name: "pressure",
+		When: Trigger{Ain: "AIN_A", Above: ptr(5)},
+		Then: []Action{{Publish: &PublishAction{Topic: "alarm", Payload: "{value}"}}},
+	}}}, nil)
+	e.ReadAnalog = func(ctx context.Context, name string) (float64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		v := values[0]
+		if len(values) > 1 {
+			values = values[1:]
+		}
+		return v, nil
+	}
+	e.StateFile = filepath.Join(t.TempDir(), "rules-state.json")
+	stop := start(t, e)
+	eventually(t, "the second crossing", func() bool { return len(act.get()) == 2 })
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	calls := act.get()
+	if len(calls) != 2 || calls[0].payload != "6" || calls[1].payload != "8" {
+		t.Errorf("publishes %+v, want 6 and 8", calls)
+	}
+	st, err := loadState(e.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := st.Rules["pressure"]; rs == nil || !rs.Latched || rs.Fired != 2 {
+		t.Errorf("rule state %+v, want latched after 2 fires", rs)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	e, act := testEngine(&Set{Rules: []Rule{{
+		Name:     "tick",
+		When:     Trigger{Every: duration(20 * time.Millisecond)},
+		Cooldown: duration(time.Hour),
+		Then:     []Action{{Set: &SetAction{Output: "DIO_B", Value: 1}}},
+	}}}, nil)
+	stop := start(t, e)
+	time.Sleep(150 * time.Millisecond)
+	stop()
+	if calls := act.get(); len(calls) != 1 {
+		t.Errorf("%d actions within the cooldown, want 1", len(calls))
+	}
+}
+
+func TestDryRunKeepsStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules-state.json")
+	before, _ := json.Marshal(&state{Rules: map[string]*ruleState{"tick": {Fired: 3}}})
+	if err := os.WriteFile(path, before, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, act := testEngine(&Set{Rules: []Rule{{
+		Name: "tick",
+		When: Trigger{Every: duration(10 * time.Millisecond)},
+		Then: []Action{
+			{Pulse: &PulseAction{Output: "DIO_B", For: duration(time.Hour)}},
+			{After: duration(time.Hour), Set: &SetAction{Output: "DIO_C", Value: 1}},
+		},
+	}}}, nil)
+	e.StateFile, e.DryRun = path, true
+	stop := start(t, e)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	if calls := act.get(); len(calls) != 0 {
+		t.Errorf("dry-run took actions: %+v", calls)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil || string(after) != string(before) {
+		t.Errorf("dry-run changed the state file to %s (%v)", after, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		want string
+	}{
+		{"name", Rule{When: Trigger{Every: duration(time.Second)}, Then: []Action{{Set: &SetAction{Output: "DIO_B"}}}}, "name is required"},
+		{"no trigger", Rule{Name: "r", Then: []Action{{Set: &SetAction{Output: "DIO_B"}}}}, "exactly one of input, ain and every"},
+		{"two triggers", Rule{Name: "r", When: Trigger{Input: "DIO_A", Edge: "rising", Every: duration(time.Second)}, Then: []Action{{Set: &SetAction{Output: "DIO_B"}}}}, "exactly one of input, ain and every"},
+		{"edge", Rule{Name: "r", When: Trigger{Input: "DIO_A", Edge: "up"}, Then: []Action{{Set: &SetAction{Output: "DIO_B"}}}}, `edge "up"`},
+		{"threshold", Rule{Name: "r", When: Trigger{Ain: "AIN_A", Above: ptr(1), Below: ptr(2)}, Then: []Action{{Set: &SetAction{Output: "DIO_B"}}}}, "exactly one of above and below"},
+		{"every with for", Rule{Name: "r", When: Trigger{Every: duration(time.Second), For: duration(time.Second)}, Then: []Action{{Set: &SetAction{Output: "DIO_B"}}}}, "for can't be used with every"},
+		{"no actions", Rule{Name: "r", When: Trigger{Every: duration(time.Second)}}, "then has no actions"},
+		{"two kinds", Rule{Name: "r", When: Trigger{Every: duration(time.Second)}, Then: []Action{{Set: &SetAction{Output: "DIO_B"}, SMS: &SMSAction{To: []string{"+45"}}}}}, "action 1: needs exactly one"},
+		{"replay", Rule{Name: "r", When: Trigger{Every: duration(time.Second)}, Then: []Action{{Pulse: &PulseAction{Output: "DIO_B", Replay: true}}}}, "replay needs an input trigger"},
+		{"pulse length", Rule{Name: "r", When: Trigger{Every: duration(time.Second)}, Then: []Action{{Pulse: &PulseAction{Output: "DIO_B"}}}}, "pulse needs for or replay"},
+		{"qos", Rule{Name: "r", When: Trigger{Every: duration(time.Second)}, Then: []Action{{Publish: &PublishAction{Topic: "t", QoS: 3}}}}, "qos must be 0, 1 or 2"},
+		{"sms", Rule{Name: "r", When: Trigger{Every: duration(time.Second)}, Then: []Action{{SMS: &SMSAction{Text: "hi"}}}}, "sms needs numbers"},
+	}
+	for _, tt := range tests {
+		err := (&Set{Rules: []Rule{tt.rule}}).Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Validate = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	// every mistake is reported, names used twice included
+	ok := Rule{Name: "r", When: Trigger{Input: "DIO_A", Edge: "both"}, Then: []Action{{Set: &SetAction{Output: "DIO_B"}}}}
+	if err := (&Set{Rules: []Rule{ok}}).Validate(); err != nil {
+		t.Errorf("valid rule: %v", err)
+	}
+	err := (&Set{Rules: []Rule{ok, ok, {Name: "x"}}}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "r: name is used twice") || !strings.Contains(err.Error(), "x: then has no actions") {
+		t.Errorf("Validate = %v, want all mistakes", err)
+	}
+}
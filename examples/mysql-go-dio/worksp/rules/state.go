@@ -0,0 +1,155 @@
+package rules
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// what survives a restart: when the rules fired and the actions still waiting for their time
+type state struct {
+	Rules   map[string]*ruleState `json:"rules"`
+	Pending []*pending            `json:"pending"`
+}
+
+type ruleState struct {
+	LastFired time.Time `json:"lastFired,omitempty"`
+	Fired     int       `json:"fired"`
+	// threshold rules: crossed and already fired; fires again after the value went back
+	Latched bool `json:"latched,omitempty"`
+}
+
+// action waiting for its time; after a crash the overdue ones are taken right after the start
+type pending struct {
+	At     time.Time `json:"at"`
+	Action Action    `json:"action"`
+	Fire   Fire      `json:"fire"`
+	// switches a pulsing output off; taken right away on shutdown
+	PulseEnd bool `json:"pulseEnd,omitempty"`
+}
+
+// reads the state file; a missing file is an empty state
+func loadState(path string) (*state, error) {
+	st := &state{Rules: map[string]*ruleState{}}
+	if path == "" {
+		return st, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.Rules == nil {
+		st.Rules = map[string]*ruleState{}
+	}
+	return st, nil
+}
+
+// writes the state file; replaced in one step so a crash doesn't leave half a file
+func (st *state) save(path string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (st *state) rule(name string) *ruleState {
+	rs, ok := st.Rules[name]
+	if !ok {
+		rs = &ruleState{}
+		st.Rules[name] = rs
+	}
+	return rs
+}
+
+// something the engine has to do at a time; exactly one of action, hold and tick is set
+type item struct {
+	at time.Time
+	// persisted action
+	action *pending
+	// a level or threshold that has to hold until at
+	hold *hold
+	// next run of an every trigger
+	tick string
+
+	index int
+}
+
+type hold struct {
+	rule  string
+	since time.Time
+	fire  Fire
+}
+
+// items ordered by time; the engine sleeps until the first one
+type schedule []*item
+
+func (s schedule) Len() int           { return len(s) }
+func (s schedule) Less(i, j int) bool { return s[i].at.Before(s[j].at) }
+
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].index = i
+	s[j].index = j
+}
+
+func (s *schedule) Push(x any) {
+	it := x.(*item)
+	it.index = len(*s)
+	*s = append(*s, it)
+}
+
+func (s *schedule) Pop() any {
+	old := *s
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*s = old[:len(old)-1]
+	return it
+}
+
+// time of the first item
+func (s schedule) next() (time.Time, bool) {
+	if len(s) == 0 {
+		return time.Time{}, false
+	}
+	return s[0].at, true
+}
+
+// removes the items for which drop returns true
+func (s *schedule) remove(drop func(*item) bool) {
+	kept := (*s)[:0]
+	for _, it := range *s {
+		if !drop(it) {
+			kept = append(kept, it)
+		}
+	}
+	for i := len(kept); i < len(*s); i++ {
+		(*s)[i] = nil
+	}
+	*s = kept
+	for i, it := range *s {
+		it.index = i
+	}
+	heap.Init(s)
+}
@@ -0,0 +1,264 @@
+package webapi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dios json struct
+type Dios struct {
+	ID int64 `json:"id"`
+	// how long the input was high in milliseconds
+	Duration float64 `json:"duration"`
+	WhatTime string  `json:"whattime"`
+}
+
+// one page of detections; nextCursor is empty on the last page
+type page struct {
+	Items      []Dios `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// count, total and average duration of the detections in one hour or day
+type aggregate struct {
+	Period  string  `json:"period"`
+	Count   int64   `json:"count"`
+	Total   float64 `json:"total"`
+	Average float64 `json:"average"`
+}
+
+// errors come back as JSON like the ones of the whitelist
+func fail(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"status":  status,
+		"message": message,
+	})
+}
+
+// logs the database error and hides it from the client
+func failDatabase(c *gin.Context, err error) {
+	log.Println("webapi: database error: ", err)
+	fail(c, http.StatusInternalServerError, "database error")
+}
+
+// get all dios from database; filters work like on /api/v1/detections
+func getDios(c *gin.Context) {
+	f, err := parseFilter(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	where, args := f.where()
+	dios, err := queryDios(c.Request.Context(), "SELECT id, duration, whattime FROM dios"+where+" ORDER BY id", args...)
+	if err != nil {
+		failDatabase(c, err)
+		return
+	}
+
+	// show in JSON format
+	c.JSON(http.StatusOK, dios)
+}
+
+// pages through the detections, newest first unless order=asc
+func listDios(c *gin.Context) {
+	f, err := parseFilter(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := parsePaging(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	where, args := f.where()
+	if p.after > 0 {
+		where, args = and(where, args, "id "+p.comparison()+" ?", p.after)
+	}
+	// one more row than asked tells whether there is a next page
+	query := "SELECT id, duration, whattime FROM dios" + where + " ORDER BY id " + p.direction() + " LIMIT ?"
+	dios, err := queryDios(c.Request.Context(), query, append(args, p.limit+1)...)
+	if err != nil {
+		failDatabase(c, err)
+		return
+	}
+
+	result := page{Items: dios}
+	if len(dios) > p.limit {
+		result.Items = dios[:p.limit]
+		result.NextCursor = encodeCursor(result.Items[p.limit-1].ID)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func getDio(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "id must be a number")
+		return
+	}
+	var di Dios
+	err = db.QueryRowContext(c.Request.Context(), "SELECT id, duration, whattime FROM dios WHERE id = ?", id).
+		Scan(&di.ID, &di.Duration, &di.WhatTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		fail(c, http.StatusNotFound, fmt.Sprintf("detection %d not found", id))
+		return
+	}
+	if err != nil {
+		failDatabase(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, di)
+}
+
+// count, total and average duration per hour or day
+func aggregateDios(c *gin.Context) {
+	f, err := parseFilter(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := map[string]string{"hour": "%Y-%m-%d %H:00:00", "day": "%Y-%m-%d"}[c.DefaultQuery("interval", "hour")]
+	if format == "" {
+		fail(c, http.StatusBadRequest, "interval must be hour or day")
+		return
+	}
+
+	where, args := f.where()
+	query := "SELECT DATE_FORMAT(whattime, ?) AS period, COUNT(*), COALESCE(SUM(duration), 0), COALESCE(AVG(duration), 0)" +
+		" FROM dios" + where + " GROUP BY period ORDER BY period"
+	rows, err := db.QueryContext(c.Request.Context(), query, append([]any{format}, args...)...)
+	if err != nil {
+		failDatabase(c, err)
+		return
+	}
+	defer rows.Close()
+
+	aggregates := []aggregate{}
+	for rows.Next() {
+		var a aggregate
+		if err := rows.Scan(&a.Period, &a.Count, &a.Total, &a.Average); err != nil {
+			failDatabase(c, err)
+			return
+		}
+		aggregates = append(aggregates, a)
+	}
+	if err := rows.Err(); err != nil {
+		failDatabase(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, aggregates)
+}
+
+// streams the filtered detections as CSV
+func exportDios(c *gin.Context) {
+	f, err := parseFilter(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	where, args := f.where()
+	rows, err := db.QueryContext(c.Request.Context(), "SELECT id, duration, whattime FROM dios"+where+" ORDER BY id", args...)
+	if err != nil {
+		failDatabase(c, err)
+		return
+	}
+	defer rows.Close()
+
+	// once the header is sent an error can only end the file early
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="detections.csv"`)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "duration", "whattime"})
+	for rows.Next() {
+		var di Dios
+		if err := rows.Scan(&di.ID, &di.Duration, &di.WhatTime); err != nil {
+			log.Println("webapi: export stopped: ", err)
+			break
+		}
+		w.Write([]string{strconv.FormatInt(di.ID, 10), strconv.FormatFloat(di.Duration, 'f', -1, 64), di.WhatTime})
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("webapi: export stopped: ", err)
+	}
+	w.Flush()
+}
+
+func deleteDio(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		fail(c, http.StatusBadRequest, "id must be a number")
+		return
+	}
+	result, err := db.ExecContext(c.Request.Context(), "DELETE FROM dios WHERE id = ?", id)
+	if err != nil {
+		failDatabase(c, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		fail(c, http.StatusNotFound, fmt.Sprintf("detection %d not found", id))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// retention: deletes the detections older than olderThan (e.g. 720h) or before a time
+func purgeDios(c *gin.Context) {
+	var before time.Time
+	switch {
+	case c.Query("olderThan") != "":
+		age, err := time.ParseDuration(c.Query("olderThan"))
+		if err != nil || age <= 0 {
+			fail(c, http.StatusBadRequest, "olderThan must be a duration like 720h")
+			return
+		}
+		before = time.Now().Add(-age)
+	case c.Query("before") != "":
+		var err error
+		if before, err = parseTime(c.Query("before")); err != nil {
+			fail(c, http.StatusBadRequest, "before: "+err.Error())
+			return
+		}
+	default:
+		// a DELETE without a limit would empty the table
+		fail(c, http.StatusBadRequest, "olderThan or before is required")
+		return
+	}
+
+	result, err := db.ExecContext(c.Request.Context(), "DELETE FROM dios WHERE whattime < ?", before.Format(timeLayout))
+	if err != nil {
+		failDatabase(c, err)
+		return
+	}
+	deleted, _ := result.RowsAffected()
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted, "before": before.Format(time.RFC3339)})
+}
+
+func queryDios(ctx context.Context, query string, args ...any) ([]Dios, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// looping through rows; using scan to assign column data to struct fields
+	dios := []Dios{}
+	for rows.Next() {
+		var di Dios
+		if err := rows.Scan(&di.ID, &di.Duration, &di.WhatTime); err != nil {
+			return nil, err
+		}
+		dios = append(dios, di)
+	}
+	return dios, rows.Err()
+}
@@ -0,0 +1,281 @@
+package webapi
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// kinds of pushed events
+const (
+	EventDetection = "detection"
+	EventDio       = "dio"
+	EventAin       = "ain"
+)
+
+// one pushed event; the id is "<start of the process>-<number>" so ids of an earlier run are recognized
+type Event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// DIO or AIN name; empty for detections
+	Channel string    `json:"channel,omitempty"`
+	Time    time.Time `json:"time"`
+	Data    any       `json:"data"`
+
+	seq uint64
+	// duration of detections for the minDuration filter
+	duration float64
+}
+
+// events of the example for /api/v1/events; main publishes into it
+// the last 1024 events of each type are kept for clients that reconnect
+var Events = NewHub(1024)
+
+// keeps the last events for clients that reconnect and hands new ones to the connected clients
+// every type has its own ring, so a noisy AIN doesn't push the detections out
+type Hub struct {
+	mu    sync.Mutex
+	epoch int64
+	seq   uint64
+	// last size events per type
+	recent map[string][]Event
+	// newest event per type that no longer fits its ring
+	dropped map[string]uint64
+	size    int
+	// last DIO and AIN event per channel, sent to new clients as the current state
+	latest map[string]Event
+	subs   map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	filter eventFilter
+	events chan Event
+}
+
+func NewHub(size int) *Hub {
+	return &Hub{
+		epoch:   time.Now().Unix(),
+		size:    size,
+		recent:  map[string][]Event{},
+		dropped: map[string]uint64{},
+		latest:  map[string]Event{},
+		subs:    map[*subscriber]struct{}{},
+	}
+}
+
+// publishes a new duration record
+func (h *Hub) Detection(d Dios) {
+	h.publish(Event{Type: EventDetection, Data: d, duration: d.Duration})
+}
+
+// publishes a DIO or AIN state; data is sent as JSON
+func (h *Hub) State(typ string, channel string, data any) {
+	h.publish(Event{Type: typ, Channel: channel, Data: data})
+}
+
+func (h *Hub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e.seq = h.seq
+	e.ID = fmt.Sprintf("%d-%d", h.epoch, e.seq)
+	e.Time = time.Now()
+
+	ring := append(h.recent[e.Type], e)
+	if len(ring) > h.size {
+		h.dropped[e.Type] = ring[len(ring)-h.size-1].seq
+		ring = append(ring[:0], ring[len(ring)-h.size:]...)
+	}
+	h.recent[e.Type] = ring
+	if e.Channel != "" {
+		h.latest[e.Type+"/"+e.Channel] = e
+	}
+	for s := range h.subs {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			// too slow; the client reconnects with Last-Event-ID and gets the missed events replayed
+			delete(h.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+// registers a client; replays the events after lastID, or the current states without one
+// gap is true when events after lastID of the types the client wants are no longer kept
+func (h *Hub) subscribe(f eventFilter, lastID string) (s *subscriber, replay []Event, gap bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if lastID == "" {
+		for _, e := range h.latest {
+			if f.match(e) {
+				replay = append(replay, e)
+			}
+		}
+	} else {
+		after, ok := h.parseID(lastID)
+		gap = !ok
+		for typ, ring := range h.recent {
+			if f.types != nil && !f.types[typ] {
+				continue
+			}
+			if h.dropped[typ] > after {
+				gap = true
+			}
+			for _, e := range ring {
+				if e.seq > after && f.match(e) {
+					replay = append(replay, e)
+				}
+			}
+		}
+	}
+	slices.SortFunc(replay, func(a, b Event) int { return cmp.Compare(a.seq, b.seq) })
+
+	s = &subscriber{filter: f, events: make(chan Event, 256)}
+	h.subs[s] = struct{}{}
+	return s, replay, gap
+}
+
+func (h *Hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// number of the event; ok is false for ids of an earlier run
+func (h *Hub) parseID(id string) (uint64, bool) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found || epoch != strconv.FormatInt(h.epoch, 10) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil && n <= h.seq
+}
+
+// per-client filters: types=detection,dio,ain channels=DIO_B,AIN_A minDuration=100
+type eventFilter struct {
+	types       map[string]bool
+	channels    map[string]bool
+	minDuration float64
+}
+
+func parseEventFilter(c *gin.Context) (eventFilter, error) {
+	f := eventFilter{types: list(c.Query("types")), channels: list(c.Query("channels"))}
+	for t := range f.types {
+		if t != EventDetection && t != EventDio && t != EventAin {
+			return f, fmt.Errorf("type %q is not detection, dio or ain", t)
+		}
+	}
+	if s := c.Query("minDuration"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return f, fmt.Errorf("minDuration must be a number")
+		}
+		f.minDuration = v
+	}
+	return f, nil
+}
+
+func list(s string) map[string]bool {
+	if s == "" {
+		return nil
+	}
+	m := map[string]bool{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			m[item] = true
+		}
+	}
+	return m
+}
+
+func (f eventFilter) match(e Event) bool {
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	if e.Type == EventDetection {
+		return e.duration >= f.minDuration
+	}
+	return f.channels == nil || f.channels[e.Channel]
+}
+
+// /api/v1/events of one server
+type eventStream struct {
+	// closed when the server shuts down
+	closing <-chan struct{}
+}
+
+// Server-Sent Events; browsers reconnect on their own and send Last-Event-ID so nothing is missed
+func (s *eventStream) serve(c *gin.Context) {
+	f, err := parseEventFilter(c)
+	if err != nil {
+		fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("lastEventId")
+	}
+
+	sub, replay, gap := Events.subscribe(f, lastID)
+	defer Events.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// nginx would hold the events back otherwise
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// browsers wait this long before reconnecting
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+	if gap {
+		// missed events are gone; the client should read the state again from the REST API
+		fmt.Fprint(c.Writer, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range replay {
+		writeEvent(c, e)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			writeEvent(c, e)
+		case <-heartbeat.C:
+			// keeps proxies from closing an idle connection
+			fmt.Fprint(c.Writer, ": ping\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(c *gin.Context, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
@@ -0,0 +1,66 @@
+package webapi
+
+import "testing"
+
+func TestReplayAfterLastID(t *testing.T) {
+	h := NewHub(4)
+	h.Detection(Dios{ID: 1, Duration: 50})
+	h.State(EventDio, "DIO_B", 1)
+	h.Detection(Dios{ID: 2, Duration: 150})
+	h.State(EventDio, "DIO_B", 0)
+
+	first, replay, gap := h.subscribe(eventFilter{}, "")
+	defer h.unsubscribe(first)
+	if gap || len(replay) != 1 || replay[0].Channel != "DIO_B" || replay[0].Data != 0 {
+		t.Fatalf("without Last-Event-ID: %+v gap %v, want the current DIO_B level", replay, gap)
+	}
+
+	lastID := replay[0].ID
+	h.Detection(Dios{ID: 3, Duration: 300})
+	s, replay, gap := h.subscribe(eventFilter{types: list("detection"), minDuration: 100}, lastID)
+	defer h.unsubscribe(s)
+	if gap || len(replay) != 1 || replay[0].Data.(Dios).ID != 3 {
+		t.Errorf("after %s: %+v gap %v, want detection 3", lastID, replay, gap)
+	}
+}
+
+// a noisy AIN fills its own ring; detection clients still get their replay
+func TestRingPerType(t *testing.T) {
+	h := NewHub(4)
+	h.Detection(Dios{ID: 1})
+	lastID := h.recent[EventDetection][0].ID
+
+	h.Detection(Dios{ID: 2})
+	for i := 0; i < 100; i++ {
+		h.State(EventAin, "AIN_A", float64(i))
+	}
+	h.Detection(Dios{ID: 3})
+
+	s, replay, gap := h.subscribe(eventFilter{types: list("detection")}, lastID)
+	h.unsubscribe(s)
+	if gap || len(replay) != 2 || replay[0].Data.(Dios).ID != 2 || replay[1].Data.(Dios).ID != 3 {
+		t.Errorf("detections after the AIN flood: %+v gap %v, want 2 and 3", replay, gap)
+	}
+
+	// the AIN values in between are gone, so clients of every type are told to read the state again
+	s, replay, gap = h.subscribe(eventFilter{}, lastID)
+	h.unsubscribe(s)
+	if !gap || len(replay) != 6 {
+		t.Errorf("all types: %d events gap %v, want 6 and a gap", len(replay), gap)
+	}
+	for i := 1; i < len(replay); i++ {
+		if replay[i-1].seq >= replay[i].seq {
+			t.Errorf("replay out of order: %s before %s", replay[i-1].ID, replay[i].ID)
+		}
+	}
+}
+
+func TestReplayEarlierRun(t *testing.T) {
+	h := NewHub(4)
+	h.Detection(Dios{ID: 1})
+	s, replay, gap := h.subscribe(eventFilter{}, "1-1")
+	defer h.unsubscribe(s)
+	if !gap || len(replay) != 1 {
+		t.Errorf("id of an earlier run: %+v gap %v, want a gap and the kept events", replay, gap)
+	}
+}
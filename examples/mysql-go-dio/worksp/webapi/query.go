@@ -0,0 +1,166 @@
+package webapi
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// format of whattime in the database
+const timeLayout = "2006-01-02 15:04:05"
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// filters of the detection endpoints, all optional:
+// from and to limit whattime, minDuration and maxDuration the duration in milliseconds
+type filter struct {
+	from, to                 time.Time
+	minDuration, maxDuration *float64
+}
+
+func parseFilter(c *gin.Context) (filter, error) {
+	var f filter
+	var err error
+	if s := c.Query("from"); s != "" {
+		if f.from, err = parseTime(s); err != nil {
+			return f, fmt.Errorf("from: %w", err)
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if f.to, err = parseTime(s); err != nil {
+			return f, fmt.Errorf("to: %w", err)
+		}
+	}
+	if !f.from.IsZero() && !f.to.IsZero() && f.to.Before(f.from) {
+		return f, errors.New("to is before from")
+	}
+	if f.minDuration, err = parseNumber(c, "minDuration"); err != nil {
+		return f, err
+	}
+	if f.maxDuration, err = parseNumber(c, "maxDuration"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// accepts RFC 3339 or the format of the database; times without a zone are local
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Local(), nil
+	}
+	for _, layout := range []string{timeLayout, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is no time like 2026-10-18T08:00:00Z or 2026-10-18 08:00:00", s)
+}
+
+func parseNumber(c *gin.Context, name string) (*float64, error) {
+	s := c.Query(name)
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", name)
+	}
+	return &v, nil
+}
+
+// WHERE clause of the filter with its arguments; empty without filters
+func (f filter) where() (string, []any) {
+	where, args := "", []any(nil)
+	if !f.from.IsZero() {
+		where, args = and(where, args, "whattime >= ?", f.from.Format(timeLayout))
+	}
+	if !f.to.IsZero() {
+		where, args = and(where, args, "whattime < ?", f.to.Format(timeLayout))
+	}
+	if f.minDuration != nil {
+		where, args = and(where, args, "duration >= ?", *f.minDuration)
+	}
+	if f.maxDuration != nil {
+		where, args = and(where, args, "duration <= ?", *f.maxDuration)
+	}
+	return where, args
+}
+
+func and(where string, args []any, condition string, arg any) (string, []any) {
+	if where == "" {
+		return " WHERE " + condition, append(args, arg)
+	}
+	return where + " AND " + condition, append(args, arg)
+}
+
+// cursor pagination: the cursor holds the last id of the page before
+type paging struct {
+	limit     int
+	after     int64
+	ascending bool
+}
+
+func parsePaging(c *gin.Context) (paging, error) {
+	p := paging{limit: defaultLimit}
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+		p.limit = n
+	}
+	switch c.DefaultQuery("order", "desc") {
+	case "asc":
+		p.ascending = true
+	case "desc":
+	default:
+		return p, errors.New("order must be asc or desc")
+	}
+	if s := c.Query("cursor"); s != "" {
+		id, err := decodeCursor(s)
+		if err != nil {
+			return p, errors.New("cursor is invalid")
+		}
+		p.after = id
+	}
+	return p, nil
+}
+
+func (p paging) direction() string {
+	if p.ascending {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+func (p paging) comparison() string {
+	if p.ascending {
+		return ">"
+	}
+	return "<"
+}
+
+// opaque to clients so the paging may change without breaking them
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(s string) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := strings.CutPrefix(string(data), "id:")
+	if !ok {
+		return 0, errors.New("no id")
+	}
+	return strconv.ParseInt(id, 10, 64)
+}
@@ -1,96 +1,169 @@
 package webapi
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"tdce-shared/config"
 	"worksp/middleware"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
-// IP whitelist to give access to specific IPs
-// add IP to whitelist to access data
-var IPWhitelist = map[string]bool{
-	"127.0.0.1":     true,
-	"192.168.0.100": true,
+// webapi settings; part of the settings file of the example
+type Settings struct {
+	// address the API listens on; 0.0.0.0:6001 by default
+	Listen string `json:"listen" validate:"required,hostport" help:"address of the web API"`
+	// allows origins from clients specified in slice -> add to list if new services want to communicate
+	AllowOrigins []string `json:"allowOrigins" help:"comma separated origins allowed by CORS"`
+	// IP whitelist to give access to specific IPs or CIDR ranges; applies to every route, empty allows all
+	// add IP to whitelist to access data
+	Whitelist []string `json:"whitelist" help:"comma separated IPs or CIDR ranges allowed to use the API"`
+	// proxies whose X-Forwarded-For is believed; without them the client IP is the peer address
+	TrustedProxies []string `json:"trustedProxies" help:"comma separated IPs or CIDR ranges of reverse proxies"`
+	// which requests need an API key or a bearer token of the device
+	RequireAuth string `json:"requireAuth" validate:"oneof=none writes all" help:"requests needing authentication: none, writes or all"`
+	// sent as X-API-Key or Authorization: Bearer; better referenced from a file
+	APIKeys config.Secret `json:"apiKeys" help:"comma separated API keys"`
+	// accepts the bearer tokens the device REST API issues
+	DeviceTokens bool `json:"deviceTokens" help:"accept bearer tokens of the device"`
+	// requests per second and client; 0 disables the limit
+	RateLimit float64 `json:"rateLimit" validate:"min=0" help:"requests per second per client, 0 disables the limit"`
+	RateBurst int     `json:"rateBurst" validate:"min=0" help:"requests a client may send at once"`
+	// who asked for what as JSON lines; - writes to stdout
+	AuditLog string `json:"auditLog" help:"file of the audit log, - for stdout, empty disables it"`
+	// connections to the database the requests share with the inserts and the health check
+	MaxOpenConns int `json:"maxOpenConns" validate:"min=1" help:"most open connections to the database"`
 }
 
-// runs webapi; capital letter to be public
-func InitializeWebApi() {
-	router := gin.Default()
-
-	// apply CORS
-	config := cors.DefaultConfig()
-	// allows origins from clients specofoed in slice -> add to list is new services want to communicate
-	config.AllowOrigins = []string{"http://192.168.0.100:8201", "http://localhost:8201"}
-	router.Use(cors.New(config))
-
-	router.GET("/api/v1/detection", getDios)
-
-	// security; will not show API values if the IP isn't whitelisted
-	restrictedPage := router.Group("/")
-	restrictedPage.Use(middleware.IPWhiteList(IPWhitelist))
-
-	// 0.0.0.0:6001
-	err := router.Run(":6001")
-	if err != nil {
-		panic("[Error] failed to start Gin server due to: " + err.Error())
+func (s *Settings) Validate() error {
+	if _, err := middleware.ParseNetworks(s.Whitelist); err != nil {
+		return fmt.Errorf("webapi.whitelist: %w", err)
+	}
+	if _, err := middleware.ParseNetworks(s.TrustedProxies); err != nil {
+		return fmt.Errorf("webapi.trustedProxies: %w", err)
 	}
+	if s.RequireAuth != middleware.AuthNone && s.APIKeys.Value() == "" && !s.DeviceTokens {
+		return fmt.Errorf("webapi.requireAuth: %s needs apiKeys or deviceTokens", s.RequireAuth)
+	}
+	return nil
 }
 
-// dios json struct
-type Dios struct {
-	ID       int64  `json:"id"`
-	Duration string `json:"duration"`
-	WhatTime string `json:"whattime"`
+func (s *Settings) apiKeys() []string {
+	var keys []string
+	for _, k := range strings.Split(s.APIKeys.Value(), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
 }
 
-// fetches dios in Dios format
-func fetchDios() ([]Dios, error) {
-	var db *sql.DB
-	var err error
-	var dios []Dios
-
-	db, err = sql.Open("mysql", "root:TDC_arch2023@tcp(192.168.0.100:3306)/diobase")
-	if err != nil {
-		return nil, fmt.Errorf("dios %q", err)
+// pool of connections to the database; shared with the caller of InitializeWebApi
+var db *sql.DB
+
+// runs webapi until ctx is cancelled; capital letter to be public
+// verify checks bearer tokens of the device when settings.DeviceTokens is set
+// database stays open when the server stops; the caller closes it
+func InitializeWebApi(ctx context.Context, settings Settings, database *sql.DB, verify middleware.TokenVerifier) error {
+	db = database
+
+	audit := io.Discard
+	switch settings.AuditLog {
+	case "":
+	case "-":
+		audit = os.Stdout
+	default:
+		f, err := os.OpenFile(settings.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return fmt.Errorf("opening audit log: %w", err)
+		}
+		defer f.Close()
+		audit = f
 	}
-	defer db.Close()
 
-	// fetches all dios
-	rows, err := db.Query("SELECT * FROM dios;")
+	// event streams never finish on their own, so they are ended when the shutdown starts
+	closing := make(chan struct{})
+	router, err := newRouter(settings, verify, audit, closing)
 	if err != nil {
-		return nil, fmt.Errorf("dios %q", err)
+		return err
 	}
-	defer rows.Close()
 
-	// looping through rows; using scan to assign column data to struct fields
-	for rows.Next() {
-		var di Dios
-		if err := rows.Scan(&di.ID, &di.Duration, &di.WhatTime); err != nil {
-			return nil, fmt.Errorf("dios %q", err)
-		}
-		dios = append(dios, di)
+	// running requests are finished before the server stops
+	srv := &http.Server{Addr: settings.Listen, Handler: router}
+	srv.RegisterOnShutdown(func() { close(closing) })
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	err = srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
+	return fmt.Errorf("failed to start Gin server due to: %w", err)
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("dios %q", err)
+// every route goes through the access checks: audit log, whitelist, rate limit and authentication
+// closing ends the event streams of this router
+func newRouter(settings Settings, verify middleware.TokenVerifier, audit io.Writer, closing <-chan struct{}) (*gin.Engine, error) {
+	whitelist, err := middleware.ParseNetworks(settings.Whitelist)
+	if err != nil {
+		return nil, err
+	}
+	router := gin.Default()
+	// X-Forwarded-For is only believed from these; gin trusts every proxy otherwise
+	if err := router.SetTrustedProxies(settings.TrustedProxies); err != nil {
+		return nil, err
 	}
 
-	return dios, nil
-}
+	// apply CORS; first, so preflights are answered without credentials and the GUI can read the errors below
+	config := cors.DefaultConfig()
+	config.AllowOrigins = settings.AllowOrigins
+	config.AddAllowHeaders("Authorization", "X-API-Key")
+	router.Use(cors.New(config))
 
-// get all dios from database
-func getDios(c *gin.Context) {
-	dios, err := fetchDios()
-	if err != nil {
-		log.Fatal(err)
+	router.Use(middleware.Audit(audit))
+	// security; will not show API values if the IP isn't whitelisted
+	router.Use(middleware.IPWhiteList(whitelist))
+	if settings.RateLimit > 0 {
+		router.Use(middleware.RateLimit(settings.RateLimit, settings.RateBurst))
 	}
+	auth := &middleware.Auth{Require: settings.RequireAuth, Keys: settings.apiKeys()}
+	if settings.DeviceTokens {
+		auth.Verify = verify
+	}
+	router.Use(middleware.RequireAuth(auth))
+
+	// the GUI reads all detections as one array
+	router.GET("/api/v1/detection", getDios)
+
+	// filters: from, to (RFC 3339 or 2026-10-18 08:00:00), minDuration, maxDuration (ms)
+	// list pages with limit (max 1000), order (asc or desc) and the nextCursor of the page before
+	// aggregate groups by interval=hour or day; export sends CSV
+	api := router.Group("/api/v1/detections")
+	api.GET("", listDios)
+	api.GET("/:id", getDio)
+	api.GET("/aggregate", aggregateDios)
+	api.GET("/export", exportDios)
+
+	// live push: new detections and DIO/AIN states as Server-Sent Events
+	// filters: types=detection,dio,ain channels=DIO_B,AIN_A minDuration=100; missed events are replayed after Last-Event-ID
+	router.GET("/api/v1/events", (&eventStream{closing: closing}).serve)
+
+	// deleting needs authentication unless requireAuth is none; retention with olderThan=720h or before=<time>
+	api.DELETE("/:id", deleteDio)
+	api.DELETE("", purgeDios)
 
-	// show in JSON format
-	c.JSON(http.StatusOK, dios)
+	return router, nil
 }
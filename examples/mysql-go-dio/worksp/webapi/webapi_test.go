@@ -0,0 +1,184 @@
+package webapi
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "github.com/go-sql-driver/mysql"
+	"tdce-shared/config"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	// nothing listens on port 1, so the handlers fail fast with a database error
+	var err error
+	db, err = sql.Open("mysql", "dio:dio@tcp(127.0.0.1:1)/diobase?timeout=1s")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func testSettings() Settings {
+	return Settings{
+		AllowOrigins: []string{"http://localhost:8201"},
+		Whitelist:    []string{"127.0.0.1", "192.168.0.0/24"},
+		RequireAuth:  "none",
+		MaxOpenConns: 1,
+	}
+}
+
+func testRouter(t *testing.T, settings Settings) *gin.Engine {
+	t.Helper()
+	router, err := newRouter(settings, nil, io.Discard, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+// sends a request from remoteAddr; the event stream ends right after its headers
+func serve(router *gin.Engine, method, path, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(method, path, nil).WithContext(ctx)
+	req.RemoteAddr = remoteAddr
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// every registered route with :id filled in
+func routes(router *gin.Engine) [][2]string {
+	var list [][2]string
+	for _, r := range router.Routes() {
+		list = append(list, [2]string{r.Method, strings.ReplaceAll(r.Path, ":id", "1")})
+	}
+	return list
+}
+
+func TestWhitelistDenies(t *testing.T) {
+	router := testRouter(t, testSettings())
+	list := routes(router)
+	if len(list) < 8 {
+		t.Fatalf("only %d routes registered", len(list))
+	}
+	for _, r := range list {
+		w := serve(router, r[0], r[1], "10.1.2.3:40000", nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s from 10.1.2.3: %d, want 403", r[0], r[1], w.Code)
+		}
+	}
+}
+
+func TestWhitelistAllows(t *testing.T) {
+	router := testRouter(t, testSettings())
+	for _, addr := range []string{"127.0.0.1:40000", "192.168.0.7:40000"} {
+		for _, r := range routes(router) {
+			w := serve(router, r[0], r[1], addr, nil)
+			if w.Code == http.StatusForbidden {
+				t.Errorf("%s %s from %s: 403, want it to pass the whitelist", r[0], r[1], addr)
+			}
+		}
+	}
+	w := serve(router, http.MethodGet, "/api/v1/events", "192.168.0.7:40000", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("events: %d %q, want the stream", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	spoofed := http.Header{"X-Forwarded-For": {"127.0.0.1"}}
+
+	// from a client that isn't a trusted proxy the header is ignored
+	router := testRouter(t, testSettings())
+	for _, path := range []string{"/api/v1/detections", "/api/v1/events"} {
+		if w := serve(router, http.MethodGet, path, "10.1.2.3:40000", spoofed); w.Code != http.StatusForbidden {
+			t.Errorf("%s with spoofed X-Forwarded-For: %d, want 403", path, w.Code)
+		}
+	}
+
+	// behind a trusted proxy the client it names is checked
+	settings := testSettings()
+	settings.TrustedProxies = []string{"10.1.2.3"}
+	router = testRouter(t, settings)
+	if w := serve(router, http.MethodGet, "/api/v1/events", "10.1.2.3:40000", spoofed); w.Code != http.StatusOK {
+		t.Errorf("X-Forwarded-For from a trusted proxy: %d, want 200", w.Code)
+	}
+	outside := http.Header{"X-Forwarded-For": {"10.9.9.9"}}
+	if w := serve(router, http.MethodGet, "/api/v1/events", "10.1.2.3:40000", outside); w.Code != http.StatusForbidden {
+		t.Errorf("trusted proxy forwarding 10.9.9.9: %d, want 403", w.Code)
+	}
+}
+
+func TestCORSBeforeAuth(t *testing.T) {
+	settings := testSettings()
+	settings.RequireAuth = "all"
+	settings.APIKeys = config.NewSecret("secret")
+	router := testRouter(t, settings)
+	origin := "http://localhost:8201"
+
+	// preflights carry no credentials and must not need them
+	w := serve(router, http.MethodOptions, "/api/v1/detections/1", "127.0.0.1:40000", http.Header{
+		"Origin":                         {origin},
+		"Access-Control-Request-Method":  {http.MethodDelete},
+		"Access-Control-Request-Headers": {"X-API-Key"},
+	})
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != origin {
+		t.Errorf("preflight: %d, Access-Control-Allow-Origin %q; want 204 for %s", w.Code, w.Header().Get("Access-Control-Allow-Origin"), origin)
+	}
+
+	// the GUI can read the errors
+	for _, c := range []struct {
+		addr string
+		want int
+	}{{"127.0.0.1:40000", http.StatusUnauthorized}, {"10.1.2.3:40000", http.StatusForbidden}} {
+		w := serve(router, http.MethodGet, "/api/v1/detections", c.addr, http.Header{"Origin": {origin}})
+		if w.Code != c.want || w.Header().Get("Access-Control-Allow-Origin") != origin {
+			t.Errorf("from %s: %d, Access-Control-Allow-Origin %q; want %d with the origin", c.addr, w.Code, w.Header().Get("Access-Control-Allow-Origin"), c.want)
+		}
+	}
+}
+
+// the shutdown of one server ends its own event streams, not the ones of another
+func TestClosingEndsOwnStreams(t *testing.T) {
+	stream := func(closing chan struct{}) chan struct{} {
+		router, err := newRouter(testSettings(), nil, io.Discard, closing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events", nil)
+			req.RemoteAddr = "127.0.0.1:40000"
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		return done
+	}
+	closingA, closingB := make(chan struct{}), make(chan struct{})
+	doneA, doneB := stream(closingA), stream(closingB)
+
+	close(closingA)
+	select {
+	case <-doneA:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not ended by the shutdown of its server")
+	}
+	select {
+	case <-doneB:
+		t.Error("stream ended by the shutdown of another server")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(closingB)
+	<-doneB
+}
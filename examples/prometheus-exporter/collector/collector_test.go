@@ -0,0 +1,193 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tdce-shared/modem"
+	"tdce-shared/tdce"
+)
+
+/* Fake device API: the DIO/AIN REST API and the device manager modem endpoints with canned answers */
+/* Paths in failing answer 500 */
+func fakeDevice(t *testing.T, failing ...string) *httptest.Server {
+	t.Helper()
+	responses := map[string]string{
+		"POST /user/Service/token":              `{"token": "test-token"}`,
+		"GET /tdce/dio/GetState/DIO_A":          `{"DioName": "DIO_A", "Value": 1, "Direction": "Output"}`,
+		"GET /tdce/dio/GetState/DIO_B":          `{"DioName": "DIO_B", "Value": 0, "Direction": "Input"}`,
+		"GET /tdce/analog-inputs/GetValues":     `[{"AinName": "AIN_A", "Value": 4.02}, {"AinName": "AIN_B", "Value": 12.5}]`,
+		"GET /networking/modem/ppp0/details":    `{"operatorName": "HT HR", "dataLinkType": "LTE", "accessTechnology": "E-UTRAN", "simStatus": "READY", "gsmRegistrationStatus": "registered", "utranRegistrationStatus": "registered", "rssi": -71}`,
+		"GET /networking/modem/ppp0/statistics": `{"name": "ppp0", "packetsSent": 120, "packetsReceived": 140, "bytesSent": 10240, "bytesReceived": 20480, "errorsRx": 1, "errorsTx": 2, "droppedRx": 3, "droppedTx": 4}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range failing {
+			if r.URL.Path == path {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+		body, ok := responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestIO(srv *httptest.Server) *IO {
+	return NewIO(tdce.NewClient(srv.URL, "servicelevel"), []string{"DIO_A", "DIO_B"})
+}
+
+func newTestModem(srv *httptest.Server) *Modem {
+	return NewModem(&modem.Client{API: srv.Client(), BaseURL: srv.URL})
+}
+
+func TestIO(t *testing.T) {
+	expected := `
+# HELP tdce_ain_up Whether the analog inputs could be read.
+# TYPE tdce_ain_up gauge
+tdce_ain_up 1
+# HELP tdce_ain_value Analog input value.
+# TYPE tdce_ain_value gauge
+tdce_ain_value{ain="AIN_A"} 4.02
+tdce_ain_value{ain="AIN_B"} 12.5
+# HELP tdce_dio_state DIO state, 1 is high.
+# TYPE tdce_dio_state gauge
+tdce_dio_state{dio="DIO_A",direction="Output"} 1
+tdce_dio_state{dio="DIO_B",direction="Input"} 0
+# HELP tdce_dio_up Whether the DIO states could be read.
+# TYPE tdce_dio_up gauge
+tdce_dio_up 1
+`
+	if err := testutil.CollectAndCompare(newTestIO(fakeDevice(t)), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+/* A DIO that can't be read is left out and marks the DIOs down; failing AINs leave only ain_up 0 */
+func TestIODown(t *testing.T) {
+	expected := `
+# HELP tdce_ain_up Whether the analog inputs could be read.
+# TYPE tdce_ain_up gauge
+tdce_ain_up 0
+# HELP tdce_dio_state DIO state, 1 is high.
+# TYPE tdce_dio_state gauge
+tdce_dio_state{dio="DIO_A",direction="Output"} 1
+# HELP tdce_dio_up Whether the DIO states could be read.
+# TYPE tdce_dio_up gauge
+tdce_dio_up 0
+`
+	srv := fakeDevice(t, "/tdce/dio/GetState/DIO_B", "/tdce/analog-inputs/GetValues")
+	if err := testutil.CollectAndCompare(newTestIO(srv), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+/* Without a token nothing can be read */
+func TestIOTokenFails(t *testing.T) {
+	expected := `
+# HELP tdce_ain_up Whether the analog inputs could be read.
+# TYPE tdce_ain_up gauge
+tdce_ain_up 0
+# HELP tdce_dio_up Whether the DIO states could be read.
+# TYPE tdce_dio_up gauge
+tdce_dio_up 0
+`
+	srv := fakeDevice(t, "/user/Service/token")
+	if err := testutil.CollectAndCompare(newTestIO(srv), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+/* SetDios changes the reported DIOs */
+func TestIOSetDios(t *testing.T) {
+	io := newTestIO(fakeDevice(t))
+	io.SetDios([]string{"DIO_B"})
+	expected := `
+# HELP tdce_dio_state DIO state, 1 is high.
+# TYPE tdce_dio_state gauge
+tdce_dio_state{dio="DIO_B",direction="Input"} 0
+`
+	if err := testutil.CollectAndCompare(io, strings.NewReader(expected), "tdce_dio_state"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestModem(t *testing.T) {
+	expected := `
+# HELP tdce_modem_dropped_packets_total Dropped packets since the link came up.
+# TYPE tdce_modem_dropped_packets_total counter
+tdce_modem_dropped_packets_total{direction="rx"} 3
+tdce_modem_dropped_packets_total{direction="tx"} 4
+# HELP tdce_modem_errors_total Receive and transmit errors since the link came up.
+# TYPE tdce_modem_errors_total counter
+tdce_modem_errors_total{direction="rx"} 1
+tdce_modem_errors_total{direction="tx"} 2
+# HELP tdce_modem_info Modem link information; the value is always 1.
+# TYPE tdce_modem_info gauge
+tdce_modem_info{access_technology="E-UTRAN",data_link_type="LTE",gsm_registration="registered",operator="HT HR",sim_status="READY",utran_registration="registered"} 1
+# HELP tdce_modem_received_bytes_total Bytes received since the link came up.
+# TYPE tdce_modem_received_bytes_total counter
+tdce_modem_received_bytes_total 20480
+# HELP tdce_modem_received_packets_total Packets received since the link came up.
+# TYPE tdce_modem_received_packets_total counter
+tdce_modem_received_packets_total 140
+# HELP tdce_modem_rssi Signal strength as reported by the modem.
+# TYPE tdce_modem_rssi gauge
+tdce_modem_rssi -71
+# HELP tdce_modem_sent_bytes_total Bytes sent since the link came up.
+# TYPE tdce_modem_sent_bytes_total counter
+tdce_modem_sent_bytes_total 10240
+# HELP tdce_modem_sent_packets_total Packets sent since the link came up.
+# TYPE tdce_modem_sent_packets_total counter
+tdce_modem_sent_packets_total 120
+# HELP tdce_modem_up Whether the modem data could be read.
+# TYPE tdce_modem_up gauge
+tdce_modem_up 1
+`
+	if err := testutil.CollectAndCompare(newTestModem(fakeDevice(t)), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+/* Failing details leave only modem_up 0; details without statistics still give RSSI and info */
+func TestModemDown(t *testing.T) {
+	tests := []struct {
+		name     string
+		failing  string
+		expected string
+	}{
+		{"details fail", "/networking/modem/ppp0/details", `
+# HELP tdce_modem_up Whether the modem data could be read.
+# TYPE tdce_modem_up gauge
+tdce_modem_up 0
+`},
+		{"statistics fail", "/networking/modem/ppp0/statistics", `
+# HELP tdce_modem_info Modem link information; the value is always 1.
+# TYPE tdce_modem_info gauge
+tdce_modem_info{access_technology="E-UTRAN",data_link_type="LTE",gsm_registration="registered",operator="HT HR",sim_status="READY",utran_registration="registered"} 1
+# HELP tdce_modem_rssi Signal strength as reported by the modem.
+# TYPE tdce_modem_rssi gauge
+tdce_modem_rssi -71
+# HELP tdce_modem_up Whether the modem data could be read.
+# TYPE tdce_modem_up gauge
+tdce_modem_up 0
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeDevice(t, tt.failing)
+			if err := testutil.CollectAndCompare(newTestModem(srv), strings.NewReader(tt.expected)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
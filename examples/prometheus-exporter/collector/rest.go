@@ -0,0 +1,154 @@
+/* Package created 18.10.2026. */
+/* Collectors that query the device when Prometheus scrapes */
+
+package collector
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"tdce-shared/metrics"
+	"tdce-shared/modem"
+	"tdce-shared/tdce"
+)
+
+/* Time a scrape may spend on one device API */
+const scrapeTimeout = 5 * time.Second
+
+func desc(subsystem, name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, subsystem, name), help, labels, nil)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/* Modem details and statistics from the device manager API */
+type Modem struct {
+	Client *modem.Client
+
+	up, rssi, info                                    *prometheus.Desc
+	bytesSent, bytesReceived, packetsSent, packetsRcv *prometheus.Desc
+	errors, dropped                                   *prometheus.Desc
+}
+
+func NewModem(client *modem.Client) *Modem {
+	return &Modem{
+		Client:        client,
+		up:            desc("modem", "up", "Whether the modem data could be read."),
+		rssi:          desc("modem", "rssi", "Signal strength as reported by the modem."),
+		info:          desc("modem", "info", "Modem link information; the value is always 1.", "operator", "data_link_type", "access_technology", "sim_status", "gsm_registration", "utran_registration"),
+		bytesSent:     desc("modem", "sent_bytes_total", "Bytes sent since the link came up."),
+		bytesReceived: desc("modem", "received_bytes_total", "Bytes received since the link came up."),
+		packetsSent:   desc("modem", "sent_packets_total", "Packets sent since the link came up."),
+		packetsRcv:    desc("modem", "received_packets_total", "Packets received since the link came up."),
+		errors:        desc("modem", "errors_total", "Receive and transmit errors since the link came up.", "direction"),
+		dropped:       desc("modem", "dropped_packets_total", "Dropped packets since the link came up.", "direction"),
+	}
+}
+
+func (c *Modem) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.up, c.rssi, c.info, c.bytesSent, c.bytesReceived, c.packetsSent, c.packetsRcv, c.errors, c.dropped} {
+		ch <- d
+	}
+}
+
+func (c *Modem) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	details, err := c.Client.Details(ctx)
+	if err == nil {
+		var stats modem.Statistics
+		stats, err = c.Client.Statistics(ctx)
+		if err == nil {
+			ch <- prometheus.MustNewConstMetric(c.bytesSent, prometheus.CounterValue, float64(stats.BytesSent))
+			ch <- prometheus.MustNewConstMetric(c.bytesReceived, prometheus.CounterValue, float64(stats.BytesReceived))
+			ch <- prometheus.MustNewConstMetric(c.packetsSent, prometheus.CounterValue, float64(stats.PacketsSent))
+			ch <- prometheus.MustNewConstMetric(c.packetsRcv, prometheus.CounterValue, float64(stats.PacketsReceived))
+			ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(stats.ErrorsRx), "rx")
+			ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(stats.ErrorsTx), "tx")
+			ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.DroppedRx), "rx")
+			ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.DroppedTx), "tx")
+		}
+		ch <- prometheus.MustNewConstMetric(c.rssi, prometheus.GaugeValue, float64(details.Rssi))
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1,
+			details.OperatorName, details.DataLinkType, details.AccessTechnology, details.SimStatus,
+			details.GsmRegistrationStatus, details.UtranRegistrationStatus)
+	}
+	if err != nil {
+		log.Println("Error reading modem: ", err)
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, boolValue(err == nil))
+}
+
+/* DIO states and AIN values from the device REST API */
+type IO struct {
+	Device *tdce.Client
+
+	mu   sync.Mutex
+	dios []string
+
+	dioUp, dio, ainUp, ain *prometheus.Desc
+}
+
+func NewIO(device *tdce.Client, dios []string) *IO {
+	return &IO{
+		Device: device,
+		dios:   dios,
+		dioUp:  desc("dio", "up", "Whether the DIO states could be read."),
+		dio:    desc("dio", "state", "DIO state, 1 is high.", "dio", "direction"),
+		ainUp:  desc("ain", "up", "Whether the analog inputs could be read."),
+		ain:    desc("ain", "value", "Analog input value.", "ain"),
+	}
+}
+
+/* Changes the reported DIOs, e.g. after the settings were reloaded */
+func (c *IO) SetDios(dios []string) {
+	c.mu.Lock()
+	c.dios = dios
+	c.mu.Unlock()
+}
+
+func (c *IO) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.dioUp
+	ch <- c.dio
+	ch <- c.ainUp
+	ch <- c.ain
+}
+
+func (c *IO) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	dios := c.dios
+	c.mu.Unlock()
+
+	dioOk := true
+	for _, name := range dios {
+		dio, err := c.Device.GetDIO(ctx, name)
+		if err != nil {
+			log.Printf("Error reading %s: %v\n", name, err)
+			dioOk = false
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.dio, prometheus.GaugeValue, float64(dio.Value), name, dio.Direction)
+	}
+	ch <- prometheus.MustNewConstMetric(c.dioUp, prometheus.GaugeValue, boolValue(dioOk))
+
+	values, err := c.Device.AnalogValues(ctx)
+	if err != nil {
+		log.Println("Error reading analog inputs: ", err)
+	}
+	for _, v := range values {
+		ch <- prometheus.MustNewConstMetric(c.ain, prometheus.GaugeValue, v.Value, v.AinName)
+	}
+	ch <- prometheus.MustNewConstMetric(c.ainUp, prometheus.GaugeValue, boolValue(err == nil))
+}
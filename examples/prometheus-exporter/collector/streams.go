@@ -0,0 +1,146 @@
+/* Package created 18.10.2026. */
+/* Collectors fed by the WebSocket streams; they report the latest data received */
+
+package collector
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
+)
+
+/* Latest GNSS position from /ws/tdce/gps/data */
+type Gps struct {
+	mu       sync.Mutex
+	latest   tdce.GpsData
+	received time.Time
+
+	connected, lastUpdate, fix, hdop, satellites, latitude, longitude, altitude, speed *prometheus.Desc
+
+	stream *wsclient.Client
+}
+
+func NewGps() *Gps {
+	return &Gps{
+		connected:  desc("gps", "stream_connected", "Whether the GPS WebSocket is connected."),
+		lastUpdate: desc("gps", "last_update_timestamp_seconds", "Time the last position was received."),
+		fix:        desc("gps", "fix", "Fix type; 0 is no fix, 1 the best fix."),
+		hdop:       desc("gps", "hdop", "Horizontal dilution of precision."),
+		satellites: desc("gps", "satellites", "Satellites used for the fix."),
+		latitude:   desc("gps", "latitude_degrees", "Latitude."),
+		longitude:  desc("gps", "longitude_degrees", "Longitude."),
+		altitude:   desc("gps", "altitude_meters", "Altitude."),
+		speed:      desc("gps", "speed_knots", "Speed over ground."),
+	}
+}
+
+/* Consumes the GPS stream of the device at host until ctx is cancelled */
+func (c *Gps) Run(ctx context.Context, host string) {
+	client, stream := wsclient.Subscribe[tdce.GpsData](ctx, wsclient.Config{URL: wsclient.URL(host, wsclient.GpsData)})
+	c.mu.Lock()
+	c.stream = client
+	c.mu.Unlock()
+
+	for pos := range stream {
+		c.mu.Lock()
+		c.latest = pos
+		c.received = time.Now()
+		c.mu.Unlock()
+	}
+}
+
+func (c *Gps) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.connected, c.lastUpdate, c.fix, c.hdop, c.satellites, c.latitude, c.longitude, c.altitude, c.speed} {
+		ch <- d
+	}
+}
+
+func (c *Gps) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.connected, prometheus.GaugeValue, boolValue(c.stream != nil && c.stream.Connected()))
+	if c.received.IsZero() {
+		return
+	}
+	pos := c.latest
+	ch <- prometheus.MustNewConstMetric(c.lastUpdate, prometheus.GaugeValue, float64(c.received.UnixNano())/1e9)
+	ch <- prometheus.MustNewConstMetric(c.fix, prometheus.GaugeValue, float64(pos.Fix))
+	ch <- prometheus.MustNewConstMetric(c.hdop, prometheus.GaugeValue, float64(pos.Hdop))
+	ch <- prometheus.MustNewConstMetric(c.satellites, prometheus.GaugeValue, float64(pos.NumberOfSatellites))
+	if pos.Fix != 0 {
+		ch <- prometheus.MustNewConstMetric(c.latitude, prometheus.GaugeValue, float64(pos.Latitude))
+		ch <- prometheus.MustNewConstMetric(c.longitude, prometheus.GaugeValue, float64(pos.Longitude))
+		ch <- prometheus.MustNewConstMetric(c.altitude, prometheus.GaugeValue, float64(pos.Altitude))
+		ch <- prometheus.MustNewConstMetric(c.speed, prometheus.GaugeValue, float64(pos.SpeedKnots))
+	}
+}
+
+/* Temperatures from /ws/tdce/onewire/data */
+type OneWire struct {
+	mu      sync.Mutex
+	devices map[string]oneWireReading
+
+	connected, temperature, lastSeen *prometheus.Desc
+
+	stream *wsclient.Client
+}
+
+type oneWireReading struct {
+	family      string
+	temperature float64
+	received    time.Time
+}
+
+func NewOneWire() *OneWire {
+	return &OneWire{
+		devices:     map[string]oneWireReading{},
+		connected:   desc("onewire", "stream_connected", "Whether the 1-Wire WebSocket is connected."),
+		temperature: desc("onewire", "temperature_celsius", "Temperature reported by a 1-Wire sensor.", "id", "family"),
+		lastSeen:    desc("onewire", "last_update_timestamp_seconds", "Time the last reading of a sensor was received.", "id", "family"),
+	}
+}
+
+/* Consumes the 1-Wire stream of the device at host until ctx is cancelled */
+func (c *OneWire) Run(ctx context.Context, host string) {
+	client, stream := wsclient.Subscribe[[]tdce.OneWireDevice](ctx, wsclient.Config{URL: wsclient.URL(host, wsclient.OneWireData)})
+	c.mu.Lock()
+	c.stream = client
+	c.mu.Unlock()
+
+	for devices := range stream {
+		now := time.Now()
+		c.mu.Lock()
+		for _, d := range devices {
+			/* Only temperature sensors report a number */
+			temp, err := strconv.ParseFloat(d.DeviceDetails, 64)
+			if err != nil {
+				continue
+			}
+			c.devices[d.IdAsString] = oneWireReading{family: d.FamilyAsString, temperature: temp, received: now}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *OneWire) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connected
+	ch <- c.temperature
+	ch <- c.lastSeen
+}
+
+func (c *OneWire) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.connected, prometheus.GaugeValue, boolValue(c.stream != nil && c.stream.Connected()))
+	for id, r := range c.devices {
+		ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, r.temperature, id, r.family)
+		ch <- prometheus.MustNewConstMetric(c.lastSeen, prometheus.GaugeValue, float64(r.received.UnixNano())/1e9, id, r.family)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"exporter/collector"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tdce-shared/config"
+	"tdce-shared/metrics"
+	"tdce-shared/modem"
+	"tdce-shared/ropc"
+	"tdce-shared/tdce"
+)
+
+/* Settings read from config.yaml, EXPORTER_* environment variables and flags */
+/* The reported DIOs are applied on SIGHUP, the other settings after a restart */
+/* Every device address can be changed, so the exporter can also be pointed at a fake device API */
+type settings struct {
+	Listen     string        `json:"listen" validate:"required,hostport" help:"address of the /metrics endpoint"`
+	Device     string        `json:"device" validate:"required,url" help:"base URL of the DIO/AIN REST API"`
+	Password   config.Secret `json:"password" validate:"required" help:"password of the DIO/AIN REST API"`
+	API        string        `json:"api" validate:"required,url" help:"base URL of the device manager API"`
+	WebSocket  string        `json:"ws" validate:"required,hostport" help:"host of the WebSocket streams"`
+	ParamsFile string        `json:"params" help:"file with the OAuth2.0 settings of the device manager API"`
+	Dios       []string      `json:"dios" reload:"true" help:"comma separated DIOs to report"`
+}
+
+var defaults = settings{
+	Listen:     ":9108",
+	Device:     tdce.DefaultBaseURL,
+	Password:   config.NewSecret("servicelevel"),
+	API:        modem.DefaultAPI,
+	WebSocket:  "192.168.0.100:31768",
+	ParamsFile: "params.json",
+	Dios:       []string{"DIO_A", "DIO_B", "DIO_C", "DIO_D"},
+}
+
+/* Exposes TDC-E telemetry on /metrics */
+func main() {
+	conf := config.NewStore(defaults, config.Options{
+		Name:      "exporter",
+		File:      "config.yaml",
+		EnvPrefix: "EXPORTER",
+		Args:      os.Args[1:],
+	})
+	cfg := conf.Get()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reg := metrics.NewRegistry()
+
+	/* Modem data needs the device manager API; without its settings the modem metrics are left out */
+	oauthConf, err := ropc.LoadConfig(cfg.ParamsFile)
+	if err != nil {
+		fmt.Println("Modem metrics disabled: ", err)
+	} else {
+		client := ropc.NewClient(ropc.NewTokenSource(oauthConf))
+		reg.MustRegister(collector.NewModem(&modem.Client{API: client, BaseURL: cfg.API}))
+	}
+
+	io := collector.NewIO(tdce.NewClient(cfg.Device, cfg.Password.Value()), cfg.Dios)
+	reg.MustRegister(io)
+	go conf.WatchSIGHUP(ctx, func(cfg *settings) { io.SetDios(cfg.Dios) })
+
+	gps := collector.NewGps()
+	go gps.Run(ctx, cfg.WebSocket)
+	reg.MustRegister(gps)
+
+	oneWire := collector.NewOneWire()
+	go oneWire.Run(ctx, cfg.WebSocket)
+	reg.MustRegister(oneWire)
+
+	fmt.Printf("Serving metrics on %s/metrics\n", cfg.Listen)
+	if err := metrics.Serve(ctx, cfg.Listen, reg); err != nil && ctx.Err() == nil {
+		fmt.Println("Error: ", err)
+	}
+}
@@ -1,67 +1,50 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
-	"sync"
+	"syscall"
 
-	websocket "websocket-1wire/websockets"
+	"tdce-shared/config"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
 )
 
-type Wire1 struct {
-	Family         interface{} `json:"Family"`
-	FamilyAsString string      `json:"FamilyAsString"`
-	FullPath       string      `json:"FullPath"`
-	Id             interface{} `json:"Id"`
-	IdAsString     string      `json:"IdAsString"`
-	LastSeenTime   string      `json:"LastSeenTime"`
-	DeviceDetails  string      `json:"DeviceDetails"`
+/* Settings read from config.yaml, ONEWIRE_* environment variables and flags */
+type settings struct {
+	WebSocket string `json:"websocket" validate:"required,hostport" help:"host:port of the device websocket"`
 }
 
 func main() {
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	// Goroutine for fetching 1wire data
-	go func() {
-		defer wg.Done()
-
-		conn, err := websocket.OpenWebsocket("ws", "192.168.0.100:31768", "/ws/tdce/onewire/data")
-		if err != nil {
-			fmt.Println("Error opening websocket: ", err)
-			return
-		}
-		defer conn.Close()
-
-		for {
-			msg, err := websocket.ListenOnWS(conn)
+	cfg := config.NewStore(settings{WebSocket: "192.168.0.100:31768"}, config.Options{
+		Name:      "websocket-1wire",
+		File:      "config.yaml",
+		EnvPrefix: "ONEWIRE",
+		Args:      os.Args[1:],
+	}).Get()
+
+	/* The client reconnects on its own; Ctrl-C closes the websocket cleanly */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ws := wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.OneWireData)}
+	_, stream := wsclient.Subscribe[[]tdce.OneWireDevice](ctx, ws)
+
+	/* 1wire objects */
+	for wire1 := range stream {
+		for _, item := range wire1 {
+			fmt.Printf("Received object: %+v\n", item)
+
+			/* Parsed in case of working with temperature */
+			temp, err := strconv.ParseFloat(item.DeviceDetails, 32)
 			if err != nil {
-				fmt.Println("Error fetching data: ", err)
-				return
-			}
-
-			/* 1wire object */
-			var wire1 []Wire1
-			err = json.Unmarshal(msg, &wire1)
-			if err != nil {
-				fmt.Println("Error decoding JSON: ", err)
-				return
-			}
-
-			for _, item := range wire1 {
-				fmt.Printf("Received object: %+v\n", item)
-
-				/* Parsed in case of working with temperature */
-				temp, err := strconv.ParseFloat(item.DeviceDetails, 32)
-				if err != nil {
-					fmt.Println("Error parsing: ", err)
-					continue
-				}
-				fmt.Printf("Temperature: %f\n", temp)
+				fmt.Println("Error parsing: ", err)
+				continue
 			}
+			fmt.Printf("Temperature: %f\n", temp)
 		}
-	}()
-
-	wg.Wait()
+	}
 }
@@ -4,82 +4,96 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
-	"strconv"
-	"strings"
+	"os"
 	"time"
+
+	"tdce-shared/ain"
+	"tdce-shared/config"
 )
 
-func execute(cmd string) float64 {
-	out, err := exec.Command("sh", "-c", cmd).Output()
-	if err != nil {
-		fmt.Printf("%s", err)
-		return 0
-	}
-	output := string(out)
+/* Settings read from config.yaml, AIN_* environment variables and flags, e.g. -channel 0 -mode voltage */
+type settings struct {
+	Root   string `json:"root" validate:"required" help:"IIO sysfs root; point it to a copy of the tree to test without the device"`
+	Device string `json:"device" validate:"required" help:"IIO device of the analog inputs"`
+	/* for AIN F */
+	Channel int `json:"channel" validate:"min=0" help:"N of in_voltageN_raw"`
+	/* set current or voltage here */
+	Mode string `json:"mode" validate:"oneof=current voltage" help:"current or voltage"`
+	/* set if accounting for voltage divisor */
+	Account  bool            `json:"account" help:"apply the ADC correction, the voltage divider and the shunt"`
+	Profiles string          `json:"profiles" help:"JSON file with calibration profiles; replaces channel, mode and account"`
+	Interval config.Duration `json:"interval" help:"time between readings"`
+}
 
-	/* spaces removed */
-	output = strings.TrimSpace(output)
+func defaults() settings {
+	return settings{
+		Root:     ain.DefaultRoot,
+		Device:   ain.DefaultDevice,
+		Channel:  5,
+		Mode:     ain.ModeCurrent,
+		Account:  true,
+		Interval: config.Duration(time.Second),
+	}
+}
 
-	outputFloat, err := strconv.ParseFloat(output, 32)
+/* calibration profiles from a JSON file, see profiles.json; one profile per channel */
+func loadProfiles(path string) ([]ain.Profile, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("Problem parsing: ", err)
+		return nil, err
+	}
+	var profiles []ain.Profile
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
-	return outputFloat
+	return profiles, nil
 }
 
 func main() {
-	/* infinite for loop; sleeps for 5 seconds before getting new value */
-	/* for AIN F */
+	cfg := config.NewStore(defaults(), config.Options{
+		Name:      "ain-direct",
+		File:      "config.yaml",
+		EnvPrefix: "AIN",
+		Args:      os.Args[1:],
+	}).Get()
 
-	/* set current or voltage here */
-	//mode := "voltage"
-	mode := "current"
+	profiles := []ain.Profile{ain.Default("AIN", cfg.Channel, cfg.Mode)}
+	if !cfg.Account {
+		/* value as the driver gives it: raw * scale */
+		profiles = []ain.Profile{{Name: "AIN", Channel: cfg.Channel, Mode: ain.ModeVoltage}}
+	}
+	if cfg.Profiles != "" {
+		var err error
+		if profiles, err = loadProfiles(cfg.Profiles); err != nil {
+			fmt.Println("Problem loading profiles: ", err)
+			os.Exit(1)
+		}
+	}
+	var errs []error
+	for _, p := range profiles {
+		errs = append(errs, p.Validate())
+	}
+	if err := errors.Join(errs...); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	/* set if accounting for voltage divisor */
-	account := true
-	//account := false
+	iio := ain.IIO{Root: cfg.Root, Device: cfg.Device}
 
+	/* infinite for loop; sleeps for the interval before getting new values */
 	for {
-		command := "cat /sys/bus/iio/devices/iio:device1/in_voltage5_raw"
-		raw := execute(command)
-		command2 := "cat /sys/bus/iio/devices/iio:device1/in_voltage5_scale"
-		scale := execute(command2)
-
-		avg_clean := raw * scale
-		err := 0.0059*avg_clean - 0.013
-		avg_comp := avg_clean + err
-
-		switch mode {
-		case "voltage":
-			if account {
-				if avg_comp < 0 {
-					avg_comp = 0
-				}
-				avg_comp = (avg_comp * 27.5) / 7.5
-			}
-			if !account {
-				avg_comp = avg_clean
-			}
-			fmt.Printf("Current voltage: %f\n", avg_comp)
-			break
-
-		case "current":
-			if account {
-				if avg_comp < 0 {
-					avg_comp = 0
-				}
-				avg_comp = (avg_comp * 27.5) / 7.5
-				avg_comp = avg_comp * 1000 / 100.2
-			}
-			if !account {
-				avg_comp = avg_clean
+		for _, p := range profiles {
+			reading, err := iio.Measure(p)
+			if err != nil {
+				fmt.Println("Problem reading: ", err)
+				continue
 			}
-			fmt.Printf("Current: %f\n", avg_comp)
-			break
+			fmt.Printf("%s: %f %s (%s, raw %.0f, %.4f V at the ADC)\n",
+				reading.Name, reading.Value, reading.Unit, reading.Status, reading.Raw, reading.Volts)
 		}
-
-		time.Sleep(1 * time.Second)
+		time.Sleep(time.Duration(cfg.Interval))
 	}
 }
@@ -1,179 +1,87 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/websocket"
+	"tdce-shared/ain"
+	"tdce-shared/config"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
 )
 
-var (
-	token   string
-	anaval  string
-	voltage float64
-)
-
-// creating a structs to show values
-type Analog struct {
-	AinName string `json:"AinName"`
-	State   string `json:"State"`
-}
-
-type AnalogVal struct {
-	AinName string  `json:"AinName"`
-	Value   float64 `json:"Value"`
-}
-
-// for websocket listener object
-type AnalogValueChange struct {
-	AinName       string  `json:"AinName"`
-	PreviousValue float64 `json:"PreviousValue"`
-	NewValue      float64 `json:"NewValue"`
-}
-
-type TokenResponse struct {
-	Token string `json:"token"`
+// settings read from config.yaml, AINWS_* environment variables and flags
+type settings struct {
+	Device string `json:"device" validate:"required,url" help:"base URL of the device REST API"`
+	// for safety, reference the password from a file, e.g. AINWS_PASSWORD_FILE=/run/secrets/tdce_password
+	Password  config.Secret `json:"password" validate:"required" help:"password of the AIN REST API"`
+	WebSocket string        `json:"websocket" validate:"required,hostport" help:"host:port of the device websocket"`
+	// DSN of the MySQL database, e.g. user:password@tcp(host:3306)/analog_base;
+	// it holds the database password, so give it as a file, e.g. AINWS_DATABASE_FILE=/run/secrets/analog_dsn
+	Database config.Secret `json:"database" validate:"required" help:"MySQL DSN of the analog_base database"`
+	// input read over REST at startup
+	Ain    string     `json:"ain" validate:"required" help:"AIN read over REST, e.g. AIN_A"`
+	Filter ain.Filter `json:"filter"`
 }
 
-func getToken() string {
-	tokenURL := "http://192.168.0.100:59801/user/Service/token"
-	/* set real password here */
-	password := "PASSWORD"
-
-	form := url.Values{}
-	form.Add("password", password)
-
-	resp, err := http.PostForm(tokenURL, form)
-	if err != nil {
-		fmt.Println("Error making request:", err)
-		return ""
+func defaults() settings {
+	return settings{
+		Device:    tdce.DefaultBaseURL,
+		Password:  config.NewSecret("servicelevel"),
+		WebSocket: "192.168.0.100:31768",
+		Ain:       "AIN_A",
+		// only values that moved past the deadband are stored; a value is stored every 10 minutes anyway
+		Filter: ain.Filter{
+			Median:    3,
+			Deadband:  0.05,
+			Heartbeat: config.Duration(10 * time.Minute),
+			Window:    config.Duration(time.Minute),
+		},
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Response status code:", resp.StatusCode)
-		return ""
-	}
+var cfg = config.NewStore(defaults(), config.Options{
+	Name:      "ain-restapi-websocket",
+	File:      "config.yaml",
+	EnvPrefix: "AINWS",
+	Args:      os.Args[1:],
+}).Get()
 
-	var tokenResp TokenResponse
-	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
-	if err != nil {
-		fmt.Println("Error decoding JSON:", err)
-		return ""
-	}
-
-	return tokenResp.Token
-}
+// client for the device REST API; fetches and refreshes the token on its own
+var device = tdce.NewClient(cfg.Device, cfg.Password.Value())
 
 // connect to database
 func connect() (*sql.DB, error) {
 	// opens connection to database
-	db, err := sql.Open("mysql", "root:TDC_arch2023@tcp(192.168.0.100:3306)/analog_base")
+	db, err := sql.Open("mysql", cfg.Database.Value())
 	if err != nil {
 		return nil, err
 	}
 	return db, nil
 }
 
-func sendRequest(token string, url string, method string, js ...[]byte) *http.Response {
-
-	client := &http.Client{}
-
-	var reqBody io.Reader
-	if len(js) > 0 {
-		reqBody = bytes.NewBuffer(js[0])
-	} else {
-		reqBody = nil
-	}
-
-	req, _ := http.NewRequest(method, url, reqBody)
-	req.Header.Add("Authorization", "Bearer "+token)
-	req.Header.Add("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error making request:", err)
-		return nil
-	}
-	return resp
-}
-
-func getAllAnalogStates(token string) []Analog {
-	url := "http://192.168.0.100:59801/tdce/analog-inputs/GetStates"
-	resp := sendRequest(token, url, "GET")
-	defer resp.Body.Close()
-	var analogs []Analog
-	err := json.NewDecoder(resp.Body).Decode(&analogs)
+func addToDb(db *sql.DB, m ain.Measurement) {
+	_, err := db.Exec("INSERT INTO analogi (value, whattime) VALUES (?, CURRENT_TIMESTAMP())", m.Value)
 	if err != nil {
-		fmt.Println("Error decoding JSON:", err)
-		return nil
-	}
-
-	return analogs
-}
-
-func getAllAnalogValues(token string) []AnalogVal {
-	url := "http://192.168.0.100:59801/tdce/analog-inputs/GetValues"
-	resp := sendRequest(token, url, "GET")
-	defer resp.Body.Close()
-	var analogValues []AnalogVal
-	err := json.NewDecoder(resp.Body).Decode(&analogValues)
-	if err != nil {
-		fmt.Println("Error decoding JSON: ", err)
-		return nil
-	}
-	return analogValues
-}
-
-func printAnalogState(token string, ain string) {
-	url := "http://192.168.0.100:59801/tdce/analog-inputs/GetState/" + ain
-	resp := sendRequest(token, url, "GET")
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
+		fmt.Println("Error inserting value:", err)
 		return
 	}
-
-	// Print the content of the response body as a string
-	fmt.Printf("\nAnalog Input %s, State: %s", ain, string(body))
+	fmt.Println("\n1 record inserted.")
 }
 
-func getAnalogValue(token string, ain string) (float64, error) {
-	url := "http://192.168.0.100:59801/tdce/analog-inputs/GetValue/" + ain
-	resp := sendRequest(token, url, "GET")
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body: ", err)
-		return 0, err
-	}
-
-	// Parse the response body into a float64
-	value, err := strconv.ParseFloat(string(body), 32)
-	if err != nil {
-		fmt.Println("Error parsing float64: ", err)
-		return 0, err
-	}
-
-	return float64(value), nil
-}
+func listenAinVal() {
+	// the context is cancelled on an interruption signal; the client then closes the websocket normally
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-func addToDb(value float64) {
+	// one connection pool for all inserts
 	db, err := connect()
 	if err != nil {
 		fmt.Println(err)
@@ -181,83 +89,75 @@ func addToDb(value float64) {
 	}
 	defer db.Close()
 
-	_, err = db.Exec("INSERT INTO analogi (value, whattime) VALUES (?, CURRENT_TIMESTAMP())", value)
-	fmt.Println("\n1 record inserted.")
-}
-
-func listenAinVal() {
-	// create webapi
-
-	serverUrl := url.URL{
-		Scheme: "ws",
-		Host:   "192.168.0.100:31768",
-		Path:   "/ws/tdce/analog-inputs/value",
-	}
-
-	conn, _, err := websocket.DefaultDialer.Dial(serverUrl.String(), nil)
-	if err != nil {
-		log.Fatal("Error connecting to WebSocket: ", err)
-	}
-	// close when websocket dial is over
-	defer conn.Close()
-
-	// handling OS signals
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	go func() {
-		// infinite listening loop
-		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				log.Println("Error reading message: ", err)
+	// the client reconnects on its own if the connection drops
+	ws := wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.AnalogInputsValue)}
+	_, changes := wsclient.Subscribe[tdce.AnalogValueChange](ctx, ws)
+
+	// one filter per AIN; min/max/avg of every minute are printed
+	channels := ain.NewChannels(func(string) *ain.Pipeline {
+		return cfg.Filter.Build(func(stats ain.Stats) {
+			fmt.Printf("%s from %s: min %f, max %f, avg %f of %d values\n",
+				stats.Channel, stats.Start.Format(time.TimeOnly), stats.Min, stats.Max, stats.Avg, stats.Count)
+		})
+	})
+	// ends the statistics windows of inputs that stopped changing
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// listening until the client is closed
+	for {
+		select {
+		case avchange, ok := <-changes:
+			if !ok {
+				log.Println("WebSocket connection closed.")
 				return
 			}
-			// save the message in json
-			var avchange AnalogValueChange
-			errM := json.Unmarshal(message, &avchange)
-			if errM != nil {
-				fmt.Println("Error decoding JSON: ", errM)
-				continue
-			}
 			fmt.Printf("Received AnalogValueChange: %+v\n", avchange)
-			addToDb(avchange.NewValue)
-		}
-	}()
-
-	// interruption signal closing
-	select {
-	case <-interrupt:
-		log.Println("Received interrupt signal. Closing WebSocket connection...")
-		err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		if err != nil {
-			log.Println("Error closing WebSocket:", err)
+			m := ain.Measurement{Channel: avchange.AinName, Value: avchange.NewValue, Time: time.Now()}
+			if m, ok := channels.Push(m); ok {
+				addToDb(db, m)
+			}
+		case now := <-ticker.C:
+			channels.Tick(now)
 		}
-		time.Sleep(time.Second)
-		return
 	}
 }
 
 func httpGetAin() {
+	ctx := context.Background()
 
-	token = getToken()
-	analogs := getAllAnalogStates(token)
+	analogs, err := device.ListAnalogInputs(ctx)
+	if err != nil {
+		fmt.Println("Error fetching analog states:", err)
+		return
+	}
 	fmt.Println("Printing all analog states:")
 	for _, analog := range analogs {
 		fmt.Printf("AinName: %s, State: %s\n", analog.AinName, analog.State)
 	}
-	analogVals := getAllAnalogValues(token)
+
+	analogVals, err := device.AnalogValues(ctx)
+	if err != nil {
+		fmt.Println("Error fetching analog values:", err)
+		return
+	}
 	fmt.Println("\nAnalog Values:")
 	for _, analogVals := range analogVals {
 		fmt.Printf("\nAnalog Name: %s, Value: %f\n", analogVals.AinName, analogVals.Value)
 	}
 
-	ain := "AIN_A"
+	ain := cfg.Ain
+
+	state, err := device.AnalogState(ctx, ain)
+	if err != nil {
+		fmt.Println("Error fetching analog state:", err)
+		return
+	}
+	fmt.Printf("\nAnalog Input %s, State: %s", ain, state)
 
-	printAnalogState(token, "AIN_A")
-	value, err := getAnalogValue(token, ain)
+	value, err := device.ReadAnalog(ctx, ain)
 	if err != nil {
-		fmt.Print("Problem during function execution.")
+		fmt.Println("Error fetching analog value:", err)
 		return
 	}
 	fmt.Printf("\nAnalog Name: %s, Value: %f", ain, value)
@@ -1,15 +1,21 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
-	"net/url"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/gorilla/websocket"
+	"tdce-shared/config"
+	"tdce-shared/wsclient"
 )
 
+/* Settings read from config.yaml, CAN_* environment variables and flags */
+type settings struct {
+	WebSocket string `json:"websocket" validate:"required,hostport" help:"host:port of the device websocket"`
+}
+
 type CanBus struct {
 	CanBusName                  string `json:"CanBusName"`
 	Id                          int    `json:"Id"`
@@ -19,64 +25,22 @@ type CanBus struct {
 	IsRemoteTransmissionRequest bool   `json:"IsRemoteTransmissionRequest"`
 }
 
-/* opens websocket by creating a url object with the provided scheme, host and path */
-func OpenWebsocket(scheme, host, path string) (*websocket.Conn, error) {
-
-	serverUrl := url.URL{
-		Scheme: scheme,
-		Host:   host,
-		Path:   path,
-	}
-
-	conn, _, err := websocket.DefaultDialer.Dial(serverUrl.String(), nil)
-	if err != nil {
-		log.Fatal("Error connecting to WebSocket: ", err)
-		return nil, err
-	}
-
-	/* to close connection write defer conn.Close() in calling package */
-	return conn, nil
-}
-
-/* listens on the provided websocket connection; use after opening the websocket and open in separate goroutine*/
-/* implemented with an infinite loop */
-func ListenOnWS(conn *websocket.Conn) ([]byte, error) {
-
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Println("Error reading message: ", err)
-			return nil, err
-		}
-		/* returns bytes from the websocket */
-		return message, nil
-	}
-
-}
-
 func main() {
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		defer wg.Done()
-		conn, err := OpenWebsocket("ws", "192.168.0.100:31768", "/ws/tdce/can-a/data")
-		if err != nil {
-			fmt.Println("Error opening websocket: ", err)
-		}
-		defer conn.Close()
-
-		for {
-			msg, erro := ListenOnWS(conn)
-			if erro != nil {
-				fmt.Println("Error fetching data: ", erro)
-			}
-			var canBus CanBus
-			json.Unmarshal(msg, &canBus)
-			fmt.Printf("Received Object: %v\n", canBus)
-		}
-
-	}()
-	wg.Wait()
+	cfg := config.NewStore(settings{WebSocket: "192.168.0.100:31768"}, config.Options{
+		Name:      "websocket-can",
+		File:      "config.yaml",
+		EnvPrefix: "CAN",
+		Args:      os.Args[1:],
+	}).Get()
+
+	/* The client reconnects on its own; Ctrl-C closes the websocket cleanly */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ws := wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.CanAData)}
+	_, stream := wsclient.Subscribe[CanBus](ctx, ws)
+
+	for canBus := range stream {
+		fmt.Printf("Received Object: %v\n", canBus)
+	}
 }
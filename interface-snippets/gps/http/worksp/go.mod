@@ -2,4 +2,13 @@ module worksp
 
 go 1.21.0
 
-require github.com/gorilla/websocket v1.5.0
+require tdce-shared v0.0.0
+
+require (
+	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace tdce-shared => ../../../../shared
@@ -1,63 +1,47 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"os/signal"
-	"time"
 
-	"github.com/gorilla/websocket"
+	"tdce-shared/config"
+	"tdce-shared/wsclient"
 )
 
-// fetches data indefinitely until signal interrupt
-func getData() {
-	// setting up URL to fetch data from
-	serverUrl := url.URL{
-		Scheme: "ws",                  //wss is secure
-		Host:   "192.168.0.100:31768", // address
-		Path:   "/ws/tdce/gps/data",   //endpoint path
-	}
-
-	// dials a websocket with the created URL
-	conn, _, err := websocket.DefaultDialer.Dial(serverUrl.String(), nil)
-	if err != nil {
-		log.Fatal("Error connecting to WebSocket: ", err)
-	}
-	// makes sure to close the connection after work with websocket has finished
-	defer conn.Close()
-
-	// handling OS signals
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	// goroutine for listening to messages
-	go func() {
-		for {
-			_, message, err := conn.ReadMessage()
-			if err != nil {
-				log.Println("Error reading message: ", err)
-				return
-			}
-			// prints the message
-			fmt.Printf("received message: %s\n", message)
-		}
-	}()
+// settings read from config.yaml, GPS_* environment variables and flags
+type settings struct {
+	WebSocket string `json:"websocket" validate:"required,hostport" help:"host:port of the device websocket"`
+}
 
-	select {
-	// in case of an interruption signal, close the websocket normally, then sleep for a second
-	case <-interrupt:
-		log.Println("Received interrupt signal. Closing WebSocket connection...")
-		err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		if err != nil {
-			log.Println("Error closing WebSocket:", err)
-		}
-		time.Sleep(time.Second)
-		return
+// fetches data indefinitely until signal interrupt
+func getData(cfg *settings) {
+	// the context is cancelled on an interruption signal; the client then closes the websocket normally
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// setting up URL to fetch data from; the client reconnects on its own if the connection drops
+	client := wsclient.New(wsclient.Config{
+		URL: wsclient.URL(cfg.WebSocket, wsclient.GpsData),
+	})
+	go client.Run(ctx)
+
+	// listening to messages until the client is closed
+	for message := range client.Messages() {
+		// prints the message
+		fmt.Printf("received message: %s\n", message)
 	}
+	log.Println("WebSocket connection closed.")
 }
 
 func main() {
-	getData()
+	cfg := config.NewStore(settings{WebSocket: "192.168.0.100:31768"}, config.Options{
+		Name:      "gps-http",
+		File:      "config.yaml",
+		EnvPrefix: "GPS",
+		Args:      os.Args[1:],
+	}).Get()
+	getData(cfg)
 }
@@ -1,117 +1,158 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	o2 "modem/request"
-	"sync"
+	"modem/monitor"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
-)
 
-var (
-	token     string
-	modemUrls []string
-	modfull   modemFull
-	modstat   modemStatistics
+	"tdce-shared/config"
+	"tdce-shared/modem"
+	mq "tdce-shared/mqttset"
+	"tdce-shared/ropc"
 )
 
-type modemFull struct {
-	GsmRegistrationStatus   string `json:"gsmRegistrationStatus"`
-	UtranRegistrationStatus string `json:"utranRegistrationStatus"`
-	AccessTechnology        string `json:"accessTechnology"`
-	DataLinkType            string `json:"dataLinkType"`
-	OperatorName            string `json:"operatorName"`
-	SimStatus               string `json:"simStatus"`
-	LatestError             string `json:"latestError"`
-	Imei                    string `json:"imei"`
-	Ccid                    string `json:"ccid"`
-	Imsi                    string `json:"imsi"`
-	Rssi                    int    `json:"rssi"`
-	Ip                      string `json:"ip"`
-	Gateway                 string `json:"gateway"`
-	Dns1                    string `json:"dns1"`
-	Dns2                    string `json:"dns2"`
-	LocalIp                 string `json:"localIp"`
-	RemoteIp                string `json:"remoteIp"`
-	Segment                 string `json:"segment"`
-	SegmentType             string `json:"segmentType"`
-	Persist                 bool   `json:"persist"`
-	Name                    string `json:"name"`
-	Type                    string `json:"type"`
-	Enabled                 bool   `json:"enabled"`
-	State                   string `json:"state"`
+/* Settings read from config.yaml, MODEM_* environment variables and flags */
+type settings struct {
+	// device manager API; its OAuth client is read from oauthConf in params
+	API    string `json:"api" validate:"required,url" help:"device manager API base URL"`
+	Params string `json:"params" validate:"required" help:"JSON file with oauthConf"`
+
+	Interval   config.Duration `json:"interval" validate:"min=1s" help:"time between samples"`
+	Flush      config.Duration `json:"flush" validate:"min=1s" help:"time between writes of the usage history"`
+	HistoryDir string          `json:"historyDir" validate:"required" help:"directory of the usage history"`
+	// day of month the data plan period starts on
+	BillingDay       int       `json:"billingDay" validate:"min=1,max=28" help:"day of month the data plan period starts on"`
+	CapMegabytes     uint64    `json:"capMegabytes" help:"data plan cap in MB, 0 disables the usage alerts"`
+	CapAlertPercents []float64 `json:"capAlertPercents"`
+	RssiMin          int       `json:"rssiMin" help:"RSSI below this raises an alert, 0 disables it"`
+	RssiHysteresis   int       `json:"rssiHysteresis" help:"dB above rssiMin that clear the alert"`
+	ErrorsPerMinute  float64   `json:"errorsPerMinute" help:"interface errors per minute that raise an alert, 0 disables it"`
+	ConfirmSamples   int       `json:"confirmSamples" validate:"min=1" help:"samples a condition must last before it is raised or cleared"`
+	RegisteredStates []string  `json:"registeredStates" help:"registration states counted as registered"`
+	SimOkStates      []string  `json:"simOkStates" help:"SIM states counted as ok"`
+
+	/* Alert channels; empty values disable a channel */
+	Mqtt struct {
+		Broker   string `json:"broker" validate:"url" help:"MQTT broker address, empty disables MQTT alerts"`
+		ClientId string `json:"clientId" help:"MQTT client ID"`
+		Username string `json:"username" help:"MQTT user"`
+		// for safety, reference the password from a file, e.g. MODEM_MQTT_PASSWORD_FILE=/run/secrets/mqtt_password
+		Password config.Secret `json:"password" help:"MQTT password"`
+		TLS      mq.TLS        `json:"tls"`
+		Topic    string        `json:"topic" help:"topic of the alerts"`
+		Qos      byte          `json:"qos" validate:"max=2" help:"QoS of the alerts"`
+	} `json:"mqtt"`
+	SmsNumbers []string `json:"smsNumbers" help:"numbers the alerts are sent to by SMS"`
+	WebhookUrl string   `json:"webhookUrl" validate:"url" help:"URL the alerts are posted to"`
 }
 
-type modemStatistics struct {
-	Name            string `json:"name"`
-	PacketsSent     int    `json:"packetsSent"`
-	PacketsReceived int    `json:"packetsReceived"`
-	BytesSent       int    `json:"bytesSent"`
-	BytesReceived   int    `json:"bytesReceived"`
-	ErrorsRx        int    `json:"errorsRx"`
-	ErrorsTx        int    `json:"errorsTx"`
-	DroppedRx       int    `json:"droppedRx"`
-	DroppedTx       int    `json:"droppedTx"`
-	Multicast       int    `json:"multicast"`
-	Collisions      int    `json:"collisions"`
-	Carrier_errors  int    `json:"carrier_errors"`
-	Over_errors     int    `json:"over_errors"`
+func defaults() settings {
+	var s settings
+	s.API = modem.DefaultAPI
+	s.Params = "params.json"
+	s.Interval = config.Duration(time.Second)
+	s.Flush = config.Duration(5 * time.Minute)
+	s.HistoryDir = "history"
+	s.BillingDay = 1
+	s.CapAlertPercents = []float64{80, 100}
+	s.ConfirmSamples = 3
+	s.Mqtt.ClientId = "modem-monitor"
+	s.Mqtt.Topic = "modem/alerts"
+	s.Mqtt.Qos = 1
+	return s
 }
 
-func setToken() {
-	for {
-		token = o2.Authorize()
-		/* Sleep for 59 minutes before reset */
-		if token != "" {
-			time.Sleep(59 * time.Minute)
+/* Creates the configured alert channels */
+func createNotifiers(conf *settings, device *modem.Client) ([]monitor.Notifier, error) {
+	var notifiers []monitor.Notifier
+
+	if conf.Mqtt.Broker != "" {
+		mqttClient, err := mq.NewClient(mq.ClientOptions{
+			Broker:    conf.Mqtt.Broker,
+			ClientId:  conf.Mqtt.ClientId,
+			Username:  conf.Mqtt.Username,
+			Password:  conf.Mqtt.Password.Value(),
+			TLS:       conf.Mqtt.TLS,
+			Reconnect: mq.Reconnect{Enabled: true},
+		})
+		if err != nil {
+			return nil, err
 		}
+		/* With connect retry the client keeps trying in the background */
+		mqttClient.Connect()
+		notifiers = append(notifiers, &monitor.MQTTNotifier{Client: mqttClient, Topic: conf.Mqtt.Topic, QoS: conf.Mqtt.Qos})
 	}
+	if len(conf.SmsNumbers) > 0 {
+		notifiers = append(notifiers, &monitor.SMSNotifier{Modem: device, Numbers: conf.SmsNumbers})
+	}
+	if conf.WebhookUrl != "" {
+		notifiers = append(notifiers, &monitor.WebhookNotifier{URL: conf.WebhookUrl, Client: &http.Client{Timeout: 10 * time.Second}})
+	}
+	return notifiers, nil
 }
 
-/* Function for handling errors */
-func handleError(err error) {
-	fmt.Println("Error: ", err)
-	panic(err)
+/* Prints rates and usage of every sample */
+func printSample(s monitor.Sample) {
+	fmt.Printf("%s %s RSSI %d | rx %.1f kB/s tx %.1f kB/s | %.1f/%.1f pkt/s | errors %d dropped %d | used %.1f MB since %s\n",
+		s.Details.OperatorName, s.Details.DataLinkType, s.Details.Rssi,
+		s.Rates.BytesReceived/1000, s.Rates.BytesSent/1000,
+		s.Rates.PacketsReceived, s.Rates.PacketsSent,
+		s.Delta.Errors, s.Delta.Dropped,
+		float64(s.Usage.Total())/1e6, s.Usage.PeriodStart.Format("2006-01-02"))
 }
 
-/* Sets up environment for fetching and printing data */
-func fetchData() {
-	for {
-		if token != "" {
-			fetchModemData()
-			fmt.Printf("Received details data: %v\n", modfull)
-			fmt.Printf("Received statistics data: %v\n", modstat)
-			time.Sleep(time.Second)
-		}
-	}
-}
+func main() {
+	conf := config.NewStore(defaults(), config.Options{
+		Name:      "modem-monitor",
+		File:      "config.yaml",
+		EnvPrefix: "MODEM",
+		Args:      os.Args[1:],
+	}).Get()
 
-/* Makes OAuth2.0-authenticated request to REST API for fetching modem data */
-func fetchModemData() {
-	err := json.Unmarshal(o2.MakeROPCRequest("http://192.168.0.100/devicemanager/api/v1/networking/modem/ppp0/details", token), &modfull)
+	oauthConf, err := ropc.LoadConfig(conf.Params)
 	if err != nil {
-		handleError(err)
+		fmt.Println("Error opening config file: ", err)
+		return
 	}
-	err = json.Unmarshal(o2.MakeROPCRequest("http://192.168.0.100/devicemanager/api/v1/networking/modem/ppp0/statistics", token), &modstat)
+	device := &modem.Client{API: ropc.NewClient(ropc.NewTokenSource(oauthConf)), BaseURL: conf.API}
+	notifiers, err := createNotifiers(conf, device)
 	if err != nil {
-		handleError(err)
+		fmt.Println("Error creating alert channels: ", err)
+		return
 	}
-}
 
-func main() {
-	var wg sync.WaitGroup
-	// Adds 2 processes to WaitGroup
-	wg.Add(2)
+	history, err := monitor.OpenHistory(conf.HistoryDir, conf.BillingDay, time.Now())
+	if err != nil {
+		fmt.Println("Error opening history: ", err)
+		return
+	}
+
+	m := &monitor.Monitor{
+		Modem:   device,
+		History: history,
+		Thresholds: monitor.Thresholds{
+			RssiMin:          conf.RssiMin,
+			RssiHysteresis:   conf.RssiHysteresis,
+			ErrorsPerMinute:  conf.ErrorsPerMinute,
+			CapBytes:         conf.CapMegabytes * 1000 * 1000,
+			CapAlertPercents: conf.CapAlertPercents,
+			RegisteredStates: conf.RegisteredStates,
+			SimOkStates:      conf.SimOkStates,
+			Confirm:          conf.ConfirmSamples,
+		},
+		Notifiers:     notifiers,
+		Interval:      time.Duration(conf.Interval),
+		FlushInterval: time.Duration(conf.Flush),
+		OnSample:      printSample,
+	}
 
-	// Authorize periodically
-	go func() {
-		defer wg.Done()
-		setToken()
-	}()
-	// Fetch modem data
-	go func() {
-		defer wg.Done()
-		fetchData()
-	}()
-	wg.Wait()
+	/* Pending usage is written to the history on Ctrl-C or a docker stop */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	m.Run(ctx)
 }
@@ -0,0 +1,118 @@
+/* Package created 18.10.2026. */
+/* Alerts and the channels they are sent to */
+
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/modem"
+)
+
+/* Alert kinds */
+const (
+	AlertAPI          = "api"
+	AlertRegistration = "registration"
+	AlertSim          = "sim"
+	AlertModemError   = "modem-error"
+	AlertRssi         = "rssi"
+	AlertErrors       = "errors"
+	AlertUsage        = "usage"
+)
+
+/* A condition that started (Raised) or ended */
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Raised  bool      `json:"raised"`
+	Message string    `json:"message"`
+	// for usage alerts the percentage of the cap that was crossed
+	Limit float64 `json:"limit,omitempty"`
+}
+
+func (a Alert) String() string {
+	state := "CLEARED"
+	if a.Raised {
+		state = "ALERT"
+	}
+	return fmt.Sprintf("%s %s: %s", state, a.Kind, a.Message)
+}
+
+/* Notifier delivers alerts to one channel */
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+/* Publishes alerts as JSON */
+type MQTTNotifier struct {
+	Client mqtt.Client
+	Topic  string
+	QoS    byte
+}
+
+func (n *MQTTNotifier) Notify(ctx context.Context, alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	token := n.Client.Publish(n.Topic, n.QoS, false, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		return errors.New("mqtt publish timed out")
+	}
+	return token.Error()
+}
+
+/* Sends alerts by SMS through the modem */
+type SMSNotifier struct {
+	Modem   *modem.Client
+	Numbers []string
+}
+
+func (n *SMSNotifier) Notify(ctx context.Context, alert Alert) error {
+	var errs []error
+	for _, number := range n.Numbers {
+		if err := n.Modem.SendSMS(ctx, number, alert.String()); err != nil {
+			errs = append(errs, fmt.Errorf("sms to %s: %w", number, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/* Posts alerts as JSON to a URL */
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %s", n.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/* Package created 18.10.2026. */
+/* Turns the monotonic modem counters into deltas and rates */
+
+package monitor
+
+import (
+	"time"
+
+	"tdce-shared/modem"
+)
+
+/* Change of the modem counters between two samples */
+type Delta struct {
+	Interval        time.Duration
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+	Errors          uint64
+	Dropped         uint64
+	// a counter went backwards: the link was re-established and the counters started over
+	Reset bool
+}
+
+/* Per second values of a Delta */
+type Rates struct {
+	BytesSent       float64
+	BytesReceived   float64
+	PacketsSent     float64
+	PacketsReceived float64
+	Errors          float64
+	Dropped         float64
+}
+
+/* Computes the change from prev to cur */
+/* After a reset the whole current value is counted, since everything up to it was transferred after the reset */
+/* Traffic between the last sample before a reset and the reset itself is lost; keep the interval short */
+func Diff(prev, cur modem.Statistics, interval time.Duration) Delta {
+	reset := cur.BytesSent < prev.BytesSent || cur.BytesReceived < prev.BytesReceived ||
+		cur.PacketsSent < prev.PacketsSent || cur.PacketsReceived < prev.PacketsReceived
+	if reset {
+		prev = modem.Statistics{}
+	}
+
+	return Delta{
+		Interval:        interval,
+		BytesSent:       counterDelta(prev.BytesSent, cur.BytesSent),
+		BytesReceived:   counterDelta(prev.BytesReceived, cur.BytesReceived),
+		PacketsSent:     counterDelta(prev.PacketsSent, cur.PacketsSent),
+		PacketsReceived: counterDelta(prev.PacketsReceived, cur.PacketsReceived),
+		Errors:          counterDelta(prev.ErrorsRx+prev.ErrorsTx, cur.ErrorsRx+cur.ErrorsTx),
+		Dropped:         counterDelta(prev.DroppedRx+prev.DroppedTx, cur.DroppedRx+cur.DroppedTx),
+		Reset:           reset,
+	}
+}
+
+/* A counter that went backwards on its own started over as well */
+func counterDelta(prev, cur int) uint64 {
+	if cur < prev {
+		return uint64(max(cur, 0))
+	}
+	return uint64(cur - prev)
+}
+
+func (d Delta) Rates() Rates {
+	seconds := d.Interval.Seconds()
+	if seconds <= 0 {
+		return Rates{}
+	}
+	return Rates{
+		BytesSent:       float64(d.BytesSent) / seconds,
+		BytesReceived:   float64(d.BytesReceived) / seconds,
+		PacketsSent:     float64(d.PacketsSent) / seconds,
+		PacketsReceived: float64(d.PacketsReceived) / seconds,
+		Errors:          float64(d.Errors) / seconds,
+		Dropped:         float64(d.Dropped) / seconds,
+	}
+}
+
+/* Adds other to d */
+func (d *Delta) Add(other Delta) {
+	d.Interval += other.Interval
+	d.BytesSent += other.BytesSent
+	d.BytesReceived += other.BytesReceived
+	d.PacketsSent += other.PacketsSent
+	d.PacketsReceived += other.PacketsReceived
+	d.Errors += other.Errors
+	d.Dropped += other.Dropped
+}
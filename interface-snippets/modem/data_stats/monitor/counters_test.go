@@ -0,0 +1,51 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"tdce-shared/modem"
+)
+
+func TestDiff(t *testing.T) {
+	prev := modem.Statistics{BytesSent: 1000, BytesReceived: 5000, PacketsSent: 10, PacketsReceived: 50, ErrorsRx: 1, DroppedTx: 2}
+	cur := modem.Statistics{BytesSent: 1500, BytesReceived: 7000, PacketsSent: 15, PacketsReceived: 60, ErrorsRx: 2, ErrorsTx: 1, DroppedTx: 2}
+	d := Diff(prev, cur, 2*time.Second)
+	want := Delta{Interval: 2 * time.Second, BytesSent: 500, BytesReceived: 2000, PacketsSent: 5, PacketsReceived: 10, Errors: 2}
+	if d != want {
+		t.Errorf("Diff = %+v, want %+v", d, want)
+	}
+	if r := d.Rates(); r.BytesSent != 250 || r.BytesReceived != 1000 || r.Errors != 1 {
+		t.Errorf("Rates = %+v", r)
+	}
+}
+
+/* After the link came back the counters start over; everything they show was transferred since */
+func TestDiffAcrossReset(t *testing.T) {
+	prev := modem.Statistics{BytesSent: 1000, BytesReceived: 5000, PacketsSent: 10, PacketsReceived: 50, ErrorsRx: 7}
+	cur := modem.Statistics{BytesSent: 300, BytesReceived: 6000, PacketsSent: 3, PacketsReceived: 55, ErrorsRx: 1}
+	d := Diff(prev, cur, time.Second)
+	want := Delta{Interval: time.Second, BytesSent: 300, BytesReceived: 6000, PacketsSent: 3, PacketsReceived: 55, Errors: 1, Reset: true}
+	if d != want {
+		t.Errorf("Diff = %+v, want %+v", d, want)
+	}
+
+	/* an error counter going back alone is no reset of the traffic counters */
+	cur = modem.Statistics{BytesSent: 1100, BytesReceived: 5100, PacketsSent: 11, PacketsReceived: 51, ErrorsRx: 2}
+	d = Diff(prev, cur, time.Second)
+	if d.Reset || d.BytesSent != 100 || d.Errors != 2 {
+		t.Errorf("Diff = %+v, want 100 bytes sent and the 2 errors since the error counter started over", d)
+	}
+}
+
+func TestDeltaAdd(t *testing.T) {
+	var total Delta
+	total.Add(Delta{Interval: time.Second, BytesSent: 1, Errors: 2})
+	total.Add(Delta{Interval: time.Second, BytesSent: 3, Dropped: 1})
+	if total.Interval != 2*time.Second || total.BytesSent != 4 || total.Errors != 2 || total.Dropped != 1 {
+		t.Errorf("Add = %+v", total)
+	}
+	if (Delta{}).Rates() != (Rates{}) {
+		t.Errorf("rates of an empty interval")
+	}
+}
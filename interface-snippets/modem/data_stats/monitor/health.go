@@ -0,0 +1,192 @@
+/* Package created 18.10.2026. */
+/* Detects link problems and turns them into alerts */
+
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"tdce-shared/modem"
+)
+
+/* Limits that raise alerts; zero values disable a check */
+type Thresholds struct {
+	// RSSI in the unit the device reports; alert below RssiMin, cleared at RssiMin+RssiHysteresis
+	RssiMin        int
+	RssiHysteresis int
+	// errors plus dropped packets per minute
+	ErrorsPerMinute float64
+	// data plan cap in bytes (sent + received) and the percentages of it that raise an alert
+	CapBytes         uint64
+	CapAlertPercents []float64
+	// registration states that count as registered, compared case-insensitive
+	RegisteredStates []string
+	// SIM states that count as healthy, compared case-insensitive
+	SimOkStates []string
+	// samples a condition has to persist before it is raised or cleared
+	Confirm int
+}
+
+func (t *Thresholds) setDefaults() {
+	if len(t.RegisteredStates) == 0 {
+		t.RegisteredStates = []string{"registered", "registeredHome", "registeredRoaming", "home", "roaming"}
+	}
+	if len(t.SimOkStates) == 0 {
+		t.SimOkStates = []string{"ready", "ok", "inserted"}
+	}
+	if t.Confirm <= 0 {
+		t.Confirm = 1
+	}
+	sort.Float64s(t.CapAlertPercents)
+}
+
+/* A condition with hysteresis: it changes state only after Confirm samples in a row */
+type condition struct {
+	active bool
+	streak int
+}
+
+/* raise and clear are evaluated for the current sample; reports whether the state changed */
+func (c *condition) update(raise, clear bool, confirm int) bool {
+	next := raise
+	if c.active {
+		next = !clear
+	}
+	if next == c.active {
+		c.streak = 0
+		return false
+	}
+	c.streak++
+	if c.streak < confirm {
+		return false
+	}
+	c.active = next
+	c.streak = 0
+	return true
+}
+
+/* Sample passed to the checker */
+type observation struct {
+	Time    time.Time
+	Err     error
+	Details modem.Details
+	Delta   Delta
+	Usage   Usage
+}
+
+/* Keeps the state of every check between samples */
+type checker struct {
+	th         Thresholds
+	conditions map[string]*condition
+	lastError  string
+	// usage alert percentages already sent in the current period
+	usagePeriod time.Time
+	usageSent   map[float64]bool
+}
+
+func newChecker(th Thresholds) *checker {
+	th.setDefaults()
+	return &checker{th: th, conditions: map[string]*condition{}, usageSent: map[float64]bool{}}
+}
+
+func (c *checker) cond(kind string) *condition {
+	if c.conditions[kind] == nil {
+		c.conditions[kind] = &condition{}
+	}
+	return c.conditions[kind]
+}
+
+/* Runs all checks and returns the alerts whose state changed */
+func (c *checker) check(obs observation) []Alert {
+	var alerts []Alert
+	emit := func(kind string, raise, clear bool, format string, args ...interface{}) {
+		cond := c.cond(kind)
+		if cond.update(raise, clear, c.th.Confirm) {
+			alerts = append(alerts, Alert{Time: obs.Time, Kind: kind, Raised: cond.active, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	if obs.Err != nil {
+		emit(AlertAPI, true, false, "device manager API not reachable: %v", obs.Err)
+		return alerts
+	}
+	emit(AlertAPI, false, true, "device manager API reachable again")
+
+	d := obs.Details
+	registered := contains(c.th.RegisteredStates, d.GsmRegistrationStatus) || contains(c.th.RegisteredStates, d.UtranRegistrationStatus)
+	emit(AlertRegistration, !registered, registered, "registration gsm %q utran %q, operator %q", d.GsmRegistrationStatus, d.UtranRegistrationStatus, d.OperatorName)
+
+	simOk := contains(c.th.SimOkStates, d.SimStatus)
+	emit(AlertSim, !simOk, simOk, "SIM status %q", d.SimStatus)
+
+	/* A new error text is reported even while an older one is active */
+	if d.LatestError != c.lastError {
+		if d.LatestError != "" {
+			alerts = append(alerts, Alert{Time: obs.Time, Kind: AlertModemError, Raised: true, Message: d.LatestError})
+		} else {
+			alerts = append(alerts, Alert{Time: obs.Time, Kind: AlertModemError, Message: "modem error cleared"})
+		}
+		c.lastError = d.LatestError
+	}
+
+	if c.th.RssiMin != 0 {
+		emit(AlertRssi, d.Rssi < c.th.RssiMin, d.Rssi >= c.th.RssiMin+c.th.RssiHysteresis, "RSSI %d, limit %d", d.Rssi, c.th.RssiMin)
+	}
+
+	if c.th.ErrorsPerMinute > 0 && obs.Delta.Interval > 0 {
+		perMinute := float64(obs.Delta.Errors+obs.Delta.Dropped) / obs.Delta.Interval.Minutes()
+		emit(AlertErrors, perMinute > c.th.ErrorsPerMinute, perMinute <= c.th.ErrorsPerMinute, "%.0f errors and drops per minute, limit %.0f", perMinute, c.th.ErrorsPerMinute)
+	}
+
+	if c.th.CapBytes > 0 {
+		if !obs.Usage.PeriodStart.Equal(c.usagePeriod) {
+			c.usagePeriod = obs.Usage.PeriodStart
+			c.usageSent = map[float64]bool{}
+		}
+		used := float64(obs.Usage.Total()) / float64(c.th.CapBytes) * 100
+		for _, percent := range c.th.CapAlertPercents {
+			if used >= percent && !c.usageSent[percent] {
+				c.usageSent[percent] = true
+				alerts = append(alerts, Alert{Time: obs.Time, Kind: AlertUsage, Raised: true, Limit: percent,
+					Message: fmt.Sprintf("%s of %s used since %s (%.0f%%)", formatBytes(obs.Usage.Total()), formatBytes(c.th.CapBytes), obs.Usage.PeriodStart.Format("2006-01-02"), used)})
+			}
+		}
+	}
+	return alerts
+}
+
+/* Remembers usage alerts already sent, e.g. from the history after a restart */
+func (c *checker) usageAlerted(period time.Time, percents []float64) {
+	if !period.Equal(c.usagePeriod) {
+		c.usagePeriod = period
+		c.usageSent = map[float64]bool{}
+	}
+	for _, percent := range percents {
+		c.usageSent[percent] = true
+	}
+}
+
+func contains(states []string, state string) bool {
+	for _, s := range states {
+		if strings.EqualFold(s, state) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
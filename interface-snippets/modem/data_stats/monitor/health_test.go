@@ -0,0 +1,95 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"tdce-shared/modem"
+)
+
+func healthy(rssi int) observation {
+	return observation{
+		Time:    time.Now(),
+		Details: modem.Details{GsmRegistrationStatus: "registered", SimStatus: "ready", Rssi: rssi},
+	}
+}
+
+/* The RSSI alert is raised below RssiMin and cleared only at RssiMin+RssiHysteresis, each after Confirm samples in a row */
+func TestRssiHysteresis(t *testing.T) {
+	c := newChecker(Thresholds{RssiMin: -100, RssiHysteresis: 5, Confirm: 2})
+	steps := []struct {
+		rssi int
+		want string
+	}{
+		{-90, ""},
+		{-101, ""},
+		/* back up before it was confirmed */
+		{-90, ""},
+		{-101, ""},
+		{-102, "raised"},
+		{-103, ""},
+		/* above RssiMin but within the hysteresis */
+		{-98, ""},
+		{-96, ""},
+		{-95, ""},
+		{-97, ""},
+		{-95, ""},
+		{-94, "cleared"},
+		{-90, ""},
+	}
+	for i, step := range steps {
+		alerts := c.check(healthy(step.rssi))
+		got := ""
+		for _, a := range alerts {
+			if a.Kind != AlertRssi {
+				t.Errorf("step %d: unexpected alert %s", i, a)
+				continue
+			}
+			got = "cleared"
+			if a.Raised {
+				got = "raised"
+			}
+		}
+		if got != step.want {
+			t.Errorf("step %d, RSSI %d: got %q, want %q", i, step.rssi, got, step.want)
+		}
+	}
+}
+
+func TestUsageAlerts(t *testing.T) {
+	c := newChecker(Thresholds{CapBytes: 1000, CapAlertPercents: []float64{100, 80}})
+	period := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	usage := func(period time.Time, bytes uint64) observation {
+		obs := healthy(-70)
+		obs.Usage = Usage{PeriodStart: period, BytesReceived: bytes}
+		return obs
+	}
+	limits := func(alerts []Alert) []float64 {
+		var got []float64
+		for _, a := range alerts {
+			got = append(got, a.Limit)
+		}
+		return got
+	}
+
+	if got := limits(c.check(usage(period, 700))); len(got) != 0 {
+		t.Errorf("alerts at 70%%: %v", got)
+	}
+	if got := limits(c.check(usage(period, 1200))); len(got) != 2 || got[0] != 80 || got[1] != 100 {
+		t.Errorf("alerts at 120%%: %v, want 80 and 100", got)
+	}
+	if got := limits(c.check(usage(period, 1300))); len(got) != 0 {
+		t.Errorf("alerts repeated: %v", got)
+	}
+	next := period.AddDate(0, 1, 0)
+	if got := limits(c.check(usage(next, 850))); len(got) != 1 || got[0] != 80 {
+		t.Errorf("alerts in the next period: %v, want 80", got)
+	}
+
+	/* sent before a restart, as the history tells */
+	c = newChecker(Thresholds{CapBytes: 1000, CapAlertPercents: []float64{80, 100}})
+	c.usageAlerted(period, []float64{80})
+	if got := limits(c.check(usage(period, 900))); len(got) != 0 {
+		t.Errorf("alert sent before the restart repeated: %v", got)
+	}
+}
@@ -0,0 +1,217 @@
+/* Package created 18.10.2026. */
+/* Local history of data usage and alerts, one JSON lines file per billing period */
+
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"tdce-shared/modem"
+)
+
+/* One line of a history file */
+type Record struct {
+	// "usage" or "alert"
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	/* Usage since the previous usage record */
+	Seconds         float64 `json:"seconds,omitempty"`
+	BytesSent       uint64  `json:"bytesSent,omitempty"`
+	BytesReceived   uint64  `json:"bytesReceived,omitempty"`
+	PacketsSent     uint64  `json:"packetsSent,omitempty"`
+	PacketsReceived uint64  `json:"packetsReceived,omitempty"`
+	Errors          uint64  `json:"errors,omitempty"`
+	Dropped         uint64  `json:"dropped,omitempty"`
+	// counter resets, i.e. link re-establishments, seen in this interval
+	Resets       int    `json:"resets,omitempty"`
+	Rssi         int    `json:"rssi,omitempty"`
+	Operator     string `json:"operator,omitempty"`
+	DataLinkType string `json:"dataLinkType,omitempty"`
+	// raw counters at Time; the baseline for the first delta after a restart
+	Counters *modem.Statistics `json:"counters,omitempty"`
+
+	Alert *Alert `json:"alert,omitempty"`
+}
+
+/* Data used in one billing period */
+type Usage struct {
+	PeriodStart   time.Time
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+func (u Usage) Total() uint64 {
+	return u.BytesSent + u.BytesReceived
+}
+
+/* Start of the billing period containing t; billingDay is the day of month a period starts on (1-28) */
+func PeriodStart(t time.Time, billingDay int) time.Time {
+	if billingDay < 1 || billingDay > 28 {
+		billingDay = 1
+	}
+	start := time.Date(t.Year(), t.Month(), billingDay, 0, 0, 0, 0, t.Location())
+	if t.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+/* History appends records to <dir>/<period start>.jsonl; safe for concurrent use */
+type History struct {
+	dir        string
+	billingDay int
+
+	mu          sync.Mutex
+	usage       Usage
+	usageAlerts []float64
+	baseline    *modem.Statistics
+}
+
+/* Opens the history in dir and restores the usage of the current period and the last counters */
+func OpenHistory(dir string, billingDay int, now time.Time) (*History, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	h := &History{dir: dir, billingDay: billingDay}
+	h.usage.PeriodStart = PeriodStart(now, billingDay)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	current := h.path(h.usage.PeriodStart)
+	for _, file := range files {
+		err := readRecords(file, func(rec Record) {
+			if rec.Type == "alert" && rec.Alert != nil && rec.Alert.Kind == AlertUsage && file == current {
+				h.usageAlerts = append(h.usageAlerts, rec.Alert.Limit)
+			}
+			if rec.Type != "usage" {
+				return
+			}
+			if file == current {
+				h.usage.BytesSent += rec.BytesSent
+				h.usage.BytesReceived += rec.BytesReceived
+			}
+			if rec.Counters != nil {
+				h.baseline = rec.Counters
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+/* Counters of the last usage record, nil if there is none */
+func (h *History) Baseline() *modem.Statistics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.baseline
+}
+
+/* Usage of the period containing now; empty when that period has no records yet */
+func (h *History) Usage(now time.Time) Usage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	period := PeriodStart(now, h.billingDay)
+	if period.After(h.usage.PeriodStart) {
+		return Usage{PeriodStart: period}
+	}
+	return h.usage
+}
+
+/* Cap percentages usage alerts were sent for in the current period */
+func (h *History) UsageAlerts() []float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]float64(nil), h.usageAlerts...)
+}
+
+/* Appends a record; a usage record from a new period starts the usage over */
+func (h *History) Append(rec Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	period := PeriodStart(rec.Time, h.billingDay)
+	if err := appendRecord(h.path(period), rec); err != nil {
+		return err
+	}
+
+	if period.After(h.usage.PeriodStart) {
+		h.usage = Usage{PeriodStart: period}
+		h.usageAlerts = nil
+	}
+	if rec.Type == "alert" && rec.Alert != nil && rec.Alert.Kind == AlertUsage && period.Equal(h.usage.PeriodStart) {
+		h.usageAlerts = append(h.usageAlerts, rec.Alert.Limit)
+	}
+	if rec.Type == "usage" {
+		if period.Equal(h.usage.PeriodStart) {
+			h.usage.BytesSent += rec.BytesSent
+			h.usage.BytesReceived += rec.BytesReceived
+		}
+		if rec.Counters != nil {
+			h.baseline = rec.Counters
+		}
+	}
+	return nil
+}
+
+func (h *History) periodOf(t time.Time) time.Time {
+	return PeriodStart(t, h.billingDay)
+}
+
+func (h *History) path(period time.Time) string {
+	return filepath.Join(h.dir, period.Format("2006-01-02")+".jsonl")
+}
+
+func appendRecord(path string, rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/* Calls fn for every record in path; a torn last line from a crash is skipped */
+func readRecords(path string, fn func(Record)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		fn(rec)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	zagreb, err := time.LoadLocation("Europe/Zagreb")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, zagreb)
+	}
+	tests := []struct {
+		name       string
+		t          time.Time
+		billingDay int
+		want       time.Time
+	}{
+		{"on the billing day at midnight", date(2026, 10, 15, 0, 0), 15, date(2026, 10, 15, 0, 0)},
+		{"just before the billing day", date(2026, 10, 14, 23, 59), 15, date(2026, 9, 15, 0, 0)},
+		{"later in the month", date(2026, 10, 28, 12, 0), 15, date(2026, 10, 15, 0, 0)},
+		{"january before the billing day", date(2026, 1, 10, 8, 0), 15, date(2025, 12, 15, 0, 0)},
+		{"first of the month", date(2026, 3, 1, 0, 0), 1, date(2026, 3, 1, 0, 0)},
+		{"day 28 in february", date(2026, 3, 27, 12, 0), 28, date(2026, 2, 28, 0, 0)},
+		{"invalid day is the first", date(2026, 3, 30, 12, 0), 31, date(2026, 3, 1, 0, 0)},
+		/* the clocks go back on 25 October; the period still starts at local midnight */
+		{"across the DST change", date(2026, 10, 26, 1, 0), 25, date(2026, 10, 25, 0, 0)},
+	}
+	for _, tt := range tests {
+		if got := PeriodStart(tt.t, tt.billingDay); !got.Equal(tt.want) {
+			t.Errorf("%s: PeriodStart(%s, %d) = %s, want %s", tt.name, tt.t, tt.billingDay, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/* Package created 18.10.2026. */
+/* Long-running cellular link monitor: rates, data usage against the plan cap, link health alerts and local history */
+
+package monitor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"tdce-shared/modem"
+)
+
+type Monitor struct {
+	Modem      *modem.Client
+	History    *History
+	Thresholds Thresholds
+	Notifiers  []Notifier
+
+	// time between samples
+	Interval time.Duration
+	// usage is written to the history this often; shorter intervals explain a bill in more detail
+	FlushInterval time.Duration
+	// called with every sample, e.g. for printing or exporting
+	OnSample func(Sample)
+}
+
+/* One sample of the link */
+type Sample struct {
+	Time    time.Time
+	Details modem.Details
+	Stats   modem.Statistics
+	Delta   Delta
+	Rates   Rates
+	Usage   Usage
+}
+
+/* Samples the modem until ctx is cancelled; pending usage is written to the history before it returns */
+func (m *Monitor) Run(ctx context.Context) error {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	flushInterval := m.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Minute
+	}
+
+	checks := newChecker(m.Thresholds)
+	now := time.Now()
+	checks.usageAlerted(m.History.Usage(now).PeriodStart, m.History.UsageAlerts())
+
+	var (
+		prev     *modem.Statistics
+		prevAt   time.Time
+		pending  Record
+		lastSeen Sample
+	)
+	/* Traffic while the monitor was not running is counted against the last recorded counters */
+	if baseline := m.History.Baseline(); baseline != nil {
+		prev = baseline
+	}
+	lastFlush := now
+
+	flush := func(at time.Time) {
+		if pending.Seconds == 0 && pending.Resets == 0 && pending.BytesSent == 0 && pending.BytesReceived == 0 {
+			return
+		}
+		pending.Type = "usage"
+		pending.Time = at
+		pending.Rssi = lastSeen.Details.Rssi
+		pending.Operator = lastSeen.Details.OperatorName
+		pending.DataLinkType = lastSeen.Details.DataLinkType
+		stats := lastSeen.Stats
+		pending.Counters = &stats
+		if err := m.History.Append(pending); err != nil {
+			log.Println("Error writing history: ", err)
+			return
+		}
+		pending = Record{}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		sample, err := m.sample(ctx, now)
+		if ctx.Err() != nil {
+			flush(now)
+			return ctx.Err()
+		}
+
+		/* Usage of a period never spills into the next one */
+		if m.History.periodOf(now).After(m.History.periodOf(lastFlush)) {
+			flush(lastFlush)
+			lastFlush = now
+		}
+
+		var delta Delta
+		if err == nil {
+			if prev != nil {
+				elapsed := now.Sub(prevAt)
+				if prevAt.IsZero() {
+					elapsed = 0
+				}
+				delta = Diff(*prev, sample.Stats, elapsed)
+				pending.Seconds += elapsed.Seconds()
+				pending.BytesSent += delta.BytesSent
+				pending.BytesReceived += delta.BytesReceived
+				pending.PacketsSent += delta.PacketsSent
+				pending.PacketsReceived += delta.PacketsReceived
+				pending.Errors += delta.Errors
+				pending.Dropped += delta.Dropped
+				if delta.Reset {
+					pending.Resets++
+				}
+			}
+			stats := sample.Stats
+			prev, prevAt = &stats, now
+			sample.Delta = delta
+			sample.Rates = delta.Rates()
+			lastSeen = sample
+		}
+
+		usage := m.History.Usage(now)
+		usage.BytesSent += pending.BytesSent
+		usage.BytesReceived += pending.BytesReceived
+		sample.Usage = usage
+
+		for _, alert := range checks.check(observation{Time: now, Err: err, Details: sample.Details, Delta: delta, Usage: usage}) {
+			m.raise(ctx, alert)
+		}
+		if err == nil && m.OnSample != nil {
+			m.OnSample(sample)
+		}
+
+		if now.Sub(lastFlush) >= flushInterval {
+			flush(now)
+			lastFlush = now
+		}
+
+		select {
+		case <-ctx.Done():
+			flush(time.Now())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) sample(ctx context.Context, now time.Time) (Sample, error) {
+	details, err := m.Modem.Details(ctx)
+	if err != nil {
+		return Sample{Time: now}, err
+	}
+	stats, err := m.Modem.Statistics(ctx)
+	if err != nil {
+		return Sample{Time: now}, err
+	}
+	return Sample{Time: now, Details: details, Stats: stats}, nil
+}
+
+/* Records an alert in the history and sends it to every notifier */
+func (m *Monitor) raise(ctx context.Context, alert Alert) {
+	log.Println(alert)
+	if err := m.History.Append(Record{Type: "alert", Time: alert.Time, Alert: &alert}); err != nil {
+		log.Println("Error writing history: ", err)
+	}
+	for _, n := range m.Notifiers {
+		if err := n.Notify(ctx, alert); err != nil {
+			log.Printf("Error sending %s alert: %v\n", alert.Kind, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/* Package created 18.10.2026. */
+/* Commands accepted by SMS */
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"tdce-shared/tdce"
+)
+
+/* Command verbs */
+const (
+	CmdSet    = "SET"
+	CmdStatus = "STATUS"
+	CmdGps    = "GPS"
+	CmdReboot = "REBOOT"
+	CmdHelp   = "HELP"
+)
+
+const helpText = "Commands: DIO_x ON|OFF, STATUS, GPS, REBOOT, HELP"
+
+var dioName = regexp.MustCompile(`^DIO_[A-Z]$`)
+
+/* Parsed SMS command */
+type Command struct {
+	Verb string
+	// DIO name for CmdSet
+	Target string
+	// 1 or 0 for CmdSet
+	Value int
+}
+
+/* Parses the content of an SMS; case and surrounding whitespace are ignored */
+/* Accepted forms: "DIO_A ON", "DIO_A OFF", "STATUS", "GPS", "REBOOT", "HELP" */
+func ParseCommand(content string) (Command, error) {
+	fields := strings.Fields(strings.ToUpper(content))
+	if len(fields) == 0 {
+		return Command{}, fmt.Errorf("empty message")
+	}
+
+	switch {
+	case len(fields) == 1 && (fields[0] == CmdStatus || fields[0] == CmdGps || fields[0] == CmdReboot || fields[0] == CmdHelp):
+		return Command{Verb: fields[0]}, nil
+	case len(fields) == 2 && dioName.MatchString(fields[0]):
+		switch fields[1] {
+		case "ON", "1":
+			return Command{Verb: CmdSet, Target: fields[0], Value: 1}, nil
+		case "OFF", "0":
+			return Command{Verb: CmdSet, Target: fields[0], Value: 0}, nil
+		}
+		return Command{}, fmt.Errorf("unknown state %q for %s", fields[1], fields[0])
+	}
+	return Command{}, fmt.Errorf("unknown command %q", strings.TrimSpace(content))
+}
+
+/* Executes a command and returns the reply */
+/* A reboot is not started here; Gateway.handle starts it after the reply was sent and the message deleted */
+func (g *Gateway) execute(ctx context.Context, cmd Command) string {
+	switch cmd.Verb {
+	case CmdSet:
+		if err := g.Device.SetDIO(ctx, cmd.Target, cmd.Value, tdce.Output); err != nil {
+			return fmt.Sprintf("%s failed: %v", cmd.Target, err)
+		}
+		return fmt.Sprintf("%s set to %s", cmd.Target, onOff(cmd.Value))
+
+	case CmdStatus:
+		return g.status(ctx)
+
+	case CmdGps:
+		if g.Position == nil {
+			return "GPS not available"
+		}
+		pos, ok := g.Position()
+		if !ok {
+			return "GPS: no position received"
+		}
+		if pos.Fix == 0 {
+			return fmt.Sprintf("GPS: no fix (%d satellites)", pos.NumberOfSatellites)
+		}
+		return fmt.Sprintf("GPS %.6f,%.6f sats %d hdop %.1f %s https://maps.google.com/?q=%.6f,%.6f",
+			pos.Latitude, pos.Longitude, pos.NumberOfSatellites, pos.Hdop, pos.Time, pos.Latitude, pos.Longitude)
+
+	case CmdReboot:
+		return "Rebooting"
+	}
+	return helpText
+}
+
+/* Reports the configured DIOs and the modem link */
+func (g *Gateway) status(ctx context.Context) string {
+	var parts []string
+	for _, name := range g.StatusDios {
+		dio, err := g.Device.GetDIO(ctx, name)
+		if err != nil {
+			parts = append(parts, name+" ?")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", name, onOff(dio.Value)))
+	}
+
+	details, err := g.modemDetails(ctx)
+	if err != nil {
+		parts = append(parts, "modem ?")
+	} else {
+		parts = append(parts, fmt.Sprintf("%s %s RSSI %d", details.OperatorName, details.DataLinkType, details.Rssi))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func onOff(value int) string {
+	if value != 0 {
+		return "ON"
+	}
+	return "OFF"
+}
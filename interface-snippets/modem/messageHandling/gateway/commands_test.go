@@ -0,0 +1,53 @@
+package gateway
+
+import "testing"
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		content string
+		want    Command
+	}{
+		{"STATUS", Command{Verb: CmdStatus}},
+		{"  status\n", Command{Verb: CmdStatus}},
+		{"gps", Command{Verb: CmdGps}},
+		{"Reboot", Command{Verb: CmdReboot}},
+		{"help", Command{Verb: CmdHelp}},
+		{"DIO_A ON", Command{Verb: CmdSet, Target: "DIO_A", Value: 1}},
+		{"dio_b  off", Command{Verb: CmdSet, Target: "DIO_B", Value: 0}},
+		{"DIO_C 1", Command{Verb: CmdSet, Target: "DIO_C", Value: 1}},
+		{"DIO_C 0", Command{Verb: CmdSet, Target: "DIO_C", Value: 0}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCommand(tt.content)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseCommand(%q) = %+v, %v; want %+v", tt.content, got, err, tt.want)
+		}
+	}
+
+	for _, content := range []string{"", "   ", "DIO_A", "DIO_A TOGGLE", "DIO_AB ON", "DIO_1 ON", "STATUS NOW", "OPEN DIO_A"} {
+		if got, err := ParseCommand(content); err == nil {
+			t.Errorf("ParseCommand(%q) = %+v, want an error", content, got)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct{ number, want string }{
+		{"+4512345678", "+4512345678"},
+		{"004512345678", "+4512345678"},
+		{"+45 12 34 56 78", "+4512345678"},
+		{"+45-1234-5678", "+4512345678"},
+		{"(+45) 12345678", "+4512345678"},
+		{"12345678", "12345678"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.number); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+
+	g := &Gateway{Whitelist: []string{"0045 12 34 56 78"}}
+	if !g.allowed("+4512345678") || g.allowed("+4587654321") {
+		t.Errorf("whitelist not compared after Normalize")
+	}
+}
@@ -0,0 +1,234 @@
+/* Package created 18.10.2026. */
+/* SMS command gateway: polls the modem for messages, executes commands from whitelisted senders and replies by SMS */
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tdce-shared/modem"
+	"tdce-shared/ropc"
+	"tdce-shared/tdce"
+)
+
+const DefaultAPI = "http://192.168.0.100/devicemanager/api/v1"
+
+/* Handled messages missing from the listings are remembered this long before they are forgotten */
+const HandledGrace = 24 * time.Hour
+
+/* SMS as returned by /networking/modem/ppp0/sms/messages */
+type Message struct {
+	Index   int    `json:"index"`
+	Sender  string `json:"sender"`
+	Content string `json:"content"`
+	Time    string `json:"time"`
+	Pdu     string `json:"pdu"`
+}
+
+/* Key under which a message is remembered as handled */
+/* The modem reuses indexes of deleted messages, so sender and time are part of the key */
+func (m Message) Key() string {
+	return fmt.Sprintf("%d|%s|%s", m.Index, m.Sender, m.Time)
+}
+
+/* Position as sent on /ws/tdce/gps/data; only the fields the GPS reply needs */
+type Position struct {
+	Fix                int     `json:"Fix"`
+	Hdop               float32 `json:"Hdop"`
+	Latitude           float32 `json:"Latitude"`
+	Longitude          float32 `json:"Longitude"`
+	NumberOfSatellites int     `json:"NumberOfSatellites"`
+	Time               string  `json:"Time"`
+}
+
+type modemDetails struct {
+	OperatorName string `json:"operatorName"`
+	DataLinkType string `json:"dataLinkType"`
+	Rssi         int    `json:"rssi"`
+}
+
+type Gateway struct {
+	// authorized client for the device manager API, see ropc.NewClient
+	API *http.Client
+	// device manager API base URL, DefaultAPI if empty
+	APIURL string
+	// client for the DIO REST API
+	Device *tdce.Client
+
+	// only these numbers may send commands; numbers are compared after Normalize
+	Whitelist []string
+	// DIOs reported by STATUS
+	StatusDios []string
+	// latest GPS position; GPS replies "not available" when nil
+	Position func() (Position, bool)
+
+	Handled  *Handled
+	Interval time.Duration
+}
+
+/* Removes spaces and dashes and turns a leading 00 into + */
+func Normalize(number string) string {
+	number = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(number)
+	if strings.HasPrefix(number, "00") {
+		number = "+" + number[2:]
+	}
+	return number
+}
+
+func (g *Gateway) allowed(sender string) bool {
+	sender = Normalize(sender)
+	for _, number := range g.Whitelist {
+		if Normalize(number) == sender {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) url(path string) string {
+	base := g.APIURL
+	if base == "" {
+		base = DefaultAPI
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+/* Polls for messages until ctx is cancelled */
+/* A poll that is running when ctx is cancelled still replies to and deletes its messages */
+func (g *Gateway) Run(ctx context.Context) error {
+	interval := g.Interval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.Poll(context.WithoutCancel(ctx)); err != nil {
+			log.Println("Error polling messages: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+/* Fetches the stored messages once and handles the new ones */
+func (g *Gateway) Poll(ctx context.Context) error {
+	body, err := ropc.MakeROPCRequest(ctx, g.API, g.url("/networking/modem/ppp0/sms/messages"))
+	if err != nil {
+		return err
+	}
+	var messages []Message
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return err
+	}
+
+	present := map[string]bool{}
+	for _, m := range messages {
+		present[m.Key()] = true
+		if g.Handled.Has(m.Key()) {
+			/* Handled before but still stored, the delete failed last time */
+			g.delete(ctx, m)
+			continue
+		}
+		g.handle(ctx, m)
+	}
+	return g.Handled.Retain(present, HandledGrace)
+}
+
+/* Executes one message and deletes it */
+func (g *Gateway) handle(ctx context.Context, m Message) {
+	/* Marked as handled before anything is executed; if persisting fails nothing runs */
+	if err := g.Handled.Add(m.Key()); err != nil {
+		log.Printf("Error saving handled message %d: %v\n", m.Index, err)
+		return
+	}
+
+	if !g.allowed(m.Sender) {
+		log.Printf("Ignoring message %d from %s: sender not whitelisted\n", m.Index, m.Sender)
+		g.delete(ctx, m)
+		return
+	}
+
+	cmd, parseErr := ParseCommand(m.Content)
+	var reply string
+	if parseErr != nil {
+		reply = fmt.Sprintf("%v. %s", parseErr, helpText)
+	} else {
+		log.Printf("Executing %q from %s\n", m.Content, m.Sender)
+		reply = g.execute(ctx, cmd)
+	}
+
+	if err := g.Send(ctx, m.Sender, reply); err != nil {
+		log.Printf("Error replying to %s: %v\n", m.Sender, err)
+	}
+	g.delete(ctx, m)
+
+	if parseErr == nil && cmd.Verb == CmdReboot {
+		if err := g.reboot(ctx); err != nil {
+			log.Println("Error rebooting: ", err)
+			g.Send(ctx, m.Sender, fmt.Sprintf("Reboot failed: %v", err))
+		}
+	}
+}
+
+/* Sends an SMS; replies longer than modem.MaxSMS are cut */
+func (g *Gateway) Send(ctx context.Context, number string, content string) error {
+	m := modem.Client{API: g.API, BaseURL: g.APIURL}
+	return m.SendSMS(ctx, number, content)
+}
+
+/* Deletes a message from the modem storage by its index */
+func (g *Gateway) delete(ctx context.Context, m Message) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, g.url("/networking/modem/ppp0/sms/messages/"+strconv.Itoa(m.Index)), nil)
+	if err != nil {
+		log.Println("Error deleting message: ", err)
+		return
+	}
+	resp, err := g.API.Do(req)
+	if err != nil {
+		log.Printf("Error deleting message %d: %v\n", m.Index, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Error deleting message %d: %s\n", m.Index, resp.Status)
+	}
+}
+
+func (g *Gateway) reboot(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, g.url("/system/power"), strings.NewReader(`{"operation":"reboot"}`))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.API.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT /system/power: %s", resp.Status)
+	}
+	return nil
+}
+
+func (g *Gateway) modemDetails(ctx context.Context) (modemDetails, error) {
+	var details modemDetails
+	body, err := ropc.MakeROPCRequest(ctx, g.API, g.url("/networking/modem/ppp0/details"))
+	if err != nil {
+		return details, err
+	}
+	err = json.Unmarshal(body, &details)
+	return details, err
+}
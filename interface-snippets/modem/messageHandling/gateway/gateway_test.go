@@ -0,0 +1,88 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+/* Device manager that lists messages, counts sent SMS and fails every delete */
+type fakeModem struct {
+	mu       sync.Mutex
+	messages []Message
+	sent     []string
+	deletes  int
+}
+
+func (f *fakeModem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/networking/modem/ppp0/sms/messages":
+		json.NewEncoder(w).Encode(f.messages)
+	case r.Method == http.MethodPost && r.URL.Path == "/networking/modem/ppp0/sms/messages":
+		var sms struct{ Content string }
+		json.NewDecoder(r.Body).Decode(&sms)
+		f.sent = append(f.sent, sms.Content)
+	case r.Method == http.MethodDelete:
+		f.deletes++
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeModem) list(messages ...Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = messages
+}
+
+/* The delete fails and the next listing is empty; when the SMS shows up again it is not run again */
+func TestRedeliveryAfterEmptyListing(t *testing.T) {
+	modem := &fakeModem{}
+	server := httptest.NewServer(modem)
+	defer server.Close()
+
+	handled, err := OpenHandled(filepath.Join(t.TempDir(), "handled.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gateway{API: server.Client(), APIURL: server.URL, Whitelist: []string{"+4512345678"}, Handled: handled}
+	help := Message{Index: 1, Sender: "+4512345678", Content: "HELP", Time: "2026-10-18 08:00:00"}
+
+	ctx := context.Background()
+	for _, listing := range [][]Message{{help}, {}, nil, {help}, {help}} {
+		modem.list(listing...)
+		if err := g.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(modem.sent) != 1 {
+		t.Errorf("%d replies sent, want 1: %q", len(modem.sent), modem.sent)
+	}
+	/* the delete is tried again whenever the message is listed */
+	if modem.deletes != 3 {
+		t.Errorf("%d deletes, want 3", modem.deletes)
+	}
+}
+
+func TestNotWhitelisted(t *testing.T) {
+	modem := &fakeModem{}
+	server := httptest.NewServer(modem)
+	defer server.Close()
+
+	handled, _ := OpenHandled(filepath.Join(t.TempDir(), "handled.json"))
+	g := &Gateway{API: server.Client(), APIURL: server.URL, Whitelist: []string{"+4512345678"}, Handled: handled}
+	modem.list(Message{Index: 2, Sender: "+4587654321", Content: "REBOOT", Time: "2026-10-18 08:00:00"})
+	if err := g.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(modem.sent) != 0 || modem.deletes != 1 {
+		t.Errorf("message from an unknown sender: %d replies, %d deletes; want none and a delete", len(modem.sent), modem.deletes)
+	}
+}
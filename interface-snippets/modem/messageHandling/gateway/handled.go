@@ -0,0 +1,126 @@
+/* Package created 18.10.2026. */
+/* Remembers which SMS messages were already handled, across restarts */
+
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* Handled is a set of message keys persisted to a JSON file; safe for concurrent use */
+/* Every change is written to disk before it is reported, so a command is never executed twice */
+type Handled struct {
+	path string
+
+	mu sync.Mutex
+	// when the message was handled or last seen in a listing
+	keys map[string]time.Time
+}
+
+type handledFile struct {
+	Handled map[string]time.Time `json:"handled"`
+}
+
+/* Loads the set from path; a missing file is an empty set */
+func OpenHandled(path string) (*Handled, error) {
+	h := &Handled{path: path, keys: map[string]time.Time{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file handledFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, at := range file.Handled {
+		h.keys[key] = at
+	}
+	return h, nil
+}
+
+func (h *Handled) Has(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.keys[key]
+	return ok
+}
+
+/* Adds key and persists the set */
+func (h *Handled) Add(key string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.keys[key]; ok {
+		return nil
+	}
+	h.keys[key] = time.Now()
+	if err := h.save(); err != nil {
+		delete(h.keys, key)
+		return err
+	}
+	return nil
+}
+
+/* Drops the keys that are not in present and were last seen more than grace ago */
+/* A listing can come back partial or empty, so a missing key is only forgotten once the message can't come back */
+/* The time of a present key is refreshed when it is older than half of grace, so the file isn't written on every poll */
+func (h *Handled) Retain(present map[string]bool, grace time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+	for key, seen := range h.keys {
+		switch {
+		case present[key] && now.Sub(seen) > grace/2:
+			h.keys[key] = now
+			changed = true
+		case !present[key] && now.Sub(seen) > grace:
+			delete(h.keys, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return h.save()
+}
+
+/* Writes the set to a temporary file and renames it over the old one */
+func (h *Handled) save() error {
+	data, err := json.MarshalIndent(handledFile{Handled: h.keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.path)
+}
@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandledPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handled.json")
+	h, err := OpenHandled(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Has("1|+4512345678|t") {
+		t.Fatalf("empty set has a key")
+	}
+	if err := h.Add("1|+4512345678|t"); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = OpenHandled(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Has("1|+4512345678|t") {
+		t.Errorf("key lost across a restart")
+	}
+}
+
+func TestHandledBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handled.json")
+	os.WriteFile(path, []byte("{"), 0o644)
+	if _, err := OpenHandled(path); err == nil {
+		t.Errorf("OpenHandled accepted a broken file")
+	}
+}
+
+/* A partial or empty listing must not make the gateway forget a message it already executed */
+func TestHandledRetainGrace(t *testing.T) {
+	h, err := OpenHandled(filepath.Join(t.TempDir(), "handled.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add("fresh")
+	h.Add("old")
+	h.Add("old but listed")
+	h.keys["old"] = time.Now().Add(-25 * time.Hour)
+	h.keys["old but listed"] = time.Now().Add(-25 * time.Hour)
+
+	if err := h.Retain(map[string]bool{"old but listed": true}, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Has("fresh") {
+		t.Errorf("key missing from one listing forgotten within the grace period")
+	}
+	if h.Has("old") {
+		t.Errorf("key missing for longer than the grace period kept")
+	}
+	/* still stored on the modem: it is kept and its time refreshed */
+	if !h.Has("old but listed") || time.Since(h.keys["old but listed"]) > time.Minute {
+		t.Errorf("listed key dropped or not refreshed")
+	}
+}
@@ -1,29 +1,63 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	o2 "modemmsg/request"
+	"modemmsg/gateway"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"tdce-shared/config"
+	"tdce-shared/health"
+	"tdce-shared/ropc"
+	"tdce-shared/supervisor"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
 )
 
-type modemMsg struct {
-	Index   int    `json:"index"`
-	Sender  string `json:"sender"`
-	Content string `json:"content"`
-	Time    string `json:"time"`
-	Pdu     string `json:"pdu"`
+/* Settings read from config.yaml, SMS_* environment variables and flags */
+type settings struct {
+	// numbers allowed to send commands, e.g. "+385981234567"
+	Whitelist []string `json:"whitelist" validate:"required" help:"numbers allowed to send commands"`
+	// DIOs reported by STATUS
+	StatusDios []string `json:"statusDios" help:"DIOs reported by STATUS"`
+	// device manager API; its OAuth client is read from oauthConf in params
+	API    string `json:"api" validate:"required,url" help:"device manager API base URL"`
+	Params string `json:"params" validate:"required" help:"JSON file with oauthConf"`
+	Device string `json:"device" validate:"required,url" help:"base URL of the DIO REST API"`
+	// for safety, reference the password from a file, e.g. SMS_PASSWORD_FILE=/run/secrets/tdce_password
+	Password  config.Secret `json:"password" validate:"required" help:"password of the DIO REST API"`
+	WebSocket string        `json:"websocket" validate:"required,hostport" help:"host:port of the device websocket"`
+	// file with the messages already handled
+	StateFile    string          `json:"stateFile" validate:"required" help:"file with the messages already handled"`
+	PollInterval config.Duration `json:"pollInterval" validate:"min=1s" help:"time between polls of the SMS inbox"`
+	// /healthz and /readyz for Docker HEALTHCHECK and Portainer; empty disables them
+	HealthAddress string `json:"healthAddress" help:"address of /healthz and /readyz, empty disables them"`
 }
 
-type postMsg struct {
-	PhoneNumber string `json:"phoneNumber"`
-	Content     string `json:"content"`
+func defaults() settings {
+	return settings{
+		StatusDios:    []string{"DIO_A", "DIO_B"},
+		API:           gateway.DefaultAPI,
+		Params:        "params.json",
+		Device:        tdce.DefaultBaseURL,
+		Password:      config.NewSecret("servicelevel"),
+		WebSocket:     "192.168.0.100:31768",
+		StateFile:     "handled.json",
+		PollInterval:  config.Duration(2 * time.Second),
+		HealthAddress: ":8083",
+	}
 }
 
 var (
-	token string
-	msg   []modemMsg
+	latestGps     gateway.Position
+	latestGpsOk   bool
+	latestGpsLock sync.Mutex
+	gpsStream     atomic.Pointer[wsclient.Client]
 )
 
 /* Function for handling errors */
@@ -32,76 +66,86 @@ func handleError(err error) {
 	panic(err)
 }
 
-/* Sets OAuth2.0 token every 59 minutes (expires after 60 minutes) */
-func setToken() {
-	for {
-		token = o2.Authorize()
-		/* Sleep for 59 minutes before reset */
-		if token != "" {
-			time.Sleep(59 * time.Minute)
-		}
-	}
-}
+/* Keeps the latest GPS position for the GPS command */
+func trackGps(ctx context.Context, websocket string) error {
+	cfg := wsclient.Config{URL: wsclient.URL(websocket, wsclient.GpsData)}
+	client, stream := wsclient.Subscribe[gateway.Position](ctx, cfg)
+	gpsStream.Store(client)
 
-/* Fetches mdoem messages from REST API */
-func fetchMessages() {
-	for {
-		time.Sleep(2 * time.Second)
-		err := json.Unmarshal(o2.MakeROPCRequest("http://192.168.0.100/devicemanager/api/v1/networking/modem/ppp0/sms/messages", token), &msg)
-		if err != nil {
-			handleError(err)
-		}
-		fmt.Println(msg)
+	for pos := range stream {
+		latestGpsLock.Lock()
+		latestGps = pos
+		latestGpsOk = true
+		latestGpsLock.Unlock()
 	}
+	return nil
 }
 
-/* Posts message with defined parameters */
-func postMessage() {
-	time.Sleep(5 * time.Second)
-	if token != "" {
-		// insert phone number here
-		phoneNumber := "+XXXXXXXXXXXX"
-		content := "hello world"
-		url := "http://192.168.0.100/devicemanager/api/v1/networking/modem/ppp0/sms/messages"
-
-		// setting values
-		var poster postMsg
-		poster.PhoneNumber = phoneNumber
-		poster.Content = content
-
-		// setting up a JSON object from created object
-		jsonData, err := json.Marshal(poster)
-		if err != nil {
-			handleError(err)
-		}
-		o2.PostROPCMessage(url, token, jsonData)
-	} else {
-		fmt.Println("Token wasn't fetched. Try again.")
-	}
+func currentGps() (gateway.Position, bool) {
+	latestGpsLock.Lock()
+	defer latestGpsLock.Unlock()
+	return latestGps, latestGpsOk
 }
 
 func main() {
-	var wg sync.WaitGroup
-	wg.Add(3)
-
-	// setting token
-	go func() {
-		defer wg.Done()
-		setToken()
-	}()
-
-	// fecth REST API messages
-	go func() {
-		defer wg.Done()
-		fetchMessages()
-	}()
-
-	// send REST API messages
-	go func() {
-		defer wg.Done()
-		postMessage()
-	}()
-
-	// wait for all goroutines to finish
-	wg.Wait()
+	conf := config.NewStore(defaults(), config.Options{
+		Name:      "modemmsg",
+		File:      "config.yaml",
+		EnvPrefix: "SMS",
+		Args:      os.Args[1:],
+	}).Get()
+
+	oauthConf, err := ropc.LoadConfig(conf.Params)
+	if err != nil {
+		fmt.Println("Error opening config file: ", err)
+		return
+	}
+
+	handled, err := gateway.OpenHandled(conf.StateFile)
+	if err != nil {
+		handleError(err)
+	}
+
+	token := ropc.NewTokenSource(oauthConf)
+	gw := &gateway.Gateway{
+		API:        ropc.NewClient(token),
+		APIURL:     conf.API,
+		Device:     tdce.NewClient(conf.Device, conf.Password.Value()),
+		Whitelist:  conf.Whitelist,
+		StatusDios: conf.StatusDios,
+		Position:   currentGps,
+		Handled:    handled,
+		Interval:   time.Duration(conf.PollInterval),
+	}
+	/* Both loops are restarted if they crash; Ctrl-C or docker stop lets the running poll finish */
+	sup := supervisor.New()
+	sup.Go("gps", func(ctx context.Context) error {
+		return trackGps(ctx, conf.WebSocket)
+	})
+	sup.Go("sms", gw.Run)
+
+	/* /healthz restarts a wedged gateway, /readyz also reports the APIs it needs */
+	if conf.HealthAddress != "" {
+		checks := health.New()
+		checks.Live("services", health.Supervisor(sup))
+		checks.Ready("api token", health.Token(token))
+		checks.Ready("device token", func(ctx context.Context) (map[string]any, error) {
+			_, err := gw.Device.Token(ctx)
+			return nil, err
+		})
+		/* No position is not fatal, GPS only answers that it has none */
+		checks.Ready("gps stream", health.Stream(gpsStream.Load, time.Minute))
+		sup.Go("health", func(ctx context.Context) error {
+			return checks.Serve(ctx, conf.HealthAddress)
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("SMS gateway running, accepting commands from %v\n", conf.Whitelist)
+	if err := sup.Run(ctx); err != nil {
+		fmt.Println("Error shutting down: ", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,27 @@
+#!/bin/bash
+# Creates a test CA, a broker certificate and a client certificate in ./certs
+# The broker certificate is valid for mosquitto, localhost, 127.0.0.1 and 192.168.0.100;
+# add more names with BROKER_NAMES="DNS:broker.example.com,IP:10.0.0.5" ./certs.sh
+
+set -e
+mkdir -p certs
+cd certs
+
+NAMES="DNS:mosquitto,DNS:localhost,IP:127.0.0.1,IP:192.168.0.100${BROKER_NAMES:+,$BROKER_NAMES}"
+CLIENT=${CLIENT:-clientest}
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -subj "/CN=TDC-E test CA" \
+    -keyout ca.key -out ca.crt
+
+openssl req -newkey rsa:2048 -nodes -subj "/CN=mosquitto" -keyout server.key -out server.csr
+openssl x509 -req -in server.csr -CA ca.crt -CAkey ca.key -CAcreateserial -days 825 \
+    -extfile <(printf "subjectAltName=%s\nextendedKeyUsage=serverAuth" "$NAMES") -out server.crt
+
+openssl req -newkey rsa:2048 -nodes -subj "/CN=$CLIENT" -keyout client.key -out client.csr
+openssl x509 -req -in client.csr -CA ca.crt -CAkey ca.key -CAcreateserial -days 825 \
+    -extfile <(printf "extendedKeyUsage=clientAuth") -out client.crt
+
+rm -f server.csr client.csr
+# mosquitto runs as its own user in the container
+chmod 644 server.key
+echo "Created certs/ca.crt, certs/server.{crt,key} and certs/client.{crt,key}"
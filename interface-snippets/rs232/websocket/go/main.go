@@ -1,43 +1,59 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"sync"
-	websocket "websocket-rs232/websockets"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tdce-shared/config"
+	"tdce-shared/wsclient"
 )
 
+/* Settings read from config.yaml, RS232_* environment variables and flags */
+type settings struct {
+	WebSocket string `json:"websocket" validate:"required,hostport" help:"host:port of the device websocket"`
+}
+
 func main() {
-	var wg sync.WaitGroup
-	wg.Add(1)
+	cfg := config.NewStore(settings{WebSocket: "192.168.0.100:31768"}, config.Options{
+		Name:      "websocket-rs232",
+		File:      "config.yaml",
+		EnvPrefix: "RS232",
+		Args:      os.Args[1:],
+	}).Get()
+
+	/* The client reconnects on its own; Ctrl-C closes the websocket cleanly */
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	/* Open connection for reading and writing to websocket */
-	conn, err := websocket.OpenWebsocket("ws", "192.168.0.100:31768", "/ws/tdce/rs232/data")
-	if err != nil {
-		fmt.Println("Error opening websocket: ", err)
-	}
-	defer conn.Close()
+	client := wsclient.New(wsclient.Config{URL: wsclient.URL(cfg.WebSocket, wsclient.Rs232Data)})
+	go client.Run(ctx)
 
-	/* Goroutine for data fetching */
+	/* Sending data to websocket once the connection is up */
+	/* Specify data here... */
 	go func() {
-		defer wg.Done()
-		fmt.Println("Listening on websocket...")
-		for {
-			msg, erro := websocket.ListenOnWS(conn)
-			if erro != nil {
-				fmt.Println("Error fetching data: ", erro)
-				break
+		message := "dGVzdAo="
+		for !client.Connected() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(100 * time.Millisecond):
 			}
-			receivedString := string(msg)
-			fmt.Printf("Received string: %s\n", receivedString)
+		}
+		if err := client.Send([]byte(message)); err != nil {
+			log.Println("Error sending message: ", err)
 		}
 	}()
 
-	/* Sending data to websocket */
-	/* Specify data here... */
-	message := "dGVzdAo="
-	if err := websocket.SendToWS(conn, []byte(message)); err != nil {
-		log.Println("Error sending message: ", err)
+	/* Data fetching */
+	fmt.Println("Listening on websocket...")
+	for msg := range client.Messages() {
+		receivedString := string(msg)
+		fmt.Printf("Received string: %s\n", receivedString)
 	}
-	wg.Wait()
 }
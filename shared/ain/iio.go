@@ -0,0 +1,100 @@
+/* Package created 18.10.2026. */
+/* Analog inputs read straight from the IIO sysfs files, calibrated and mapped to engineering units */
+
+package ain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRoot   = "/sys/bus/iio/devices"
+	DefaultDevice = "iio:device1"
+)
+
+/* Reads the ADC channels of one IIO device, e.g. AIN F is in_voltage5_raw and in_voltage5_scale */
+/* Root can point to a copy of the tree, so the calibration can be checked without the device */
+type IIO struct {
+	// defaults to /sys/bus/iio/devices
+	Root string
+	// defaults to iio:device1
+	Device string
+}
+
+/* One conversion of an ADC channel as the driver reports it */
+type Sample struct {
+	Channel int
+	Raw     float64
+	// (raw + offset) * scale; the unit is whatever the driver's scale gives
+	Value float64
+	Time  time.Time
+}
+
+func (d IIO) dir() string {
+	root, device := d.Root, d.Device
+	if root == "" {
+		root = DefaultRoot
+	}
+	if device == "" {
+		device = DefaultDevice
+	}
+	return filepath.Join(root, device)
+}
+
+/* Reads in_voltageN_raw and applies the scale and offset of the channel */
+/* Drivers that share one scale for all channels only have in_voltage_scale, so that is the fallback */
+func (d IIO) Read(channel int) (Sample, error) {
+	dir := d.dir()
+	raw, err := readFloat(filepath.Join(dir, fmt.Sprintf("in_voltage%d_raw", channel)))
+	if err != nil {
+		return Sample{}, err
+	}
+	scale, err := d.attribute(channel, "scale", 1)
+	if err != nil {
+		return Sample{}, err
+	}
+	offset, err := d.attribute(channel, "offset", 0)
+	if err != nil {
+		return Sample{}, err
+	}
+	return Sample{
+		Channel: channel,
+		Raw:     raw,
+		Value:   (raw + offset) * scale,
+		Time:    time.Now(),
+	}, nil
+}
+
+/* Per-channel attribute, the shared one, or def when the driver has neither */
+func (d IIO) attribute(channel int, name string, def float64) (float64, error) {
+	dir := d.dir()
+	for _, file := range []string{
+		fmt.Sprintf("in_voltage%d_%s", channel, name),
+		"in_voltage_" + name,
+	} {
+		v, err := readFloat(filepath.Join(dir, file))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		return v, err
+	}
+	return def, nil
+}
+
+func readFloat(path string) (float64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,110 @@
+package ain
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* Writes the sysfs files of one IIO device under a temporary root */
+func fakeTree(t *testing.T, files map[string]string) IIO {
+	t.Helper()
+	root := t.TempDir()
+	dir := filepath.Join(root, DefaultDevice)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return IIO{Root: root}
+}
+
+func TestRead(t *testing.T) {
+	iio := fakeTree(t, map[string]string{
+		"in_voltage5_raw":    "2048\n",
+		"in_voltage5_scale":  "0.5\n",
+		"in_voltage3_raw":    "100\n",
+		"in_voltage2_raw":    "100\n",
+		"in_voltage2_offset": "-20\n",
+		"in_voltage_scale":   "0.25\n",
+	})
+	tests := []struct {
+		channel int
+		raw     float64
+		value   float64
+	}{
+		{5, 2048, 1024},
+		/* no in_voltage3_scale: the shared scale */
+		{3, 100, 25},
+		{2, 100, 20},
+	}
+	for _, tt := range tests {
+		s, err := iio.Read(tt.channel)
+		if err != nil {
+			t.Fatalf("Read(%d): %v", tt.channel, err)
+		}
+		if s.Channel != tt.channel || s.Raw != tt.raw || s.Value != tt.value {
+			t.Errorf("Read(%d) = %+v, want raw %g value %g", tt.channel, s, tt.raw, tt.value)
+		}
+	}
+}
+
+/* Without any scale file the driver's value is the raw value */
+func TestReadWithoutScale(t *testing.T) {
+	iio := fakeTree(t, map[string]string{"in_voltage0_raw": "42"})
+	s, err := iio.Read(0)
+	if err != nil || s.Value != 42 {
+		t.Errorf("Read(0) = %+v, %v; want 42", s, err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	iio := fakeTree(t, map[string]string{
+		"in_voltage1_raw":   "12ab",
+		"in_voltage4_raw":   "100",
+		"in_voltage4_scale": "",
+	})
+	if _, err := iio.Read(0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read(0) of a missing channel = %v, want not exist", err)
+	}
+	if _, err := iio.Read(1); err == nil || !strings.Contains(err.Error(), "in_voltage1_raw") {
+		t.Errorf("Read(1) = %v, want a parse error naming the file", err)
+	}
+	if _, err := iio.Read(4); err == nil || !strings.Contains(err.Error(), "in_voltage4_scale") {
+		t.Errorf("Read(4) = %v, want a parse error naming the scale", err)
+	}
+	if _, err := (IIO{Root: iio.Root, Device: "iio:device7"}).Read(5); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of another device = %v, want not exist", err)
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	iio := fakeTree(t, map[string]string{
+		"in_voltage5_raw":   "1500",
+		"in_voltage5_scale": "0.001",
+	})
+	p := Profile{Name: "AIN_F", Channel: 5, Mode: ModeVoltage, Divider: 2}
+	r, err := iio.Measure(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "AIN_F" || r.Raw != 1500 || !near(r.Volts, 1.5) || !near(r.Signal, 3) || r.Unit != "V" || r.Status != StatusOK {
+		t.Errorf("Measure = %+v, want 3 V from 1.5 V at the ADC", r)
+	}
+
+	p.Channel = 6
+	if _, err := iio.Measure(p); err == nil || !strings.HasPrefix(err.Error(), "AIN_F: ") {
+		t.Errorf("Measure of a missing channel = %v, want an error naming the profile", err)
+	}
+}
+
+func TestDefaultTree(t *testing.T) {
+	if dir := (IIO{}).dir(); dir != filepath.Join("/sys/bus/iio/devices", "iio:device1") {
+		t.Errorf("dir() = %s, want the TDCE device", dir)
+	}
+}
@@ -0,0 +1,275 @@
+package ain
+
+import (
+	"math"
+	"slices"
+	"time"
+
+	"tdce-shared/config"
+)
+
+/* One value of an input on its way through a pipeline */
+type Measurement struct {
+	Channel string    `json:"channel"`
+	Value   float64   `json:"value"`
+	Time    time.Time `json:"time"`
+	// empty when the source doesn't know it, e.g. the WebSocket stream
+	Status Status `json:"status,omitempty"`
+}
+
+func (r Reading) Measurement() Measurement {
+	return Measurement{Channel: r.Name, Value: r.Value, Time: r.Time, Status: r.Status}
+}
+
+/* A step of a pipeline; ok is false when the value goes no further */
+/* Stages keep state, so every channel needs its own */
+type Stage interface {
+	Process(m Measurement) (out Measurement, ok bool)
+}
+
+/* Stages that also act on time passing, like the end of a statistics window */
+type Ticker interface {
+	Tick(now time.Time)
+}
+
+/* Stages run one after another; typically filters first and Deadband last */
+type Pipeline struct {
+	stages []Stage
+}
+
+func NewPipeline(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+/* Runs m through the stages; ok is true when it came out at the end and should be stored or published */
+func (p *Pipeline) Push(m Measurement) (Measurement, bool) {
+	for _, s := range p.stages {
+		var ok bool
+		if m, ok = s.Process(m); !ok {
+			return m, false
+		}
+	}
+	return m, true
+}
+
+/* Lets the stages act on time passing, e.g. from a ticker, so windows end without new values */
+func (p *Pipeline) Tick(now time.Time) {
+	for _, s := range p.stages {
+		if t, ok := s.(Ticker); ok {
+			t.Tick(now)
+		}
+	}
+}
+
+/* One pipeline per channel, built on first use; not safe for concurrent use */
+type Channels struct {
+	build     func(channel string) *Pipeline
+	pipelines map[string]*Pipeline
+}
+
+func NewChannels(build func(channel string) *Pipeline) *Channels {
+	return &Channels{build: build, pipelines: map[string]*Pipeline{}}
+}
+
+func (c *Channels) Push(m Measurement) (Measurement, bool) {
+	p, ok := c.pipelines[m.Channel]
+	if !ok {
+		p = c.build(m.Channel)
+		c.pipelines[m.Channel] = p
+	}
+	return p.Push(m)
+}
+
+func (c *Channels) Tick(now time.Time) {
+	for _, p := range c.pipelines {
+		p.Tick(now)
+	}
+}
+
+/* Averages every N values into one; fast sampling then gives fewer, less noisy values */
+type Oversample struct {
+	N int
+
+	sum   float64
+	count int
+}
+
+func (o *Oversample) Process(m Measurement) (Measurement, bool) {
+	if o.N <= 1 {
+		return m, true
+	}
+	o.sum += m.Value
+	o.count++
+	if o.count < o.N {
+		return m, false
+	}
+	m.Value = o.sum / float64(o.count)
+	o.sum, o.count = 0, 0
+	return m, true
+}
+
+/* Median of the last Size values; removes single spikes without smearing steps */
+type Median struct {
+	Size int
+
+	window []float64
+}
+
+func (f *Median) Process(m Measurement) (Measurement, bool) {
+	if f.Size <= 1 {
+		return m, true
+	}
+	f.window = append(f.window, m.Value)
+	if len(f.window) > f.Size {
+		f.window = f.window[1:]
+	}
+	sorted := slices.Clone(f.window)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		m.Value = sorted[n/2]
+	} else {
+		m.Value = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return m, true
+}
+
+/* Exponential moving average; Alpha between 0 and 1, smaller smooths more */
+type EMA struct {
+	Alpha float64
+
+	value  float64
+	primed bool
+}
+
+func (f *EMA) Process(m Measurement) (Measurement, bool) {
+	if f.Alpha <= 0 || f.Alpha >= 1 {
+		return m, true
+	}
+	if !f.primed {
+		f.value, f.primed = m.Value, true
+	} else {
+		f.value += f.Alpha * (m.Value - f.value)
+	}
+	m.Value = f.value
+	return m, true
+}
+
+/* Lets a value through only when it moved far enough from the last one that went through */
+/* With neither Absolute nor Percent set, every change goes through */
+type Deadband struct {
+	// smallest change in engineering units
+	Absolute float64
+	// or in percent of the last value that went through; after a 0 only Absolute applies, if set
+	Percent float64
+	// lets a value through after this long anyway, so receivers know the input is alive; 0 never
+	Heartbeat time.Duration
+
+	last *Measurement
+}
+
+func (d *Deadband) Process(m Measurement) (Measurement, bool) {
+	if d.last == nil || d.changed(*d.last, m) {
+		d.last = &m
+		return m, true
+	}
+	return m, false
+}
+
+func (d *Deadband) changed(last, m Measurement) bool {
+	/* Faults and their end are always worth a message */
+	if m.Status != last.Status {
+		return true
+	}
+	if d.Heartbeat > 0 && m.Time.Sub(last.Time) >= d.Heartbeat {
+		return true
+	}
+	delta := math.Abs(m.Value - last.Value)
+	if d.Absolute <= 0 && d.Percent <= 0 {
+		return delta > 0
+	}
+	if d.Absolute > 0 && delta >= d.Absolute {
+		return true
+	}
+	if d.Percent <= 0 {
+		return false
+	}
+	/* Any percentage of 0 is 0, so an idle input would go through every time; Absolute decides there */
+	/* Without it any move away from 0 goes through */
+	if last.Value == 0 {
+		return d.Absolute <= 0 && delta > 0
+	}
+	return delta >= d.Percent/100*math.Abs(last.Value)
+}
+
+/* Minimum, maximum and average of one channel over one window */
+type Stats struct {
+	Channel string    `json:"channel"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Count   int       `json:"count"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Avg     float64   `json:"avg"`
+}
+
+/* Collects statistics of the values passing by and hands them to Emit when a window is over */
+/* Windows are aligned to the clock, e.g. full minutes; windows without values are not emitted */
+type Window struct {
+	Length time.Duration
+	Emit   func(Stats)
+
+	current Stats
+	sum     float64
+}
+
+func (w *Window) Process(m Measurement) (Measurement, bool) {
+	if w.Length <= 0 {
+		return m, true
+	}
+	w.Tick(m.Time)
+	if w.current.Count == 0 {
+		start := m.Time.Truncate(w.Length)
+		w.current = Stats{Channel: m.Channel, Start: start, End: start.Add(w.Length), Min: m.Value, Max: m.Value}
+		w.sum = 0
+	}
+	w.current.Count++
+	w.current.Min = min(w.current.Min, m.Value)
+	w.current.Max = max(w.current.Max, m.Value)
+	w.sum += m.Value
+	return m, true
+}
+
+func (w *Window) Tick(now time.Time) {
+	if w.current.Count == 0 || now.Before(w.current.End) {
+		return
+	}
+	stats := w.current
+	stats.Avg = w.sum / float64(stats.Count)
+	w.current = Stats{}
+	if w.Emit != nil {
+		w.Emit(stats)
+	}
+}
+
+/* Settings of a pipeline for the config files of the examples; zero values leave a stage out */
+type Filter struct {
+	Oversample int             `json:"oversample" validate:"min=0" help:"number of values averaged into one"`
+	Median     int             `json:"median" validate:"min=0" help:"size of the median filter"`
+	EMA        float64         `json:"ema" validate:"min=0,max=1" help:"factor of the exponential moving average, 0 disables it"`
+	Deadband   float64         `json:"deadband" validate:"min=0" help:"smallest change that is reported"`
+	Percent    float64         `json:"percent" validate:"min=0" help:"smallest change in percent that is reported"`
+	Heartbeat  config.Duration `json:"heartbeat" help:"report the value after this long even without a change, 0 never"`
+	Window     config.Duration `json:"window" help:"length of the min/max/avg statistics windows, 0 disables them"`
+}
+
+/* Oversampling, median, EMA, statistics of the filtered values, then the deadband */
+func (f Filter) Build(emit func(Stats)) *Pipeline {
+	return NewPipeline(
+		&Oversample{N: f.Oversample},
+		&Median{Size: f.Median},
+		&EMA{Alpha: f.EMA},
+		&Window{Length: time.Duration(f.Window), Emit: emit},
+		&Deadband{Absolute: f.Deadband, Percent: f.Percent, Heartbeat: time.Duration(f.Heartbeat)},
+	)
+}
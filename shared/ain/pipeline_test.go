@@ -0,0 +1,215 @@
+package ain
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"tdce-shared/config"
+)
+
+var t0 = time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+
+/* Measurements of AIN_A one second apart */
+func signal(values ...float64) []Measurement {
+	ms := make([]Measurement, len(values))
+	for i, v := range values {
+		ms[i] = Measurement{Channel: "AIN_A", Value: v, Time: t0.Add(time.Duration(i) * time.Second), Status: StatusOK}
+	}
+	return ms
+}
+
+/* Runs the measurements through s; the values that went through, in order */
+func run(s Stage, ms []Measurement) []float64 {
+	var out []float64
+	for _, m := range ms {
+		if m, ok := s.Process(m); ok {
+			out = append(out, m.Value)
+		}
+	}
+	return out
+}
+
+func equal(t *testing.T, name string, got, want []float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %v, want %v", name, got, want)
+		return
+	}
+	for i := range got {
+		if !near(got[i], want[i]) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestOversample(t *testing.T) {
+	equal(t, "N=4", run(&Oversample{N: 4}, signal(1, 2, 3, 4, 10, 10, 10, 14, 99)), []float64{2.5, 11})
+	equal(t, "N=1", run(&Oversample{N: 1}, signal(1, 2, 3)), []float64{1, 2, 3})
+	equal(t, "N=0", run(&Oversample{}, signal(1, 2)), []float64{1, 2})
+
+	/* the averaged value carries the time of the last one */
+	o := &Oversample{N: 2}
+	ms := signal(1, 3)
+	o.Process(ms[0])
+	if m, _ := o.Process(ms[1]); !m.Time.Equal(ms[1].Time) {
+		t.Errorf("time %s, want %s", m.Time, ms[1].Time)
+	}
+}
+
+func TestMedianRejectsSpikes(t *testing.T) {
+	/* single spikes up and down disappear, the step from 5 to 8 stays sharp */
+	got := run(&Median{Size: 3}, signal(5, 5, 50, 5, 5, -40, 5, 8, 8, 8))
+	equal(t, "size 3", got, []float64{5, 5, 5, 5, 5, 5, 5, 5, 8, 8})
+
+	/* even sizes average the middle two */
+	equal(t, "size 4", run(&Median{Size: 4}, signal(1, 2, 3, 4)), []float64{1, 1.5, 2, 2.5})
+	equal(t, "size 1", run(&Median{Size: 1}, signal(1, 9, 1)), []float64{1, 9, 1})
+}
+
+func TestEMAStepResponse(t *testing.T) {
+	/* a step from 0 to 1 closes (1-alpha)^n of the gap after n values */
+	alpha := 0.25
+	got := run(&EMA{Alpha: alpha}, signal(0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1))
+	if got[0] != 0 {
+		t.Errorf("first value %g, want 0: the first value primes the average", got[0])
+	}
+	for n := 1; n < len(got); n++ {
+		want := 1 - math.Pow(1-alpha, float64(n))
+		if !near(got[n], want) {
+			t.Errorf("%d values after the step: %g, want %g", n, got[n], want)
+		}
+	}
+	/* 0 and 1 disable the filter */
+	equal(t, "alpha 0", run(&EMA{}, signal(0, 1)), []float64{0, 1})
+	equal(t, "alpha 1", run(&EMA{Alpha: 1}, signal(0, 1)), []float64{0, 1})
+}
+
+func TestDeadband(t *testing.T) {
+	tests := []struct {
+		name   string
+		d      Deadband
+		values []float64
+		want   []float64
+	}{
+		{"every change", Deadband{}, []float64{1, 1, 2, 2, 1}, []float64{1, 2, 1}},
+		{"absolute", Deadband{Absolute: 0.5}, []float64{10, 10.2, 10.4, 10.5, 10.7, 9.9}, []float64{10, 10.5, 9.9}},
+		/* 10 % of the last value that went through: 10 needs 1, 11 needs 1.1 */
+		{"percent", Deadband{Percent: 10}, []float64{10, 10.5, 10.99, 11, 12, 12.2, 9.8}, []float64{10, 11, 12.2, 9.8}},
+		{"percent of negative", Deadband{Percent: 10}, []float64{-10, -10.5, -11}, []float64{-10, -11}},
+		{"absolute or percent", Deadband{Absolute: 3, Percent: 50}, []float64{100, 102, 103, 104}, []float64{100, 103}},
+		/* an idle input at 0 stays quiet; leaving 0 goes through */
+		{"percent at zero", Deadband{Percent: 10}, []float64{0, 0, 0, 0, 0.2, 0.21, 0.23, 0}, []float64{0, 0.2, 0.23, 0}},
+		/* with Absolute set only that counts after a 0 */
+		{"percent at zero with absolute", Deadband{Absolute: 0.5, Percent: 10}, []float64{0, 0, 0.2, 0.4, 0.6, 0.62, 0.7}, []float64{0, 0.6, 0.7}},
+	}
+	for _, tt := range tests {
+		d := tt.d
+		equal(t, tt.name, run(&d, signal(tt.values...)), tt.want)
+	}
+}
+
+func TestDeadbandHeartbeat(t *testing.T) {
+	d := &Deadband{Absolute: 1, Heartbeat: 10 * time.Second}
+	ms := signal(make([]float64, 25)...)
+	var passed []int
+	for i, m := range ms {
+		if _, ok := d.Process(m); ok {
+			passed = append(passed, i)
+		}
+	}
+	if len(passed) != 3 || passed[0] != 0 || passed[1] != 10 || passed[2] != 20 {
+		t.Errorf("unchanged values went through at seconds %v, want 0, 10, 20", passed)
+	}
+}
+
+func TestDeadbandStatusChange(t *testing.T) {
+	d := &Deadband{Absolute: 100}
+	ms := signal(3.7, 3.5, 3.5, 3.7, 3.7)
+	ms[1].Status, ms[2].Status = StatusFaultLow, StatusFaultLow
+	ms[0].Status, ms[3].Status, ms[4].Status = StatusUnderRange, StatusUnderRange, StatusUnderRange
+	equal(t, "fault and its end", run(d, ms), []float64{3.7, 3.5, 3.7})
+}
+
+func TestWindowAligned(t *testing.T) {
+	var emitted []Stats
+	w := &Window{Length: time.Minute, Emit: func(s Stats) { emitted = append(emitted, s) }}
+
+	/* 08:00:30 to 08:01:29, one value a second; the first window only has its second half */
+	start := t0.Add(30 * time.Second)
+	for i := 0; i < 60; i++ {
+		m := Measurement{Channel: "AIN_A", Value: float64(i), Time: start.Add(time.Duration(i) * time.Second)}
+		if out, ok := w.Process(m); !ok || out != m {
+			t.Fatalf("Process changed or held back %+v", m)
+		}
+	}
+	if len(emitted) != 1 {
+		t.Fatalf("%d windows emitted, want 1", len(emitted))
+	}
+	s := emitted[0]
+	if s.Channel != "AIN_A" || !s.Start.Equal(t0) || !s.End.Equal(t0.Add(time.Minute)) ||
+		s.Count != 30 || s.Min != 0 || s.Max != 29 || !near(s.Avg, 14.5) {
+		t.Errorf("first window = %+v, want 08:00-08:01 with 30 values 0..29", s)
+	}
+
+	/* the input goes quiet; Tick ends the window at its end, not before */
+	w.Tick(t0.Add(time.Minute + 59*time.Second))
+	if len(emitted) != 1 {
+		t.Fatalf("window emitted before its end")
+	}
+	w.Tick(t0.Add(2 * time.Minute))
+	if len(emitted) != 2 {
+		t.Fatalf("Tick at the end of the window emitted %d windows, want 2", len(emitted))
+	}
+	s = emitted[1]
+	if !s.Start.Equal(t0.Add(time.Minute)) || s.Count != 30 || s.Min != 30 || s.Max != 59 || !near(s.Avg, 44.5) {
+		t.Errorf("second window = %+v, want 08:01-08:02 with 30 values 30..59", s)
+	}
+
+	/* windows without values are not emitted */
+	w.Tick(t0.Add(10 * time.Minute))
+	if len(emitted) != 2 {
+		t.Errorf("empty window emitted: %+v", emitted[2:])
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var windows []Stats
+	f := Filter{Median: 3, Deadband: 1, Window: 0}
+	p := f.Build(func(s Stats) { windows = append(windows, s) })
+
+	var out []float64
+	for _, m := range signal(5, 5, 40, 5, 5.5, 7, 7, 7) {
+		if m, ok := p.Push(m); ok {
+			out = append(out, m.Value)
+		}
+	}
+	equal(t, "median then deadband", out, []float64{5, 7})
+
+	/* Tick reaches the window stage through the pipeline */
+	f.Window = config.Duration(time.Minute)
+	p = f.Build(func(s Stats) { windows = append(windows, s) })
+	p.Push(signal(1)[0])
+	p.Tick(t0.Add(time.Minute))
+	if len(windows) != 1 || windows[0].Count != 1 {
+		t.Errorf("windows after Tick = %+v, want one", windows)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	built := map[string]int{}
+	c := NewChannels(func(ch string) *Pipeline {
+		built[ch]++
+		return NewPipeline(&Deadband{Absolute: 1})
+	})
+	for _, m := range []Measurement{{Channel: "AIN_A", Value: 1}, {Channel: "AIN_B", Value: 1}, {Channel: "AIN_A", Value: 1.5}} {
+		_, ok := c.Push(m)
+		if want := m.Value == 1; ok != want {
+			t.Errorf("Push(%+v) = %v, want %v", m, ok, want)
+		}
+	}
+	if built["AIN_A"] != 1 || built["AIN_B"] != 1 {
+		t.Errorf("pipelines built %v, want one per channel", built)
+	}
+}
@@ -0,0 +1,257 @@
+package ain
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+/* What is wired to an input */
+const (
+	// 4-20 mA loop over the shunt
+	ModeCurrent = "current"
+	// 0-10 V signal over the divider
+	ModeVoltage = "voltage"
+)
+
+/* Where a signal lies compared to its span and fault limits */
+type Status string
+
+const (
+	StatusOK = Status("ok")
+	// below the span but not a fault, e.g. 3.8 mA
+	StatusUnderRange = Status("underrange")
+	// above the span but not a fault, e.g. 20.7 mA
+	StatusOverRange = Status("overrange")
+	// below the lower fault limit: open loop or broken wire in current mode
+	StatusFaultLow = Status("fault-low")
+	// above the upper fault limit: short circuit or a failed transmitter
+	StatusFaultHigh = Status("fault-high")
+)
+
+func (s Status) Fault() bool {
+	return s == StatusFaultLow || s == StatusFaultHigh
+}
+
+/* Calibration of one input, from the driver's value to engineering units */
+/* The steps run in this order: units, gain and offset, divider, shunt, linearization, range */
+type Profile struct {
+	Name string `json:"name"`
+	// N of in_voltageN_raw
+	Channel int `json:"channel"`
+	// current or voltage
+	Mode string `json:"mode"`
+	// volts per unit of the driver's value; 1 by default, 0.001 for drivers that give millivolts
+	Units float64 `json:"units,omitempty"`
+	// correction of the ADC: value*gain + offset in volts; gain defaults to 1
+	Gain   float64 `json:"gain,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+	// input voltage per ADC voltage of the divider in front of the ADC; 1 without one
+	Divider float64 `json:"divider,omitempty"`
+	// ohms of the shunt in current mode
+	Shunt float64 `json:"shunt,omitempty"`
+	// measured and true signal (V or mA) from a comparison against a reference; empty for none
+	Points []Point `json:"points,omitempty"`
+	Range  Range   `json:"range"`
+}
+
+/* One point of the linearization table */
+type Point struct {
+	Measured float64 `json:"measured"`
+	Actual   float64 `json:"actual"`
+}
+
+/* Maps the signal to engineering units and tells faults apart from readings that are only out of span */
+type Range struct {
+	// span of the signal; 4-20 mA or 0-10 V by default
+	SignalLow  float64 `json:"signalLow,omitempty"`
+	SignalHigh float64 `json:"signalHigh,omitempty"`
+	// engineering values at the ends of the span; the signal itself when both are 0
+	Low  float64 `json:"low,omitempty"`
+	High float64 `json:"high,omitempty"`
+	Unit string  `json:"unit,omitempty"`
+	// signals outside of these are faults; 3.6 and 21 mA (NAMUR NE 43) or -0.5 and 10.5 V by default
+	FaultLow  *float64 `json:"faultLow,omitempty"`
+	FaultHigh *float64 `json:"faultHigh,omitempty"`
+}
+
+/* One calibrated reading */
+type Reading struct {
+	Name    string  `json:"name"`
+	Channel int     `json:"channel"`
+	Raw     float64 `json:"raw"`
+	// volts at the ADC after the gain and offset correction
+	Volts float64 `json:"volts"`
+	// volts or milliamps at the terminal after the linearization
+	Signal float64 `json:"signal"`
+	// engineering value; still calculated for readings out of span, meaningless for faults
+	Value  float64   `json:"value"`
+	Unit   string    `json:"unit"`
+	Status Status    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+/* The calibration of the TDCE analog inputs: the ADC error measured on the board, the 27.5/7.5 divider and the 100.2 ohm shunt */
+func Default(name string, channel int, mode string) Profile {
+	return Profile{
+		Name:    name,
+		Channel: channel,
+		Mode:    mode,
+		Gain:    1.0059,
+		Offset:  -0.013,
+		Divider: 27.5 / 7.5,
+		Shunt:   100.2,
+	}
+}
+
+/* Profile with the zero values replaced by their defaults */
+func (p Profile) withDefaults() Profile {
+	if p.Units == 0 {
+		p.Units = 1
+	}
+	if p.Gain == 0 {
+		p.Gain = 1
+	}
+	if p.Divider == 0 {
+		p.Divider = 1
+	}
+	r := &p.Range
+	if r.SignalLow == 0 && r.SignalHigh == 0 {
+		if p.Mode == ModeCurrent {
+			r.SignalLow, r.SignalHigh = 4, 20
+		} else {
+			r.SignalLow, r.SignalHigh = 0, 10
+		}
+	}
+	if r.Low == 0 && r.High == 0 {
+		r.Low, r.High = r.SignalLow, r.SignalHigh
+		if r.Unit == "" {
+			r.Unit = "V"
+			if p.Mode == ModeCurrent {
+				r.Unit = "mA"
+			}
+		}
+	}
+	if r.FaultLow == nil {
+		limit := -0.5
+		if p.Mode == ModeCurrent {
+			limit = 3.6
+		}
+		r.FaultLow = &limit
+	}
+	if r.FaultHigh == nil {
+		limit := 10.5
+		if p.Mode == ModeCurrent {
+			limit = 21
+		}
+		r.FaultHigh = &limit
+	}
+	return p
+}
+
+func (p Profile) Validate() error {
+	var errs []error
+	if p.Mode != ModeCurrent && p.Mode != ModeVoltage {
+		errs = append(errs, fmt.Errorf("mode must be current or voltage, not %q", p.Mode))
+	}
+	if p.Channel < 0 {
+		errs = append(errs, fmt.Errorf("channel must not be negative"))
+	}
+	if p.Units < 0 || p.Gain < 0 || p.Divider < 0 {
+		errs = append(errs, fmt.Errorf("units, gain and divider must be positive"))
+	}
+	if p.Mode == ModeCurrent && p.Shunt <= 0 {
+		errs = append(errs, fmt.Errorf("current mode needs the shunt in ohms"))
+	}
+	if len(p.Points) == 1 {
+		errs = append(errs, fmt.Errorf("linearization needs at least 2 points"))
+	}
+	for i := 1; i < len(p.Points); i++ {
+		if p.Points[i].Measured <= p.Points[i-1].Measured {
+			errs = append(errs, fmt.Errorf("linearization points must be sorted by measured value"))
+			break
+		}
+	}
+	r := p.withDefaults().Range
+	if r.SignalHigh <= r.SignalLow {
+		errs = append(errs, fmt.Errorf("signalHigh must be above signalLow"))
+	}
+	if *r.FaultLow > r.SignalLow || *r.FaultHigh < r.SignalHigh {
+		errs = append(errs, fmt.Errorf("fault limits must lie outside of the signal span"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+/* Calibrates one sample of the profile's channel */
+func (p Profile) Convert(s Sample) Reading {
+	p = p.withDefaults()
+
+	volts := s.Value*p.Units*p.Gain + p.Offset
+	/* The offset correction pulls readings near 0 below it; the ADC can't measure negative voltages */
+	volts = max(volts, 0)
+
+	signal := volts * p.Divider
+	if p.Mode == ModeCurrent {
+		signal = signal * 1000 / p.Shunt
+	}
+	signal = linearize(p.Points, signal)
+
+	r := p.Range
+	return Reading{
+		Name:    p.Name,
+		Channel: p.Channel,
+		Raw:     s.Raw,
+		Volts:   volts,
+		Signal:  signal,
+		Value:   r.Low + (signal-r.SignalLow)/(r.SignalHigh-r.SignalLow)*(r.High-r.Low),
+		Unit:    r.Unit,
+		Status:  r.status(signal),
+		Time:    s.Time,
+	}
+}
+
+func (r Range) status(signal float64) Status {
+	switch {
+	case signal < *r.FaultLow:
+		return StatusFaultLow
+	case signal > *r.FaultHigh:
+		return StatusFaultHigh
+	case signal < r.SignalLow:
+		return StatusUnderRange
+	case signal > r.SignalHigh:
+		return StatusOverRange
+	}
+	return StatusOK
+}
+
+/* Interpolates between the points; outside of them the first or last segment is continued */
+func linearize(points []Point, v float64) float64 {
+	if len(points) < 2 {
+		return v
+	}
+	i, _ := slices.BinarySearchFunc(points, v, func(p Point, v float64) int {
+		switch {
+		case p.Measured < v:
+			return -1
+		case p.Measured > v:
+			return 1
+		}
+		return 0
+	})
+	i = min(max(i, 1), len(points)-1)
+	a, b := points[i-1], points[i]
+	return a.Actual + (v-a.Measured)/(b.Measured-a.Measured)*(b.Actual-a.Actual)
+}
+
+/* Reads the profile's channel and calibrates it */
+func (d IIO) Measure(p Profile) (Reading, error) {
+	s, err := d.Read(p.Channel)
+	if err != nil {
+		return Reading{}, fmt.Errorf("%s: %w", p.Name, err)
+	}
+	return p.Convert(s), nil
+}
@@ -0,0 +1,175 @@
+package ain
+
+import (
+	"math"
+	"testing"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+/* The formula the direct snippet had inline before the profiles */
+func inline(raw, scale float64, mode string, account bool) float64 {
+	clean := raw * scale
+	comp := clean + (0.0059*clean - 0.013)
+	if !account {
+		return clean
+	}
+	comp = max(comp, 0)
+	comp = comp * 27.5 / 7.5
+	if mode == ModeCurrent {
+		comp = comp * 1000 / 100.2
+	}
+	return comp
+}
+
+func TestDefaultMatchesInlineFormula(t *testing.T) {
+	for _, mode := range []string{ModeCurrent, ModeVoltage} {
+		for _, raw := range []float64{0, 1, 5, 100, 1000, 2047, 4095} {
+			s := Sample{Channel: 5, Raw: raw, Value: raw * 0.000732}
+			got := Default("AIN_F", 5, mode).Convert(s).Signal
+			if want := inline(raw, 0.000732, mode, true); !near(got, want) {
+				t.Errorf("%s raw %g: %g, want %g", mode, raw, got, want)
+			}
+			/* without the correction: the value as the driver gives it */
+			got = Profile{Channel: 5, Mode: ModeVoltage}.Convert(s).Signal
+			if want := inline(raw, 0.000732, mode, false); !near(got, want) {
+				t.Errorf("%s raw %g without correction: %g, want %g", mode, raw, got, want)
+			}
+		}
+	}
+}
+
+func TestDefaultProfileValid(t *testing.T) {
+	for _, mode := range []string{ModeCurrent, ModeVoltage} {
+		if err := Default("AIN", 0, mode).Validate(); err != nil {
+			t.Errorf("Default %s: %v", mode, err)
+		}
+	}
+}
+
+/* A current profile whose signal in mA equals the volts at the ADC */
+func currentProfile() Profile {
+	return Profile{Name: "loop", Mode: ModeCurrent, Shunt: 1000}
+}
+
+func TestCurrentStatus(t *testing.T) {
+	tests := []struct {
+		mA     float64
+		status Status
+	}{
+		{0, StatusFaultLow},
+		{3.59, StatusFaultLow},
+		{3.6, StatusUnderRange},
+		{3.8, StatusUnderRange},
+		{4, StatusOK},
+		{12, StatusOK},
+		{20, StatusOK},
+		{20.7, StatusOverRange},
+		{21, StatusOverRange},
+		{21.01, StatusFaultHigh},
+	}
+	for _, tt := range tests {
+		r := currentProfile().Convert(Sample{Value: tt.mA})
+		if !near(r.Signal, tt.mA) || r.Status != tt.status || r.Unit != "mA" {
+			t.Errorf("%g mA: signal %g %s %s, want %s", tt.mA, r.Signal, r.Unit, r.Status, tt.status)
+		}
+		if r.Status.Fault() != (tt.status == StatusFaultLow || tt.status == StatusFaultHigh) {
+			t.Errorf("%g mA: Fault() = %v", tt.mA, r.Status.Fault())
+		}
+	}
+}
+
+func TestEngineeringRange(t *testing.T) {
+	p := currentProfile()
+	p.Range = Range{Low: 0, High: 10, Unit: "bar"}
+	tests := []struct{ mA, bar float64 }{{4, 0}, {12, 5}, {20, 10}, {3.8, -0.125}, {20.8, 10.5}}
+	for _, tt := range tests {
+		r := p.Convert(Sample{Value: tt.mA})
+		if !near(r.Value, tt.bar) || r.Unit != "bar" {
+			t.Errorf("%g mA = %g %s, want %g bar", tt.mA, r.Value, r.Unit, tt.bar)
+		}
+	}
+
+	/* own fault limits replace NAMUR */
+	low, high := 3.0, 22.0
+	p.Range.FaultLow, p.Range.FaultHigh = &low, &high
+	if r := p.Convert(Sample{Value: 3.5}); r.Status != StatusUnderRange {
+		t.Errorf("3.5 mA with fault limit 3: %s, want underrange", r.Status)
+	}
+}
+
+func TestVoltageStatus(t *testing.T) {
+	p := Profile{Mode: ModeVoltage}
+	tests := []struct {
+		volts  float64
+		status Status
+	}{{0, StatusOK}, {10, StatusOK}, {10.4, StatusOverRange}, {10.6, StatusFaultHigh}}
+	for _, tt := range tests {
+		if r := p.Convert(Sample{Value: tt.volts}); r.Status != tt.status || r.Unit != "V" {
+			t.Errorf("%g V: %s %s, want %s", tt.volts, r.Unit, r.Status, tt.status)
+		}
+	}
+}
+
+/* The ADC can't measure below 0, so the offset correction never gives a negative voltage */
+func TestNegativeClamped(t *testing.T) {
+	r := Default("AIN", 0, ModeVoltage).Convert(Sample{Value: 0.005})
+	if r.Volts != 0 || r.Signal != 0 {
+		t.Errorf("5 mV with -13 mV offset = %g V at the ADC, %g V signal; want 0", r.Volts, r.Signal)
+	}
+}
+
+func TestLinearize(t *testing.T) {
+	points := []Point{{Measured: 4, Actual: 4.1}, {Measured: 12, Actual: 12}, {Measured: 20, Actual: 19.8}}
+	tests := []struct{ measured, actual float64 }{
+		{4, 4.1},
+		{8, 8.05},
+		{12, 12},
+		{16, 15.9},
+		{20, 19.8},
+		/* outside of the points the first and last segment are continued */
+		{0, 4.1 - 4*(7.9/8)},
+		{2, 4.1 - 2*(7.9/8)},
+		{24, 19.8 + 4*(7.8/8)},
+	}
+	for _, tt := range tests {
+		if got := linearize(points, tt.measured); !near(got, tt.actual) {
+			t.Errorf("linearize(%g) = %g, want %g", tt.measured, got, tt.actual)
+		}
+	}
+	if got := linearize(points[:1], 7); got != 7 {
+		t.Errorf("linearize with one point = %g, want it unchanged", got)
+	}
+
+	p := currentProfile()
+	p.Points = points
+	if r := p.Convert(Sample{Value: 24}); !near(r.Signal, 23.7) || r.Status != StatusFaultHigh {
+		t.Errorf("24 mA measured: %g %s, want 23.7 fault-high", r.Signal, r.Status)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Profile
+	}{
+		{"mode", Profile{Mode: "resistance"}},
+		{"channel", Profile{Mode: ModeVoltage, Channel: -1}},
+		{"shunt", Profile{Mode: ModeCurrent}},
+		{"one point", Profile{Mode: ModeVoltage, Points: []Point{{1, 1}}}},
+		{"unsorted points", Profile{Mode: ModeVoltage, Points: []Point{{2, 2}, {1, 1}}}},
+		{"span", Profile{Mode: ModeVoltage, Range: Range{SignalLow: 5, SignalHigh: 1}}},
+		{"fault limits", Profile{Mode: ModeCurrent, Shunt: 100, Range: Range{FaultLow: ptr(4.5)}}},
+	}
+	for _, tt := range tests {
+		if err := tt.p.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted %+v", tt.name, tt.p)
+		}
+	}
+}
+
+func ptr(f float64) *float64 {
+	return &f
+}
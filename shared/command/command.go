@@ -0,0 +1,174 @@
+/* Package created 18.10.2026. */
+/* Remote commands over MQTT: JSON requests on devices/{id}/cmd/{command}, responses on devices/{id}/resp/{correlationId} */
+
+package command
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"tdce-shared/config"
+	"tdce-shared/modem"
+)
+
+/* Commands, the last level of the command topic */
+const (
+	SetDIO    = "setDio"
+	PulseDIO  = "pulseDio"
+	ReadAIN   = "readAin"
+	SendRS232 = "sendRs232"
+	SendSMS   = "sendSms"
+)
+
+/* Status of a response */
+const (
+	StatusOK = "ok"
+	// the request was not executed, see Error
+	StatusInvalid = "invalid"
+	StatusError   = "error"
+	// the command did not finish within its time box; it may have taken effect partly
+	StatusTimeout = "timeout"
+)
+
+/* Encodings of the RS-232 data */
+const (
+	EncodingText   = "text"
+	EncodingHex    = "hex"
+	EncodingBase64 = "base64"
+)
+
+/* Largest RS-232 payload of one command */
+const maxRS232 = 4096
+
+var (
+	dioName = regexp.MustCompile(`^DIO_[A-Z]$`)
+	ainName = regexp.MustCompile(`^AIN_[A-Z]$`)
+	// becomes a topic level, so no wildcards or separators
+	correlationID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	phoneNumber   = regexp.MustCompile(`^\+?[0-9]{3,15}$`)
+)
+
+/* Payload of a command; which fields are needed depends on the command */
+/*   setDio    {"correlationId": "c1", "dio": "DIO_A", "value": 1} */
+/*   pulseDio  {"correlationId": "c2", "dio": "DIO_A", "value": 1, "duration": "500ms"} */
+/*   readAin   {"correlationId": "c3", "ain": "AIN_A"} */
+/*   sendRs232 {"correlationId": "c4", "data": "68656c6c6f0a", "encoding": "hex"} */
+/*   sendSms   {"correlationId": "c5", "number": "+385981234567", "text": "hello"} */
+type Request struct {
+	// unique per command; a command repeated with the same ID is not executed again
+	CorrelationID string `json:"correlationId"`
+	// taken from the topic when empty; must match it otherwise
+	Command string `json:"command,omitempty"`
+	// time box of the command; the handler's default when empty
+	Timeout config.Duration `json:"timeout,omitempty"`
+
+	DIO string `json:"dio,omitempty"`
+	// level set by setDio, or held for the duration of a pulse; 1 for pulses when empty
+	Value *int `json:"value,omitempty"`
+	// length of the pulse; the output returns to the opposite level afterwards
+	Duration config.Duration `json:"duration,omitempty"`
+
+	AIN string `json:"ain,omitempty"`
+
+	Data string `json:"data,omitempty"`
+	// text (the default), hex or base64
+	Encoding string `json:"encoding,omitempty"`
+
+	Number string `json:"number,omitempty"`
+	Text   string `json:"text,omitempty"`
+}
+
+/* Published on devices/{id}/resp/{correlationId} */
+type Response struct {
+	CorrelationID string `json:"correlationId"`
+	Command       string `json:"command"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+	// value read by readAin
+	Value *float64 `json:"value,omitempty"`
+	// true when the command was seen before and this is the response of its first execution
+	Duplicate bool      `json:"duplicate,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+/* Checks the fields the command needs; the time box is checked by the handler */
+func (r *Request) Validate() error {
+	var errs []error
+	if !correlationID.MatchString(r.CorrelationID) {
+		errs = append(errs, fmt.Errorf("correlationId: must be 1 to 128 letters, digits or ._:-, got %q", r.CorrelationID))
+	}
+	if r.Timeout < 0 {
+		errs = append(errs, errors.New("timeout: must not be negative"))
+	}
+
+	switch r.Command {
+	case SetDIO, PulseDIO:
+		if !dioName.MatchString(r.DIO) {
+			errs = append(errs, fmt.Errorf("dio: must be like DIO_A, got %q", r.DIO))
+		}
+		if r.Value == nil && r.Command == SetDIO {
+			errs = append(errs, errors.New("value: required"))
+		} else if r.Value != nil && *r.Value != 0 && *r.Value != 1 {
+			errs = append(errs, fmt.Errorf("value: must be 0 or 1, got %d", *r.Value))
+		}
+		if r.Command == PulseDIO && r.Duration <= 0 {
+			errs = append(errs, errors.New("duration: required for a pulse"))
+		}
+	case ReadAIN:
+		if !ainName.MatchString(r.AIN) {
+			errs = append(errs, fmt.Errorf("ain: must be like AIN_A, got %q", r.AIN))
+		}
+	case SendRS232:
+		if data, err := r.Bytes(); err != nil {
+			errs = append(errs, fmt.Errorf("data: %w", err))
+		} else if len(data) == 0 || len(data) > maxRS232 {
+			errs = append(errs, fmt.Errorf("data: must be 1 to %d bytes, got %d", maxRS232, len(data)))
+		}
+	case SendSMS:
+		if !phoneNumber.MatchString(NormalizeNumber(r.Number)) {
+			errs = append(errs, fmt.Errorf("number: must be a phone number like +385981234567, got %q", r.Number))
+		}
+		if r.Text == "" || utf8.RuneCountInString(r.Text) > modem.MaxSMS {
+			errs = append(errs, fmt.Errorf("text: must be 1 to %d characters", modem.MaxSMS))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown command %q", r.Command))
+	}
+	return errors.Join(errs...)
+}
+
+/* Level of the DIO while the command is in effect */
+func (r *Request) level() int {
+	if r.Value == nil {
+		return 1
+	}
+	return *r.Value
+}
+
+/* RS-232 data decoded from its encoding */
+func (r *Request) Bytes() ([]byte, error) {
+	switch r.Encoding {
+	case "", EncodingText:
+		return []byte(r.Data), nil
+	case EncodingHex:
+		return hex.DecodeString(r.Data)
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(r.Data)
+	}
+	return nil, fmt.Errorf("unknown encoding %q, use text, hex or base64", r.Encoding)
+}
+
+/* Removes spaces and dashes and turns a leading 00 into + */
+func NormalizeNumber(number string) string {
+	number = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(number)
+	if strings.HasPrefix(number, "00") {
+		number = "+" + number[2:]
+	}
+	return number
+}
@@ -0,0 +1,64 @@
+/* What the commands act on, and its implementation with the TDC-E APIs */
+
+package command
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"tdce-shared/modem"
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
+)
+
+var ErrUnavailable = errors.New("not available on this device")
+
+/* Every call must give up when ctx is done, so commands keep to their time box */
+type Device interface {
+	SetDIO(ctx context.Context, name string, value int) error
+	ReadAIN(ctx context.Context, name string) (float64, error)
+	WriteRS232(ctx context.Context, data []byte) error
+	SendSMS(ctx context.Context, number string, text string) error
+}
+
+/* Device through the DIO/AIN REST API, the RS-232 WebSocket stream and the device manager API */
+/* Commands whose API is nil answer with ErrUnavailable */
+type API struct {
+	IO *tdce.Client
+	// connected to wsclient.Rs232Data and running
+	RS232 *wsclient.Client
+	Modem *modem.Client
+}
+
+func (a *API) SetDIO(ctx context.Context, name string, value int) error {
+	if a.IO == nil {
+		return ErrUnavailable
+	}
+	return a.IO.SetDIO(ctx, name, value, tdce.Output)
+}
+
+func (a *API) ReadAIN(ctx context.Context, name string) (float64, error) {
+	if a.IO == nil {
+		return 0, ErrUnavailable
+	}
+	return a.IO.ReadAnalog(ctx, name)
+}
+
+/* The stream takes the bytes base64 encoded */
+func (a *API) WriteRS232(ctx context.Context, data []byte) error {
+	if a.RS232 == nil {
+		return ErrUnavailable
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.RS232.Send([]byte(base64.StdEncoding.EncodeToString(data)))
+}
+
+func (a *API) SendSMS(ctx context.Context, number string, text string) error {
+	if a.Modem == nil {
+		return ErrUnavailable
+	}
+	return a.Modem.SendSMS(ctx, number, text)
+}
@@ -0,0 +1,415 @@
+/* Handler executing the commands of one device and publishing their responses */
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/config"
+	mq "tdce-shared/mqttset"
+)
+
+var ErrClosed = errors.New("command handler is closed")
+
+/* Settings of a handler; the tags make it a section of the examples' settings, zero values take the defaults */
+type Options struct {
+	// 1 by default; QoS 0 commands may get lost, QoS 2 gains nothing over the correlation IDs
+	QoS     int             `json:"qos" validate:"max=2" help:"QoS of the command subscription"`
+	Timeout config.Duration `json:"timeout" help:"time box of commands that don't set their own, 10s by default"`
+	// commands asking for a longer time box are rejected
+	MaxTimeout config.Duration `json:"maxTimeout" help:"longest time box a command may ask for, 1m by default"`
+	// a repeated command within this window gets the first response again instead of running twice
+	Remember config.Duration `json:"remember" help:"how long executed commands are remembered, 10m by default"`
+	// executed commands and their responses survive restarts here, so a redelivery of a persistent session isn't run again
+	StateFile string `json:"stateFile" help:"file the executed commands are kept in across restarts, empty keeps them in memory only"`
+}
+
+/* Executes each correlation ID once within Remember; with a StateFile also across restarts */
+type Handler struct {
+	deviceID  string
+	device    Device
+	publisher *mq.Publisher
+	opts      Options
+
+	mu      sync.Mutex
+	seen    map[string]*execution
+	closed  bool
+	running sync.WaitGroup
+}
+
+/* A command that ran or is running */
+type execution struct {
+	done     chan struct{}
+	response Response
+	finished time.Time
+}
+
+/* Execution as kept in the state file; Finished is zero while the command runs */
+type stored struct {
+	Response Response  `json:"response"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+/* Reads the commands executed before a restart from opts.StateFile; a missing file is no error */
+func NewHandler(deviceID string, device Device, publisher *mq.Publisher, opts Options) (*Handler, error) {
+	if opts.QoS == 0 {
+		opts.QoS = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = config.Duration(10 * time.Second)
+	}
+	if opts.MaxTimeout <= 0 {
+		opts.MaxTimeout = config.Duration(time.Minute)
+	}
+	if opts.Remember <= 0 {
+		opts.Remember = config.Duration(10 * time.Minute)
+	}
+	h := &Handler{
+		deviceID:  deviceID,
+		device:    device,
+		publisher: publisher,
+		opts:      opts,
+		seen:      map[string]*execution{},
+	}
+	if err := h.load(); err != nil {
+		return nil, fmt.Errorf("%s: %w", opts.StateFile, err)
+	}
+	return h, nil
+}
+
+/* A command that was still running when the process stopped answers as interrupted; whether it took effect is unknown */
+func (h *Handler) load() error {
+	if h.opts.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(h.opts.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var executed map[string]stored
+	if err := json.Unmarshal(data, &executed); err != nil {
+		return err
+	}
+	now := time.Now()
+	for id, st := range executed {
+		e := &execution{done: make(chan struct{}), response: st.Response, finished: st.Finished}
+		if st.Finished.IsZero() {
+			e.response.Status, e.response.Error = StatusError, "interrupted by a restart, it may have taken effect"
+			e.finished = now
+		}
+		close(e.done)
+		h.seen[id] = e
+	}
+	h.forget(now)
+	return nil
+}
+
+/* Writes the executions to the state file, replacing it in one step; h.mu is held */
+func (h *Handler) save() error {
+	if h.opts.StateFile == "" {
+		return nil
+	}
+	executed := make(map[string]stored, len(h.seen))
+	for id, e := range h.seen {
+		executed[id] = stored{Response: e.response, Finished: e.finished}
+	}
+	data, err := json.Marshal(executed)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(h.opts.StateFile), filepath.Base(h.opts.StateFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.opts.StateFile)
+}
+
+/* Topic filter of the device's commands, devices/{id}/cmd/# */
+func (h *Handler) Topic() string {
+	return "devices/" + h.deviceID + "/cmd/#"
+}
+
+/* Topic of the response to a command */
+func ResponseTopic(deviceID string, correlationID string) string {
+	return "devices/" + deviceID + "/resp/" + correlationID
+}
+
+/* Subscribes client to the commands; call it from the OnConnect handler, so the subscription survives clean sessions */
+func (h *Handler) Subscribe(client mqtt.Client) error {
+	token := client.Subscribe(h.Topic(), byte(h.opts.QoS), h.received)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return err
+	}
+	fmt.Printf("Subscribed to topic %s.\n", h.Topic())
+	return nil
+}
+
+/* Stops taking commands and waits for the running ones; they end with their time box at the latest */
+func (h *Handler) Close(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* Runs in the client's callback, so the command is handled in its own goroutine */
+func (h *Handler) received(_ mqtt.Client, msg mqtt.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		fmt.Printf("Dropping command on %s: %v\n", msg.Topic(), ErrClosed)
+		return
+	}
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		h.handle(msg)
+	}()
+}
+
+func (h *Handler) handle(msg mqtt.Message) {
+	req, err := h.parse(msg)
+	if err != nil {
+		if !correlationID.MatchString(req.CorrelationID) {
+			/* Without a usable ID there is no topic to answer on */
+			fmt.Printf("Dropping command on %s: %v\n", msg.Topic(), err)
+			return
+		}
+		h.respond(msg, Response{CorrelationID: req.CorrelationID, Command: req.Command, Status: StatusInvalid, Error: err.Error()})
+		return
+	}
+
+	h.mu.Lock()
+	h.forget(time.Now())
+	if e, ok := h.seen[req.CorrelationID]; ok {
+		h.mu.Unlock()
+		/* A redelivery or a retry of the sender; it gets the outcome of the first execution */
+		<-e.done
+		resp := e.response
+		resp.Duplicate = true
+		h.respond(msg, resp)
+		return
+	}
+	e := &execution{done: make(chan struct{}), response: Response{CorrelationID: req.CorrelationID, Command: req.Command}}
+	h.seen[req.CorrelationID] = e
+	/* Kept before anything runs; if that fails nothing runs */
+	if err := h.save(); err != nil {
+		fmt.Println("Error saving executed commands: ", err)
+		/* Forgotten again, so a retry may run it; a duplicate waiting for it gets the error too */
+		e.response.Status, e.response.Error, e.finished = StatusError, "not executed: "+err.Error(), time.Now()
+		close(e.done)
+		delete(h.seen, req.CorrelationID)
+		h.mu.Unlock()
+		h.respond(msg, e.response)
+		return
+	}
+	h.mu.Unlock()
+
+	resp := h.run(req)
+	if resp.Error != "" {
+		fmt.Printf("Command %s %s: %s: %s\n", req.CorrelationID, req.Command, resp.Status, resp.Error)
+	} else {
+		fmt.Printf("Command %s %s: %s\n", req.CorrelationID, req.Command, resp.Status)
+	}
+
+	h.mu.Lock()
+	e.response, e.finished = resp, time.Now()
+	close(e.done)
+	if err := h.save(); err != nil {
+		fmt.Println("Error saving executed commands: ", err)
+	}
+	h.mu.Unlock()
+	h.respond(msg, resp)
+}
+
+/* Drops the executions older than Remember; running ones stay */
+func (h *Handler) forget(now time.Time) {
+	for id, e := range h.seen {
+		if !e.finished.IsZero() && now.Sub(e.finished) > time.Duration(h.opts.Remember) {
+			delete(h.seen, id)
+		}
+	}
+}
+
+/* Decodes and validates a command; the name comes from the topic, e.g. devices/tdce-1/cmd/setDio */
+/* On errors the returned request still has the correlation ID if the payload had one */
+func (h *Handler) parse(msg mqtt.Message) (Request, error) {
+	var req Request
+	name := ""
+	if prefix := "devices/" + h.deviceID + "/cmd/"; strings.HasPrefix(msg.Topic(), prefix) {
+		name = msg.Topic()[len(prefix):]
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(msg.Payload()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		/* Looks for the ID alone, so the sender learns what was wrong */
+		var id struct {
+			CorrelationID string `json:"correlationId"`
+		}
+		json.Unmarshal(msg.Payload(), &id)
+		return Request{CorrelationID: id.CorrelationID, Command: name}, fmt.Errorf("payload: %w", err)
+	}
+
+	switch {
+	case req.Command == "":
+		req.Command = name
+	case name != "" && req.Command != name:
+		return req, fmt.Errorf("command: %q doesn't match the topic %s", req.Command, msg.Topic())
+	}
+	if err := req.Validate(); err != nil {
+		return req, err
+	}
+
+	if req.Timeout == 0 {
+		req.Timeout = h.opts.Timeout
+	}
+	if req.Timeout > h.opts.MaxTimeout {
+		return req, fmt.Errorf("timeout: must be at most %s, got %s", h.opts.MaxTimeout, req.Timeout)
+	}
+	if req.Command == PulseDIO && req.Duration >= req.Timeout {
+		return req, fmt.Errorf("duration: must be shorter than the timeout %s", req.Timeout)
+	}
+	return req, nil
+}
+
+/* Executes req within its time box */
+func (h *Handler) run(req Request) Response {
+	resp := Response{CorrelationID: req.CorrelationID, Command: req.Command, Status: StatusOK}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(req.Timeout))
+	defer cancel()
+
+	type result struct {
+		value *float64
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := h.execute(ctx, req)
+		done <- result{value, err}
+	}()
+
+	/* A device call that ignores ctx doesn't hold up the response */
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	}
+	switch {
+	case errors.Is(r.err, context.DeadlineExceeded):
+		resp.Status, resp.Error = StatusTimeout, fmt.Sprintf("not done within %s", req.Timeout)
+	case r.err != nil:
+		resp.Status, resp.Error = StatusError, r.err.Error()
+	default:
+		resp.Value = r.value
+	}
+	return resp
+}
+
+func (h *Handler) execute(ctx context.Context, req Request) (*float64, error) {
+	switch req.Command {
+	case SetDIO:
+		return nil, h.device.SetDIO(ctx, req.DIO, req.level())
+	case PulseDIO:
+		return nil, h.pulse(ctx, req)
+	case ReadAIN:
+		value, err := h.device.ReadAIN(ctx, req.AIN)
+		if err != nil {
+			return nil, err
+		}
+		return &value, nil
+	case SendRS232:
+		data, err := req.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return nil, h.device.WriteRS232(ctx, data)
+	case SendSMS:
+		return nil, h.device.SendSMS(ctx, NormalizeNumber(req.Number), req.Text)
+	}
+	return nil, fmt.Errorf("unknown command %q", req.Command)
+}
+
+/* Holds the level for the duration, then sets the opposite one */
+func (h *Handler) pulse(ctx context.Context, req Request) error {
+	level := req.level()
+	if err := h.device.SetDIO(ctx, req.DIO, level); err != nil {
+		return err
+	}
+	timer := time.NewTimer(time.Duration(req.Duration))
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	/* Its own context, so a pulse cut short by the time box doesn't leave the output on */
+	reset, cancel := context.WithTimeout(context.Background(), time.Duration(h.opts.Timeout))
+	defer cancel()
+	return errors.Join(err, h.device.SetDIO(reset, req.DIO, 1-level))
+}
+
+/* Publishes resp on the response topic; MQTT 5 requests naming their own response topic get it there too */
+func (h *Handler) respond(request mqtt.Message, resp Response) {
+	resp.Time = time.Now()
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		fmt.Println("Problem encoding response: ", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.opts.Timeout))
+	defer cancel()
+	topic := ResponseTopic(h.deviceID, resp.CorrelationID)
+	props := mq.PropertiesOf(request)
+	var replyProps *mq.Properties
+	if props != nil && props.CorrelationData != nil {
+		replyProps = &mq.Properties{CorrelationData: props.CorrelationData}
+	}
+	h.publisher.Publish(ctx, mq.Message{Topic: topic, Payload: payload, Properties: replyProps})
+	if props != nil && props.ResponseTopic != "" && props.ResponseTopic != topic {
+		h.publisher.Publish(ctx, mq.Message{Topic: props.ResponseTopic, Payload: payload, Properties: replyProps})
+	}
+}
@@ -0,0 +1,295 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/config"
+	mq "tdce-shared/mqttset"
+)
+
+/* Acknowledged at once */
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+/* Keeps the responses; calls other than Publish are not used by the handler */
+type fakeClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	responses []Response
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var resp Response
+	json.Unmarshal(payload.([]byte), &resp)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses = append(c.responses, resp)
+	return doneToken{}
+}
+
+func (c *fakeClient) sent() []Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Response(nil), c.responses...)
+}
+
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload string
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return []byte(m.payload) }
+
+/* Counts the calls; SetDIO blocks while block is set, ignoring ctx like a hung API */
+type fakeDevice struct {
+	mu    sync.Mutex
+	calls int
+	block chan struct{}
+}
+
+func (d *fakeDevice) SetDIO(ctx context.Context, name string, value int) error {
+	d.mu.Lock()
+	d.calls++
+	block := d.block
+	d.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	return nil
+}
+
+func (d *fakeDevice) ReadAIN(ctx context.Context, name string) (float64, error) {
+	return 4.2, nil
+}
+
+func (d *fakeDevice) WriteRS232(ctx context.Context, data []byte) error {
+	return nil
+}
+
+func (d *fakeDevice) SendSMS(ctx context.Context, number string, text string) error {
+	return nil
+}
+
+func (d *fakeDevice) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+func testHandler(t *testing.T, device Device, opts Options) (*Handler, *fakeClient) {
+	t.Helper()
+	client := &fakeClient{}
+	h, err := NewHandler("tdce-1", device, mq.NewPublisher(client, mq.Options{}), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, client
+}
+
+func TestValidate(t *testing.T) {
+	one, two := 1, 2
+	tests := []struct {
+		name string
+		req  Request
+		want string
+	}{
+		{"setDio", Request{CorrelationID: "c1", Command: SetDIO, DIO: "DIO_A", Value: &one}, ""},
+		{"pulse without value", Request{CorrelationID: "c2", Command: PulseDIO, DIO: "DIO_B", Duration: config.Duration(time.Second)}, ""},
+		{"readAin", Request{CorrelationID: "c3", Command: ReadAIN, AIN: "AIN_A"}, ""},
+		{"hex data", Request{CorrelationID: "c4", Command: SendRS232, Data: "68690a", Encoding: EncodingHex}, ""},
+		{"sms with spaces", Request{CorrelationID: "c5", Command: SendSMS, Number: "00385 98 123 4567", Text: "hello"}, ""},
+		{"correlation ID with a slash", Request{CorrelationID: "a/b", Command: ReadAIN, AIN: "AIN_A"}, "correlationId"},
+		{"negative timeout", Request{CorrelationID: "c", Command: ReadAIN, AIN: "AIN_A", Timeout: -1}, "timeout"},
+		{"setDio without value", Request{CorrelationID: "c", Command: SetDIO, DIO: "DIO_A"}, "value: required"},
+		{"level 2", Request{CorrelationID: "c", Command: SetDIO, DIO: "DIO_A", Value: &two}, "value: must be 0 or 1"},
+		{"bad dio", Request{CorrelationID: "c", Command: SetDIO, DIO: "DO_A", Value: &one}, "dio"},
+		{"pulse without duration", Request{CorrelationID: "c", Command: PulseDIO, DIO: "DIO_A"}, "duration"},
+		{"bad ain", Request{CorrelationID: "c", Command: ReadAIN, AIN: "AIN_1"}, "ain"},
+		{"bad hex", Request{CorrelationID: "c", Command: SendRS232, Data: "6", Encoding: EncodingHex}, "data"},
+		{"empty data", Request{CorrelationID: "c", Command: SendRS232}, "data: must be 1"},
+		{"unknown encoding", Request{CorrelationID: "c", Command: SendRS232, Data: "x", Encoding: "utf16"}, "unknown encoding"},
+		{"bad number", Request{CorrelationID: "c", Command: SendSMS, Number: "12", Text: "hi"}, "number"},
+		{"empty text", Request{CorrelationID: "c", Command: SendSMS, Number: "+385981234567"}, "text"},
+		{"unknown command", Request{CorrelationID: "c", Command: "reboot"}, "unknown command"},
+	}
+	for _, tt := range tests {
+		err := tt.req.Validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: error %v, want one about %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	h, _ := testHandler(t, &fakeDevice{}, Options{Timeout: config.Duration(5 * time.Second), MaxTimeout: config.Duration(30 * time.Second)})
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		want    string
+	}{
+		{"command from the topic", "devices/tdce-1/cmd/readAin", `{"correlationId":"c1","ain":"AIN_A"}`, ""},
+		{"matching command", "devices/tdce-1/cmd/readAin", `{"correlationId":"c1","command":"readAin","ain":"AIN_A"}`, ""},
+		{"command doesn't match the topic", "devices/tdce-1/cmd/setDio", `{"correlationId":"c1","command":"readAin","ain":"AIN_A"}`, "doesn't match the topic"},
+		{"unknown field", "devices/tdce-1/cmd/readAin", `{"correlationId":"c1","ain":"AIN_A","pin":1}`, "payload"},
+		{"timeout over the maximum", "devices/tdce-1/cmd/readAin", `{"correlationId":"c1","ain":"AIN_A","timeout":"31s"}`, "timeout: must be at most"},
+		{"pulse as long as the timeout", "devices/tdce-1/cmd/pulseDio", `{"correlationId":"c1","dio":"DIO_A","duration":"2s","timeout":"2s"}`, "duration: must be shorter"},
+		{"pulse as long as the default timeout", "devices/tdce-1/cmd/pulseDio", `{"correlationId":"c1","dio":"DIO_A","duration":"5s"}`, "duration: must be shorter"},
+		{"pulse within the timeout", "devices/tdce-1/cmd/pulseDio", `{"correlationId":"c1","dio":"DIO_A","duration":"1s","timeout":"2s"}`, ""},
+	}
+	for _, tt := range tests {
+		req, err := h.parse(fakeMessage{topic: tt.topic, payload: tt.payload})
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: error %v, want one about %s", tt.name, err, tt.want)
+		}
+		if req.CorrelationID != "c1" {
+			t.Errorf("%s: correlation ID %q lost", tt.name, req.CorrelationID)
+		}
+	}
+
+	req, _ := h.parse(fakeMessage{topic: "devices/tdce-1/cmd/readAin", payload: `{"correlationId":"c1","ain":"AIN_A"}`})
+	if req.Command != ReadAIN || req.Timeout != config.Duration(5*time.Second) {
+		t.Errorf("command %q, timeout %s; want readAin with the default time box", req.Command, req.Timeout)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	device := &fakeDevice{}
+	h, client := testHandler(t, device, Options{})
+	msg := fakeMessage{topic: "devices/tdce-1/cmd/setDio", payload: `{"correlationId":"c1","dio":"DIO_A","value":1}`}
+	h.handle(msg)
+	h.handle(msg)
+
+	if device.count() != 1 {
+		t.Errorf("executed %d times, want once", device.count())
+	}
+	sent := client.sent()
+	if len(sent) != 2 {
+		t.Fatalf("%d responses, want 2", len(sent))
+	}
+	if sent[0].Status != StatusOK || sent[0].Duplicate {
+		t.Errorf("first response %+v", sent[0])
+	}
+	if sent[1].Status != StatusOK || !sent[1].Duplicate || sent[1].CorrelationID != "c1" {
+		t.Errorf("second response %+v, want the first one marked as duplicate", sent[1])
+	}
+}
+
+func TestTimeBox(t *testing.T) {
+	device := &fakeDevice{block: make(chan struct{})}
+	defer close(device.block)
+	h, client := testHandler(t, device, Options{})
+
+	start := time.Now()
+	h.handle(fakeMessage{topic: "devices/tdce-1/cmd/setDio", payload: `{"correlationId":"c1","dio":"DIO_A","value":1,"timeout":"100ms"}`})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("responded after %s, the device call held up the response", elapsed)
+	}
+	sent := client.sent()
+	if len(sent) != 1 || sent[0].Status != StatusTimeout || !strings.Contains(sent[0].Error, "100ms") {
+		t.Errorf("responses %+v, want one timeout", sent)
+	}
+}
+
+func TestInvalidResponse(t *testing.T) {
+	device := &fakeDevice{}
+	h, client := testHandler(t, device, Options{})
+	h.handle(fakeMessage{topic: "devices/tdce-1/cmd/setDio", payload: `{"correlationId":"c1","dio":"DIO_A","value":3}`})
+	/* without a correlation ID there is no topic to answer on */
+	h.handle(fakeMessage{topic: "devices/tdce-1/cmd/setDio", payload: `{"dio":"DIO_A","value":1}`})
+
+	sent := client.sent()
+	if len(sent) != 1 || sent[0].Status != StatusInvalid || sent[0].CorrelationID != "c1" {
+		t.Errorf("responses %+v, want one invalid for c1", sent)
+	}
+	if device.count() != 0 {
+		t.Errorf("invalid commands executed")
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "commands.json")
+	device := &fakeDevice{}
+	h, _ := testHandler(t, device, Options{StateFile: file})
+	msg := fakeMessage{topic: "devices/tdce-1/cmd/setDio", payload: `{"correlationId":"c1","dio":"DIO_A","value":1}`}
+	h.handle(msg)
+
+	/* c2 was running when the process stopped */
+	var executed map[string]stored
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &executed); err != nil {
+		t.Fatal(err)
+	}
+	executed["c2"] = stored{Response: Response{CorrelationID: "c2", Command: SetDIO}}
+	data, _ = json.Marshal(executed)
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, client := testHandler(t, device, Options{StateFile: file})
+	restarted.handle(msg)
+	restarted.handle(fakeMessage{topic: "devices/tdce-1/cmd/setDio", payload: `{"correlationId":"c2","dio":"DIO_A","value":1}`})
+
+	if device.count() != 1 {
+		t.Errorf("executed %d times, want once across the restart", device.count())
+	}
+	sent := client.sent()
+	if len(sent) != 2 {
+		t.Fatalf("%d responses, want 2", len(sent))
+	}
+	if sent[0].Status != StatusOK || !sent[0].Duplicate {
+		t.Errorf("redelivery after the restart got %+v", sent[0])
+	}
+	if sent[1].Status != StatusError || !sent[1].Duplicate || !strings.Contains(sent[1].Error, "interrupted") {
+		t.Errorf("interrupted command got %+v", sent[1])
+	}
+
+	if err := os.WriteFile(file, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHandler("tdce-1", device, nil, Options{StateFile: file}); err == nil {
+		t.Errorf("NewHandler read a broken state file")
+	}
+}
+
+/* A command that can't be kept isn't run, so a redelivery after a restart can't run it twice */
+func TestStateFileNotWritable(t *testing.T) {
+	device := &fakeDevice{}
+	h, client := testHandler(t, device, Options{StateFile: filepath.Join(t.TempDir(), "missing", "commands.json")})
+	h.handle(fakeMessage{topic: "devices/tdce-1/cmd/setDio", payload: `{"correlationId":"c1","dio":"DIO_A","value":1}`})
+
+	if device.count() != 0 {
+		t.Errorf("executed without being kept")
+	}
+	sent := client.sent()
+	if len(sent) != 1 || sent[0].Status != StatusError || !strings.Contains(sent[0].Error, "not executed") {
+		t.Errorf("responses %+v, want one error", sent)
+	}
+}
@@ -0,0 +1,194 @@
+/* Package created 18.10.2026. */
+/* Settings of the examples, loaded from a YAML, JSON or TOML file and overridden by environment variables and flags */
+/* Every setting is named after the json tags of the settings struct; the setting mqtt.broker is */
+/*   the key broker in the mqtt section of the file, */
+/*   the environment variable <PREFIX>_MQTT_BROKER (or <PREFIX>_MQTT_BROKER_FILE holding the value), */
+/*   the flag -mqtt.broker */
+/* Later sources win: defaults, file, environment, flags */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+type Options struct {
+	/* Name shown in the flag usage, usually the binary name */
+	Name string
+	/* File read when neither -config nor <PREFIX>_CONFIG is given; it may be missing */
+	File string
+	/* Prefix of the environment variables, e.g. "GPS" */
+	EnvPrefix string
+	/* Command line arguments without the program name, usually os.Args[1:] */
+	Args []string
+}
+
+/* Loads the settings on top of defaults; the result is validated, see validate.go */
+func Load[T any](defaults T, opts Options) (*T, error) {
+	cfg := defaults
+	fields := collect(&cfg)
+	origins := map[string]string{}
+
+	/* Flags are parsed first since -config selects the file, but applied last */
+	flags := flag.NewFlagSet(opts.Name, flag.ContinueOnError)
+	configFlag := flags.String("config", "", "settings file (.yaml, .yml, .json or .toml)")
+	pending := map[string]string{}
+	for _, f := range fields {
+		if f.settable() {
+			flags.Var(&flagValue{field: f, pending: pending}, f.path, f.help())
+		}
+	}
+	if err := flags.Parse(opts.Args); err != nil {
+		return nil, err
+	}
+
+	file, required := opts.File, false
+	if env := opts.env("CONFIG"); os.Getenv(env) != "" {
+		file, required = os.Getenv(env), true
+	}
+	if *configFlag != "" {
+		file, required = *configFlag, true
+	}
+	if file != "" {
+		tree, err := readFile(file, &cfg)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !required:
+		case err != nil:
+			return nil, err
+		default:
+			for _, f := range fields {
+				if tree.has(f.path) {
+					origins[f.path] = file
+				}
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if !f.settable() {
+			continue
+		}
+		env := opts.env(f.path)
+		if path := os.Getenv(env + "_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s_FILE: %w", env, err)
+			}
+			if err := f.set(strings.TrimSpace(string(data))); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			origins[f.path] = env + "_FILE"
+		} else if value, ok := os.LookupEnv(env); ok {
+			if err := f.set(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", env, err)
+			}
+			origins[f.path] = env
+		}
+	}
+
+	for _, f := range fields {
+		if value, ok := pending[f.path]; ok {
+			f.set(value)
+			origins[f.path] = "-" + f.path
+		}
+	}
+
+	/* Secrets given as file references are read last so every source can use them */
+	for _, f := range fields {
+		if s, ok := f.value.Addr().Interface().(*Secret); ok {
+			if err := s.resolve(); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.path, err)
+			}
+		}
+	}
+
+	if err := validate(&cfg, fields, origins); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+/* Load for main functions: prints the error and exits, -h prints the flags */
+func MustLoad[T any](defaults T, opts Options) *T {
+	cfg, err := Load(defaults, opts)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configuration: ", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+/* Environment variable of a setting, e.g. GPS_MQTT_BROKER for mqtt.broker */
+func (o Options) env(path string) string {
+	name := strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+	if o.EnvPrefix == "" {
+		return name
+	}
+	return strings.ToUpper(o.EnvPrefix) + "_" + name
+}
+
+/* Decoded file contents, used to tell which settings the file contains */
+type tree map[string]any
+
+func (t tree) has(path string) bool {
+	var node any = map[string]any(t)
+	for _, key := range strings.Split(path, ".") {
+		m, ok := node.(map[string]any)
+		if !ok {
+			return false
+		}
+		if node, ok = m[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+/* Reads the file into cfg; YAML and TOML go through JSON so only json tags are needed */
+func readFile(path string, cfg any) (tree, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t tree
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &t)
+	case ".toml":
+		err = toml.Unmarshal(data, &t)
+	case ".json":
+		err = json.Unmarshal(data, &t)
+	default:
+		return nil, fmt.Errorf("%s: unknown settings format, use .yaml, .yml, .json or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	data, err = json.Marshal(t)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	/* A misspelled key would otherwise be ignored silently */
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,262 @@
+/* Settings struct fields and the types with their own file syntax */
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Duration written as "30s" or "5m" in files, variables and flags; a plain number in a file is seconds */
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\" or a number of seconds")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+/* Password, token or connection string; it is never printed */
+/* In a file it is better given as a reference to a file, e.g. a Docker secret: */
+/*   password: { file: /run/secrets/mqtt_password } */
+type Secret struct {
+	value string
+	file  string
+}
+
+func NewSecret(value string) Secret {
+	return Secret{value: value}
+}
+
+func (s Secret) Value() string {
+	return s.value
+}
+
+func (s Secret) String() string {
+	if s.value == "" {
+		return ""
+	}
+	return "******"
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var ref struct {
+		File string `json:"file"`
+	}
+	if err := json.Unmarshal(data, &ref); err == nil {
+		if ref.File == "" {
+			return fmt.Errorf("secret reference needs a file")
+		}
+		*s = Secret{file: ref.File}
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("secret must be a string or { file: <path> }")
+	}
+	*s = Secret{value: value}
+	return nil
+}
+
+/* Reads the referenced file; done on every load so rotated secrets are picked up */
+func (s *Secret) resolve() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	s.value = strings.TrimSpace(string(data))
+	return nil
+}
+
+var (
+	durationType = reflect.TypeOf(Duration(0))
+	secretType   = reflect.TypeOf(Secret{})
+)
+
+/* One setting of the settings struct */
+type field struct {
+	path  string
+	value reflect.Value
+	tag   reflect.StructTag
+	/* Tagged reload:"true" itself or inside a struct that is; applied on SIGHUP */
+	reload bool
+}
+
+/* Lists the settings of the struct cfg points to, nested structs are flattened to dotted paths */
+func collect(cfg any) []field {
+	var fields []field
+	walk(reflect.ValueOf(cfg).Elem(), "", false, &fields)
+	return fields
+}
+
+func walk(v reflect.Value, prefix string, reload bool, fields *[]field) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(sf.Name[:1]) + sf.Name[1:]
+		}
+		path := prefix + name
+		hot := reload || sf.Tag.Get("reload") == "true"
+
+		if sf.Type.Kind() == reflect.Struct && sf.Type != secretType {
+			walk(v.Field(i), path+".", hot, fields)
+			continue
+		}
+		*fields = append(*fields, field{path: path, value: v.Field(i), tag: sf.Tag, reload: hot})
+	}
+}
+
+/* Whether the setting can be given as an environment variable or flag */
+func (f field) settable() bool {
+	switch f.value.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return f.value.Type().Elem().Kind() == reflect.String
+	}
+	return f.value.Type() == secretType
+}
+
+func (f field) help() string {
+	return f.tag.Get("help")
+}
+
+/* Parses s as the type of the setting; lists are comma separated */
+func (f field) parse(s string) (reflect.Value, error) {
+	t := f.value.Type()
+	v := reflect.New(t).Elem()
+
+	switch {
+	case t == secretType:
+		v.Set(reflect.ValueOf(NewSecret(s)))
+	case t == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid duration %q, use e.g. \"30s\"", s)
+		}
+		v.SetInt(int64(d))
+	default:
+		switch t.Kind() {
+		case reflect.String:
+			v.SetString(s)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return v, fmt.Errorf("invalid boolean %q, use true or false", s)
+			}
+			v.SetBool(b)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, t.Bits())
+			if err != nil {
+				return v, fmt.Errorf("invalid integer %q", s)
+			}
+			v.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(s, 10, t.Bits())
+			if err != nil {
+				return v, fmt.Errorf("invalid unsigned integer %q", s)
+			}
+			v.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			n, err := strconv.ParseFloat(s, t.Bits())
+			if err != nil {
+				return v, fmt.Errorf("invalid number %q", s)
+			}
+			v.SetFloat(n)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items).Convert(t))
+		default:
+			return v, fmt.Errorf("%s cannot be set from text", f.path)
+		}
+	}
+	return v, nil
+}
+
+func (f field) set(s string) error {
+	v, err := f.parse(s)
+	if err != nil {
+		return err
+	}
+	f.value.Set(v)
+	return nil
+}
+
+/* Flag that remembers its value until the file and environment are applied */
+type flagValue struct {
+	field   field
+	pending map[string]string
+}
+
+func (v *flagValue) String() string {
+	if v == nil || v.pending == nil {
+		return ""
+	}
+	if v.field.value.Type() == secretType {
+		return ""
+	}
+	if v.field.value.Kind() == reflect.Slice {
+		return strings.Join(v.field.value.Convert(reflect.TypeOf([]string(nil))).Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.field.value.Interface())
+}
+
+func (v *flagValue) Set(s string) error {
+	if _, err := v.field.parse(s); err != nil {
+		return err
+	}
+	v.pending[v.field.path] = s
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.field.value.Kind() == reflect.Bool
+}
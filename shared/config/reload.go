@@ -0,0 +1,99 @@
+/* Hot reload of the settings tagged reload:"true" */
+/* Connection settings (brokers, addresses, credentials) are only read at start; */
+/* a reload that changes them reports them so the service can be restarted when convenient */
+
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+)
+
+/* Holds the active settings; a reload swaps them as a whole so readers never see half of a change */
+type Store[T any] struct {
+	current  atomic.Pointer[T]
+	defaults T
+	opts     Options
+}
+
+/* Loads the settings like MustLoad and keeps what is needed to load them again */
+func NewStore[T any](defaults T, opts Options) *Store[T] {
+	s := &Store[T]{defaults: defaults, opts: opts}
+	s.current.Store(MustLoad(defaults, opts))
+	return s
+}
+
+/* The active settings; do not modify them */
+func (s *Store[T]) Get() *T {
+	return s.current.Load()
+}
+
+/* Loads the settings again and applies the reloadable ones */
+/* Returns the applied settings and the changed ones that need a restart */
+func (s *Store[T]) Reload() (applied, restart []string, err error) {
+	next, err := Load(s.defaults, s.opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	merged := *s.Get()
+	nextFields := collect(next)
+	for i, f := range collect(&merged) {
+		n := nextFields[i]
+		if reflect.DeepEqual(f.value.Interface(), n.value.Interface()) {
+			continue
+		}
+		if f.reload {
+			f.value.Set(n.value)
+			applied = append(applied, f.path)
+		} else {
+			restart = append(restart, f.path)
+		}
+	}
+
+	/* Checks across settings may fail for the mix of old and new values */
+	if len(applied) > 0 {
+		if err := validate(&merged, collect(&merged), nil); err != nil {
+			return nil, nil, err
+		}
+		s.current.Store(&merged)
+	}
+	return applied, restart, nil
+}
+
+/* Reloads on SIGHUP until ctx is cancelled; onReload runs after settings were applied and may be nil */
+func (s *Store[T]) WatchSIGHUP(ctx context.Context, onReload func(cfg *T)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		applied, restart, err := s.Reload()
+		if err != nil {
+			log.Println("Configuration not reloaded: ", err)
+			continue
+		}
+		if len(restart) > 0 {
+			log.Printf("Changed settings %v are applied after a restart\n", restart)
+		}
+		if len(applied) == 0 {
+			log.Println("Configuration reloaded, nothing to apply")
+			continue
+		}
+		log.Printf("Configuration reloaded, applied %v\n", applied)
+		if onReload != nil {
+			onReload(s.Get())
+		}
+	}
+}
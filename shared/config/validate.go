@@ -0,0 +1,146 @@
+/* Checks of the validate tag and the Validate method of the settings struct */
+/* Rules, separated by commas: */
+/*   required         the setting must not be empty or zero */
+/*   min=N, max=N     bounds of numbers and durations, or of the length of text and lists */
+/*   oneof=a b c      one of the listed words */
+/*   url              absolute URL, e.g. tcp://192.168.0.100:1883 */
+/*   hostport         host:port or :port, e.g. :9101 */
+/* Rules other than required are skipped for empty settings */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Lists every invalid setting with where its value came from */
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+func validate(cfg any, fields []field, origins map[string]string) error {
+	var problems []string
+	for _, f := range fields {
+		if err := check(f); err != nil {
+			problem := fmt.Sprintf("%s: %v", f.path, err)
+			if origin, ok := origins[f.path]; ok {
+				problem += " (set by " + origin + ")"
+			}
+			problems = append(problems, problem)
+		}
+	}
+	if v, ok := cfg.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func check(f field) error {
+	rules := f.tag.Get("validate")
+	if rules == "" {
+		return nil
+	}
+	if isEmpty(f.value) {
+		if strings.Contains(","+rules+",", ",required,") {
+			return errors.New("is required")
+		}
+		return nil
+	}
+
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		var err error
+		switch name {
+		case "required":
+		case "min", "max":
+			err = checkBound(f.value, name, arg)
+		case "oneof":
+			allowed := strings.Fields(arg)
+			s := fmt.Sprint(f.value.Interface())
+			if !slices.Contains(allowed, s) {
+				err = fmt.Errorf("must be one of %s, got %q", strings.Join(allowed, ", "), s)
+			}
+		case "url":
+			u, perr := url.Parse(f.value.String())
+			if perr != nil || u.Scheme == "" || u.Host == "" {
+				err = fmt.Errorf("must be a URL like tcp://host:1883, got %q", f.value.String())
+			}
+		case "hostport":
+			if _, port, perr := net.SplitHostPort(f.value.String()); perr != nil || port == "" {
+				err = fmt.Errorf("must be host:port or :port, got %q", f.value.String())
+			}
+		default:
+			err = fmt.Errorf("unknown validate rule %q", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	if s, ok := v.Interface().(Secret); ok {
+		return s.Value() == ""
+	}
+	return v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0)
+}
+
+func checkBound(v reflect.Value, rule, arg string) error {
+	var value, bound float64
+	var err error
+	show := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+
+	switch v.Kind() {
+	case reflect.String, reflect.Slice:
+		value = float64(v.Len())
+		bound, err = strconv.ParseFloat(arg, 64)
+		show = func(f float64) string { return fmt.Sprintf("%g characters or items", f) }
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(arg)
+			value, bound = float64(v.Int()), float64(d)
+			show = func(f float64) string { return time.Duration(f).String() }
+			break
+		}
+		value = float64(v.Int())
+		bound, err = strconv.ParseFloat(arg, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value = float64(v.Uint())
+		bound, err = strconv.ParseFloat(arg, 64)
+	case reflect.Float32, reflect.Float64:
+		value = v.Float()
+		bound, err = strconv.ParseFloat(arg, 64)
+	default:
+		return fmt.Errorf("%s cannot be checked on %s", rule, v.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("bad %s=%s rule", rule, arg)
+	}
+
+	if rule == "min" && value < bound {
+		return fmt.Errorf("must be at least %s, got %s", show(bound), show(value))
+	}
+	if rule == "max" && value > bound {
+		return fmt.Errorf("must be at most %s, got %s", show(bound), show(value))
+	}
+	return nil
+}
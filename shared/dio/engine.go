@@ -0,0 +1,244 @@
+/* Package created 18.10.2026. */
+/* Edge events of the DIOs: debounced rising and falling edges with the time they happened */
+/* Levels come from a Source (WebSocket stream, rate-limited REST poll or sysfs GPIO interrupts); */
+/* every subscriber filters them on its own, so one engine serves consumers with different filters */
+
+package dio
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+type Edge int
+
+const (
+	Rising Edge = iota + 1
+	Falling
+)
+
+func (e Edge) String() string {
+	switch e {
+	case Rising:
+		return "rising"
+	case Falling:
+		return "falling"
+	}
+	return "none"
+}
+
+/* Level of a channel as read by a source */
+type Sample struct {
+	Channel string
+	Value   int
+	Time    time.Time
+}
+
+/* Accepted change of a channel's level */
+type Event struct {
+	Channel string
+	Edge    Edge
+	// when the new level was first seen, before the filters confirmed it
+	Time time.Time
+	// how long the previous level lasted; 0 for the first edge after start
+	Previous time.Duration
+}
+
+/* Delivers the levels of its channels until ctx is cancelled */
+/* Sources may report unchanged levels; the engine only reacts to changes */
+type Source interface {
+	Name() string
+	Run(ctx context.Context, emit func(Sample)) error
+}
+
+/* Filters of a subscription; zero values disable them */
+type Filter struct {
+	// glitch filter: a new level has to hold this long before it is accepted
+	Debounce time.Duration
+	// high pulses shorter than this produce neither a rising nor a falling edge
+	MinPulse time.Duration
+	// deliver only this edge; 0 delivers both
+	Only Edge
+}
+
+type Engine struct {
+	Source Source
+
+	mu   sync.Mutex
+	subs map[string][]*Subscription
+}
+
+func NewEngine(source Source) *Engine {
+	return &Engine{Source: source, subs: map[string][]*Subscription{}}
+}
+
+/* Subscribes to the edges of channel, e.g. "DIO_B" */
+func (e *Engine) Subscribe(channel string, filter Filter) *Subscription {
+	sub := &Subscription{
+		engine:  e,
+		channel: channel,
+		filter:  filter,
+		events:  make(chan Event, 64),
+	}
+	e.mu.Lock()
+	e.subs[channel] = append(e.subs[channel], sub)
+	e.mu.Unlock()
+	return sub
+}
+
+func (e *Engine) unsubscribe(sub *Subscription) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	subs := e.subs[sub.channel]
+	for i, s := range subs {
+		if s == sub {
+			e.subs[sub.channel] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
+
+/* Reads the source until ctx is cancelled */
+func (e *Engine) Run(ctx context.Context) error {
+	if e.Source == nil {
+		return errors.New("dio: engine has no source")
+	}
+	err := e.Source.Run(ctx, e.feed)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (e *Engine) feed(s Sample) {
+	e.mu.Lock()
+	subs := append([]*Subscription(nil), e.subs[s.Channel]...)
+	e.mu.Unlock()
+	for _, sub := range subs {
+		sub.feed(s.Value, s.Time)
+	}
+}
+
+/* Edges of one channel after the subscription's filters */
+type Subscription struct {
+	engine  *Engine
+	channel string
+	filter  Filter
+	events  chan Event
+
+	mu     sync.Mutex
+	known  bool
+	level  int
+	since  time.Time
+	closed bool
+	// whether an edge was accepted, so since is when the level really started
+	edged bool
+	// level waiting for the filters to confirm it
+	pending     bool
+	candidate   int
+	candidateAt time.Time
+	timer       *time.Timer
+	generation  int
+}
+
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+/* Accepted level of the channel and since when; ok is false before the first sample */
+func (s *Subscription) Level() (level int, since time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.level, s.since, s.known
+}
+
+/* Stops the subscription and closes Events */
+func (s *Subscription) Close() {
+	s.engine.unsubscribe(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	close(s.events)
+}
+
+func (s *Subscription) feed(value int, at time.Time) {
+	if value != 0 {
+		value = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if !s.known {
+		/* The level before the first sample is unknown, so the first sample is no edge */
+		s.known, s.level, s.since = true, value, at
+		return
+	}
+	if value == s.level {
+		/* Back to the accepted level before the filters confirmed the change: a glitch */
+		s.cancelPending()
+		return
+	}
+	if s.pending {
+		return
+	}
+
+	delay := s.filter.Debounce
+	if value == 1 {
+		delay = max(delay, s.filter.MinPulse)
+	}
+	s.pending, s.candidate, s.candidateAt = true, value, at
+	if delay <= 0 {
+		s.accept()
+		return
+	}
+	s.generation++
+	generation := s.generation
+	s.timer = time.AfterFunc(delay-time.Since(at), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pending && s.generation == generation && !s.closed {
+			s.accept()
+		}
+	})
+}
+
+func (s *Subscription) cancelPending() {
+	if s.pending && s.timer != nil {
+		s.timer.Stop()
+	}
+	s.pending = false
+	s.generation++
+}
+
+/* Makes the pending level the accepted one and delivers its edge; s.mu is held */
+func (s *Subscription) accept() {
+	event := Event{Channel: s.channel, Edge: Rising, Time: s.candidateAt}
+	if s.candidate == 0 {
+		event.Edge = Falling
+	}
+	if s.edged {
+		event.Previous = s.candidateAt.Sub(s.since)
+	}
+	s.level, s.since, s.pending, s.edged = s.candidate, s.candidateAt, false, true
+
+	if s.filter.Only != 0 && s.filter.Only != event.Edge {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		log.Printf("DIO %s: subscriber is too slow, dropped %s edge\n", s.channel, event.Edge)
+	}
+}
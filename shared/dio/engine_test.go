@@ -0,0 +1,240 @@
+package dio
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type timed struct {
+	at    time.Duration
+	value int
+}
+
+/* Emits the levels of DIO_A at their offsets from the start, in real time, stamped with start+offset */
+type timedSource struct {
+	start   time.Time
+	samples []timed
+	done    chan struct{}
+}
+
+func (s *timedSource) Name() string {
+	return "timed"
+}
+
+func (s *timedSource) Run(ctx context.Context, emit func(Sample)) error {
+	for _, t := range s.samples {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(s.start.Add(t.at))):
+		}
+		emit(Sample{Channel: "DIO_A", Value: t.value, Time: s.start.Add(t.at)})
+	}
+	close(s.done)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+type edge struct {
+	edge     Edge
+	at       time.Duration
+	previous time.Duration
+}
+
+func TestFilters(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		filter  Filter
+		samples []timed
+		want    []edge
+	}{
+		{"no filter", Filter{},
+			[]timed{{0, 0}, {10 * ms, 1}, {30 * ms, 0}, {60 * ms, 1}},
+			[]edge{{Rising, 10 * ms, 0}, {Falling, 30 * ms, 20 * ms}, {Rising, 60 * ms, 30 * ms}}},
+		/* the first sample only sets the level, unchanged levels are no edges */
+		{"first sample and repeats", Filter{},
+			[]timed{{0, 1}, {10 * ms, 1}, {20 * ms, 1}},
+			nil},
+		{"glitch shorter than debounce", Filter{Debounce: 50 * ms},
+			[]timed{{0, 0}, {20 * ms, 1}, {30 * ms, 0}, {100 * ms, 1}, {250 * ms, 0}, {320 * ms, 1}, {330 * ms, 0}},
+			[]edge{{Rising, 100 * ms, 0}, {Falling, 250 * ms, 150 * ms}}},
+		{"glitch of a high level", Filter{Debounce: 50 * ms},
+			[]timed{{0, 1}, {20 * ms, 0}, {30 * ms, 1}},
+			nil},
+		/* a short high pulse gives neither edge, a short low one still ends the high level at once */
+		{"pulse shorter than min pulse", Filter{MinPulse: 60 * ms},
+			[]timed{{0, 0}, {20 * ms, 1}, {40 * ms, 0}, {100 * ms, 1}, {200 * ms, 0}, {210 * ms, 1}, {230 * ms, 0}},
+			[]edge{{Rising, 100 * ms, 0}, {Falling, 200 * ms, 100 * ms}}},
+		{"only falling", Filter{Only: Falling},
+			[]timed{{0, 0}, {10 * ms, 1}, {30 * ms, 0}, {60 * ms, 1}},
+			[]edge{{Falling, 30 * ms, 20 * ms}}},
+		/* values other than 0 are high */
+		{"non-zero is high", Filter{},
+			[]timed{{0, 0}, {10 * ms, 5}, {20 * ms, 1}},
+			[]edge{{Rising, 10 * ms, 0}}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			src := &timedSource{start: time.Now().Add(20 * time.Millisecond), samples: tt.samples, done: make(chan struct{})}
+			e := NewEngine(src)
+			sub := e.Subscribe("DIO_A", tt.filter)
+			other := e.Subscribe("DIO_B", Filter{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			finished := make(chan error)
+			go func() { finished <- e.Run(ctx) }()
+			<-src.done
+			/* lets the last filter timers run out */
+			time.Sleep(tt.filter.Debounce + tt.filter.MinPulse + 50*time.Millisecond)
+			cancel()
+			if err := <-finished; err != nil {
+				t.Errorf("Run: %v", err)
+			}
+			sub.Close()
+			other.Close()
+
+			var got []edge
+			for ev := range sub.Events() {
+				if ev.Channel != "DIO_A" {
+					t.Errorf("event of %s", ev.Channel)
+				}
+				got = append(got, edge{ev.Edge, ev.Time.Sub(src.start), ev.Previous})
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("edges %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("edges %v, want %v", got, tt.want)
+					break
+				}
+			}
+			if _, ok := <-other.Events(); ok {
+				t.Errorf("DIO_B got an edge of DIO_A")
+			}
+		})
+	}
+}
+
+func TestLevel(t *testing.T) {
+	e := NewEngine(nil)
+	sub := e.Subscribe("DIO_A", Filter{})
+	defer sub.Close()
+	if _, _, ok := sub.Level(); ok {
+		t.Errorf("level known before the first sample")
+	}
+	at := time.Now()
+	e.feed(Sample{Channel: "DIO_A", Value: 1, Time: at})
+	if level, since, ok := sub.Level(); !ok || level != 1 || !since.Equal(at) {
+		t.Errorf("Level = %d, %s, %v; want 1 since the sample", level, since, ok)
+	}
+	if err := e.Run(context.Background()); err == nil {
+		t.Errorf("Run without a source succeeded")
+	}
+}
+
+/* Emits one level, then another one after it was stopped, like a poll that was still running */
+type staleFallback struct {
+	stopped chan struct{}
+}
+
+func (f *staleFallback) Name() string {
+	return "stale"
+}
+
+func (f *staleFallback) Run(ctx context.Context, emit func(Sample)) error {
+	emit(Sample{Channel: "DIO_A", Value: 0, Time: time.Now()})
+	<-ctx.Done()
+	emit(Sample{Channel: "DIO_A", Value: 0, Time: time.Now()})
+	close(f.stopped)
+	return ctx.Err()
+}
+
+func TestFallbackStopsBeforeStream(t *testing.T) {
+	var up atomic.Bool
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() || r.URL.Path != "/ws/tdce/dio/states" {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`[{"DioName":"DIO_A","Value":1,"Direction":"Input"}]`))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	fallback := &staleFallback{stopped: make(chan struct{})}
+	src := &WebSocketSource{Host: strings.TrimPrefix(server.URL, "http://"), Fallback: fallback}
+	var mu sync.Mutex
+	var values []int
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx, func(s Sample) {
+		mu.Lock()
+		defer mu.Unlock()
+		values = append(values, s.Value)
+	})
+
+	/* the stream comes up only once the fallback delivered */
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(values)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("fallback not started while the stream is down")
+		}
+	}
+	up.Store(true)
+	select {
+	case <-fallback.stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("fallback not stopped after the stream connected")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(values) != 2 || values[0] != 0 || values[1] != 1 {
+		t.Errorf("levels %v, want 0 from the fallback and then only 1 from the stream", values)
+	}
+}
+
+func TestDecodeStates(t *testing.T) {
+	at := time.Now()
+	samples, err := decodeStates([]byte(`[{"DioName":"DIO_A","Value":1},{"DioName":"DIO_B","Value":0}]`), at)
+	if err != nil || len(samples) != 2 || samples[0] != (Sample{"DIO_A", 1, at}) || samples[1] != (Sample{"DIO_B", 0, at}) {
+		t.Errorf("array: %v, %v", samples, err)
+	}
+	samples, err = decodeStates([]byte(`{"DioName":"DIO_C","Value":1}`), at)
+	if err != nil || len(samples) != 1 || samples[0].Channel != "DIO_C" {
+		t.Errorf("single: %v, %v", samples, err)
+	}
+	for _, msg := range []string{`{"Value":1}`, `nonsense`} {
+		if _, err := decodeStates([]byte(msg), at); err == nil {
+			t.Errorf("decodeStates(%s) succeeded", msg)
+		}
+	}
+}
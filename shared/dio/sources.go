@@ -0,0 +1,154 @@
+/* Sources of DIO levels */
+
+package dio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"tdce-shared/tdce"
+	"tdce-shared/wsclient"
+)
+
+/* Reads the levels over the REST API, at most once per Interval */
+type PollSource struct {
+	Device   *tdce.Client
+	Channels []string
+	// time between two reads of all channels; defaults to 100ms
+	Interval time.Duration
+}
+
+func (p *PollSource) Name() string {
+	return "poll"
+}
+
+func (p *PollSource) Run(ctx context.Context, emit func(Sample)) error {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, ch := range p.Channels {
+			d, err := p.Device.GetDIO(ctx, ch)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("Error reading %s: %v\n", ch, err)
+				continue
+			}
+			emit(Sample{Channel: ch, Value: d.Value, Time: time.Now()})
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+/* Reads the levels from /ws/tdce/dio/states */
+/* While the stream is not connected, Fallback (usually a PollSource) delivers the levels */
+type WebSocketSource struct {
+	// device address with the WebSocket port, e.g. 192.168.0.100:31768
+	Host     string
+	Fallback Source
+}
+
+func (w *WebSocketSource) Name() string {
+	return "websocket"
+}
+
+func (w *WebSocketSource) Run(ctx context.Context, emit func(Sample)) error {
+	client := wsclient.New(wsclient.Config{URL: wsclient.URL(w.Host, wsclient.DioStates)})
+	go client.Run(ctx)
+
+	/* The stream and the fallback emit under mu, and a stopped fallback no longer emits, */
+	/* so a read the fallback started before the stream came back can't override newer levels */
+	var mu sync.Mutex
+	startFallback := func() context.CancelFunc {
+		fallbackCtx, cancel := context.WithCancel(ctx)
+		go w.Fallback.Run(fallbackCtx, func(s Sample) {
+			mu.Lock()
+			defer mu.Unlock()
+			if fallbackCtx.Err() == nil {
+				emit(s)
+			}
+		})
+		return func() {
+			mu.Lock()
+			cancel()
+			mu.Unlock()
+		}
+	}
+	var stopFallback context.CancelFunc
+	stop := func() {
+		if stopFallback != nil {
+			stopFallback()
+			stopFallback = nil
+		}
+	}
+	defer stop()
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+
+	for {
+		/* The fallback runs until the stream is back */
+		connected := client.Connected()
+		if !connected && stopFallback == nil && w.Fallback != nil {
+			log.Printf("DIO stream not connected, reading levels with %s\n", w.Fallback.Name())
+			stopFallback = startFallback()
+		}
+		if connected {
+			stop()
+		}
+
+		select {
+		case msg, ok := <-client.Messages():
+			if !ok {
+				return ctx.Err()
+			}
+			/* A message means the stream is back, even if Connected was checked just before it connected */
+			stop()
+			samples, err := decodeStates(msg, time.Now())
+			if err != nil {
+				log.Println("Error decoding DIO states: ", err)
+				continue
+			}
+			mu.Lock()
+			for _, s := range samples {
+				emit(s)
+			}
+			mu.Unlock()
+		case <-check.C:
+		}
+	}
+}
+
+/* The stream sends the states in the format of the REST API, one DIO or an array of them */
+func decodeStates(msg []byte, at time.Time) ([]Sample, error) {
+	var dios []tdce.Dio
+	if err := json.Unmarshal(msg, &dios); err != nil {
+		var single tdce.Dio
+		if err := json.Unmarshal(msg, &single); err != nil {
+			return nil, err
+		}
+		dios = []tdce.Dio{single}
+	}
+
+	samples := make([]Sample, 0, len(dios))
+	for _, d := range dios {
+		if d.DioName == "" {
+			return nil, fmt.Errorf("state without DioName: %s", msg)
+		}
+		samples = append(samples, Sample{Channel: d.DioName, Value: d.Value, Time: at})
+	}
+	return samples, nil
+}
@@ -0,0 +1,114 @@
+package dio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Reads the levels from sysfs GPIOs, e.g. DIO_A is /sys/class/gpio/gpio496 */
+/* The edge file is set to "both", so poll(2) wakes up on every change of the value file */
+type SysfsSource struct {
+	// channel name to GPIO number
+	Pins map[string]int
+	// defaults to /sys/class/gpio
+	Root string
+}
+
+func (s *SysfsSource) Name() string {
+	return "sysfs"
+}
+
+type gpioValue struct {
+	channel string
+	file    *os.File
+}
+
+func (s *SysfsSource) Run(ctx context.Context, emit func(Sample)) error {
+	root := s.Root
+	if root == "" {
+		root = "/sys/class/gpio"
+	}
+
+	var values []gpioValue
+	defer func() {
+		for _, v := range values {
+			v.file.Close()
+		}
+	}()
+	for channel, pin := range s.Pins {
+		file, err := openGpio(root, pin)
+		if err != nil {
+			return fmt.Errorf("%s: %w", channel, err)
+		}
+		values = append(values, gpioValue{channel: channel, file: file})
+	}
+
+	fds := make([]unix.PollFd, len(values))
+	for i, v := range values {
+		fds[i] = unix.PollFd{Fd: int32(v.file.Fd()), Events: unix.POLLPRI | unix.POLLERR}
+		/* Reading clears the pending interrupt and gives the starting level */
+		if err := readGpio(v, emit); err != nil {
+			return err
+		}
+	}
+
+	for ctx.Err() == nil {
+		/* A timeout so a cancelled ctx is noticed */
+		n, err := unix.Poll(fds, 500)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		for i := range fds {
+			if fds[i].Revents&(unix.POLLPRI|unix.POLLERR) != 0 {
+				if err := readGpio(values[i], emit); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+/* Exports the GPIO if needed, enables interrupts on both edges and opens its value */
+func openGpio(root string, pin int) (*os.File, error) {
+	dir := filepath.Join(root, "gpio"+strconv.Itoa(pin))
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(filepath.Join(root, "export"), []byte(strconv.Itoa(pin)), 0); err != nil {
+			return nil, err
+		}
+		/* udev may need a moment to create the attribute files */
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "edge"), []byte("both"), 0); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(dir, "value"))
+}
+
+func readGpio(v gpioValue, emit func(Sample)) error {
+	buf := make([]byte, 8)
+	n, err := v.file.ReadAt(buf, 0)
+	if err != nil && n == 0 {
+		return fmt.Errorf("%s: %w", v.channel, err)
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return fmt.Errorf("%s: %w", v.channel, err)
+	}
+	emit(Sample{Channel: v.channel, Value: value, Time: time.Now()})
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package dio
+
+import (
+	"context"
+	"errors"
+)
+
+/* Reads the levels from sysfs GPIOs with edge interrupts */
+type SysfsSource struct {
+	Pins map[string]int
+	Root string
+}
+
+func (s *SysfsSource) Name() string {
+	return "sysfs"
+}
+
+func (s *SysfsSource) Run(ctx context.Context, emit func(Sample)) error {
+	return errors.New("sysfs GPIO is only supported on Linux")
+}
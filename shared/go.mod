@@ -0,0 +1,27 @@
+module tdce-shared
+
+go 1.21.0
+
+require (
+	github.com/eclipse/paho.golang v0.21.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/gorilla/websocket v1.5.1
+	github.com/pelletier/go-toml/v2 v2.0.8
+	github.com/prometheus/client_golang v1.19.1
+	golang.org/x/oauth2 v0.16.0
+	golang.org/x/sys v0.17.0
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	google.golang.org/appengine v1.6.7 // indirect
+)
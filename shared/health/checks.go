@@ -0,0 +1,98 @@
+/* Checks for the dependencies the examples share */
+
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+	"tdce-shared/supervisor"
+	"tdce-shared/wsclient"
+)
+
+/* Broker connection of a paho client */
+func MQTT(client interface{ IsConnectionOpen() bool }) Check {
+	return func(context.Context) (map[string]any, error) {
+		open := client.IsConnectionOpen()
+		details := map[string]any{"connected": open}
+		if !open {
+			return details, errors.New("not connected to the broker")
+		}
+		return details, nil
+	}
+}
+
+/* Reachability of a database or any other service with a ping, e.g. (*sql.DB).PingContext */
+func Ping(ping func(ctx context.Context) error) Check {
+	return func(ctx context.Context) (map[string]any, error) {
+		started := time.Now()
+		err := ping(ctx)
+		return map[string]any{"latency": time.Since(started).Round(time.Microsecond).String()}, err
+	}
+}
+
+/* Freshness of a WebSocket stream: connected and a message received within maxAge */
+/* current returns the client in use, or nil before the stream was started */
+func Stream(current func() *wsclient.Client, maxAge time.Duration) Check {
+	return func(context.Context) (map[string]any, error) {
+		client := current()
+		if client == nil {
+			return nil, errors.New("stream not started")
+		}
+		connected := client.Connected()
+		last := client.LastMessage()
+		details := map[string]any{"connected": connected}
+		if last.IsZero() {
+			return details, errors.New("no message received yet")
+		}
+		age := time.Since(last)
+		details["lastMessage"] = last.Format(time.RFC3339)
+		details["age"] = age.Round(time.Millisecond).String()
+		if !connected {
+			return details, errors.New("stream is not connected")
+		}
+		if age > maxAge {
+			return details, fmt.Errorf("no message for %s, more than %s", age.Round(time.Second), maxAge)
+		}
+		return details, nil
+	}
+}
+
+/* Validity of an OAuth2.0 token; the token source fetches or refreshes it if needed */
+func Token(ts oauth2.TokenSource) Check {
+	return func(context.Context) (map[string]any, error) {
+		token, err := ts.Token()
+		if err != nil {
+			return nil, err
+		}
+		details := map[string]any{"valid": token.Valid()}
+		if !token.Expiry.IsZero() {
+			details["expiresIn"] = time.Until(token.Expiry).Round(time.Second).String()
+		}
+		if !token.Valid() {
+			return details, errors.New("token is expired")
+		}
+		return details, nil
+	}
+}
+
+/* State of every supervised service; fails while one is not running */
+func Supervisor(sup *supervisor.Supervisor) Check {
+	return func(context.Context) (map[string]any, error) {
+		details := map[string]any{}
+		var failing []string
+		for _, st := range sup.Status() {
+			details[st.Name] = st
+			if st.State != supervisor.Running {
+				failing = append(failing, st.Name)
+			}
+		}
+		if len(failing) > 0 {
+			return details, fmt.Errorf("services not running: %v", failing)
+		}
+		return details, nil
+	}
+}
@@ -0,0 +1,149 @@
+/* Package created 18.10.2026. */
+/* /healthz and /readyz endpoints for Docker HEALTHCHECK and Portainer */
+/* /healthz fails when the process is wedged and should be restarted, */
+/* /readyz additionally fails while a dependency (broker, database, token) is unavailable */
+/* Both answer 200 or 503 with every check and its details as JSON */
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* Returns details shown in the response and an error when the check fails */
+type Check func(ctx context.Context) (details map[string]any, err error)
+
+/* Outcome of one check */
+type Result struct {
+	Name     string         `json:"name"`
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Details  map[string]any `json:"details,omitempty"`
+	Duration string         `json:"duration"`
+}
+
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+type entry struct {
+	name  string
+	check Check
+}
+
+type Checker struct {
+	/* Time a check may take before it fails */
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	live  []entry
+	ready []entry
+}
+
+func New() *Checker {
+	return &Checker{Timeout: 5 * time.Second}
+}
+
+/* Adds a check to /healthz and /readyz; a failure means the process should be restarted */
+func (c *Checker) Live(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.live = append(c.live, entry{name: name, check: check})
+}
+
+/* Adds a check to /readyz only; a failure means the process cannot do its work right now */
+func (c *Checker) Ready(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ready = append(c.ready, entry{name: name, check: check})
+}
+
+/* Runs the checks concurrently */
+func (c *Checker) run(ctx context.Context, entries []entry) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	report := Report{Status: "ok", Checks: make([]Result, len(entries))}
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		wg.Add(1)
+		go func(i int, e entry) {
+			defer wg.Done()
+			started := time.Now()
+			details, err := e.check(ctx)
+			result := Result{Name: e.name, Status: "ok", Details: details, Duration: time.Since(started).Round(time.Microsecond).String()}
+			if err != nil {
+				result.Status, result.Error = "fail", err.Error()
+			}
+			report.Checks[i] = result
+		}(i, e)
+	}
+	wg.Wait()
+
+	for _, r := range report.Checks {
+		if r.Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+/* Report of /healthz */
+func (c *Checker) Liveness(ctx context.Context) Report {
+	c.mu.Lock()
+	entries := append([]entry(nil), c.live...)
+	c.mu.Unlock()
+	return c.run(ctx, entries)
+}
+
+/* Report of /readyz */
+func (c *Checker) Readiness(ctx context.Context) Report {
+	c.mu.Lock()
+	entries := append(append([]entry(nil), c.live...), c.ready...)
+	c.mu.Unlock()
+	return c.run(ctx, entries)
+}
+
+/* Handler serving /healthz and /readyz */
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Liveness(r.Context()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Readiness(r.Context()))
+	})
+	return mux
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+/* Serves the endpoints on addr until ctx is cancelled */
+func (c *Checker) Serve(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: c.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return err
+}
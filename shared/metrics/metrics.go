@@ -0,0 +1,87 @@
+/* Package created 18.10.2026. */
+/* Prometheus metrics shared by the examples and the /metrics endpoint that serves them */
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const Namespace = "tdce"
+
+/* Registry with the Go runtime and process collectors */
+func NewRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+/* Serves reg on addr under /metrics until ctx is cancelled */
+func Serve(ctx context.Context, addr string, reg *prometheus.Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true, Registry: reg}))
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return err
+}
+
+/* Counters of an MQTT publisher */
+type MQTT struct {
+	published *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+}
+
+/* Registers the publish counters; queued reports the messages waiting for the broker and may be nil */
+func NewMQTT(reg prometheus.Registerer, queued func() int) *MQTT {
+	m := &MQTT{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: "mqtt",
+			Name:      "published_total",
+			Help:      "Messages acknowledged by the broker.",
+		}, []string{"topic"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: "mqtt",
+			Name:      "publish_failures_total",
+			Help:      "Publish attempts the broker did not acknowledge.",
+		}, []string{"topic"}),
+	}
+	reg.MustRegister(m.published, m.failed)
+
+	if queued != nil {
+		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Subsystem: "mqtt",
+			Name:      "queued_messages",
+			Help:      "Messages stored until the broker acknowledges them.",
+		}, func() float64 { return float64(queued()) }))
+	}
+	return m
+}
+
+func (m *MQTT) Published(topic string) {
+	m.published.WithLabelValues(topic).Inc()
+}
+
+func (m *MQTT) Failed(topic string) {
+	m.failed.WithLabelValues(topic).Inc()
+}
@@ -0,0 +1,122 @@
+/* Package created 18.10.2026. */
+/* Modem details, statistics and SMS from the device manager API */
+
+package modem
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"tdce-shared/ropc"
+)
+
+const DefaultAPI = "http://192.168.0.100/devicemanager/api/v1"
+
+/* Response of /networking/modem/{interface}/details */
+type Details struct {
+	GsmRegistrationStatus   string `json:"gsmRegistrationStatus"`
+	UtranRegistrationStatus string `json:"utranRegistrationStatus"`
+	AccessTechnology        string `json:"accessTechnology"`
+	DataLinkType            string `json:"dataLinkType"`
+	OperatorName            string `json:"operatorName"`
+	SimStatus               string `json:"simStatus"`
+	LatestError             string `json:"latestError"`
+	Imei                    string `json:"imei"`
+	Ccid                    string `json:"ccid"`
+	Imsi                    string `json:"imsi"`
+	Rssi                    int    `json:"rssi"`
+	Ip                      string `json:"ip"`
+	Gateway                 string `json:"gateway"`
+	Dns1                    string `json:"dns1"`
+	Dns2                    string `json:"dns2"`
+	LocalIp                 string `json:"localIp"`
+	RemoteIp                string `json:"remoteIp"`
+	Segment                 string `json:"segment"`
+	SegmentType             string `json:"segmentType"`
+	Persist                 bool   `json:"persist"`
+	Name                    string `json:"name"`
+	Type                    string `json:"type"`
+	Enabled                 bool   `json:"enabled"`
+	State                   string `json:"state"`
+}
+
+/* Response of /networking/modem/{interface}/statistics; all counters count up from the moment the link came up */
+type Statistics struct {
+	Name            string `json:"name"`
+	PacketsSent     int    `json:"packetsSent"`
+	PacketsReceived int    `json:"packetsReceived"`
+	BytesSent       int    `json:"bytesSent"`
+	BytesReceived   int    `json:"bytesReceived"`
+	ErrorsRx        int    `json:"errorsRx"`
+	ErrorsTx        int    `json:"errorsTx"`
+	DroppedRx       int    `json:"droppedRx"`
+	DroppedTx       int    `json:"droppedTx"`
+	Multicast       int    `json:"multicast"`
+	Collisions      int    `json:"collisions"`
+	Carrier_errors  int    `json:"carrier_errors"`
+	Over_errors     int    `json:"over_errors"`
+}
+
+/* SMS longer than this are cut; one SMS holds 160 GSM characters */
+const MaxSMS = 160
+
+/* Body of POST /networking/modem/{interface}/sms/messages */
+type outgoingSMS struct {
+	PhoneNumber string `json:"phoneNumber"`
+	Content     string `json:"content"`
+}
+
+/* Client reads modem data with an authorized client, see ropc.NewClient */
+type Client struct {
+	API *http.Client
+	// DefaultAPI if empty
+	BaseURL string
+	// ppp0 if empty
+	Interface string
+}
+
+func (c *Client) url(resource string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultAPI
+	}
+	iface := c.Interface
+	if iface == "" {
+		iface = "ppp0"
+	}
+	return strings.TrimRight(base, "/") + "/networking/modem/" + iface + "/" + resource
+}
+
+func (c *Client) get(ctx context.Context, resource string, out interface{}) error {
+	body, err := ropc.MakeROPCRequest(ctx, c.API, c.url(resource))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *Client) Details(ctx context.Context) (Details, error) {
+	var details Details
+	err := c.get(ctx, "details", &details)
+	return details, err
+}
+
+func (c *Client) Statistics(ctx context.Context) (Statistics, error) {
+	var stats Statistics
+	err := c.get(ctx, "statistics", &stats)
+	return stats, err
+}
+
+/* Sends an SMS; content longer than MaxSMS is cut */
+func (c *Client) SendSMS(ctx context.Context, number string, content string) error {
+	if runes := []rune(content); len(runes) > MaxSMS {
+		content = string(runes[:MaxSMS])
+	}
+	data, err := json.Marshal(outgoingSMS{PhoneNumber: number, Content: content})
+	if err != nil {
+		return err
+	}
+	return ropc.PostROPCMessage(ctx, c.API, c.url("sms/messages"), data)
+}
@@ -0,0 +1,59 @@
+/* Package created 19.09.2023. */
+/* Handles MQTT connections, message sending and subscription; messages are sent with a Publisher, see publisher.go */
+
+package mqttset
+
+import (
+	"fmt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+	fmt.Println("Connected")
+}
+
+var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
+	fmt.Printf("Connect lost: %+v\n", err)
+}
+
+/* Creates options for new mqtt client */
+func CreateMqttClient(brokerAddress string, clientId string, username string) mqtt.Client {
+	return CreateMqttClientWithHandler(brokerAddress, clientId, username, "", connectHandler)
+}
+
+/* Creates options for new mqtt client with password */
+func CreateMqttClientPass(brokerAddress string, clientId string, username string, password string) mqtt.Client {
+	return CreateMqttClientWithHandler(brokerAddress, clientId, username, password, connectHandler)
+}
+
+/* Creates options for new mqtt client; onConnect runs after the first connect and after every automatic reconnect */
+func CreateMqttClientWithHandler(brokerAddress string, clientId string, username string, password string, onConnect mqtt.OnConnectHandler) mqtt.Client {
+	opts := mqtt.NewClientOptions().AddBroker(brokerAddress).SetClientID(clientId).SetUsername(username).SetPassword(password)
+	opts.OnConnect = onConnect
+	opts.OnConnectionLost = connectLostHandler
+	client := mqtt.NewClient(opts)
+	return client
+}
+
+/* Connects to a broker */
+/* With connect retry enabled the client keeps trying in the background, so this returns right away */
+func ConnectClientToBroker(client mqtt.Client) error {
+	token := client.Connect()
+	if v5, ok := client.(*v5Client); ok {
+		if v5.opts.Reconnect.Enabled {
+			return nil
+		}
+	} else if reader := client.OptionsReader(); reader.ConnectRetry() {
+		return nil
+	}
+	token.Wait()
+	return token.Error()
+}
+
+/* Function subscribes a client to a broker */
+func SubscribeToTopic(client mqtt.Client, topic string) {
+	token := client.Subscribe(topic, 2, nil)
+	token.Wait()
+	fmt.Printf("Subscribed to topic %s.\n", topic)
+}
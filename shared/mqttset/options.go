@@ -0,0 +1,214 @@
+/* Connection options: TLS, reconnects, persistent sessions and the online/offline status of the device */
+
+package mqttset
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/config"
+)
+
+/* TLS of ssl:// and tls:// brokers; the tags make it a section of the examples' settings */
+type TLS struct {
+	CA         string `json:"ca" help:"PEM file with the CA certificates of the broker, empty uses the system ones"`
+	Cert       string `json:"cert" help:"PEM file with the client certificate"`
+	Key        string `json:"key" help:"PEM file with the key of the client certificate"`
+	ServerName string `json:"serverName" help:"name (SNI) the broker certificate is checked against, the broker host by default"`
+	// only for tests against a broker with a self-made certificate
+	InsecureSkipVerify bool `json:"insecureSkipVerify" help:"accept any broker certificate"`
+}
+
+func (t TLS) enabled() bool {
+	return t.CA != "" || t.Cert != "" || t.ServerName != "" || t.InsecureSkipVerify
+}
+
+func (t TLS) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", t.CA)
+		}
+	}
+	if t.Cert != "" || t.Key != "" {
+		if t.Cert == "" || t.Key == "" {
+			return nil, errors.New("a client certificate needs both cert and key")
+		}
+		pair, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+/* Retries of the first connect and reconnects after a lost connection */
+type Reconnect struct {
+	Enabled bool `json:"enabled" help:"retry the first connect and reconnect after a lost connection"`
+	// wait between the attempts of the first connect
+	RetryInterval config.Duration `json:"retryInterval" help:"wait between attempts of the first connect"`
+	// reconnects wait 1s, 2s, 4s and so on up to this
+	MaxBackoff config.Duration `json:"maxBackoff" help:"longest wait between reconnects"`
+}
+
+/* A persistent session keeps subscriptions and unacknowledged QoS 1 and 2 messages across reconnects and restarts */
+type Session struct {
+	Persistent bool `json:"persistent" help:"keep the session on the broker (clean session off)"`
+	// directory for the messages in flight, so a restart doesn't lose them; memory when empty
+	StoreDir string `json:"storeDir" help:"directory of the session store, empty keeps it in memory"`
+}
+
+/* Retained online/offline message of the device; the broker sends the offline one as last will */
+type Status struct {
+	// e.g. devices/tdce-1/status; empty disables the messages
+	Topic   string `json:"topic" help:"topic of the retained online/offline status, empty disables it"`
+	Online  string `json:"online" help:"payload sent after every connect, online by default"`
+	Offline string `json:"offline" help:"payload the broker sends when the connection is lost, offline by default"`
+	QoS     int    `json:"qos" validate:"max=2" help:"QoS of the status messages"`
+}
+
+/* Last will other than the status, e.g. a Sparkplug NDEATH */
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+/* Everything needed for a client; zero values keep paho's defaults */
+type ClientOptions struct {
+	// MQTT version, 3 (3.1.1, the default) or 5
+	Version   int
+	Broker    string
+	ClientId  string
+	Username  string
+	Password  string
+	TLS       TLS
+	Reconnect Reconnect
+	Session   Session
+	Status    Status
+	V5        V5
+	// replaces the offline status as last will; the online status is still sent
+	Will *Will
+	// runs after the first connect and after every reconnect, once the online message was sent
+	OnConnect mqtt.OnConnectHandler
+	// runs when the connection is lost, not when Disconnect is called
+	OnConnectionLost mqtt.ConnectionLostHandler
+}
+
+func (o ClientOptions) connectionLost(c mqtt.Client, err error) {
+	connectLostHandler(c, err)
+	if o.OnConnectionLost != nil {
+		o.OnConnectionLost(c, err)
+	}
+}
+
+/* Creates a client from the options; nothing is connected yet */
+/* Version 5 gives a client with the same interface, so callers don't change */
+func NewClient(o ClientOptions) (mqtt.Client, error) {
+	o.Status = o.Status.withDefaults()
+	switch o.Version {
+	case 0, 3, 4:
+	case 5:
+		if o.Session.Persistent && o.ClientId == "" {
+			return nil, errors.New("a persistent session needs a client ID")
+		}
+		return newV5Client(o)
+	default:
+		return nil, fmt.Errorf("unknown MQTT version %d", o.Version)
+	}
+
+	opts, err := o.v3()
+	if err != nil {
+		return nil, err
+	}
+	return mqtt.NewClient(opts), nil
+}
+
+/* The paho v3 options for o; the v5 client also keeps them for its OptionsReader */
+func (o ClientOptions) v3() (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions().AddBroker(o.Broker).SetClientID(o.ClientId).SetUsername(o.Username).SetPassword(o.Password)
+	opts.OnConnectionLost = o.connectionLost
+
+	if o.TLS.enabled() {
+		tlsConfig, err := o.TLS.Config()
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	opts.SetAutoReconnect(o.Reconnect.Enabled).SetConnectRetry(o.Reconnect.Enabled)
+	if o.Reconnect.RetryInterval > 0 {
+		opts.SetConnectRetryInterval(time.Duration(o.Reconnect.RetryInterval))
+	}
+	if o.Reconnect.MaxBackoff > 0 {
+		opts.SetMaxReconnectInterval(time.Duration(o.Reconnect.MaxBackoff))
+	}
+
+	if o.Session.Persistent {
+		/* The broker only keeps sessions of clients with a fixed ID */
+		if o.ClientId == "" {
+			return nil, errors.New("a persistent session needs a client ID")
+		}
+		opts.SetCleanSession(false).SetResumeSubs(true)
+	}
+	if o.Session.StoreDir != "" {
+		if err := os.MkdirAll(o.Session.StoreDir, 0o700); err != nil {
+			return nil, err
+		}
+		opts.SetStore(mqtt.NewFileStore(o.Session.StoreDir))
+	}
+
+	status := o.Status
+	if o.Will != nil {
+		opts.SetBinaryWill(o.Will.Topic, o.Will.Payload, o.Will.QoS, o.Will.Retain)
+	} else if status.Topic != "" {
+		opts.SetWill(status.Topic, status.Offline, byte(status.QoS), true)
+	}
+	onConnect := o.OnConnect
+	if onConnect == nil {
+		onConnect = connectHandler
+	}
+	opts.OnConnect = func(c mqtt.Client) {
+		if status.Topic != "" {
+			/* Replaces the retained offline message of the last will; not waited for, the handler must not block */
+			c.Publish(status.Topic, byte(status.QoS), true, status.Online)
+		}
+		onConnect(c)
+	}
+	return opts, nil
+}
+
+func (s Status) withDefaults() Status {
+	if s.Online == "" {
+		s.Online = "online"
+	}
+	if s.Offline == "" {
+		s.Offline = "offline"
+	}
+	return s
+}
+
+/* Marks the device offline before a clean disconnect; the broker only sends the last will when the connection breaks */
+func Disconnect(client mqtt.Client, status Status, quiesce uint) {
+	if status.Topic != "" && client.IsConnectionOpen() {
+		client.Publish(status.Topic, byte(status.QoS), true, status.withDefaults().Offline).WaitTimeout(time.Duration(quiesce) * time.Millisecond)
+	}
+	client.Disconnect(quiesce)
+}
@@ -0,0 +1,274 @@
+/* Publisher with a window of unacknowledged messages and a result per message */
+
+package mqttset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	ErrTimeout = errors.New("broker did not acknowledge the message in time")
+	ErrClosed  = errors.New("publisher is closed")
+)
+
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+	// read back from the offline buffer; if it fails again, it is left to the caller instead of going back into the buffer
+	Replay bool
+	// MQTT 5 only; fields left empty are taken from Options.Properties
+	Properties *Properties
+}
+
+type Options struct {
+	// QoS 1 and 2 messages that may wait for their acknowledgement at the same time; 16 by default
+	InFlight int
+	// QoS of the topics TopicQoS has no entry for
+	QoS byte
+	// QoS per topic filter, e.g. "gps/#": 2; the longest matching filter wins
+	TopicQoS map[string]byte
+	// retains every message, not only the ones with Retain set
+	Retain bool
+	// longest wait for the acknowledgement; 10 seconds by default
+	// the future fails with ErrTimeout then, but paho keeps the message in flight and may still deliver it,
+	// so its slot stays taken until paho is done with it
+	Timeout time.Duration
+	// by default a message that timed out goes to Offline at once, so a replay can deliver it twice;
+	// with KeepTimedOut it goes there only if paho fails it later, e.g. for persistent sessions, whose
+	// messages in flight paho sends again after a reconnect
+	KeepTimedOut bool
+	// gets the messages that failed, e.g. to append them to the store-and-forward queue
+	Offline func(m Message, err error)
+	// MQTT 5 properties of every message, e.g. the content type and the device ID; a v3 client leaves them out
+	Properties *Properties
+}
+
+/* Result of one publish; completes once the broker acknowledged the message or it failed */
+type Future struct {
+	done      chan struct{}
+	mu        sync.Mutex
+	err       error
+	callbacks []func(error)
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+/* Error of the publish, the paho token's error included; nil while it is still in flight */
+func (f *Future) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+/* Waits for the result; an expired ctx only ends the waiting, not the publish */
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* Runs fn with the result once it is there, right away if it already is */
+func (f *Future) Then(fn func(err error)) {
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		err := f.err
+		f.mu.Unlock()
+		fn(err)
+	default:
+		f.callbacks = append(f.callbacks, fn)
+		f.mu.Unlock()
+	}
+}
+
+func (f *Future) complete(err error) {
+	f.mu.Lock()
+	f.err = err
+	callbacks := f.callbacks
+	f.callbacks = nil
+	close(f.done)
+	f.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(err)
+	}
+}
+
+/* Publishes without waiting for each acknowledgement; up to InFlight QoS 1 and 2 messages are unacknowledged at a time */
+type Publisher struct {
+	client mqtt.Client
+	slots  chan struct{}
+
+	mu      sync.Mutex
+	opts    Options
+	closed  bool
+	pending sync.WaitGroup
+}
+
+func NewPublisher(client mqtt.Client, opts Options) *Publisher {
+	if opts.InFlight <= 0 {
+		opts.InFlight = 16
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &Publisher{
+		client: client,
+		slots:  make(chan struct{}, opts.InFlight),
+		opts:   opts,
+	}
+}
+
+/* Changes the QoS of the following messages, e.g. after a configuration reload */
+func (p *Publisher) SetQoS(qos byte, topics map[string]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.opts.QoS, p.opts.TopicQoS = qos, topics
+}
+
+/* QoS a message on topic is sent with */
+func (p *Publisher) QoS(topic string) byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	qos, longest := p.opts.QoS, -1
+	for filter, q := range p.opts.TopicQoS {
+		if len(filter) > longest && matchTopic(filter, topic) {
+			qos, longest = q, len(filter)
+		}
+	}
+	return qos
+}
+
+/* Sends m; waits only while the in-flight window is full or until ctx expires */
+/* Failed messages go to the Offline hook before the future completes; with KeepTimedOut timed out ones only once paho fails them */
+func (p *Publisher) Publish(ctx context.Context, m Message) *Future {
+	f := newFuture()
+	qos := p.QoS(m.Topic)
+
+	if qos > 0 {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			p.finish(m, f, ctx.Err())
+			return f
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		if qos > 0 {
+			<-p.slots
+		}
+		p.finish(m, f, ErrClosed)
+		return f
+	}
+	retain := m.Retain || p.opts.Retain
+	timeout, keep := p.opts.Timeout, p.opts.KeepTimedOut
+	props := m.Properties.withDefaults(p.opts.Properties)
+	p.pending.Add(1)
+	p.mu.Unlock()
+
+	var token mqtt.Token
+	if v5, ok := p.client.(*v5Client); ok && props != nil {
+		token = v5.publishWithProperties(m.Topic, qos, retain, m.Payload, props)
+	} else {
+		token = p.client.Publish(m.Topic, qos, retain, m.Payload)
+	}
+	go func() {
+		defer p.pending.Done()
+		if qos > 0 {
+			defer func() { <-p.slots }()
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-token.Done():
+			p.finish(m, f, token.Error())
+			return
+		case <-timer.C:
+		}
+		if !keep {
+			p.finish(m, f, ErrTimeout)
+			<-token.Done()
+			return
+		}
+		err := fmt.Errorf("publish to %s: %w", m.Topic, ErrTimeout)
+		fmt.Printf("Failed to publish %d bytes: %v\n", len(m.Payload), err)
+		f.complete(err)
+		<-token.Done()
+		if err := token.Error(); err != nil {
+			p.offline(m, fmt.Errorf("publish to %s: %w", m.Topic, err))
+		}
+	}()
+	return f
+}
+
+func (p *Publisher) finish(m Message, f *Future, err error) {
+	if err != nil {
+		err = fmt.Errorf("publish to %s: %w", m.Topic, err)
+		fmt.Printf("Failed to publish %d bytes: %v\n", len(m.Payload), err)
+		p.offline(m, err)
+	}
+	f.complete(err)
+}
+
+/* Hands a failed message to the Offline hook unless it is a replay */
+func (p *Publisher) offline(m Message, err error) {
+	p.mu.Lock()
+	offline := p.opts.Offline
+	p.mu.Unlock()
+	if offline != nil && !m.Replay {
+		offline(m, err)
+	}
+}
+
+/* Stops taking messages and waits until the ones in flight are acknowledged or failed, the timed out ones included */
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* Whether topic matches filter with its + and # wildcards */
+func matchTopic(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
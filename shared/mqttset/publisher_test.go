@@ -0,0 +1,240 @@
+package mqttset
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type published struct {
+	topic  string
+	qos    byte
+	retain bool
+	token  *token
+}
+
+/* Keeps the publishes with their tokens, which the test completes like the broker would */
+type fakeClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	published []published
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := newToken()
+	c.published = append(c.published, published{topic, qos, retained, t})
+	return t
+}
+
+func (c *fakeClient) last(t *testing.T) published {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.published) == 0 {
+		t.Fatal("nothing published")
+	}
+	return c.published[len(c.published)-1]
+}
+
+/* Records the messages handed to the Offline hook */
+type offlineLog struct {
+	mu       sync.Mutex
+	messages []Message
+	errs     []error
+}
+
+func (l *offlineLog) hook(m Message, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, m)
+	l.errs = append(l.errs, err)
+}
+
+func (l *offlineLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.messages)
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"gps/data", "gps/data", true},
+		{"gps/data", "gps/data/x", false},
+		{"gps/+", "gps/data", true},
+		{"gps/+", "gps", false},
+		{"gps/+/rfid", "gps/tdce-1/rfid", true},
+		{"gps/#", "gps", true},
+		{"gps/#", "gps/a/b/c", true},
+		{"#", "anything/at/all", true},
+		{"+/+", "a/b/c", false},
+		{"gps/data", "gps/date", false},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v", tt.filter, tt.topic, got)
+		}
+	}
+}
+
+func TestTopicQoS(t *testing.T) {
+	client := &fakeClient{}
+	p := NewPublisher(client, Options{QoS: 1, TopicQoS: map[string]byte{"gps/#": 2, "gps/+/debug": 0}})
+	for topic, want := range map[string]byte{"status": 1, "gps/data": 2, "gps/tdce-1/debug": 0, "gps/tdce-1/debug/x": 2} {
+		if got := p.QoS(topic); got != want {
+			t.Errorf("QoS(%q) = %d, want %d", topic, got, want)
+		}
+	}
+
+	p.SetQoS(0, nil)
+	p.Publish(context.Background(), Message{Topic: "gps/data", Retain: true})
+	if last := client.last(t); last.qos != 0 || !last.retain {
+		t.Errorf("published with QoS %d, retain %v after SetQoS(0)", last.qos, last.retain)
+	}
+}
+
+func TestFuture(t *testing.T) {
+	f := newFuture()
+	var got []error
+	f.Then(func(err error) { got = append(got, err) })
+	if f.Err() != nil {
+		t.Errorf("Err before completion = %v", f.Err())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := f.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait of a pending future = %v", err)
+	}
+
+	failed := errors.New("refused")
+	f.complete(failed)
+	f.Then(func(err error) { got = append(got, err) })
+	if err := f.Wait(context.Background()); err != failed {
+		t.Errorf("Wait = %v", err)
+	}
+	select {
+	case <-f.Done():
+	default:
+		t.Errorf("Done not closed")
+	}
+	if len(got) != 2 || got[0] != failed || got[1] != failed {
+		t.Errorf("callbacks got %v, want the error before and after completion", got)
+	}
+}
+
+/* A failed message reaches the Offline hook before its future completes, a replayed one is left to the caller */
+func TestOffline(t *testing.T) {
+	client := &fakeClient{}
+	var log offlineLog
+	p := NewPublisher(client, Options{QoS: 1, Offline: log.hook})
+
+	refused := errors.New("not authorized")
+	f := p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("1")})
+	f.Then(func(error) {
+		if log.len() != 1 {
+			t.Errorf("future completed before the Offline hook ran")
+		}
+	})
+	client.last(t).token.complete(refused)
+	if err := f.Wait(context.Background()); !errors.Is(err, refused) {
+		t.Errorf("Wait = %v, want the token's error", err)
+	}
+	if log.len() != 1 || string(log.messages[0].Payload) != "1" || !errors.Is(log.errs[0], refused) {
+		t.Errorf("offline got %v, %v", log.messages, log.errs)
+	}
+
+	f = p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("2"), Replay: true})
+	client.last(t).token.complete(refused)
+	if err := f.Wait(context.Background()); !errors.Is(err, refused) {
+		t.Errorf("Wait of the replay = %v", err)
+	}
+	f = p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("3")})
+	client.last(t).token.complete(nil)
+	if err := f.Wait(context.Background()); err != nil {
+		t.Errorf("Wait of an acknowledged message = %v", err)
+	}
+	if log.len() != 1 {
+		t.Errorf("replayed or acknowledged message went offline")
+	}
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("4")}).Wait(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish after Close = %v", err)
+	}
+	if log.len() != 2 || !errors.Is(log.errs[1], ErrClosed) {
+		t.Errorf("message refused after Close not offline")
+	}
+}
+
+/* paho still holds a message that timed out, so its slot stays taken until paho is done with it */
+func TestTimeoutKeepsSlot(t *testing.T) {
+	client := &fakeClient{}
+	var log offlineLog
+	p := NewPublisher(client, Options{QoS: 1, InFlight: 1, Timeout: 20 * time.Millisecond, Offline: log.hook})
+
+	f := p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("1")})
+	if err := f.Wait(context.Background()); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Wait = %v, want ErrTimeout", err)
+	}
+	if log.len() != 1 {
+		t.Errorf("timed out message not offline")
+	}
+	inFlight := client.last(t).token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Publish(ctx, Message{Topic: "gps/data", Payload: []byte("2")}).Wait(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Publish while paho holds the slot = %v, want the context's error", err)
+	}
+
+	inFlight.complete(nil)
+	f = p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("3")})
+	client.last(t).token.complete(nil)
+	if err := f.Wait(context.Background()); err != nil {
+		t.Errorf("Publish after paho finished = %v", err)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+}
+
+/* With KeepTimedOut a timed out message goes offline only if paho fails it */
+func TestKeepTimedOut(t *testing.T) {
+	client := &fakeClient{}
+	var log offlineLog
+	p := NewPublisher(client, Options{QoS: 2, Timeout: 20 * time.Millisecond, KeepTimedOut: true, Offline: log.hook})
+
+	delivered := p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("1")})
+	deliveredToken := client.last(t).token
+	dropped := p.Publish(context.Background(), Message{Topic: "gps/data", Payload: []byte("2")})
+	droppedToken := client.last(t).token
+	for _, f := range []*Future{delivered, dropped} {
+		if err := f.Wait(context.Background()); !errors.Is(err, ErrTimeout) {
+			t.Errorf("Wait = %v, want ErrTimeout", err)
+		}
+	}
+	if log.len() != 0 {
+		t.Errorf("timed out message offline while paho still has it")
+	}
+
+	deliveredToken.complete(nil)
+	droppedToken.complete(mqtt.ErrNotConnected)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Close(ctx); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	if log.len() != 1 || string(log.messages[0].Payload) != "2" || !errors.Is(log.errs[0], mqtt.ErrNotConnected) {
+		t.Errorf("offline got %v, %v; want only the message paho failed", log.messages, log.errs)
+	}
+}
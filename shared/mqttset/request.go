@@ -0,0 +1,103 @@
+/* Request/response of MQTT 5: requests name the topic of the reply and carry correlation data the reply repeats */
+
+package mqttset
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	ErrNeedsV5         = errors.New("request/response needs an MQTT 5 client")
+	ErrNoResponseTopic = errors.New("request has no response topic")
+)
+
+/* Sends requests and waits for their replies on one response topic */
+type Requester struct {
+	publisher *Publisher
+	topic     string
+
+	mu      sync.Mutex
+	waiting map[string]chan mqtt.Message
+}
+
+/* Subscribes to responseTopic, which should be unique to the device, e.g. devices/tdce-1/replies; the client must be connected */
+func NewRequester(client mqtt.Client, publisher *Publisher, responseTopic string) (*Requester, error) {
+	if _, ok := client.(*v5Client); !ok {
+		return nil, ErrNeedsV5
+	}
+	r := &Requester{publisher: publisher, topic: responseTopic, waiting: map[string]chan mqtt.Message{}}
+	token := client.Subscribe(responseTopic, 1, r.received)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/* Publishes m and returns the reply; gives up when ctx expires */
+func (r *Requester) Request(ctx context.Context, m Message) (mqtt.Message, error) {
+	correlation := make([]byte, 16)
+	if _, err := rand.Read(correlation); err != nil {
+		return nil, err
+	}
+	props := Properties{}
+	if m.Properties != nil {
+		props = *m.Properties
+	}
+	props.ResponseTopic, props.CorrelationData = r.topic, correlation
+	m.Properties = &props
+
+	reply := make(chan mqtt.Message, 1)
+	r.mu.Lock()
+	r.waiting[string(correlation)] = reply
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.waiting, string(correlation))
+		r.mu.Unlock()
+	}()
+
+	if err := r.publisher.Publish(ctx, m).Wait(ctx); err != nil {
+		return nil, err
+	}
+	select {
+	case m := <-reply:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *Requester) received(_ mqtt.Client, m mqtt.Message) {
+	props := PropertiesOf(m)
+	if props == nil {
+		return
+	}
+	r.mu.Lock()
+	reply, ok := r.waiting[string(props.CorrelationData)]
+	delete(r.waiting, string(props.CorrelationData))
+	r.mu.Unlock()
+	if ok {
+		reply <- m
+	}
+}
+
+/* Sends payload as the reply to request, to its response topic and with its correlation data */
+func Respond(ctx context.Context, p *Publisher, request mqtt.Message, payload []byte) *Future {
+	props := PropertiesOf(request)
+	if props == nil || props.ResponseTopic == "" {
+		f := newFuture()
+		f.complete(ErrNoResponseTopic)
+		return f
+	}
+	return p.Publish(ctx, Message{
+		Topic:      props.ResponseTopic,
+		Payload:    payload,
+		Properties: &Properties{CorrelationData: props.CorrelationData},
+	})
+}
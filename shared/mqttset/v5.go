@@ -0,0 +1,601 @@
+/* MQTT 5 backend; it behaves like a paho v3 client, so Publisher, ConnectClientToBroker and the health checks work with both */
+
+package mqttset
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/extensions/topicaliases"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/config"
+)
+
+/* Settings only MQTT 5 has */
+type V5 struct {
+	// how long the broker keeps a persistent session after the connection is lost; 1 day by default
+	SessionExpiry config.Duration `json:"sessionExpiry" help:"how long the broker keeps a persistent session (MQTT 5)"`
+	// topics sent as a number after their first use; limited by what the broker allows, 0 disables them
+	TopicAliases int `json:"topicAliases" validate:"min=0,max=65535" help:"topic aliases used per connection (MQTT 5), 0 disables them"`
+}
+
+/* MQTT 5 properties of a message; a v3 client sends the message without them */
+type Properties struct {
+	// the broker drops the message if it couldn't deliver it in time, e.g. a GPS fix nobody wants anymore
+	Expiry          time.Duration
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	// e.g. the device ID and the schema version of the payload
+	User map[string]string
+}
+
+/* Properties of a received MQTT 5 message; nil for v3 messages */
+func PropertiesOf(m mqtt.Message) *Properties {
+	if v5, ok := m.(*v5Message); ok {
+		return v5.properties()
+	}
+	return nil
+}
+
+/* p with the fields it leaves empty taken from defaults; user properties are merged, p wins */
+func (p *Properties) withDefaults(defaults *Properties) *Properties {
+	if defaults == nil {
+		return p
+	}
+	if p == nil {
+		return defaults
+	}
+	merged := *p
+	if merged.Expiry == 0 {
+		merged.Expiry = defaults.Expiry
+	}
+	if merged.ContentType == "" {
+		merged.ContentType = defaults.ContentType
+	}
+	if merged.ResponseTopic == "" {
+		merged.ResponseTopic = defaults.ResponseTopic
+	}
+	if len(defaults.User) > 0 {
+		merged.User = make(map[string]string, len(defaults.User)+len(p.User))
+		for k, v := range defaults.User {
+			merged.User[k] = v
+		}
+		for k, v := range p.User {
+			merged.User[k] = v
+		}
+	}
+	return &merged
+}
+
+func (p *Properties) packet() *paho.PublishProperties {
+	if p == nil {
+		return nil
+	}
+	pp := &paho.PublishProperties{
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+	}
+	if p.Expiry > 0 {
+		/* The interval is in whole seconds; rounding up keeps messages a little longer instead of dropping them early */
+		seconds := uint32(math.Ceil(p.Expiry.Seconds()))
+		pp.MessageExpiry = &seconds
+	}
+	keys := make([]string, 0, len(p.User))
+	for k := range p.User {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		pp.User.Add(k, p.User[k])
+	}
+	return pp
+}
+
+/* Reason code of a refused publish or subscription, e.g. 0x87 when the broker's ACL denies the topic */
+type ReasonError struct {
+	Code   byte
+	Reason string
+}
+
+var reasonNames = map[byte]string{
+	0x80: "unspecified error",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x87: "not authorized",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "QoS not supported",
+	0x9E: "shared subscriptions not supported",
+}
+
+func (e *ReasonError) Error() string {
+	reason := e.Reason
+	if reason == "" {
+		reason = reasonNames[e.Code]
+	}
+	if reason == "" {
+		return fmt.Sprintf("broker refused with reason code 0x%02X", e.Code)
+	}
+	return fmt.Sprintf("broker refused with reason code 0x%02X: %s", e.Code, reason)
+}
+
+func publishError(resp *paho.PublishResponse, err error) error {
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		e := &ReasonError{Code: resp.ReasonCode}
+		if resp.Properties != nil {
+			e.Reason = resp.Properties.ReasonString
+		}
+		return e
+	}
+	return err
+}
+
+/* Token of the v5 client's operations */
+type token struct {
+	done chan struct{}
+	err  error
+}
+
+func newToken() *token {
+	return &token{done: make(chan struct{})}
+}
+
+func (t *token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+/* Received MQTT 5 message */
+type v5Message struct {
+	packet *paho.Publish
+}
+
+func (m *v5Message) Duplicate() bool   { return false }
+func (m *v5Message) Qos() byte         { return m.packet.QoS }
+func (m *v5Message) Retained() bool    { return m.packet.Retain }
+func (m *v5Message) Topic() string     { return m.packet.Topic }
+func (m *v5Message) MessageID() uint16 { return m.packet.PacketID }
+func (m *v5Message) Payload() []byte   { return m.packet.Payload }
+
+/* The library acknowledges received messages on its own */
+func (m *v5Message) Ack() {}
+
+func (m *v5Message) properties() *Properties {
+	pp := m.packet.Properties
+	if pp == nil {
+		return &Properties{}
+	}
+	p := &Properties{
+		ContentType:     pp.ContentType,
+		ResponseTopic:   pp.ResponseTopic,
+		CorrelationData: pp.CorrelationData,
+	}
+	if pp.MessageExpiry != nil {
+		p.Expiry = time.Duration(*pp.MessageExpiry) * time.Second
+	}
+	if len(pp.User) > 0 {
+		p.User = map[string]string{}
+		for _, u := range pp.User {
+			p.User[u.Key] = u.Value
+		}
+	}
+	return p
+}
+
+/* The autopaho connection manager behind the paho v3 client interface */
+/* Reconnects wait RetryInterval each time; autopaho has no growing backoff, so MaxBackoff is not used */
+type v5Client struct {
+	opts   ClientOptions
+	config autopaho.ClientConfig
+	// the same settings as a v3 client would have them
+	reader  mqtt.ClientOptionsReader
+	aliases atomic.Pointer[topicaliases.TAHandler]
+	open    atomic.Bool
+
+	mu      sync.Mutex
+	manager *autopaho.ConnectionManager
+	cancel  context.CancelFunc
+	// pending Connect token, completed by the first connect
+	connecting *token
+	// subscriptions, made again after every connect
+	subscriptions map[string]byte
+	routes        map[string]mqtt.MessageHandler
+}
+
+func newV5Client(o ClientOptions) (mqtt.Client, error) {
+	broker, err := url.Parse(o.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("broker: %w", err)
+	}
+	c := &v5Client{
+		opts:          o,
+		subscriptions: map[string]byte{},
+		routes:        map[string]mqtt.MessageHandler{},
+	}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{broker},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !o.Session.Persistent,
+		ConnectRetryDelay:             time.Duration(o.Reconnect.RetryInterval),
+		ConnectUsername:               o.Username,
+		ConnectPassword:               []byte(o.Password),
+		OnConnectionUp:                c.connectionUp,
+		OnConnectError:                c.connectError,
+		ClientConfig: paho.ClientConfig{
+			ClientID:          o.ClientId,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.received},
+			OnClientError:     c.connectionLost,
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				c.connectionLost(&ReasonError{Code: d.ReasonCode})
+			},
+			PublishHook: func(p *paho.Publish) {
+				if aliases := c.aliases.Load(); aliases != nil {
+					aliases.PublishHook(p)
+				}
+			},
+		},
+	}
+	if o.TLS.enabled() {
+		if cfg.TlsCfg, err = o.TLS.Config(); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	if o.Session.Persistent {
+		expiry := time.Duration(o.V5.SessionExpiry)
+		if expiry <= 0 {
+			expiry = 24 * time.Hour
+		}
+		cfg.SessionExpiryInterval = uint32(expiry.Seconds())
+	}
+	if o.Session.StoreDir != "" {
+		/* The file store wants the directory to exist */
+		if err := os.MkdirAll(o.Session.StoreDir, 0o700); err != nil {
+			return nil, err
+		}
+		sent, err := file.New(o.Session.StoreDir, "client-", ".pkt")
+		if err != nil {
+			return nil, err
+		}
+		received, err := file.New(o.Session.StoreDir, "server-", ".pkt")
+		if err != nil {
+			return nil, err
+		}
+		cfg.Session = state.New(sent, received)
+	}
+	if o.Will != nil {
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   o.Will.Topic,
+			Payload: o.Will.Payload,
+			QoS:     o.Will.QoS,
+			Retain:  o.Will.Retain,
+		}
+	} else if o.Status.Topic != "" {
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   o.Status.Topic,
+			Payload: []byte(o.Status.Offline),
+			QoS:     byte(o.Status.QoS),
+			Retain:  true,
+		}
+	}
+	c.config = cfg
+
+	v3, err := o.v3()
+	if err != nil {
+		return nil, err
+	}
+	/* A v3 client is only a struct until it connects; it is never connected */
+	c.reader = mqtt.NewClient(v3).OptionsReader()
+	return c, nil
+}
+
+func (c *v5Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.manager != nil
+}
+
+func (c *v5Client) IsConnectionOpen() bool {
+	return c.open.Load()
+}
+
+/* Starts the connection manager; the token completes with the first connect, or with its error when retries are off */
+func (c *v5Client) Connect() mqtt.Token {
+	t := newToken()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.manager != nil {
+		t.complete(nil)
+		return t
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	manager, err := autopaho.NewConnection(ctx, c.config)
+	if err != nil {
+		cancel()
+		t.complete(err)
+		return t
+	}
+	c.manager, c.cancel, c.connecting = manager, cancel, t
+	return t
+}
+
+func (c *v5Client) connectionUp(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+	c.open.Store(true)
+
+	/* Aliases only live as long as the connection and may not exceed the broker's maximum */
+	var aliases *topicaliases.TAHandler
+	if c.opts.V5.TopicAliases > 0 && connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+		if max := min(uint16(c.opts.V5.TopicAliases), *connack.Properties.TopicAliasMaximum); max > 0 {
+			aliases = topicaliases.NewTAHandler(max)
+		}
+	}
+	c.aliases.Store(aliases)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if c.opts.Status.Topic != "" {
+		/* Replaces the retained offline message of the last will */
+		manager.Publish(ctx, &paho.Publish{
+			Topic:   c.opts.Status.Topic,
+			QoS:     byte(c.opts.Status.QoS),
+			Retain:  true,
+			Payload: []byte(c.opts.Status.Online),
+		})
+	}
+
+	c.mu.Lock()
+	subscribe := &paho.Subscribe{}
+	for topic, qos := range c.subscriptions {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	connecting := c.connecting
+	c.connecting = nil
+	c.mu.Unlock()
+	if len(subscribe.Subscriptions) > 0 {
+		if _, err := manager.Subscribe(ctx, subscribe); err != nil {
+			fmt.Println("Error subscribing again: ", err)
+		}
+	}
+
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c)
+	}
+	if connecting != nil {
+		connecting.complete(nil)
+	}
+}
+
+func (c *v5Client) connectError(err error) {
+	fmt.Println("Error connecting to broker: ", err)
+	if c.opts.Reconnect.Enabled {
+		return
+	}
+	c.mu.Lock()
+	connecting := c.connecting
+	if connecting != nil {
+		/* Without retries the first failure is final */
+		c.cancel()
+		c.manager, c.cancel, c.connecting = nil, nil, nil
+	}
+	c.mu.Unlock()
+	if connecting != nil {
+		connecting.complete(err)
+	}
+}
+
+func (c *v5Client) connectionLost(err error) {
+	if !c.open.Swap(false) {
+		return
+	}
+	c.opts.connectionLost(c, err)
+	if !c.opts.Reconnect.Enabled {
+		/* Like the v3 client without auto reconnect */
+		c.mu.Lock()
+		if c.cancel != nil {
+			c.cancel()
+		}
+		c.manager, c.cancel = nil, nil
+		c.mu.Unlock()
+	}
+}
+
+/* Waits up to quiesce milliseconds for the messages in flight, then disconnects */
+func (c *v5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	manager, cancel := c.manager, c.cancel
+	c.manager, c.cancel = nil, nil
+	c.mu.Unlock()
+	if manager == nil {
+		return
+	}
+	ctx, stop := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer stop()
+	manager.Disconnect(ctx)
+	cancel()
+	c.open.Store(false)
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.publishWithProperties(topic, qos, retained, payload, nil)
+}
+
+/* Used by Publisher for the messages that have properties */
+func (c *v5Client) publishWithProperties(topic string, qos byte, retained bool, payload interface{}, props *Properties) mqtt.Token {
+	t := newToken()
+	data, err := payloadBytes(payload)
+	if err != nil {
+		t.complete(err)
+		return t
+	}
+	c.mu.Lock()
+	manager := c.manager
+	c.mu.Unlock()
+	if manager == nil {
+		t.complete(mqtt.ErrNotConnected)
+		return t
+	}
+
+	p := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: data, Properties: props.packet()}
+	go func() {
+		/* Bounds the wait for lost acknowledgements; the Publisher usually gives up earlier */
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		resp, err := manager.Publish(ctx, p)
+		t.complete(publishError(resp, err))
+	}()
+	return t
+}
+
+/* Payloads as the v3 client takes them */
+func payloadBytes(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case string:
+		return []byte(p), nil
+	case []byte:
+		return p, nil
+	case bytes.Buffer:
+		return p.Bytes(), nil
+	case *bytes.Buffer:
+		return p.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown payload type %T", payload)
+}
+
+/* Subscriptions made while the connection is down fail with ErrNotConnected like with the v3 client, */
+/* but are kept and sent on the next connect */
+func (c *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	t := newToken()
+	subscribe := &paho.Subscribe{}
+	c.mu.Lock()
+	for topic, qos := range filters {
+		c.subscriptions[topic] = qos
+		if callback != nil {
+			c.routes[topic] = callback
+		}
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	manager := c.manager
+	c.mu.Unlock()
+	if manager == nil || !c.open.Load() {
+		t.complete(mqtt.ErrNotConnected)
+		return t
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		suback, err := manager.Subscribe(ctx, subscribe)
+		if err == nil {
+			for _, reason := range suback.Reasons {
+				if reason >= 0x80 {
+					err = &ReasonError{Code: reason}
+					break
+				}
+			}
+		}
+		t.complete(err)
+	}()
+	return t
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	t := newToken()
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.subscriptions, topic)
+		delete(c.routes, topic)
+	}
+	manager := c.manager
+	c.mu.Unlock()
+	if manager == nil || !c.open.Load() {
+		t.complete(nil)
+		return t
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err := manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		t.complete(err)
+	}()
+	return t
+}
+
+func (c *v5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+/* Broker, client ID, credentials, TLS, reconnect and session as the equivalent v3 options; v5 settings are not in it */
+func (c *v5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return c.reader
+}
+
+func (c *v5Client) received(r paho.PublishReceived) (bool, error) {
+	c.mu.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range c.routes {
+		if matchTopic(filter, r.Packet.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+
+	m := &v5Message{packet: r.Packet}
+	for _, handler := range handlers {
+		handler(c, m)
+	}
+	return len(handlers) > 0, nil
+}
@@ -0,0 +1,56 @@
+package mqttset
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tdce-shared/config"
+)
+
+func newTestV5(t *testing.T, reconnect bool) *v5Client {
+	t.Helper()
+	client, err := NewClient(ClientOptions{
+		Version:   5,
+		Broker:    "tcp://127.0.0.1:1883",
+		ClientId:  "tdce-1",
+		Username:  "device",
+		Reconnect: Reconnect{Enabled: reconnect, RetryInterval: config.Duration(3 * time.Second)},
+		Session:   Session{Persistent: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*v5Client)
+}
+
+/* Callers like ConnectClientToBroker read the options of either client the same way */
+func TestV5OptionsReader(t *testing.T) {
+	r := newTestV5(t, true).OptionsReader()
+	servers := r.Servers()
+	if len(servers) != 1 || servers[0].String() != "tcp://127.0.0.1:1883" {
+		t.Errorf("Servers() = %v", servers)
+	}
+	if r.ClientID() != "tdce-1" || r.Username() != "device" {
+		t.Errorf("ClientID, Username = %q, %q", r.ClientID(), r.Username())
+	}
+	if !r.ConnectRetry() || !r.AutoReconnect() || r.ConnectRetryInterval() != 3*time.Second || r.CleanSession() {
+		t.Errorf("reconnect and session options not carried over")
+	}
+	if r := newTestV5(t, false).OptionsReader(); r.ConnectRetry() {
+		t.Errorf("ConnectRetry() without reconnect")
+	}
+}
+
+func TestV5SubscribeDisconnected(t *testing.T) {
+	c := newTestV5(t, false)
+	token := c.Subscribe("devices/tdce-1/commands", 1, func(mqtt.Client, mqtt.Message) {})
+	if !token.WaitTimeout(time.Second) || !errors.Is(token.Error(), mqtt.ErrNotConnected) {
+		t.Errorf("Subscribe while disconnected = %v, want ErrNotConnected", token.Error())
+	}
+	/* kept for the next connect */
+	if _, ok := c.subscriptions["devices/tdce-1/commands"]; !ok {
+		t.Errorf("subscription not kept for the next connect")
+	}
+}
@@ -0,0 +1,464 @@
+/* Package created 18.10.2026. */
+/* Embedded, append-only store-and-forward queue kept in segment files on disk */
+/* Messages are appended and fsynced before Append returns, read back in order with Peek and removed with Ack */
+/* The position of the first unacknowledged message is checkpointed, so a restart continues where it stopped */
+
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const checkpointName = "checkpoint"
+
+var (
+	ErrClosed         = errors.New("queue: closed")
+	ErrRecordTooLarge = errors.New("queue: record too large")
+)
+
+/* Options for opening a queue; zero values are replaced with defaults */
+type Options struct {
+	// segment files are rolled over once they grow past this size
+	MaxSegmentBytes int64
+	// largest message that can be appended
+	MaxRecordBytes int
+	// number of acknowledged messages between two checkpoint writes
+	CheckpointEvery int
+}
+
+func (o *Options) setDefaults() {
+	if o.MaxSegmentBytes <= 0 {
+		o.MaxSegmentBytes = 4 << 20
+	}
+	if o.MaxRecordBytes <= 0 {
+		o.MaxRecordBytes = 1 << 20
+	}
+	if o.CheckpointEvery <= 0 {
+		o.CheckpointEvery = 1
+	}
+}
+
+/* Queue is safe for concurrent use */
+type Queue struct {
+	mu   sync.Mutex
+	dir  string
+	opts Options
+
+	segments []*segment
+	active   segmentFile
+
+	// sequence number of the first unacknowledged record
+	head uint64
+	// sequence number the next appended record will get
+	tail uint64
+	// acks not yet written to the checkpoint file
+	unsynced int
+
+	// read cursor; readSeq is the record the reader is positioned at
+	reader  *os.File
+	readSeg *segment
+	readSeq uint64
+
+	// last record returned by Peek
+	peekSeq  uint64
+	peekData []byte
+
+	closed bool
+	// set when a failed append could not be removed again; the queue takes no more appends
+	broken error
+}
+
+/* The active segment; an interface so tests can make writes fail */
+type segmentFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+/* Opens the queue stored in dir, creating the directory if needed */
+/* A record torn by a crash at the end of the last segment is cut off */
+func Open(dir string, opts Options) (*Queue, error) {
+	opts.setDefaults()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{dir: dir, opts: opts}
+
+	head, err := q.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range segments {
+		count, validSize, torn, err := scanSegment(s.path, opts.MaxRecordBytes)
+		if err != nil {
+			return nil, err
+		}
+		if torn {
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("queue: segment %s is corrupt", s.path)
+			}
+			if err := truncateFile(s.path, validSize); err != nil {
+				return nil, err
+			}
+		}
+		s.count = count
+		s.size = validSize
+		if i > 0 && segments[i-1].next() != s.first {
+			return nil, fmt.Errorf("queue: missing records before segment %s", s.path)
+		}
+	}
+	q.segments = segments
+
+	if len(segments) > 0 {
+		q.tail = segments[len(segments)-1].next()
+		if head < segments[0].first {
+			head = segments[0].first
+		}
+	} else {
+		q.tail = head
+	}
+	if head > q.tail {
+		head = q.tail
+	}
+	q.head = head
+
+	if err := q.openActive(); err != nil {
+		return nil, err
+	}
+	if err := q.removeAcked(); err != nil {
+		q.active.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+/* Number of messages waiting to be acknowledged */
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int(q.tail - q.head)
+}
+
+/* Appends a message to the end of the queue; returns after the message is on disk */
+/* A failed write is cut off the segment again; if that fails too, every later Append fails */
+func (q *Queue) Append(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if q.broken != nil {
+		return q.broken
+	}
+	if len(data) > q.opts.MaxRecordBytes {
+		return ErrRecordTooLarge
+	}
+
+	/* Rolls over before writing, so a failed roll leaves nothing half done and the old segment stays active */
+	if q.segments[len(q.segments)-1].size >= q.opts.MaxSegmentBytes {
+		if err := q.roll(); err != nil {
+			return err
+		}
+	}
+	last := q.segments[len(q.segments)-1]
+	record := encodeRecord(data)
+	_, err := q.active.Write(record)
+	if err == nil {
+		err = q.active.Sync()
+	}
+	if err != nil {
+		/* Cuts the torn bytes off, so the next good record doesn't land behind them and get lost on reopen */
+		if terr := q.truncateActive(last.size); terr != nil {
+			q.broken = fmt.Errorf("queue: removing a failed append: %w (append failed with: %v)", terr, err)
+			return q.broken
+		}
+		return err
+	}
+	last.count++
+	last.size += int64(len(record))
+	q.tail++
+	return nil
+}
+
+/* Returns the oldest unacknowledged message without removing it; ok is false when the queue is empty */
+func (q *Queue) Peek() (data []byte, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, false, ErrClosed
+	}
+	if q.head == q.tail {
+		return nil, false, nil
+	}
+	if q.peekData != nil && q.peekSeq == q.head {
+		return q.peekData, true, nil
+	}
+
+	data, err = q.readAt(q.head)
+	if err != nil {
+		return nil, false, err
+	}
+	q.peekSeq = q.head
+	q.peekData = data
+	return data, true, nil
+}
+
+/* Removes the oldest message, i.e. the one last returned by Peek */
+func (q *Queue) Ack() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if q.head == q.tail {
+		return nil
+	}
+	q.head++
+	q.peekData = nil
+
+	q.unsynced++
+	if q.unsynced >= q.opts.CheckpointEvery {
+		if err := q.writeCheckpoint(); err != nil {
+			return err
+		}
+	}
+	return q.removeAcked()
+}
+
+/* Hands queued messages to fn in order and acknowledges each one fn accepts */
+/* Stops at the first error returned by fn and leaves that message in the queue */
+func (q *Queue) Replay(fn func(data []byte) error) (int, error) {
+	replayed := 0
+	for {
+		data, ok, err := q.Peek()
+		if err != nil || !ok {
+			return replayed, err
+		}
+		if err := fn(data); err != nil {
+			return replayed, err
+		}
+		if err := q.Ack(); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+/* Writes the final checkpoint and closes all files */
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+
+	var err error
+	if q.unsynced > 0 {
+		err = q.writeCheckpoint()
+	}
+	q.closeReader()
+	if cerr := q.active.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/* Opens the last segment for appending, or creates the first one */
+func (q *Queue) openActive() error {
+	if len(q.segments) == 0 || q.segments[len(q.segments)-1].size >= q.opts.MaxSegmentBytes {
+		return q.createSegment(q.tail)
+	}
+	f, err := os.OpenFile(q.segments[len(q.segments)-1].path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.active = f
+	return nil
+}
+
+func (q *Queue) truncateActive(size int64) error {
+	if err := q.active.Truncate(size); err != nil {
+		return err
+	}
+	return q.active.Sync()
+}
+
+/* Starts a new segment; the old one is closed only once the new one exists */
+func (q *Queue) roll() error {
+	old := q.active
+	if err := q.createSegment(q.tail); err != nil {
+		return err
+	}
+	/* Its records are synced already */
+	old.Close()
+	return nil
+}
+
+func (q *Queue) createSegment(first uint64) error {
+	path := filepath.Join(q.dir, segmentName(first))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		f.Close()
+		return err
+	}
+	q.active = f
+	q.segments = append(q.segments, &segment{first: first, path: path})
+	return nil
+}
+
+/* Deletes segments whose records have all been acknowledged; the active segment is always kept */
+func (q *Queue) removeAcked() error {
+	removed := false
+	for len(q.segments) > 1 && q.segments[0].next() <= q.head {
+		s := q.segments[0]
+		if q.readSeg == s {
+			q.closeReader()
+		}
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.segments = q.segments[1:]
+		removed = true
+	}
+	if removed {
+		return syncDir(q.dir)
+	}
+	return nil
+}
+
+/* Reads record seq, reusing the read cursor when possible */
+func (q *Queue) readAt(seq uint64) ([]byte, error) {
+	if q.reader == nil || q.readSeq != seq || q.readSeg.next() <= seq {
+		if err := q.seek(seq); err != nil {
+			return nil, err
+		}
+	}
+	data, err := readRecord(q.reader, q.opts.MaxRecordBytes)
+	if err != nil {
+		q.closeReader()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("queue: reading record %d: %w", seq, err)
+	}
+	q.readSeq++
+	return data, nil
+}
+
+/* Positions the read cursor at record seq */
+func (q *Queue) seek(seq uint64) error {
+	q.closeReader()
+
+	var seg *segment
+	for _, s := range q.segments {
+		if s.first <= seq && seq < s.next() {
+			seg = s
+			break
+		}
+	}
+	if seg == nil {
+		return fmt.Errorf("queue: record %d not found", seq)
+	}
+
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	for i := seg.first; i < seq; i++ {
+		if _, err := readRecord(f, q.opts.MaxRecordBytes); err != nil {
+			f.Close()
+			return fmt.Errorf("queue: skipping to record %d: %w", seq, err)
+		}
+	}
+	q.reader = f
+	q.readSeg = seg
+	q.readSeq = seq
+	return nil
+}
+
+func (q *Queue) closeReader() {
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	q.reader = nil
+	q.readSeg = nil
+}
+
+/* Checkpoint file holds [head uint64][crc32c uint32] */
+func (q *Queue) readCheckpoint() (uint64, error) {
+	buf, err := os.ReadFile(filepath.Join(q.dir, checkpointName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) != 12 || crc32.Checksum(buf[:8], crcTable) != binary.LittleEndian.Uint32(buf[8:12]) {
+		return 0, errors.New("queue: checkpoint file is corrupt")
+	}
+	return binary.LittleEndian.Uint64(buf[:8]), nil
+}
+
+/* Writes the checkpoint to a temporary file and renames it into place so it is never half written */
+func (q *Queue) writeCheckpoint() error {
+	var buf [12]byte
+	binary.LittleEndian.PutUint64(buf[:8], q.head)
+	binary.LittleEndian.PutUint32(buf[8:12], crc32.Checksum(buf[:8], crcTable))
+
+	path := filepath.Join(q.dir, checkpointName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf[:]); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	q.unsynced = 0
+	return syncDir(q.dir)
+}
+
+func truncateFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
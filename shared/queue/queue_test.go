@@ -0,0 +1,279 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func open(t *testing.T, dir string, opts Options) *Queue {
+	t.Helper()
+	q, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func appendAll(t *testing.T, q *Queue, messages ...string) {
+	t.Helper()
+	for _, m := range messages {
+		if err := q.Append([]byte(m)); err != nil {
+			t.Fatalf("Append(%q): %v", m, err)
+		}
+	}
+}
+
+/* Reads and acknowledges everything left in the queue */
+func drain(t *testing.T, q *Queue) []string {
+	t.Helper()
+	var got []string
+	if _, err := q.Replay(func(data []byte) error {
+		got = append(got, string(data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func equal(t *testing.T, name string, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestPeekAck(t *testing.T) {
+	q := open(t, t.TempDir(), Options{})
+	defer q.Close()
+	if _, ok, err := q.Peek(); ok || err != nil {
+		t.Fatalf("Peek on an empty queue = %v, %v", ok, err)
+	}
+	appendAll(t, q, "a", "b")
+
+	/* Peek doesn't remove, Ack does */
+	for i := 0; i < 2; i++ {
+		if data, ok, err := q.Peek(); !ok || err != nil || string(data) != "a" {
+			t.Fatalf("Peek = %q, %v, %v; want a", data, ok, err)
+		}
+	}
+	if err := q.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 1 {
+		t.Errorf("Len = %d after one Ack, want 1", q.Len())
+	}
+	equal(t, "rest", drain(t, q), "b")
+
+	/* Ack on an empty queue does nothing */
+	if err := q.Ack(); err != nil || q.Len() != 0 {
+		t.Errorf("Ack on an empty queue = %v, Len %d", err, q.Len())
+	}
+}
+
+/* A record half written when the power went is cut off; the ones before it and later appends survive */
+func TestTornTailOnReopen(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir, Options{})
+	appendAll(t, q, "one", "two", "three")
+	q.Close()
+
+	files := segmentFiles(t, dir)
+	f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeRecord([]byte("four"))[:recordHeaderSize+2])
+	f.Close()
+
+	q = open(t, dir, Options{})
+	if q.Len() != 3 {
+		t.Fatalf("Len = %d after reopening with a torn tail, want 3", q.Len())
+	}
+	appendAll(t, q, "five")
+	q.Close()
+
+	q = open(t, dir, Options{})
+	defer q.Close()
+	equal(t, "after the torn tail", drain(t, q), "one", "two", "three", "five")
+}
+
+/* A torn record in a segment before the last can't be from a crash */
+func TestCorruptOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir, Options{MaxSegmentBytes: 1})
+	appendAll(t, q, "one", "two")
+	q.Close()
+
+	f, err := os.OpenFile(segmentFiles(t, dir)[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+	if _, err := Open(dir, Options{MaxSegmentBytes: 1}); err == nil {
+		t.Errorf("Open accepted a corrupt older segment")
+	}
+}
+
+func TestSegmentRoll(t *testing.T) {
+	dir := t.TempDir()
+	/* 8 bytes of header and 4 of payload: three records fill a segment */
+	opts := Options{MaxSegmentBytes: 36}
+	q := open(t, dir, opts)
+	for i := 0; i < 10; i++ {
+		appendAll(t, q, fmt.Sprintf("m%03d", i))
+	}
+	if files := segmentFiles(t, dir); len(files) != 4 {
+		t.Errorf("%d segment files for 10 records, want 4", len(files))
+	}
+	q.Close()
+
+	q = open(t, dir, opts)
+	defer q.Close()
+	if q.Len() != 10 {
+		t.Fatalf("Len = %d after reopening, want 10", q.Len())
+	}
+	appendAll(t, q, "m010")
+	if files := segmentFiles(t, dir); len(files) != 4 {
+		t.Errorf("%d segment files after appending to the last one, want 4", len(files))
+	}
+	got := drain(t, q)
+	if len(got) != 11 || got[0] != "m000" || got[10] != "m010" {
+		t.Errorf("records after the rolls = %q", got)
+	}
+}
+
+func TestAckAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir, Options{MaxSegmentBytes: 36})
+	defer q.Close()
+	appendAll(t, q, "a000", "a001", "a002", "a003", "a004", "a005", "a006")
+
+	/* the first segment goes once its last record is acknowledged, the active one always stays */
+	for i, wantFiles := range []int{3, 3, 2, 2, 2, 1, 1} {
+		data, ok, err := q.Peek()
+		if !ok || err != nil || string(data) != fmt.Sprintf("a%03d", i) {
+			t.Fatalf("Peek %d = %q, %v, %v", i, data, ok, err)
+		}
+		if err := q.Ack(); err != nil {
+			t.Fatal(err)
+		}
+		if files := segmentFiles(t, dir); len(files) != wantFiles {
+			t.Errorf("%d segment files after %d acks, want %d", len(files), i+1, wantFiles)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len = %d, want 0", q.Len())
+	}
+
+	/* Replay stops at the first error and leaves that message queued */
+	appendAll(t, q, "b000", "b001")
+	n, err := q.Replay(func(data []byte) error {
+		if string(data) == "b001" {
+			return errors.New("broker gone")
+		}
+		return nil
+	})
+	if n != 1 || err == nil || q.Len() != 1 {
+		t.Errorf("Replay = %d, %v with %d left; want 1, an error and 1 left", n, err, q.Len())
+	}
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir, Options{})
+	appendAll(t, q, "a", "b", "c", "d")
+	for i := 0; i < 2; i++ {
+		q.Peek()
+		q.Ack()
+	}
+	q.Close()
+
+	q = open(t, dir, Options{CheckpointEvery: 10})
+	if data, _, _ := q.Peek(); string(data) != "c" || q.Len() != 2 {
+		t.Fatalf("after the restart Peek = %q with %d queued, want c and 2", data, q.Len())
+	}
+
+	/* acks since the last checkpoint are lost in a crash: the messages come again rather than never */
+	appendAll(t, q, "e")
+	equal(t, "before the crash", drain(t, q), "c", "d", "e")
+	crashed := q
+	q = open(t, dir, Options{})
+	defer q.Close()
+	equal(t, "after the crash", drain(t, q), "c", "d", "e")
+	crashed.active.Close()
+
+	os.WriteFile(filepath.Join(dir, checkpointName), []byte("broken"), 0644)
+	if _, err := Open(dir, Options{}); err == nil {
+		t.Errorf("Open accepted a corrupt checkpoint")
+	}
+}
+
+/* Writes half of each record before failing, like a full disk */
+type failingFile struct {
+	segmentFile
+	truncateErr error
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	n, _ := f.segmentFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+func TestFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir, Options{})
+	appendAll(t, q, "before")
+
+	good := q.active
+	q.active = &failingFile{segmentFile: good}
+	if err := q.Append([]byte("lost")); err == nil {
+		t.Fatalf("Append with a failing write succeeded")
+	}
+	q.active = good
+	if q.Len() != 1 {
+		t.Errorf("Len = %d after a failed Append, want 1", q.Len())
+	}
+
+	/* the torn bytes are gone, so the next record isn't dropped on reopen */
+	appendAll(t, q, "after")
+	q.Close()
+	q = open(t, dir, Options{})
+	equal(t, "after a failed Append", drain(t, q), "before", "after")
+
+	/* when the torn bytes can't be removed the queue refuses further appends */
+	good = q.active
+	q.active = &failingFile{segmentFile: good, truncateErr: errors.New("I/O error")}
+	if err := q.Append([]byte("lost")); err == nil {
+		t.Fatalf("Append with a failing write succeeded")
+	}
+	q.active = good
+	if err := q.Append([]byte("next")); err == nil {
+		t.Errorf("Append after a failed truncate succeeded")
+	}
+	q.Close()
+
+	if err := open(t, t.TempDir(), Options{MaxRecordBytes: 4}).Append([]byte("12345")); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Append of a too large record = %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Every record is stored as [length uint32][crc32c uint32][payload] */
+const (
+	recordHeaderSize = 8
+	segmentExt       = ".seg"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+/* Segment file on disk; first is the sequence number of its first record */
+type segment struct {
+	first uint64
+	count uint64
+	size  int64
+	path  string
+}
+
+/* Sequence number that follows the last record of the segment */
+func (s *segment) next() uint64 {
+	return s.first + s.count
+}
+
+/* Segment files are named after their first sequence number so they sort in write order */
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, segmentExt)
+}
+
+/* Lists segment files in dir ordered by their first sequence number */
+func listSegments(dir string) ([]*segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, &segment{first: first, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+/* Encodes a single record */
+func encodeRecord(data []byte) []byte {
+	buf := make([]byte, recordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	copy(buf[recordHeaderSize:], data)
+	return buf
+}
+
+var errTornRecord = errors.New("queue: torn or corrupt record")
+
+/* Reads the record starting at the reader's current position */
+/* Returns io.EOF at a clean end of file and errTornRecord for partially written or damaged records */
+func readRecord(r io.Reader, maxSize int) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errTornRecord
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if int64(length) > int64(maxSize) {
+		return nil, errTornRecord
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errTornRecord
+	}
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errTornRecord
+	}
+	return data, nil
+}
+
+/* Counts the records in a segment and returns the offset right after the last valid one */
+func scanSegment(path string, maxSize int) (count uint64, validSize int64, torn bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+
+	r := &countingReader{r: f}
+	for {
+		_, err := readRecord(r, maxSize)
+		if err == io.EOF {
+			return count, validSize, false, nil
+		}
+		if err != nil {
+			return count, validSize, true, nil
+		}
+		count++
+		validSize = r.n
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+/* Fsyncs a directory so that created, renamed and removed files survive a power loss */
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
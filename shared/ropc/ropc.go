@@ -0,0 +1,218 @@
+/* Package created 18.10.2026. */
+/* OAuth2.0 resource owner password credentials for the device manager API */
+/* Replaces the Authorize / setToken loops of the modem and GPS examples */
+
+package ropc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+/* One entry of "oauthConf" in params.json */
+type Config struct {
+	ClientId              string `json:"clientId"`
+	ClientSecret          string `json:"clientSecret"`
+	AuthorizationEndpoint string `json:"authorizationEndpoint"`
+	TokenEndpoint         string `json:"tokenEndpoint"`
+	RedirectURL           string `json:"redirectURL"`
+	Username              string `json:"username"`
+	Password              string `json:"password"`
+
+	// delay after a failed token request grows from MinBackoff up to MaxBackoff
+	MinBackoff time.Duration `json:"-"`
+	MaxBackoff time.Duration `json:"-"`
+	// used for token requests; http.DefaultClient when nil
+	HTTPClient *http.Client `json:"-"`
+}
+
+/* Longest a token request may take; Token holds the lock meanwhile, so every API call waits for it */
+const tokenTimeout = 30 * time.Second
+
+/* Longest an API call of a NewClient client may take, the token request included */
+const requestTimeout = time.Minute
+
+type params struct {
+	OAuthConf []Config `json:"oauthConf"`
+}
+
+/* Reads the first "oauthConf" entry of a params.json file */
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var p params
+	if err := json.Unmarshal(data, &p); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(p.OAuthConf) == 0 {
+		return Config{}, fmt.Errorf("%s: no oauthConf entry", path)
+	}
+	conf := p.OAuthConf[0]
+	if conf.TokenEndpoint == "" {
+		return Config{}, fmt.Errorf("%s: tokenEndpoint is empty", path)
+	}
+	return conf, nil
+}
+
+/* TokenSource fetches tokens with the password grant and keeps them fresh */
+/* The token is reused until it expires (expires_in), renewed with the refresh token when the server issued one */
+/* and fetched with username and password otherwise. Failed requests are not retried before the backoff delay passed. */
+/* Safe for concurrent use. */
+type TokenSource struct {
+	cfg   Config
+	oauth oauth2.Config
+	ctx   context.Context
+
+	mu          sync.Mutex
+	token       *oauth2.Token
+	failures    int
+	lastErr     error
+	nextAttempt time.Time
+}
+
+func NewTokenSource(cfg Config) *TokenSource {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+
+	ctx := context.Background()
+	if cfg.HTTPClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, cfg.HTTPClient)
+	}
+
+	return &TokenSource{
+		cfg: cfg,
+		ctx: ctx,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientId,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.AuthorizationEndpoint,
+				TokenURL: cfg.TokenEndpoint,
+				// the device user manager expects the client credentials as basic auth
+				AuthStyle: oauth2.AuthStyleInHeader,
+			},
+		},
+	}
+}
+
+/* Returns a valid token, fetching a new one if needed */
+func (ts *TokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token.Valid() {
+		return ts.token, nil
+	}
+	if time.Now().Before(ts.nextAttempt) {
+		return nil, fmt.Errorf("token request backing off until %s: %w", ts.nextAttempt.Format(time.TimeOnly), ts.lastErr)
+	}
+
+	token, err := ts.fetch()
+	if err != nil {
+		delay := ts.cfg.MinBackoff << min(ts.failures, 16)
+		if delay <= 0 || delay > ts.cfg.MaxBackoff {
+			delay = ts.cfg.MaxBackoff
+		}
+		ts.failures++
+		ts.lastErr = err
+		ts.nextAttempt = time.Now().Add(delay)
+		return nil, err
+	}
+
+	ts.token = token
+	ts.failures = 0
+	ts.lastErr = nil
+	ts.nextAttempt = time.Time{}
+	return token, nil
+}
+
+/* Uses the refresh token if there is one and falls back to the password grant */
+func (ts *TokenSource) fetch() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(ts.ctx, tokenTimeout)
+	defer cancel()
+
+	if ts.token != nil && ts.token.RefreshToken != "" {
+		refreshed, err := ts.oauth.TokenSource(ctx, &oauth2.Token{RefreshToken: ts.token.RefreshToken}).Token()
+		if err == nil {
+			return refreshed, nil
+		}
+	}
+	token, err := ts.oauth.PasswordCredentialsToken(ctx, ts.cfg.Username, ts.cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("fetching token: %w", err)
+	}
+	return token, nil
+}
+
+/* Returns an http.Client that authorizes every request with a token from ts */
+/* A request gives up after a minute even if its context has no deadline */
+func NewClient(ts *TokenSource) *http.Client {
+	client := oauth2.NewClient(ts.ctx, ts)
+	client.Timeout = requestTimeout
+	return client
+}
+
+/* Returned when the API answers with a status other than 2xx */
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+/* Fetches data from url with a client created by NewClient */
+func MakeROPCRequest(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(client, req)
+}
+
+/* Posts a JSON message to url with a client created by NewClient */
+func PostROPCMessage(ctx context.Context, client *http.Client, url string, msg []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = do(client, req)
+	return err
+}
+
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{Method: req.Method, URL: req.URL.String(), StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
@@ -0,0 +1,541 @@
+/* Sparkplug edge node: births and deaths with bdSeq, data with sequence numbers, rebirths on request */
+
+package sparkplug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mq "tdce-shared/mqttset"
+)
+
+var ErrHostOffline = errors.New("primary host went offline")
+
+/* Where the node is in its session */
+type State int
+
+const (
+	Offline State = iota
+	Connecting
+	// connected, the births wait for the STATE of the primary host
+	WaitingForHost
+	// NBIRTH and the DBIRTHs are out, data is published
+	Online
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case WaitingForHost:
+		return "waiting for host"
+	case Online:
+		return "online"
+	}
+	return "offline"
+}
+
+/* Settings of an edge node; the tags make it a section of the examples' settings */
+type Options struct {
+	Group    string `json:"group" validate:"required" help:"Sparkplug group ID"`
+	EdgeNode string `json:"edgeNode" validate:"required" help:"Sparkplug edge node ID"`
+	// births wait until this host application's STATE says it is online, and the node goes offline with it
+	PrimaryHost string `json:"primaryHost" help:"ID of the primary host application, empty doesn't wait for one"`
+	// data messages carry the alias from the birth instead of the name
+	Aliases bool `json:"aliases" help:"send data metrics by alias instead of name"`
+	// without it the bdSeq starts at 0 after every restart, so a host sees the same bdSeq again
+	BdSeqFile string `json:"bdSeqFile" help:"file the next bdSeq is kept in across restarts, empty starts at 0 after each restart"`
+}
+
+/* Metrics in the order they were first set, so births list them the same way every time */
+type metricSet struct {
+	names  []string
+	values map[string]Metric
+}
+
+/* Stores m; false when its name is new */
+func (s *metricSet) set(m Metric) bool {
+	if s.values == nil {
+		s.values = map[string]Metric{}
+	}
+	_, known := s.values[m.Name]
+	if !known {
+		s.names = append(s.names, m.Name)
+	}
+	s.values[m.Name] = m
+	return known
+}
+
+type device struct {
+	metrics metricSet
+	born    bool
+}
+
+type aliasKey struct {
+	device string
+	name   string
+}
+
+type event int
+
+const (
+	rebirth event = iota
+	hostOnline
+	hostOffline
+)
+
+/* One edge node with its devices; the MQTT connection is made anew for every session, each with its own NDEATH */
+/* Values set with Update before the node is online go out with the births */
+type EdgeNode struct {
+	mqtt      mq.ClientOptions
+	opts      Options
+	onCommand func(device string, metrics []Metric)
+	// mq.NewClient; replaced by the tests
+	newClient func(mq.ClientOptions) (mqtt.Client, error)
+
+	mu        sync.Mutex
+	state     State
+	client    mqtt.Client
+	publisher *mq.Publisher
+	sessions  uint64
+	bdSeq     uint64
+	seq       uint64
+	born      bool
+	node      metricSet
+	devices   map[string]*device
+	order     []string
+	aliases   map[aliasKey]uint64
+	byAlias   map[uint64]aliasKey
+}
+
+/* The node reconnects itself, waiting 1s, 2s, 4s... up to Reconnect.MaxBackoff of the MQTT options */
+func NewEdgeNode(mqttOptions mq.ClientOptions, opts Options) *EdgeNode {
+	return &EdgeNode{
+		mqtt:      mqttOptions,
+		opts:      opts,
+		newClient: mq.NewClient,
+		devices:   map[string]*device{},
+		aliases:   map[aliasKey]uint64{},
+		byAlias:   map[uint64]aliasKey{},
+	}
+}
+
+/* fn gets the metrics written by NCMD (device empty) and DCMD; rebirth requests are handled by the node */
+/* Names are filled in for metrics sent by alias; set it before Run */
+func (n *EdgeNode) OnCommand(fn func(device string, metrics []Metric)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onCommand = fn
+}
+
+func (n *EdgeNode) State() State {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state
+}
+
+/* For health checks */
+func (n *EdgeNode) IsConnectionOpen() bool {
+	return n.State() == Online
+}
+
+/* Sets metrics of the node (device empty) or of a device and publishes them in NDATA or DDATA */
+/* A new device gets its DBIRTH; new metrics of a born node or device are announced with a new birth */
+func (n *EdgeNode) Update(deviceID string, metrics ...Metric) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	set := &n.node
+	var dev *device
+	if deviceID != "" {
+		if dev = n.devices[deviceID]; dev == nil {
+			dev = &device{}
+			n.devices[deviceID] = dev
+			n.order = append(n.order, deviceID)
+		}
+		set = &dev.metrics
+	}
+	allKnown := true
+	for i := range metrics {
+		if metrics[i].Timestamp.IsZero() {
+			metrics[i].Timestamp = now
+		}
+		if metrics[i].DataType == Unknown {
+			metrics[i].DataType = dataTypeOf(metrics[i].Value)
+		}
+		allKnown = set.set(metrics[i]) && allKnown
+	}
+
+	if !n.born {
+		return nil
+	}
+	switch {
+	case deviceID == "" && !allKnown:
+		return n.birth()
+	case deviceID == "":
+		return n.publish(Topic{Type: NDATA}, n.data(deviceID, metrics))
+	case !dev.born || !allKnown:
+		return n.deviceBirth(deviceID, dev)
+	}
+	return n.publish(Topic{Type: DDATA, Device: deviceID}, n.data(deviceID, metrics))
+}
+
+/* Publishes DDEATH for a device that is gone and forgets its metrics */
+func (n *EdgeNode) RemoveDevice(deviceID string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dev := n.devices[deviceID]
+	if dev == nil {
+		return nil
+	}
+	delete(n.devices, deviceID)
+	for i, id := range n.order {
+		if id == deviceID {
+			n.order = append(n.order[:i], n.order[i+1:]...)
+			break
+		}
+	}
+	if !n.born || !dev.born {
+		return nil
+	}
+	return n.publish(Topic{Type: DDEATH, Device: deviceID}, &Payload{})
+}
+
+/* Connects, publishes the births and keeps the session until ctx is done, reconnecting with a new bdSeq when it is lost */
+/* On ctx done NDEATH is published before disconnecting, as the broker only sends the will when the connection breaks */
+/* With a BdSeqFile the bdSeq goes on from the last run */
+func (n *EdgeNode) Run(ctx context.Context) error {
+	if err := n.loadBdSeq(); err != nil {
+		return fmt.Errorf("%s: %w", n.opts.BdSeqFile, err)
+	}
+	maxBackoff := time.Duration(n.mqtt.Reconnect.MaxBackoff)
+	if maxBackoff <= 0 {
+		maxBackoff = 2 * time.Minute
+	}
+	delay := time.Second
+	for {
+		online, err := n.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if online {
+			delay = time.Second
+		}
+		fmt.Printf("Sparkplug session ended: %v; reconnecting in %s\n", err, delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxBackoff)
+	}
+}
+
+/* Reads the bdSeq of the next session; a missing file starts at 0 */
+func (n *EdgeNode) loadBdSeq() error {
+	if n.opts.BdSeqFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(n.opts.BdSeqFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	next, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.sessions = next
+	n.mu.Unlock()
+	return nil
+}
+
+/* Writes the bdSeq of the next session, replacing the file in one step */
+func saveBdSeq(path string, next uint64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatUint(next, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+/* One MQTT session; online tells whether the births went out */
+func (n *EdgeNode) session(ctx context.Context) (online bool, err error) {
+	n.mu.Lock()
+	bdSeq := n.sessions % 256
+	n.sessions = (n.sessions + 1) % 256
+	next := n.sessions
+	n.state = Connecting
+	n.mu.Unlock()
+	if n.opts.BdSeqFile != "" {
+		/* A session whose bdSeq isn't kept still runs; after a restart the host may see its bdSeq once more */
+		if err := saveBdSeq(n.opts.BdSeqFile, next); err != nil {
+			fmt.Println("Error saving bdSeq: ", err)
+		}
+	}
+	defer func() {
+		n.mu.Lock()
+		n.client, n.publisher, n.born, n.state = nil, nil, false, Offline
+		for _, dev := range n.devices {
+			dev.born = false
+		}
+		n.mu.Unlock()
+	}()
+
+	death, err := deathCertificate(bdSeq)
+	if err != nil {
+		return false, err
+	}
+	deathTopic := n.topic(Topic{Type: NDEATH})
+	lost := make(chan error, 1)
+	/* Sparkplug sessions are always clean; the births give the host the whole state again */
+	opts := n.mqtt
+	opts.Reconnect.Enabled, opts.Session.Persistent = false, false
+	opts.Will = &mq.Will{Topic: deathTopic, Payload: death, QoS: 1}
+	opts.OnConnectionLost = func(_ mqtt.Client, err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}
+	client, err := n.newClient(opts)
+	if err != nil {
+		return false, err
+	}
+	if err := mq.ConnectClientToBroker(client); err != nil {
+		return false, err
+	}
+	publisher := mq.NewPublisher(client, mq.Options{})
+	die := func() {
+		client.Publish(deathTopic, 1, false, death).WaitTimeout(5 * time.Second)
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		publisher.Close(closeCtx)
+		mq.Disconnect(client, n.mqtt.Status, 250)
+	}
+
+	events := make(chan event, 8)
+	filters := map[string]byte{
+		n.topic(Topic{Type: NCMD}):              1,
+		n.topic(Topic{Type: DCMD, Device: "+"}): 1,
+	}
+	if n.opts.PrimaryHost != "" {
+		filters[Topic{Type: STATE, Host: n.opts.PrimaryHost}.String()] = 1
+	}
+	token := client.SubscribeMultiple(filters, func(_ mqtt.Client, msg mqtt.Message) {
+		n.received(msg, events)
+	})
+	if token.Wait(); token.Error() != nil {
+		die()
+		return false, token.Error()
+	}
+
+	n.mu.Lock()
+	n.client, n.publisher, n.bdSeq = client, publisher, bdSeq
+	if n.opts.PrimaryHost == "" {
+		err = n.birth()
+	} else {
+		n.state = WaitingForHost
+	}
+	n.mu.Unlock()
+	if err != nil {
+		die()
+		return false, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			die()
+			return n.State() == Online, ctx.Err()
+		case err := <-lost:
+			return n.State() == Online, err
+		case e := <-events:
+			n.mu.Lock()
+			switch {
+			case e == rebirth && n.born, e == hostOnline && !n.born:
+				err = n.birth()
+			case e == hostOffline && n.born:
+				err = ErrHostOffline
+			}
+			n.mu.Unlock()
+			if err != nil {
+				die()
+				return true, err
+			}
+		}
+	}
+}
+
+/* NDEATH payload of a session; the will and the NDEATH on a clean shutdown are the same */
+func deathCertificate(bdSeq uint64) ([]byte, error) {
+	p := Payload{Timestamp: time.Now(), Metrics: []Metric{{Name: BdSeqMetric, DataType: Int64, Value: int64(bdSeq)}}}
+	return p.Marshal()
+}
+
+/* Handles NCMD, DCMD and the STATE of the primary host */
+func (n *EdgeNode) received(msg mqtt.Message, events chan<- event) {
+	send := func(e event) {
+		select {
+		case events <- e:
+		default:
+		}
+	}
+	t, err := ParseTopic(msg.Topic())
+	if err != nil {
+		fmt.Println("Ignoring message: ", err)
+		return
+	}
+	if t.Type == STATE {
+		state, err := ParseHostState(msg.Payload())
+		if err != nil {
+			fmt.Println("Ignoring host state: ", err)
+			return
+		}
+		if state.Online {
+			send(hostOnline)
+		} else {
+			send(hostOffline)
+		}
+		return
+	}
+
+	p, err := Unmarshal(msg.Payload())
+	if err != nil {
+		fmt.Printf("Ignoring %s: %v\n", t.Type, err)
+		return
+	}
+	n.mu.Lock()
+	onCommand := n.onCommand
+	var writes []Metric
+	for _, m := range p.Metrics {
+		if m.Name == "" && m.Alias != nil {
+			m.Name = n.byAlias[*m.Alias].name
+		}
+		if t.Type == NCMD && m.Name == RebirthMetric {
+			if v, _ := m.Value.(bool); v {
+				send(rebirth)
+			}
+			continue
+		}
+		writes = append(writes, m)
+	}
+	n.mu.Unlock()
+	if len(writes) > 0 && onCommand != nil {
+		onCommand(t.Device, writes)
+	}
+}
+
+func (n *EdgeNode) topic(t Topic) string {
+	t.Group, t.EdgeNode = n.opts.Group, n.opts.EdgeNode
+	return t.String()
+}
+
+/* Publishes NBIRTH and a DBIRTH per device; the sequence starts over at 0. The node is only online once all went out. Called with mu held */
+func (n *EdgeNode) birth() error {
+	n.seq = 0
+	metrics := []Metric{
+		{Name: BdSeqMetric, DataType: Int64, Value: int64(n.bdSeq)},
+		{Name: RebirthMetric, DataType: Boolean, Value: false},
+	}
+	metrics = append(metrics, n.birthMetrics("", &n.node)...)
+	if err := n.publish(Topic{Type: NBIRTH}, &Payload{Metrics: metrics}); err != nil {
+		return err
+	}
+	for _, id := range n.order {
+		if err := n.deviceBirth(id, n.devices[id]); err != nil {
+			return err
+		}
+	}
+	n.born, n.state = true, Online
+	return nil
+}
+
+func (n *EdgeNode) deviceBirth(id string, dev *device) error {
+	if err := n.publish(Topic{Type: DBIRTH, Device: id}, &Payload{Metrics: n.birthMetrics(id, &dev.metrics)}); err != nil {
+		return err
+	}
+	dev.born = true
+	return nil
+}
+
+/* Births carry the names, the aliases and the current values */
+func (n *EdgeNode) birthMetrics(deviceID string, set *metricSet) []Metric {
+	metrics := make([]Metric, 0, len(set.names))
+	for _, name := range set.names {
+		m := set.values[name]
+		if n.opts.Aliases {
+			alias := n.alias(deviceID, name)
+			m.Alias = &alias
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+/* Data messages carry only the alias when aliases are on */
+func (n *EdgeNode) data(deviceID string, metrics []Metric) *Payload {
+	p := &Payload{Metrics: make([]Metric, len(metrics))}
+	for i, m := range metrics {
+		if n.opts.Aliases {
+			alias := n.alias(deviceID, m.Name)
+			m.Name, m.Alias = "", &alias
+		}
+		p.Metrics[i] = m
+	}
+	return p
+}
+
+/* Aliases are unique across the node and its devices and stay the same across rebirths */
+func (n *EdgeNode) alias(deviceID string, name string) uint64 {
+	key := aliasKey{deviceID, name}
+	alias, ok := n.aliases[key]
+	if !ok {
+		alias = uint64(len(n.aliases) + 1)
+		n.aliases[key] = alias
+		n.byAlias[alias] = key
+	}
+	return alias
+}
+
+/* Stamps p with the time and the next sequence number and publishes it with QoS 0, waiting until it is sent. Called with mu held */
+func (n *EdgeNode) publish(t Topic, p *Payload) error {
+	if n.publisher == nil {
+		return mqtt.ErrNotConnected
+	}
+	seq := n.seq
+	n.seq = (n.seq + 1) % 256
+	p.Timestamp, p.Seq = time.Now(), &seq
+	payload, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return n.publisher.Publish(ctx, mq.Message{Topic: n.topic(t), Payload: payload}).Wait(ctx)
+}
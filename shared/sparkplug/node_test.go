@@ -0,0 +1,420 @@
+package sparkplug
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mq "tdce-shared/mqttset"
+)
+
+/* A birth the broker never got leaves the node offline */
+func TestFailedBirthStaysOffline(t *testing.T) {
+	options := mq.ClientOptions{Version: 3, Broker: "tcp://127.0.0.1:1", ClientId: "tdce-1"}
+	client, err := mq.NewClient(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewEdgeNode(options, Options{Group: "plant", EdgeNode: "tdce-1"})
+	n.publisher = mq.NewPublisher(client, mq.Options{})
+	n.devices["ain"] = &device{}
+	n.order = []string{"ain"}
+
+	n.mu.Lock()
+	err = n.birth()
+	n.mu.Unlock()
+	if !errors.Is(err, mqtt.ErrNotConnected) {
+		t.Errorf("birth while disconnected = %v, want ErrNotConnected", err)
+	}
+	if n.born || n.State() == Online || n.devices["ain"].born {
+		t.Errorf("node or device born after the failed birth")
+	}
+}
+
+/* Completed at once, as if the broker answered right away */
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+type sent struct {
+	topic   string
+	payload []byte
+}
+
+/* Hands out a fakeClient per session and collects what they publish */
+type fakeBroker struct {
+	mu        sync.Mutex
+	clients   []*fakeClient
+	published chan sent
+}
+
+func (b *fakeBroker) newClient(opts mq.ClientOptions) (mqtt.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &fakeClient{broker: b, opts: opts}
+	b.clients = append(b.clients, c)
+	return c, nil
+}
+
+func (b *fakeBroker) client(t *testing.T, i int) *fakeClient {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i >= len(b.clients) {
+		t.Fatalf("session %d not started", i)
+	}
+	return b.clients[i]
+}
+
+/* The next message of type typ; fails on any other message in between */
+func (b *fakeBroker) expect(t *testing.T, typ MessageType) *Payload {
+	t.Helper()
+	select {
+	case m := <-b.published:
+		topic, err := ParseTopic(m.topic)
+		if err != nil || topic.Type != typ {
+			t.Fatalf("got %s, want %s", m.topic, typ)
+		}
+		p, err := Unmarshal(m.payload)
+		if err != nil {
+			t.Fatalf("%s: %v", m.topic, err)
+		}
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s", typ)
+	}
+	return nil
+}
+
+/* Delivers a message to the subscription of the latest session */
+func (b *fakeBroker) deliver(t *testing.T, topic string, payload []byte) {
+	t.Helper()
+	b.mu.Lock()
+	c := b.clients[len(b.clients)-1]
+	b.mu.Unlock()
+	c.mu.Lock()
+	handler := c.handler
+	c.mu.Unlock()
+	if handler == nil {
+		t.Fatal("not subscribed")
+	}
+	handler(c, fakeMessage{topic: topic, payload: payload})
+}
+
+type fakeClient struct {
+	mqtt.Client
+	broker *fakeBroker
+	opts   mq.ClientOptions
+
+	mu      sync.Mutex
+	filters map[string]byte
+	handler mqtt.MessageHandler
+}
+
+func (c *fakeClient) Connect() mqtt.Token {
+	return doneToken{}
+}
+
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewClient(mqtt.NewClientOptions()).OptionsReader()
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	return true
+}
+
+func (c *fakeClient) Disconnect(uint) {}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.broker.published <- sent{topic, payload.([]byte)}
+	return doneToken{}
+}
+
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filters, c.handler = filters, callback
+	return doneToken{}
+}
+
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return m.payload }
+
+func testNode(opts Options) (*EdgeNode, *fakeBroker) {
+	if opts.Group == "" {
+		opts.Group, opts.EdgeNode = "plant", "tdce-1"
+	}
+	b := &fakeBroker{published: make(chan sent, 1024)}
+	n := NewEdgeNode(mq.ClientOptions{Version: 3, Broker: "tcp://127.0.0.1:1883", ClientId: "tdce-1"}, opts)
+	n.newClient = b.newClient
+	return n, b
+}
+
+/* Runs n until the returned function is called */
+func start(t *testing.T, n *EdgeNode) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- n.Run(ctx) }()
+	return func() {
+		t.Helper()
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run = %v", err)
+		}
+	}
+}
+
+func bdSeqOf(t *testing.T, p *Payload) int64 {
+	t.Helper()
+	for _, m := range p.Metrics {
+		if m.Name == BdSeqMetric {
+			return m.Value.(int64)
+		}
+	}
+	t.Fatal("no bdSeq metric")
+	return 0
+}
+
+func seqOf(t *testing.T, p *Payload) uint64 {
+	t.Helper()
+	if p.Seq == nil {
+		t.Fatal("no seq")
+	}
+	return *p.Seq
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+/* Each session has the next bdSeq, in its NBIRTH, its will and the NDEATH of a clean shutdown */
+func TestBdSeq(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bdseq")
+	n, b := testNode(Options{BdSeqFile: file})
+
+	for session := 0; session < 2; session++ {
+		stop := start(t, n)
+		birth := b.expect(t, NBIRTH)
+		if bdSeqOf(t, birth) != int64(session) || seqOf(t, birth) != 0 {
+			t.Errorf("session %d: NBIRTH bdSeq %d, seq %d", session, bdSeqOf(t, birth), seqOf(t, birth))
+		}
+		will := b.client(t, session).opts.Will
+		if will == nil || will.Topic != "spBv1.0/plant/NDEATH/tdce-1" {
+			t.Fatalf("session %d: will %+v", session, will)
+		}
+		willPayload, err := Unmarshal(will.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bdSeqOf(t, willPayload) != int64(session) {
+			t.Errorf("session %d: will bdSeq %d", session, bdSeqOf(t, willPayload))
+		}
+
+		stop()
+		death := b.expect(t, NDEATH)
+		if bdSeqOf(t, death) != int64(session) || death.Seq != nil {
+			t.Errorf("session %d: NDEATH bdSeq %d, seq %v", session, bdSeqOf(t, death), death.Seq)
+		}
+	}
+
+	/* a restart goes on from the file */
+	restarted, b := testNode(Options{BdSeqFile: file})
+	stop := start(t, restarted)
+	if bdSeq := bdSeqOf(t, b.expect(t, NBIRTH)); bdSeq != 2 {
+		t.Errorf("bdSeq after a restart %d, want 2", bdSeq)
+	}
+	stop()
+
+	/* without the file every start begins at 0 */
+	n, b = testNode(Options{})
+	stop = start(t, n)
+	if bdSeq := bdSeqOf(t, b.expect(t, NBIRTH)); bdSeq != 0 {
+		t.Errorf("bdSeq without a file %d, want 0", bdSeq)
+	}
+	stop()
+}
+
+func TestBdSeqWraps(t *testing.T) {
+	n, b := testNode(Options{})
+	n.sessions = 255
+	stop := start(t, n)
+	if bdSeq := bdSeqOf(t, b.expect(t, NBIRTH)); bdSeq != 255 {
+		t.Errorf("bdSeq %d, want 255", bdSeq)
+	}
+	stop()
+	b.expect(t, NDEATH)
+	stop = start(t, n)
+	if bdSeq := bdSeqOf(t, b.expect(t, NBIRTH)); bdSeq != 0 {
+		t.Errorf("bdSeq after 255 is %d, want 0", bdSeq)
+	}
+	stop()
+}
+
+func TestSeqWraparound(t *testing.T) {
+	n, b := testNode(Options{})
+	n.Update("", NewMetric("count", int64(0)))
+	stop := start(t, n)
+	defer stop()
+	if seq := seqOf(t, b.expect(t, NBIRTH)); seq != 0 {
+		t.Errorf("NBIRTH seq %d", seq)
+	}
+	for i := 1; i <= 300; i++ {
+		if err := n.Update("", NewMetric("count", int64(i))); err != nil {
+			t.Fatal(err)
+		}
+		if seq := seqOf(t, b.expect(t, NDATA)); seq != uint64(i%256) {
+			t.Fatalf("NDATA %d: seq %d, want %d", i, seq, i%256)
+		}
+	}
+}
+
+/* A rebirth asked for in NCMD repeats the births in the same session: same bdSeq, seq from 0, same aliases */
+func TestRebirth(t *testing.T) {
+	n, b := testNode(Options{Aliases: true})
+	n.Update("", NewMetric("count", int64(1)))
+	n.Update("ain", NewMetric("AIN_A", 1.5), NewMetric("AIN_B", 2.5))
+	stop := start(t, n)
+	defer stop()
+
+	aliases := func(p *Payload) map[string]uint64 {
+		got := map[string]uint64{}
+		for _, m := range p.Metrics {
+			if m.Alias != nil {
+				got[m.Name] = *m.Alias
+			}
+		}
+		return got
+	}
+	nodeAliases := aliases(b.expect(t, NBIRTH))
+	deviceAliases := aliases(b.expect(t, DBIRTH))
+	if len(nodeAliases) != 1 || len(deviceAliases) != 2 || deviceAliases["AIN_A"] == deviceAliases["AIN_B"] || deviceAliases["AIN_A"] == nodeAliases["count"] {
+		t.Fatalf("aliases %v and %v, want them unique", nodeAliases, deviceAliases)
+	}
+
+	if err := n.Update("ain", NewMetric("AIN_B", 3.0)); err != nil {
+		t.Fatal(err)
+	}
+	data := b.expect(t, DDATA)
+	if len(data.Metrics) != 1 || data.Metrics[0].Name != "" || data.Metrics[0].Alias == nil || *data.Metrics[0].Alias != deviceAliases["AIN_B"] {
+		t.Errorf("DDATA %+v, want AIN_B by alias only", data.Metrics)
+	}
+
+	rebirth, err := (&Payload{Metrics: []Metric{NewMetric(RebirthMetric, true)}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.deliver(t, "spBv1.0/plant/NCMD/tdce-1", rebirth)
+	birth := b.expect(t, NBIRTH)
+	if bdSeqOf(t, birth) != 0 || seqOf(t, birth) != 0 {
+		t.Errorf("rebirth bdSeq %d, seq %d; want both 0", bdSeqOf(t, birth), seqOf(t, birth))
+	}
+	deviceBirth := b.expect(t, DBIRTH)
+	if seqOf(t, deviceBirth) != 1 {
+		t.Errorf("DBIRTH seq %d, want 1", seqOf(t, deviceBirth))
+	}
+	if got := aliases(birth); got["count"] != nodeAliases["count"] {
+		t.Errorf("node aliases %v after the rebirth, were %v", got, nodeAliases)
+	}
+	for name, alias := range aliases(deviceBirth) {
+		if deviceAliases[name] != alias {
+			t.Errorf("alias of %s %d after the rebirth, was %d", name, alias, deviceAliases[name])
+		}
+	}
+	for _, m := range deviceBirth.Metrics {
+		if m.Name == "AIN_B" && m.Value != 3.0 {
+			t.Errorf("DBIRTH has AIN_B %v, want the current value", m.Value)
+		}
+	}
+}
+
+/* Metrics a birth didn't announce come with a new birth instead of a data message */
+func TestNewMetricsRebirth(t *testing.T) {
+	n, b := testNode(Options{})
+	n.Update("", NewMetric("a", int64(1)))
+	stop := start(t, n)
+	defer stop()
+	b.expect(t, NBIRTH)
+
+	n.Update("ain", NewMetric("AIN_A", 1.0))
+	if p := b.expect(t, DBIRTH); len(p.Metrics) != 1 {
+		t.Errorf("DBIRTH of a new device has %d metrics", len(p.Metrics))
+	}
+	n.Update("ain", NewMetric("AIN_A", 2.0))
+	b.expect(t, DDATA)
+	n.Update("ain", NewMetric("AIN_A", 3.0), NewMetric("AIN_B", 1.0))
+	if p := b.expect(t, DBIRTH); len(p.Metrics) != 2 {
+		t.Errorf("DBIRTH after a new device metric has %d metrics, want 2", len(p.Metrics))
+	}
+
+	n.Update("", NewMetric("b", true))
+	birth := b.expect(t, NBIRTH)
+	names := map[string]bool{}
+	for _, m := range birth.Metrics {
+		names[m.Name] = true
+	}
+	if !names["a"] || !names["b"] || !names[BdSeqMetric] || !names[RebirthMetric] {
+		t.Errorf("NBIRTH after a new node metric has %v", names)
+	}
+	/* the devices are born again with the node */
+	b.expect(t, DBIRTH)
+
+	if err := n.RemoveDevice("ain"); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, DDEATH)
+}
+
+/* With a primary host the births wait for its STATE, and the node dies when the host goes offline */
+func TestHostState(t *testing.T) {
+	n, b := testNode(Options{PrimaryHost: "scada"})
+	n.Update("", NewMetric("a", int64(1)))
+	stop := start(t, n)
+	defer stop()
+
+	eventually(t, "waiting for the host", func() bool { return n.State() == WaitingForHost })
+	if _, ok := b.client(t, 0).filters["spBv1.0/STATE/scada"]; !ok {
+		t.Errorf("STATE of the host not subscribed")
+	}
+	if err := n.Update("", NewMetric("a", int64(2))); err != nil {
+		t.Errorf("Update before the births: %v", err)
+	}
+
+	b.deliver(t, "spBv1.0/STATE/scada", []byte(`{"online":true,"timestamp":1700000000000}`))
+	birth := b.expect(t, NBIRTH)
+	for _, m := range birth.Metrics {
+		if m.Name == "a" && m.Value != int64(2) {
+			t.Errorf("NBIRTH has a = %v, want the value set while waiting", m.Value)
+		}
+	}
+	eventually(t, "online", func() bool { return n.State() == Online })
+
+	/* a repeated online STATE doesn't give another birth */
+	b.deliver(t, "spBv1.0/STATE/scada", []byte("ONLINE"))
+	b.deliver(t, "spBv1.0/STATE/scada", []byte("OFFLINE"))
+	if bdSeq := bdSeqOf(t, b.expect(t, NDEATH)); bdSeq != 0 {
+		t.Errorf("NDEATH bdSeq %d", bdSeq)
+	}
+	eventually(t, "offline", func() bool { return n.State() != Online })
+}
@@ -0,0 +1,439 @@
+/* Package created 18.10.2026. */
+/* Sparkplug B payloads; the protobuf encoding of sparkplug_b.proto is written with protowire, so no generated code is needed */
+
+package sparkplug
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/* Data types of metrics, as in the DataType enum of sparkplug_b.proto */
+type DataType uint32
+
+const (
+	Unknown  DataType = 0
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+	Text     DataType = 14
+	UUID     DataType = 15
+	Bytes    DataType = 17
+	File     DataType = 18
+)
+
+func (t DataType) String() string {
+	names := map[DataType]string{
+		Unknown: "Unknown", Int8: "Int8", Int16: "Int16", Int32: "Int32", Int64: "Int64",
+		UInt8: "UInt8", UInt16: "UInt16", UInt32: "UInt32", UInt64: "UInt64",
+		Float: "Float", Double: "Double", Boolean: "Boolean", String: "String", DateTime: "DateTime",
+		Text: "Text", UUID: "UUID", Bytes: "Bytes", File: "File",
+	}
+	if name, ok := names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("DataType(%d)", uint32(t))
+}
+
+/* Field numbers of the Payload message */
+const (
+	payloadTimestamp protowire.Number = 1
+	payloadMetrics   protowire.Number = 2
+	payloadSeq       protowire.Number = 3
+	payloadUUID      protowire.Number = 4
+	payloadBody      protowire.Number = 5
+)
+
+/* Field numbers of the Metric message; metadata, properties, datasets and templates are not supported */
+const (
+	metricName         protowire.Number = 1
+	metricAlias        protowire.Number = 2
+	metricTimestamp    protowire.Number = 3
+	metricDataType     protowire.Number = 4
+	metricIsHistorical protowire.Number = 5
+	metricIsTransient  protowire.Number = 6
+	metricIsNull       protowire.Number = 7
+	metricInt          protowire.Number = 10
+	metricLong         protowire.Number = 11
+	metricFloat        protowire.Number = 12
+	metricDouble       protowire.Number = 13
+	metricBoolean      protowire.Number = 14
+	metricString       protowire.Number = 15
+	metricBytes        protowire.Number = 16
+)
+
+var ErrMalformed = errors.New("malformed sparkplug payload")
+
+type Payload struct {
+	// zero leaves the timestamp out
+	Timestamp time.Time
+	Metrics   []Metric
+	// nil leaves the sequence number out, as in NDEATH
+	Seq  *uint64
+	UUID string
+	Body []byte
+}
+
+/* One metric; Value is nil when IsNull is set */
+/* Go types of Value: int8, int16, int32, int64, uint8, uint16, uint32, uint64, float32, float64, bool, */
+/* string (String, Text, UUID), time.Time (DateTime) and []byte (Bytes, File) */
+type Metric struct {
+	// may be left out in data messages when Alias is set
+	Name  string
+	Alias *uint64
+	// zero leaves the timestamp out
+	Timestamp    time.Time
+	DataType     DataType
+	IsHistorical bool
+	IsTransient  bool
+	IsNull       bool
+	Value        any
+}
+
+/* Metric with the data type taken from the Go type of value */
+func NewMetric(name string, value any) Metric {
+	return Metric{Name: name, DataType: dataTypeOf(value), Value: value}
+}
+
+func dataTypeOf(value any) DataType {
+	switch value.(type) {
+	case int8:
+		return Int8
+	case int16:
+		return Int16
+	case int32:
+		return Int32
+	case int64, int:
+		return Int64
+	case uint8:
+		return UInt8
+	case uint16:
+		return UInt16
+	case uint32:
+		return UInt32
+	case uint64:
+		return UInt64
+	case float32:
+		return Float
+	case float64:
+		return Double
+	case bool:
+		return Boolean
+	case string:
+		return String
+	case time.Time:
+		return DateTime
+	case []byte:
+		return Bytes
+	}
+	return Unknown
+}
+
+/* Milliseconds since the epoch, the time format of Sparkplug */
+func millis(t time.Time) uint64 {
+	return uint64(t.UnixMilli())
+}
+
+func fromMillis(ms uint64) time.Time {
+	return time.UnixMilli(int64(ms))
+}
+
+/* Encodes p in the protobuf wire format */
+func (p *Payload) Marshal() ([]byte, error) {
+	var b []byte
+	if !p.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, payloadTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, millis(p.Timestamp))
+	}
+	for i := range p.Metrics {
+		m, err := p.Metrics[i].marshal()
+		if err != nil {
+			return nil, fmt.Errorf("metric %s: %w", p.Metrics[i].Name, err)
+		}
+		b = protowire.AppendTag(b, payloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	if p.Seq != nil {
+		b = protowire.AppendTag(b, payloadSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, *p.Seq)
+	}
+	if p.UUID != "" {
+		b = protowire.AppendTag(b, payloadUUID, protowire.BytesType)
+		b = protowire.AppendString(b, p.UUID)
+	}
+	if p.Body != nil {
+		b = protowire.AppendTag(b, payloadBody, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Body)
+	}
+	return b, nil
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+func (m *Metric) marshal() ([]byte, error) {
+	var b []byte
+	if m.Name != "" {
+		b = protowire.AppendTag(b, metricName, protowire.BytesType)
+		b = protowire.AppendString(b, m.Name)
+	}
+	if m.Alias != nil {
+		b = protowire.AppendTag(b, metricAlias, protowire.VarintType)
+		b = protowire.AppendVarint(b, *m.Alias)
+	}
+	if !m.Timestamp.IsZero() {
+		b = protowire.AppendTag(b, metricTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, millis(m.Timestamp))
+	}
+	dataType := m.DataType
+	if dataType == Unknown {
+		dataType = dataTypeOf(m.Value)
+	}
+	if dataType != Unknown {
+		b = protowire.AppendTag(b, metricDataType, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(dataType))
+	}
+	if m.IsHistorical {
+		b = appendBool(b, metricIsHistorical, true)
+	}
+	if m.IsTransient {
+		b = appendBool(b, metricIsTransient, true)
+	}
+	if m.IsNull || m.Value == nil {
+		return appendBool(b, metricIsNull, true), nil
+	}
+	return appendValue(b, dataType, m.Value)
+}
+
+/* Signed integers up to 32 bits go into int_value as two's complement, 64 bit ones into long_value */
+func appendValue(b []byte, dataType DataType, value any) ([]byte, error) {
+	mismatch := fmt.Errorf("value %v (%T) is not a %s", value, value, dataType)
+	switch dataType {
+	case Int8, Int16, Int32, UInt8, UInt16, UInt32:
+		var v uint32
+		switch x := value.(type) {
+		case int8:
+			v = uint32(int32(x))
+		case int16:
+			v = uint32(int32(x))
+		case int32:
+			v = uint32(x)
+		case uint8:
+			v = uint32(x)
+		case uint16:
+			v = uint32(x)
+		case uint32:
+			v = x
+		default:
+			return nil, mismatch
+		}
+		b = protowire.AppendTag(b, metricInt, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(v)), nil
+	case Int64, UInt64, DateTime:
+		var v uint64
+		switch x := value.(type) {
+		case int64:
+			v = uint64(x)
+		case int:
+			v = uint64(x)
+		case uint64:
+			v = x
+		case time.Time:
+			v = millis(x)
+		default:
+			return nil, mismatch
+		}
+		b = protowire.AppendTag(b, metricLong, protowire.VarintType)
+		return protowire.AppendVarint(b, v), nil
+	case Float:
+		x, ok := value.(float32)
+		if !ok {
+			return nil, mismatch
+		}
+		b = protowire.AppendTag(b, metricFloat, protowire.Fixed32Type)
+		return protowire.AppendFixed32(b, math.Float32bits(x)), nil
+	case Double:
+		x, ok := value.(float64)
+		if !ok {
+			return nil, mismatch
+		}
+		b = protowire.AppendTag(b, metricDouble, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(x)), nil
+	case Boolean:
+		x, ok := value.(bool)
+		if !ok {
+			return nil, mismatch
+		}
+		return appendBool(b, metricBoolean, x), nil
+	case String, Text, UUID:
+		x, ok := value.(string)
+		if !ok {
+			return nil, mismatch
+		}
+		b = protowire.AppendTag(b, metricString, protowire.BytesType)
+		return protowire.AppendString(b, x), nil
+	case Bytes, File:
+		x, ok := value.([]byte)
+		if !ok {
+			return nil, mismatch
+		}
+		b = protowire.AppendTag(b, metricBytes, protowire.BytesType)
+		return protowire.AppendBytes(b, x), nil
+	}
+	return nil, fmt.Errorf("data type %s is not supported", dataType)
+}
+
+/* Decodes a payload; unknown and unsupported fields are skipped */
+func Unmarshal(b []byte) (*Payload, error) {
+	p := &Payload{}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch {
+		case num == payloadTimestamp && typ == protowire.VarintType:
+			p.Timestamp = fromMillis(v)
+		case num == payloadMetrics && typ == protowire.BytesType:
+			m, err := unmarshalMetric(raw)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, m)
+		case num == payloadSeq && typ == protowire.VarintType:
+			seq := v
+			p.Seq = &seq
+		case num == payloadUUID && typ == protowire.BytesType:
+			p.UUID = string(raw)
+		case num == payloadBody && typ == protowire.BytesType:
+			p.Body = append([]byte(nil), raw...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func unmarshalMetric(b []byte) (Metric, error) {
+	var m Metric
+	var intValue, longValue *uint64
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error {
+		switch num {
+		case metricName:
+			m.Name = string(raw)
+		case metricAlias:
+			alias := v
+			m.Alias = &alias
+		case metricTimestamp:
+			m.Timestamp = fromMillis(v)
+		case metricDataType:
+			m.DataType = DataType(v)
+		case metricIsHistorical:
+			m.IsHistorical = protowire.DecodeBool(v)
+		case metricIsTransient:
+			m.IsTransient = protowire.DecodeBool(v)
+		case metricIsNull:
+			m.IsNull = protowire.DecodeBool(v)
+		case metricInt:
+			intValue = &v
+		case metricLong:
+			longValue = &v
+		case metricFloat:
+			m.Value = math.Float32frombits(uint32(v))
+		case metricDouble:
+			m.Value = math.Float64frombits(v)
+		case metricBoolean:
+			m.Value = protowire.DecodeBool(v)
+		case metricString:
+			m.Value = string(raw)
+		case metricBytes:
+			m.Value = append([]byte(nil), raw...)
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	/* The integer fields only become Go values with the data type */
+	switch {
+	case intValue != nil:
+		v := uint32(*intValue)
+		switch m.DataType {
+		case Int8:
+			m.Value = int8(v)
+		case Int16:
+			m.Value = int16(v)
+		case Int32:
+			m.Value = int32(v)
+		case UInt8:
+			m.Value = uint8(v)
+		case UInt16:
+			m.Value = uint16(v)
+		default:
+			m.Value = v
+		}
+	case longValue != nil:
+		switch m.DataType {
+		case Int64:
+			m.Value = int64(*longValue)
+		case DateTime:
+			m.Value = fromMillis(*longValue)
+		default:
+			m.Value = *longValue
+		}
+	}
+	if m.IsNull {
+		m.Value = nil
+	}
+	return m, nil
+}
+
+/* Calls fn for every field of a message; v holds varints and fixed values, raw the content of length-delimited fields */
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, raw []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrMalformed, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v uint64
+		var raw []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(b)
+			v = uint64(x)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			raw, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %v", ErrMalformed, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if err := fn(num, typ, v, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
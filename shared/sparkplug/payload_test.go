@@ -0,0 +1,305 @@
+package sparkplug
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+/* Payload and Metric of sparkplug_b.proto, without the fields the codec skips, for the reference encoder */
+func referenceDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, oneof bool) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(num),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   typ.Enum(),
+		}
+		if oneof {
+			f.OneofIndex = proto.Int32(0)
+		}
+		return f
+	}
+	metrics := field("metrics", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, false)
+	metrics.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	metrics.TypeName = proto.String(".org.eclipse.tahu.protobuf.Payload.Metric")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("sparkplug_b.proto"),
+		Package: proto.String("org.eclipse.tahu.protobuf"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Payload"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("timestamp", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64, false),
+				metrics,
+				field("seq", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT64, false),
+				field("uuid", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING, false),
+				field("body", 5, descriptorpb.FieldDescriptorProto_TYPE_BYTES, false),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Metric"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, false),
+					field("alias", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64, false),
+					field("timestamp", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT64, false),
+					field("datatype", 4, descriptorpb.FieldDescriptorProto_TYPE_UINT32, false),
+					field("is_historical", 5, descriptorpb.FieldDescriptorProto_TYPE_BOOL, false),
+					field("is_transient", 6, descriptorpb.FieldDescriptorProto_TYPE_BOOL, false),
+					field("is_null", 7, descriptorpb.FieldDescriptorProto_TYPE_BOOL, false),
+					field("int_value", 10, descriptorpb.FieldDescriptorProto_TYPE_UINT32, true),
+					field("long_value", 11, descriptorpb.FieldDescriptorProto_TYPE_UINT64, true),
+					field("float_value", 12, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, true),
+					field("double_value", 13, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, true),
+					field("boolean_value", 14, descriptorpb.FieldDescriptorProto_TYPE_BOOL, true),
+					field("string_value", 15, descriptorpb.FieldDescriptorProto_TYPE_STRING, true),
+					field("bytes_value", 16, descriptorpb.FieldDescriptorProto_TYPE_BYTES, true),
+				},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("value")}},
+			}},
+		}},
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd.Messages().ByName("Payload")
+}
+
+/* The payload encoded by the protobuf library; values holds the protobuf fields of each metric by name */
+func referenceMarshal(t *testing.T, seq uint64, ts time.Time, metrics []map[string]any) []byte {
+	t.Helper()
+	desc := referenceDescriptor(t)
+	p := dynamicpb.NewMessage(desc)
+	p.Set(desc.Fields().ByName("timestamp"), protoreflect.ValueOfUint64(uint64(ts.UnixMilli())))
+	list := p.Mutable(desc.Fields().ByName("metrics")).List()
+	for _, fields := range metrics {
+		m := list.NewElement().Message()
+		for name, v := range fields {
+			m.Set(m.Descriptor().Fields().ByName(protoreflect.Name(name)), protoreflect.ValueOf(v))
+		}
+		list.Append(protoreflect.ValueOfMessage(m))
+	}
+	p.Set(desc.Fields().ByName("seq"), protoreflect.ValueOfUint64(seq))
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+var ts = time.UnixMilli(1760774400123)
+
+func seq(v uint64) *uint64 {
+	return &v
+}
+
+/* Every data type with the protobuf fields sparkplug_b.proto puts it in */
+var typeTests = []struct {
+	value    any
+	dataType DataType
+	field    string
+	wire     any
+}{
+	{int8(-1), Int8, "int_value", uint32(0xffffffff)},
+	{int8(math.MinInt8), Int8, "int_value", uint32(0xffffff80)},
+	{int8(math.MaxInt8), Int8, "int_value", uint32(127)},
+	{int16(-2), Int16, "int_value", uint32(0xfffffffe)},
+	{int16(math.MinInt16), Int16, "int_value", uint32(0xffff8000)},
+	{int32(-3), Int32, "int_value", uint32(0xfffffffd)},
+	{int32(math.MinInt32), Int32, "int_value", uint32(0x80000000)},
+	{int32(math.MaxInt32), Int32, "int_value", uint32(math.MaxInt32)},
+	{int64(-4), Int64, "long_value", uint64(0xfffffffffffffffc)},
+	{int64(math.MinInt64), Int64, "long_value", uint64(1 << 63)},
+	{int64(math.MaxInt64), Int64, "long_value", uint64(math.MaxInt64)},
+	{uint8(math.MaxUint8), UInt8, "int_value", uint32(255)},
+	{uint16(math.MaxUint16), UInt16, "int_value", uint32(65535)},
+	{uint32(math.MaxUint32), UInt32, "int_value", uint32(math.MaxUint32)},
+	{uint64(math.MaxUint64), UInt64, "long_value", uint64(math.MaxUint64)},
+	{float32(-1.5), Float, "float_value", float32(-1.5)},
+	{math.Pi, Double, "double_value", math.Pi},
+	{true, Boolean, "boolean_value", true},
+	{false, Boolean, "boolean_value", false},
+	{"22.5 °C", String, "string_value", "22.5 °C"},
+	{"", String, "string_value", ""},
+	{ts, DateTime, "long_value", uint64(ts.UnixMilli())},
+	{[]byte{0, 1, 0xff}, Bytes, "bytes_value", []byte{0, 1, 0xff}},
+}
+
+func TestDataTypesRoundTrip(t *testing.T) {
+	for _, tt := range typeTests {
+		m := NewMetric("value", tt.value)
+		if m.DataType != tt.dataType {
+			t.Errorf("NewMetric(%T) has data type %s, want %s", tt.value, m.DataType, tt.dataType)
+		}
+		p := &Payload{Timestamp: ts, Metrics: []Metric{m}, Seq: seq(7)}
+		b, err := p.Marshal()
+		if err != nil {
+			t.Fatalf("%s %v: %v", tt.dataType, tt.value, err)
+		}
+		got, err := Unmarshal(b)
+		if err != nil {
+			t.Fatalf("%s %v: %v", tt.dataType, tt.value, err)
+		}
+		if len(got.Metrics) != 1 {
+			t.Fatalf("%s %v: %d metrics", tt.dataType, tt.value, len(got.Metrics))
+		}
+		g := got.Metrics[0]
+		if g.Name != "value" || g.DataType != tt.dataType || g.IsNull || !sameValue(g.Value, tt.value) {
+			t.Errorf("%s %v came back as %s %v (%T)", tt.dataType, tt.value, g.DataType, g.Value, g.Value)
+		}
+	}
+
+	/* Text, UUID and File share the fields of String and Bytes */
+	for _, m := range []Metric{
+		{Name: "note", DataType: Text, Value: "line 1\nline 2"},
+		{Name: "id", DataType: UUID, Value: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+		{Name: "config", DataType: File, Value: []byte("a: 1\n")},
+	} {
+		got := roundTrip(t, m)
+		if got.DataType != m.DataType || !sameValue(got.Value, m.Value) {
+			t.Errorf("%s %v came back as %s %v", m.DataType, m.Value, got.DataType, got.Value)
+		}
+	}
+}
+
+func TestNullAndAliasRoundTrip(t *testing.T) {
+	alias := uint64(300)
+	tests := []Metric{
+		{Name: "AIN_A", DataType: Double, IsNull: true},
+		/* IsNull wins over a value that is still set */
+		{Name: "AIN_A", DataType: Double, IsNull: true, Value: 1.5},
+		/* a metric without a value is sent as null */
+		{Name: "AIN_A", DataType: Double},
+		{Alias: &alias, DataType: Int32, Value: int32(-9)},
+		{Alias: &alias, DataType: Int64, IsNull: true},
+		{Name: "DIO_A", Alias: &alias, Timestamp: ts, DataType: Boolean, IsHistorical: true, IsTransient: true, Value: true},
+	}
+	for _, m := range tests {
+		got := roundTrip(t, m)
+		want := m
+		if m.IsNull || m.Value == nil {
+			want.IsNull, want.Value = true, nil
+		}
+		if got.Name != want.Name || !reflect.DeepEqual(got.Alias, want.Alias) || !got.Timestamp.Equal(want.Timestamp) ||
+			got.DataType != want.DataType || got.IsHistorical != want.IsHistorical || got.IsTransient != want.IsTransient ||
+			got.IsNull != want.IsNull || !sameValue(got.Value, want.Value) {
+			t.Errorf("%+v came back as %+v", m, got)
+		}
+	}
+}
+
+/* The codec and the protobuf library give the same bytes, and the library reads back the fields */
+func TestMatchesReference(t *testing.T) {
+	for _, tt := range typeTests {
+		p := &Payload{Timestamp: ts, Metrics: []Metric{NewMetric("value", tt.value)}, Seq: seq(255)}
+		b, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := referenceMarshal(t, 255, ts, []map[string]any{{"name": "value", "datatype": uint32(tt.dataType), tt.field: tt.wire}})
+		if !bytes.Equal(b, want) {
+			t.Errorf("%s %v:\n got %x\nwant %x", tt.dataType, tt.value, b, want)
+		}
+
+		desc := referenceDescriptor(t)
+		ref := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(b, ref); err != nil {
+			t.Fatalf("%s %v: reference can't read it: %v", tt.dataType, tt.value, err)
+		}
+		m := ref.Get(desc.Fields().ByName("metrics")).List().Get(0).Message()
+		if v := m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(tt.field))).Interface(); !sameValue(v, tt.wire) {
+			t.Errorf("%s %v: reference reads %s = %v, want %v", tt.dataType, tt.value, tt.field, v, tt.wire)
+		}
+	}
+
+	alias := uint64(2)
+	p := &Payload{Timestamp: ts, Seq: seq(0), Metrics: []Metric{
+		{Name: "AIN_A", DataType: Double, IsNull: true},
+		{Alias: &alias, Timestamp: ts, DataType: Int16, IsHistorical: true, Value: int16(-300)},
+	}}
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := referenceMarshal(t, 0, ts, []map[string]any{
+		{"name": "AIN_A", "datatype": uint32(Double), "is_null": true},
+		{"alias": uint64(2), "timestamp": uint64(ts.UnixMilli()), "datatype": uint32(Int16), "is_historical": true, "int_value": uint32(0xfffffed4)},
+	})
+	if !bytes.Equal(b, want) {
+		t.Errorf("null and alias metrics:\n got %x\nwant %x", b, want)
+	}
+}
+
+/* NDATA with one historical Int8 metric of -1 by alias, as sparkplug_b.proto encodes it: */
+/* timestamp, the metric (alias 2, datatype 1, is_historical, int_value 0xffffffff) and seq 3 */
+func TestGoldenBytes(t *testing.T) {
+	const golden = "08fbd0d4b29f33" + "120c" + "1002" + "2001" + "2801" + "50ffffffff0f" + "1803"
+	alias := uint64(2)
+	p := &Payload{Timestamp: ts, Seq: seq(3), Metrics: []Metric{{Alias: &alias, DataType: Int8, IsHistorical: true, Value: int8(-1)}}}
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(b); got != golden {
+		t.Errorf("got  %s\nwant %s", got, golden)
+	}
+	got, err := Unmarshal(mustHex(golden))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Metrics) != 1 || *got.Metrics[0].Alias != 2 || got.Metrics[0].Value != int8(-1) || *got.Seq != 3 || !got.Timestamp.Equal(ts) {
+		t.Errorf("golden bytes decoded to %+v", got)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	b, _ := (&Payload{Metrics: []Metric{NewMetric("AIN_A", 1.5)}}).Marshal()
+	for n := 1; n < len(b); n++ {
+		if _, err := Unmarshal(b[:n]); err == nil {
+			t.Errorf("payload cut after %d of %d bytes decoded without an error", n, len(b))
+		}
+	}
+	if _, err := (&Payload{Metrics: []Metric{{Name: "x", DataType: Int8, Value: 1.5}}}).Marshal(); err == nil {
+		t.Errorf("Marshal accepted a float64 as Int8")
+	}
+}
+
+func roundTrip(t *testing.T, m Metric) Metric {
+	t.Helper()
+	b, err := (&Payload{Metrics: []Metric{m}}).Marshal()
+	if err != nil {
+		t.Fatalf("%+v: %v", m, err)
+	}
+	p, err := Unmarshal(b)
+	if err != nil || len(p.Metrics) != 1 {
+		t.Fatalf("%+v: %v", m, err)
+	}
+	return p.Metrics[0]
+}
+
+func sameValue(a, b any) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,93 @@
+/* Sparkplug B topics: spBv1.0/{group}/{type}/{edge node}[/{device}] and spBv1.0/STATE/{host} */
+
+package sparkplug
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const Namespace = "spBv1.0"
+
+/* Message types, the third level of a topic */
+type MessageType string
+
+const (
+	NBIRTH MessageType = "NBIRTH"
+	NDEATH MessageType = "NDEATH"
+	NDATA  MessageType = "NDATA"
+	NCMD   MessageType = "NCMD"
+	DBIRTH MessageType = "DBIRTH"
+	DDEATH MessageType = "DDEATH"
+	DDATA  MessageType = "DDATA"
+	DCMD   MessageType = "DCMD"
+	STATE  MessageType = "STATE"
+)
+
+/* Metric a host writes true to in NCMD to ask for a new NBIRTH and DBIRTHs */
+const RebirthMetric = "Node Control/Rebirth"
+
+/* Metric of NBIRTH and NDEATH that ties the death certificate to its birth */
+const BdSeqMetric = "bdSeq"
+
+type Topic struct {
+	Group    string
+	Type     MessageType
+	EdgeNode string
+	// empty for node messages
+	Device string
+	// only for STATE
+	Host string
+}
+
+func (t Topic) String() string {
+	if t.Type == STATE {
+		return Namespace + "/STATE/" + t.Host
+	}
+	s := Namespace + "/" + t.Group + "/" + string(t.Type) + "/" + t.EdgeNode
+	if t.Device != "" {
+		s += "/" + t.Device
+	}
+	return s
+}
+
+func ParseTopic(topic string) (Topic, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 || levels[0] != Namespace {
+		return Topic{}, fmt.Errorf("%q is not a sparkplug topic", topic)
+	}
+	if levels[1] == string(STATE) && len(levels) == 3 {
+		return Topic{Type: STATE, Host: levels[2]}, nil
+	}
+	t := Topic{Group: levels[1], Type: MessageType(levels[2])}
+	switch {
+	case len(levels) == 4 && strings.HasPrefix(levels[2], "N"):
+		t.EdgeNode = levels[3]
+	case len(levels) == 5 && strings.HasPrefix(levels[2], "D"):
+		t.EdgeNode, t.Device = levels[3], levels[4]
+	default:
+		return Topic{}, fmt.Errorf("%q is not a sparkplug topic", topic)
+	}
+	return t, nil
+}
+
+/* Payload of STATE messages; Sparkplug 2.2 hosts send the bare words ONLINE and OFFLINE instead */
+type HostState struct {
+	Online    bool  `json:"online"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+func ParseHostState(payload []byte) (HostState, error) {
+	switch strings.TrimSpace(string(payload)) {
+	case "ONLINE":
+		return HostState{Online: true}, nil
+	case "OFFLINE":
+		return HostState{}, nil
+	}
+	var s HostState
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return s, fmt.Errorf("STATE payload: %w", err)
+	}
+	return s, nil
+}
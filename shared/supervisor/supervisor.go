@@ -0,0 +1,226 @@
+/* Package created 18.10.2026. */
+/* Runs the goroutines of an example as named services under one root context */
+/* A service that returns an error or panics is restarted with backoff; */
+/* when the root context is cancelled the services get ShutdownTimeout to return */
+/* and the shutdown hooks (MQTT disconnect, closing stores) run within the same deadline */
+
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/* State of a service */
+const (
+	Running    = "running"
+	Restarting = "restarting"
+	Stopped    = "stopped"
+)
+
+/* Health of a service as reported by Status */
+type Status struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+	// error of the last crash, empty if it never crashed
+	LastError string `json:"lastError,omitempty"`
+}
+
+var ErrShutdownTimeout = errors.New("shutdown deadline exceeded")
+
+type Supervisor struct {
+	/* Delay before the first restart, doubled after every crash up to MaxBackoff */
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	/* A service that ran this long before crashing restarts after MinBackoff again */
+	StableAfter time.Duration
+	/* Time the services and shutdown hooks get once the root context is cancelled */
+	ShutdownTimeout time.Duration
+
+	mu       sync.Mutex
+	services []*service
+	hooks    []hook
+	started  bool
+}
+
+type service struct {
+	name   string
+	run    func(ctx context.Context) error
+	status Status
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func New() *Supervisor {
+	return &Supervisor{
+		MinBackoff:      time.Second,
+		MaxBackoff:      time.Minute,
+		StableAfter:     time.Minute,
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+/* Adds a service; run should return once ctx is cancelled */
+/* Returning nil before that ends the service without a restart */
+func (s *Supervisor) Go(name string, run func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		panic("supervisor: service " + name + " added after Run")
+	}
+	s.services = append(s.services, &service{name: name, run: run, status: Status{Name: name}})
+}
+
+/* Adds a hook that runs after the services stopped, in reverse order of adding */
+/* ctx expires at the shutdown deadline */
+func (s *Supervisor) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook{name: name, fn: fn})
+}
+
+/* Runs the services until ctx is cancelled or all of them ended, then shuts down */
+/* Returns ErrShutdownTimeout if the services or hooks did not finish within ShutdownTimeout */
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.mu.Lock()
+	s.started = true
+	services := s.services
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, svc := range services {
+		wg.Add(1)
+		go func(svc *service) {
+			defer wg.Done()
+			s.supervise(ctx, svc)
+		}(svc)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down")
+	case <-done:
+	}
+	cancel()
+
+	deadline, stop := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer stop()
+
+	var errs []error
+	select {
+	case <-done:
+	case <-deadline.Done():
+		for _, st := range s.Status() {
+			if st.State != Stopped {
+				log.Printf("Service %s did not stop in time\n", st.Name)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(deadline); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", hooks[i].name, err))
+		}
+	}
+	if deadline.Err() != nil {
+		errs = append(errs, ErrShutdownTimeout)
+	}
+	return errors.Join(errs...)
+}
+
+/* Runs one service and restarts it until ctx is cancelled */
+func (s *Supervisor) supervise(ctx context.Context, svc *service) {
+	backoff := s.MinBackoff
+	for {
+		started := time.Now()
+		s.setState(svc, Running, nil)
+		err := runSafely(ctx, svc.run)
+
+		if ctx.Err() != nil || err == nil {
+			s.setState(svc, Stopped, nil)
+			return
+		}
+
+		if time.Since(started) >= s.StableAfter {
+			backoff = s.MinBackoff
+		}
+		log.Printf("Service %s failed: %v; restarting in %s\n", svc.name, err, backoff)
+		s.setState(svc, Restarting, err)
+
+		select {
+		case <-ctx.Done():
+			s.setState(svc, Stopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.MaxBackoff)
+	}
+}
+
+/* A panicking service is reported as crashed instead of taking the process down */
+func runSafely(ctx context.Context, run func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(ctx)
+}
+
+func (s *Supervisor) setState(svc *service, state string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == Restarting {
+		svc.status.Restarts++
+	}
+	if err != nil {
+		svc.status.LastError = err.Error()
+	}
+	if svc.status.State != state {
+		svc.status.State = state
+		svc.status.Since = time.Now()
+	}
+}
+
+/* Health of every service in the order they were added */
+func (s *Supervisor) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]Status, len(s.services))
+	for i, svc := range s.services {
+		statuses[i] = svc.status
+	}
+	return statuses
+}
+
+/* Whether every service is running */
+func (s *Supervisor) Healthy() bool {
+	for _, st := range s.Status() {
+		if st.State != Running {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+/* Package created 18.10.2026. */
+/* Payloads of the WebSocket streams on port 31768, see package wsclient */
+
+package tdce
+
+/* Sent on /ws/tdce/gps/data */
+type GpsData struct {
+	Altitude           float32 `json:"Altitude"`
+	Course             *string `json:"Course"`
+	Fix                int     `json:"Fix"`
+	GpsFixAvailable    bool    `json:"GpsFixAvailable"`
+	Hdop               float32 `json:"Hdop"`
+	Latitude           float32 `json:"Latitude"`
+	Longitude          float32 `json:"Longitude"`
+	NumberOfSatellites int     `json:"NumberOfSatellites"`
+	SpeedKnots         float32 `json:"SpeedKnots"`
+	SpeedMph           float32 `json:"SpeedMph"`
+	Time               string  `json:"Time"`
+}
+
+/* Sent on /ws/tdce/analog-inputs/value whenever a value changes */
+type AnalogValueChange struct {
+	AinName       string  `json:"AinName"`
+	PreviousValue float64 `json:"PreviousValue"`
+	NewValue      float64 `json:"NewValue"`
+}
+
+/* /ws/tdce/onewire/data sends an array of these */
+/* DeviceDetails holds the temperature for temperature sensors */
+type OneWireDevice struct {
+	Family         interface{} `json:"Family"`
+	FamilyAsString string      `json:"FamilyAsString"`
+	FullPath       string      `json:"FullPath"`
+	Id             interface{} `json:"Id"`
+	IdAsString     string      `json:"IdAsString"`
+	LastSeenTime   string      `json:"LastSeenTime"`
+	DeviceDetails  string      `json:"DeviceDetails"`
+}
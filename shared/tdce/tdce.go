@@ -0,0 +1,243 @@
+/* Package created 18.10.2026. */
+/* Typed client for the TDC-E device REST API on port 59801 (DIO, AIN and the token service) */
+
+package tdce
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultBaseURL = "http://192.168.0.100:59801"
+
+/* DIO directions */
+const (
+	Input  = "Input"
+	Output = "Output"
+)
+
+type Dio struct {
+	DioName   string `json:"DioName"`
+	Value     int    `json:"Value"`
+	Direction string `json:"Direction"`
+}
+
+type AnalogInput struct {
+	AinName string `json:"AinName"`
+	State   string `json:"State"`
+}
+
+type AnalogValue struct {
+	AinName string  `json:"AinName"`
+	Value   float64 `json:"Value"`
+}
+
+/* Returned when the device answers with a status other than 2xx */
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), strings.TrimSpace(e.Body))
+}
+
+/* Client is safe for concurrent use; the token is fetched on first use and refreshed when the device rejects it */
+type Client struct {
+	BaseURL    string
+	Password   string
+	HTTPClient *http.Client
+	// tokens older than this are refreshed before a request; 0 refreshes only after a 401
+	TokenMaxAge time.Duration
+
+	mu        sync.Mutex
+	token     string
+	fetchedAt time.Time
+}
+
+/* Creates a client for the device at baseURL with the service level password */
+func NewClient(baseURL string, password string) *Client {
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		Password:    password,
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+		TokenMaxAge: 50 * time.Minute,
+	}
+}
+
+/* Fetches a new bearer token from the token service */
+func (c *Client) FetchToken(ctx context.Context) (string, error) {
+	form := url.Values{}
+	form.Add("password", c.Password)
+
+	endpoint := c.BaseURL + "/user/Service/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(req, &tokenResp); err != nil {
+		return "", fmt.Errorf("fetching token: %w", err)
+	}
+	if tokenResp.Token == "" {
+		return "", fmt.Errorf("fetching token: empty token in response")
+	}
+	return tokenResp.Token, nil
+}
+
+/* Returns the cached token or fetches a new one */
+func (c *Client) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && (c.TokenMaxAge <= 0 || time.Since(c.fetchedAt) < c.TokenMaxAge) {
+		return c.token, nil
+	}
+	token, err := c.FetchToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.fetchedAt = time.Now()
+	return token, nil
+}
+
+/* Forgets the cached token if it is still the given one */
+func (c *Client) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+/* Sets one DIO */
+func (c *Client) SetDIO(ctx context.Context, name string, value int, direction string) error {
+	return c.SetDIOs(ctx, []Dio{{DioName: name, Value: value, Direction: direction}})
+}
+
+/* Sets several DIOs in one request */
+func (c *Client) SetDIOs(ctx context.Context, dios []Dio) error {
+	return c.call(ctx, http.MethodPost, "/tdce/dio/SetStates", dios, nil)
+}
+
+/* Reads the state of one DIO */
+func (c *Client) GetDIO(ctx context.Context, name string) (Dio, error) {
+	var dio Dio
+	err := c.call(ctx, http.MethodGet, "/tdce/dio/GetState/"+url.PathEscape(name), nil, &dio)
+	return dio, err
+}
+
+/* Lists all analog inputs with their state */
+func (c *Client) ListAnalogInputs(ctx context.Context) ([]AnalogInput, error) {
+	var analogs []AnalogInput
+	err := c.call(ctx, http.MethodGet, "/tdce/analog-inputs/GetStates", nil, &analogs)
+	return analogs, err
+}
+
+/* Reads the values of all analog inputs */
+func (c *Client) AnalogValues(ctx context.Context) ([]AnalogValue, error) {
+	var values []AnalogValue
+	err := c.call(ctx, http.MethodGet, "/tdce/analog-inputs/GetValues", nil, &values)
+	return values, err
+}
+
+/* Reads the state of one analog input */
+func (c *Client) AnalogState(ctx context.Context, name string) (string, error) {
+	var body []byte
+	err := c.call(ctx, http.MethodGet, "/tdce/analog-inputs/GetState/"+url.PathEscape(name), nil, &body)
+	return strings.Trim(strings.TrimSpace(string(body)), `"`), err
+}
+
+/* Reads the value of one analog input */
+func (c *Client) ReadAnalog(ctx context.Context, name string) (float64, error) {
+	var body []byte
+	if err := c.call(ctx, http.MethodGet, "/tdce/analog-inputs/GetValue/"+url.PathEscape(name), nil, &body); err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing value of %s: %w", name, err)
+	}
+	return value, nil
+}
+
+/* Makes an authorized request; on 401 the token is refreshed and the request retried once */
+/* in is sent as JSON; out is decoded from JSON unless it is a *[]byte, which receives the raw body */
+func (c *Client) call(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.Token(ctx)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		err = c.do(req, out)
+		if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			c.invalidate(token)
+			continue
+		}
+		return err
+	}
+}
+
+/* Sends the request and decodes the response */
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &APIError{Method: req.Method, URL: req.URL.String(), StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out = body
+		return nil
+	default:
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("decoding response of %s %s: %w", req.Method, req.URL, err)
+		}
+		return nil
+	}
+}
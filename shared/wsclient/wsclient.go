@@ -0,0 +1,269 @@
+/* Package created 18.10.2026. */
+/* Reconnecting WebSocket client for the TDC-E data streams */
+/* Replaces the OpenWebsocket / ListenOnWS / SendToWS copies that used to live in every example */
+
+package wsclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* TDC-E data streams served on port 31768 */
+const (
+	GpsData           = "/ws/tdce/gps/data"
+	AnalogInputsValue = "/ws/tdce/analog-inputs/value"
+	OneWireData       = "/ws/tdce/onewire/data"
+	Rs232Data         = "/ws/tdce/rs232/data"
+	CanAData          = "/ws/tdce/can-a/data"
+	CanBData          = "/ws/tdce/can-b/data"
+	DioStates         = "/ws/tdce/dio/states"
+)
+
+var ErrNotConnected = errors.New("websocket is not connected")
+
+/* Builds a ws:// URL from the device address and a stream path */
+func URL(host, path string) string {
+	u := url.URL{Scheme: "ws", Host: host, Path: path}
+	return u.String()
+}
+
+/* Client settings; zero values are replaced with defaults */
+type Config struct {
+	URL    string
+	Header http.Header
+	Dialer *websocket.Dialer
+
+	// reconnect delay grows from MinBackoff up to MaxBackoff, with random jitter
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// a ping is sent every PingInterval; the connection is dropped when nothing arrives for PongWait
+	PingInterval time.Duration
+	PongWait     time.Duration
+	WriteWait    time.Duration
+
+	// size of the Messages channel
+	Buffer int
+}
+
+func (c *Config) setDefaults() {
+	if c.Dialer == nil {
+		c.Dialer = websocket.DefaultDialer
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Second
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 30 * time.Second
+	}
+	if c.PingInterval <= 0 {
+		c.PingInterval = 20 * time.Second
+	}
+	if c.PongWait <= 0 {
+		c.PongWait = 2 * c.PingInterval
+	}
+	if c.WriteWait <= 0 {
+		c.WriteWait = 5 * time.Second
+	}
+	if c.Buffer <= 0 {
+		c.Buffer = 64
+	}
+}
+
+/* Client keeps a WebSocket connection open until its context is cancelled */
+type Client struct {
+	cfg      Config
+	messages chan []byte
+
+	mu          sync.Mutex
+	conn        *websocket.Conn
+	lastMessage time.Time
+
+	// gorilla/websocket allows only one writer at a time
+	writeMu sync.Mutex
+}
+
+func New(cfg Config) *Client {
+	cfg.setDefaults()
+	return &Client{cfg: cfg, messages: make(chan []byte, cfg.Buffer)}
+}
+
+/* Received messages; closed when Run returns */
+func (c *Client) Messages() <-chan []byte {
+	return c.messages
+}
+
+/* Reports whether the client currently has an open connection */
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+/* Time the last message was received; zero if none arrived yet */
+func (c *Client) LastMessage() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastMessage
+}
+
+/* Sends a text message over the current connection */
+func (c *Client) Send(data []byte) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+/* Connects and reconnects until ctx is cancelled, then closes the connection cleanly */
+/* Always returns ctx.Err() */
+func (c *Client) Run(ctx context.Context) error {
+	defer close(c.messages)
+
+	attempt := 0
+	for {
+		conn, _, err := c.cfg.Dialer.DialContext(ctx, c.cfg.URL, c.cfg.Header)
+		if err == nil {
+			log.Printf("Connected to %s\n", c.cfg.URL)
+			attempt = 0
+			err = c.serve(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		delay := c.backoff(attempt)
+		attempt++
+		log.Printf("WebSocket %s: %v; reconnecting in %s\n", c.cfg.URL, err, delay.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+/* Exponential backoff with random jitter so that many clients don't reconnect in lockstep */
+func (c *Client) backoff(attempt int) time.Duration {
+	limit := c.cfg.MinBackoff << min(attempt, 16)
+	if limit <= 0 || limit > c.cfg.MaxBackoff {
+		limit = c.cfg.MaxBackoff
+	}
+	return c.cfg.MinBackoff/2 + time.Duration(rand.Int63n(int64(limit)))
+}
+
+/* Reads from one connection until it fails or ctx is cancelled */
+func (c *Client) serve(ctx context.Context, conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	})
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	/* Keepalive and clean close run next to the blocking reads */
+	go func() {
+		ticker := time.NewTicker(c.cfg.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				c.closeNormally(conn)
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.cfg.WriteWait)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+
+		c.mu.Lock()
+		c.lastMessage = time.Now()
+		c.mu.Unlock()
+
+		select {
+		case c.messages <- message:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/* Sends a close frame and gives the server a second to answer before the connection is dropped */
+func (c *Client) closeNormally(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.cfg.WriteWait)); err != nil {
+		log.Println("Error closing WebSocket: ", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+}
+
+/* Decodes every JSON message from msgs into T; messages that don't decode are logged and skipped */
+func Decode[T any](msgs <-chan []byte) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for msg := range msgs {
+			var value T
+			if err := json.Unmarshal(msg, &value); err != nil {
+				log.Printf("Error decoding %T: %v\n", value, err)
+				continue
+			}
+			out <- value
+		}
+	}()
+	return out
+}
+
+/* Starts a client for cfg in the background and returns it with its decoded messages */
+/* The channel is closed after ctx is cancelled and the connection has been closed */
+func Subscribe[T any](ctx context.Context, cfg Config) (*Client, <-chan T) {
+	client := New(cfg)
+	go client.Run(ctx)
+	return client, Decode[T](client.Messages())
+}